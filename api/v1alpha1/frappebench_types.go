@@ -1,6 +1,8 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -40,6 +42,10 @@ type FrappeBenchSpec struct {
 	// +optional
 	StorageClassName string `json:"storageClassName,omitempty"`
 
+	// Storage configures the size of the sites PVC and migrations to another storage class
+	// +optional
+	Storage *BenchStorage `json:"storage,omitempty"`
+
 	// DomainConfig defines default domain behavior for sites on this bench
 	// +optional
 	DomainConfig *DomainConfig `json:"domainConfig,omitempty"`
@@ -59,6 +65,85 @@ type FrappeBenchSpec struct {
 	// If KEDA not available, gracefully falls back to static replicas
 	// +optional
 	WorkerAutoscaling *WorkerAutoscalingConfig `json:"workerAutoscaling,omitempty"`
+
+	// ImageBuild switches the bench to image build mode: spec.apps are built into an
+	// image on top of imageConfig in-cluster, and the components run that image by digest
+	// instead of installing apps at runtime
+	// +optional
+	ImageBuild *ImageBuildConfig `json:"imageBuild,omitempty"`
+
+	// FilesStorage stores the files of every site on the bench in an S3-compatible bucket
+	// A FrappeSite can override it with its own spec.filesStorage
+	// +optional
+	FilesStorage *FilesStorage `json:"filesStorage,omitempty"`
+}
+
+// BenchStorage configures the sites PVC of a bench
+type BenchStorage struct {
+	// Size of the sites PVC (default 10Gi)
+	// Increasing it expands the PVC in place when its StorageClass allows volume expansion.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// Migration copies sites/ to a new PVC on another storage class, with the bench
+	// components stopped while the copy runs
+	// +optional
+	Migration *StorageMigration `json:"migration,omitempty"`
+}
+
+// StorageMigration selects the storage class the sites PVC is moved to
+type StorageMigration struct {
+	// StorageClassName of the new PVC
+	// +kubebuilder:validation:MinLength=1
+	StorageClassName string `json:"storageClassName"`
+
+	// AccessMode of the new PVC
+	// Defaults to ReadWriteMany when the storage class supports it, ReadWriteOnce otherwise.
+	// +kubebuilder:validation:Enum=ReadWriteOnce;ReadWriteMany
+	// +optional
+	AccessMode corev1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
+}
+
+// ImageBuildConfig configures in-cluster builds of the bench image
+type ImageBuildConfig struct {
+	// Repository the built image is pushed to (e.g. "registry.example.com/acme/erp-bench")
+	// Images are tagged with a hash of their inputs.
+	// +kubebuilder:validation:Required
+	Repository string `json:"repository"`
+
+	// PushSecretRef is a kubernetes.io/dockerconfigjson Secret with credentials for the registry
+	// +optional
+	PushSecretRef *corev1.LocalObjectReference `json:"pushSecretRef,omitempty"`
+
+	// Insecure allows pushing to a registry over plain HTTP or with an untrusted certificate,
+	// e.g. a local test registry
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// BuilderImage overrides the rootless BuildKit image that runs the build
+	// +optional
+	BuilderImage string `json:"builderImage,omitempty"`
+
+	// Resources for the build container
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// FPM adds a pinned fpm CLI binary to the image, for base images without fpm.
+	// Without it, benches with fpm apps need fpm in the base image.
+	// +optional
+	FPM *FPMBinary `json:"fpm,omitempty"`
+}
+
+// FPMBinary is an fpm CLI binary checked against its SHA-256 digest
+type FPMBinary struct {
+	// URL of the fpm binary for the platform of the build nodes
+	// (e.g. "https://github.com/acme/fpm/releases/download/v1.2.0/fpm-linux-amd64")
+	// +kubebuilder:validation:Pattern=`^https://\S+$`
+	URL string `json:"url"`
+
+	// SHA256 digest of the binary, in hex
+	// +kubebuilder:validation:Pattern=`^[a-f0-9]{64}$`
+	SHA256 string `json:"sha256"`
 }
 
 // WorkerScalingStatus reports the scaling status of a worker
@@ -76,6 +161,98 @@ type WorkerScalingStatus struct {
 	KEDAManaged bool `json:"kedaManaged"`
 }
 
+// BenchAppState represents the install state of an app on the bench
+type BenchAppState string
+
+const (
+	BenchAppStateInstalled BenchAppState = "Installed"
+	BenchAppStateFailed    BenchAppState = "Failed"
+	BenchAppStateSkipped   BenchAppState = "Skipped"
+)
+
+// BenchAppStatus reports how a single app was installed on the bench
+type BenchAppStatus struct {
+	// Name of the app
+	Name string `json:"name"`
+
+	// Source the app was installed from: fpm, git or image
+	Source string `json:"source"`
+
+	// Version requested for FPM packages
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// State of the app on the bench
+	State BenchAppState `json:"state"`
+
+	// Message with details about a failed or skipped app
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// BenchLock pins the apps of a bench, so re-running init installs exactly the same code
+type BenchLock struct {
+	// FrappeVersion the apps were resolved for
+	FrappeVersion string `json:"frappeVersion"`
+
+	// Frappe is the framework version the last init Job found in the image
+	// +optional
+	Frappe string `json:"frappe,omitempty"`
+
+	// Apps in install order, dependencies first
+	// +optional
+	Apps []LockedApp `json:"apps,omitempty"`
+}
+
+// LockedApp is the resolved form of an entry of spec.apps
+type LockedApp struct {
+	// Name of the app
+	Name string `json:"name"`
+
+	// Source the app is installed from: fpm, git or image
+	Source string `json:"source"`
+
+	// Requested is the version from spec.apps the app was resolved from
+	// +optional
+	Requested string `json:"requested,omitempty"`
+
+	// Org of an FPM package
+	// +optional
+	Org string `json:"org,omitempty"`
+
+	// Repository the FPM package was resolved in
+	// +optional
+	Repository string `json:"repository,omitempty"`
+
+	// Version is the exact version installed
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Checksum of the FPM package archive ("sha256:<hex>")
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
+
+	// GitURL of a Git app
+	// +optional
+	GitURL string `json:"gitUrl,omitempty"`
+
+	// GitBranch of a Git app
+	// +optional
+	GitBranch string `json:"gitBranch,omitempty"`
+
+	// GitCommit is the commit the init Job checked out
+	// +optional
+	GitCommit string `json:"gitCommit,omitempty"`
+
+	// RequiredApps the app depends on (required_apps in its hooks.py)
+	// +optional
+	RequiredApps []string `json:"requiredApps,omitempty"`
+
+	// Frappe is the constraint on the Frappe version the app supports
+	// +optional
+	Frappe string `json:"frappe,omitempty"`
+}
+
 // FrappeBenchStatus defines the observed state of FrappeBench
 type FrappeBenchStatus struct {
 	// Phase represents the current phase of the bench
@@ -87,9 +264,19 @@ type FrappeBenchStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 
 	// InstalledApps lists the apps that have been successfully installed
+	// Only apps the last finished init Job reported as installed are listed.
 	// +optional
 	InstalledApps []string `json:"installedApps,omitempty"`
 
+	// Apps reports the result of the last finished init Job for each app in spec.apps
+	// +optional
+	Apps []BenchAppStatus `json:"apps,omitempty"`
+
+	// Lock records the exact apps the init Job installs; it is kept while spec.apps
+	// and the Frappe version are unchanged, so every re-run installs the same code
+	// +optional
+	Lock *BenchLock `json:"lock,omitempty"`
+
 	// GitEnabled indicates whether Git is enabled for this bench
 	// +optional
 	GitEnabled bool `json:"gitEnabled,omitempty"`
@@ -105,6 +292,224 @@ type FrappeBenchStatus struct {
 	// WorkerScaling reports scaling mode per worker type
 	// +optional
 	WorkerScaling map[string]WorkerScalingStatus `json:"workerScaling,omitempty"`
+
+	// CurrentImage is the image the bench components are running
+	// Changes to the spec image are rolled out through a managed upgrade
+	// +optional
+	CurrentImage string `json:"currentImage,omitempty"`
+
+	// CurrentVersion is the Frappe version the bench components are running
+	// +optional
+	CurrentVersion string `json:"currentVersion,omitempty"`
+
+	// Upgrade reports the progress of the current or most recent upgrade
+	// +optional
+	Upgrade *BenchUpgradeStatus `json:"upgrade,omitempty"`
+
+	// ImageBuild reports the latest image build in image build mode
+	// +optional
+	ImageBuild *BenchImageBuildStatus `json:"imageBuild,omitempty"`
+
+	// Storage reports the sites PVC
+	// +optional
+	Storage *BenchStorageStatus `json:"storage,omitempty"`
+
+	// AssetsTrees lists the per-image trees under sites/.bench that an init or upgrade
+	// Job has built. Components mount sites/assets, apps and env from the tree of their
+	// image once it is listed, and the sites/assets directory of the sites PVC until then.
+	// +optional
+	AssetsTrees []string `json:"assetsTrees,omitempty"`
+}
+
+// BenchStorageStatus reports the sites PVC of a bench
+type BenchStorageStatus struct {
+	// ClaimName is the PVC the bench mounts as sites/
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
+
+	// StorageClassName of the PVC
+	// +optional
+	StorageClassName string `json:"storageClassName,omitempty"`
+
+	// AccessMode of the PVC
+	// +optional
+	AccessMode corev1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
+
+	// Capacity of the bound volume
+	// +optional
+	Capacity string `json:"capacity,omitempty"`
+
+	// Migration reports the current or most recent storage class migration
+	// +optional
+	Migration *StorageMigrationStatus `json:"migration,omitempty"`
+}
+
+// StorageMigrationPhase represents the step a storage migration is in
+type StorageMigrationPhase string
+
+const (
+	// StorageMigrationPhaseStopping - scaling the bench components down
+	StorageMigrationPhaseStopping StorageMigrationPhase = "Stopping"
+	// StorageMigrationPhaseCopying - copying sites/ to the new PVC
+	StorageMigrationPhaseCopying StorageMigrationPhase = "Copying"
+	// StorageMigrationPhaseCompleted - the bench runs on the new PVC
+	StorageMigrationPhaseCompleted StorageMigrationPhase = "Completed"
+	// StorageMigrationPhaseFailed - the copy failed and the bench runs on the old PVC
+	StorageMigrationPhaseFailed StorageMigrationPhase = "Failed"
+)
+
+// StorageMigrationStatus reports the progress of a storage class migration
+type StorageMigrationStatus struct {
+	// Phase of the migration
+	Phase StorageMigrationPhase `json:"phase"`
+
+	// FromClaim is the PVC the bench used before the migration
+	// +optional
+	FromClaim string `json:"fromClaim,omitempty"`
+
+	// ToClaim is the new PVC
+	// +optional
+	ToClaim string `json:"toClaim,omitempty"`
+
+	// StorageClassName of the new PVC
+	// +optional
+	StorageClassName string `json:"storageClassName,omitempty"`
+
+	// Message is a human readable description of the migration state
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is when the migration started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the migration finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// BenchImageBuildPhase represents the state of a bench image build
+type BenchImageBuildPhase string
+
+const (
+	// BenchImageBuildPhaseBuilding - the build Job is running
+	BenchImageBuildPhaseBuilding BenchImageBuildPhase = "Building"
+	// BenchImageBuildPhaseSucceeded - the image was pushed and is used by the bench
+	BenchImageBuildPhaseSucceeded BenchImageBuildPhase = "Succeeded"
+	// BenchImageBuildPhaseFailed - the build failed; it is retried when its inputs change
+	BenchImageBuildPhaseFailed BenchImageBuildPhase = "Failed"
+)
+
+// BenchImageBuildStatus reports the image build of a bench
+type BenchImageBuildStatus struct {
+	// Phase of the latest build
+	// +optional
+	Phase BenchImageBuildPhase `json:"phase,omitempty"`
+
+	// Hash of the inputs of the latest build (Dockerfile, builder and repository), also its tag
+	// +optional
+	Hash string `json:"hash,omitempty"`
+
+	// Lock is what the latest build installs the apps from
+	// +optional
+	Lock *BenchLock `json:"lock,omitempty"`
+
+	// Image is the last successfully built image, pinned by digest (repository@sha256:...)
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// FrappeVersion the last successfully built image was built for
+	// +optional
+	FrappeVersion string `json:"frappeVersion,omitempty"`
+
+	// Message is a human readable description of the build state
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is when the latest build started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the latest build finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// BenchUpgradePhase represents the step a bench upgrade is in
+type BenchUpgradePhase string
+
+const (
+	// BenchUpgradePhaseBackingUp - taking a backup of every site on the bench
+	BenchUpgradePhaseBackingUp BenchUpgradePhase = "BackingUp"
+	// BenchUpgradePhaseBuilding - building assets with the new image
+	BenchUpgradePhaseBuilding BenchUpgradePhase = "Building"
+	// BenchUpgradePhaseMigrating - running bench migrate on each site
+	BenchUpgradePhaseMigrating BenchUpgradePhase = "Migrating"
+	// BenchUpgradePhaseRollingOut - rolling the bench components to the new image
+	BenchUpgradePhaseRollingOut BenchUpgradePhase = "RollingOut"
+	// BenchUpgradePhaseCompleted - all components run the new image
+	BenchUpgradePhaseCompleted BenchUpgradePhase = "Completed"
+	// BenchUpgradePhaseRollingBack - restoring migrated sites from the pre-upgrade backup after a failure
+	BenchUpgradePhaseRollingBack BenchUpgradePhase = "RollingBack"
+	// BenchUpgradePhaseRolledBack - the bench is back on the previous image
+	BenchUpgradePhaseRolledBack BenchUpgradePhase = "RolledBack"
+	// BenchUpgradePhaseFailed - the upgrade was aborted or the rollback failed
+	BenchUpgradePhaseFailed BenchUpgradePhase = "Failed"
+)
+
+// BenchUpgradeStatus reports the progress of a managed bench upgrade
+type BenchUpgradeStatus struct {
+	// Phase of the upgrade
+	Phase BenchUpgradePhase `json:"phase"`
+
+	// FromImage is the image the bench ran before the upgrade
+	// +optional
+	FromImage string `json:"fromImage,omitempty"`
+
+	// ToImage is the image being upgraded to
+	// +optional
+	ToImage string `json:"toImage,omitempty"`
+
+	// FromVersion is the Frappe version before the upgrade
+	// +optional
+	FromVersion string `json:"fromVersion,omitempty"`
+
+	// ToVersion is the Frappe version being upgraded to
+	// +optional
+	ToVersion string `json:"toVersion,omitempty"`
+
+	// Sites lists the sites included in the upgrade
+	// +optional
+	Sites []string `json:"sites,omitempty"`
+
+	// MigratedSites lists the sites that were migrated successfully
+	// +optional
+	MigratedSites []string `json:"migratedSites,omitempty"`
+
+	// FailedSite is the site whose migration failed, if any
+	// +optional
+	FailedSite string `json:"failedSite,omitempty"`
+
+	// RestoredSites lists the sites restored from the pre-upgrade backup by the rollback
+	// +optional
+	RestoredSites []string `json:"restoredSites,omitempty"`
+
+	// Lock is what the build step installs the apps from, resolved for the target
+	// Frappe version; it becomes the bench lock when the components switch over
+	// +optional
+	Lock *BenchLock `json:"lock,omitempty"`
+
+	// Message is a human readable description of the upgrade state
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is when the upgrade started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the upgrade finished, successfully or not
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
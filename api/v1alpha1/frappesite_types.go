@@ -26,8 +26,9 @@ import (
 // FrappeSiteSpec defines the desired state of FrappeSite
 type FrappeSiteSpec struct {
 	// BenchRef references the FrappeBench this site belongs to
-	// +kubebuilder:validation:Required
-	BenchRef *NamespacedName `json:"benchRef"`
+	// Required unless the namespace belongs to a FrappeWorkpace with a benchTemplate
+	// +optional
+	BenchRef *NamespacedName `json:"benchRef,omitempty"`
 
 	// SiteName is the Frappe site name - MUST match the domain that will receive traffic
 	// This is what Frappe uses to route requests based on HTTP Host header
@@ -36,7 +37,8 @@ type FrappeSiteSpec struct {
 	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
 	SiteName string `json:"siteName"`
 
-	// AdminPasswordSecretRef references the Secret containing admin password
+	// AdminPasswordSecretRef references the Secret containing admin password.
+	// It must be in the site namespace or in frappe-operator-system.
 	// +optional
 	AdminPasswordSecretRef *corev1.SecretReference `json:"adminPasswordSecretRef,omitempty"`
 
@@ -60,8 +62,39 @@ type FrappeSiteSpec struct {
 	// Ingress configuration
 	// +optional
 	Ingress *IngressConfig `json:"ingress,omitempty"`
+
+	// Apps to install on the site, in installation order (e.g., ["erpnext", "hrms"])
+	// Each app must be installed on the referenced bench; frappe is always installed
+	// +listType=set
+	// +optional
+	Apps []string `json:"apps,omitempty"`
+
+	// DeletionPolicy controls what happens to the site's data when the FrappeSite is deleted
+	// Delete: drop the site folder and the database
+	// Retain: leave the site folder and the database untouched
+	// Archive: back up the site, move its folder to sites/archived_sites and drop the database;
+	// a database that could not be backed up is kept
+	// +kubebuilder:validation:Enum=Delete;Retain;Archive
+	// +kubebuilder:default=Archive
+	// +optional
+	DeletionPolicy SiteDeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// FilesStorage stores the site's public and private files in an S3-compatible bucket
+	// with the frappe_s3_attachment app. Overrides the bench's spec.filesStorage; existing
+	// files are moved to the bucket when it is enabled. It cannot be removed again.
+	// +optional
+	FilesStorage *FilesStorage `json:"filesStorage,omitempty"`
 }
 
+// SiteDeletionPolicy describes how site data is handled on deletion
+type SiteDeletionPolicy string
+
+const (
+	SiteDeletionPolicyDelete  SiteDeletionPolicy = "Delete"
+	SiteDeletionPolicyRetain  SiteDeletionPolicy = "Retain"
+	SiteDeletionPolicyArchive SiteDeletionPolicy = "Archive"
+)
+
 // FrappeSitePhase represents the current phase
 type FrappeSitePhase string
 
@@ -70,8 +103,89 @@ const (
 	FrappeSitePhaseProvisioning FrappeSitePhase = "Provisioning"
 	FrappeSitePhaseReady        FrappeSitePhase = "Ready"
 	FrappeSitePhaseFailed       FrappeSitePhase = "Failed"
+	FrappeSitePhaseTerminating  FrappeSitePhase = "Terminating"
+)
+
+// SiteAppState represents the install state of an app on a site
+type SiteAppState string
+
+const (
+	SiteAppStatePending      SiteAppState = "Pending"
+	SiteAppStateInstalling   SiteAppState = "Installing"
+	SiteAppStateInstalled    SiteAppState = "Installed"
+	SiteAppStateUninstalling SiteAppState = "Uninstalling"
+	SiteAppStateFailed       SiteAppState = "Failed"
 )
 
+// SiteAppStatus reports the install state of a single app on the site
+type SiteAppStatus struct {
+	// Name of the app
+	Name string `json:"name"`
+
+	// State of the app on the site
+	State SiteAppState `json:"state"`
+
+	// Message with details about the last operation
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// SiteFilesBackend is where the files of a site are stored
+type SiteFilesBackend string
+
+const (
+	// SiteFilesBackendLocal - files live in the site folder on the bench sites PVC
+	SiteFilesBackendLocal SiteFilesBackend = "local"
+	// SiteFilesBackendS3 - files live in an S3-compatible bucket
+	SiteFilesBackendS3 SiteFilesBackend = "s3"
+)
+
+// SiteFilesStoragePhase represents the state of a files storage change
+type SiteFilesStoragePhase string
+
+const (
+	// SiteFilesStoragePhaseMigrating - frappe_s3_attachment is being configured and files moved
+	SiteFilesStoragePhaseMigrating SiteFilesStoragePhase = "Migrating"
+	// SiteFilesStoragePhaseReady - the site uses the configured backend
+	SiteFilesStoragePhaseReady SiteFilesStoragePhase = "Ready"
+	// SiteFilesStoragePhaseFailed - the change failed, the site keeps its previous backend
+	SiteFilesStoragePhaseFailed SiteFilesStoragePhase = "Failed"
+)
+
+// SiteFilesStorageStatus reports where the files of the site are stored
+type SiteFilesStorageStatus struct {
+	// Backend the site's files are stored in
+	Backend SiteFilesBackend `json:"backend"`
+
+	// Phase of the latest files storage change
+	// +optional
+	Phase SiteFilesStoragePhase `json:"phase,omitempty"`
+
+	// Location of the files, e.g. s3://bucket/prefix/site/
+	// +optional
+	Location string `json:"location,omitempty"`
+
+	// Endpoint of the S3 API, empty for AWS S3
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Hash of the configuration the latest change was made for
+	// +optional
+	Hash string `json:"hash,omitempty"`
+
+	// MigratedFiles is the number of files moved by the latest change
+	// +optional
+	MigratedFiles int32 `json:"migratedFiles,omitempty"`
+
+	// Message is a human readable description of the state
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// CompletionTime is when the latest change finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
 // FrappeSiteStatus defines the observed state of FrappeSite
 type FrappeSiteStatus struct {
 	// Phase is the current phase
@@ -110,6 +224,49 @@ type FrappeSiteStatus struct {
 	// Values: explicit, bench-suffix, auto-detected, sitename-default
 	// +optional
 	DomainSource string `json:"domainSource,omitempty"`
+
+	// Apps reports the install state of each app managed on the site
+	// +optional
+	Apps []SiteAppStatus `json:"apps,omitempty"`
+
+	// Conditions represent the latest available observations of the site's state
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Backups summarizes the SiteBackups of this site
+	// +optional
+	Backups *SiteBackupSummary `json:"backups,omitempty"`
+
+	// FilesStorage reports where the site's files are stored
+	// +optional
+	FilesStorage *SiteFilesStorageStatus `json:"filesStorage,omitempty"`
+}
+
+// SiteBackupSummary reports the latest backups of a site
+type SiteBackupSummary struct {
+	// LastBackup is the name of the most recently created SiteBackup
+	// +optional
+	LastBackup string `json:"lastBackup,omitempty"`
+
+	// LastBackupPhase is the phase of the most recently created SiteBackup
+	// +optional
+	LastBackupPhase SiteBackupPhase `json:"lastBackupPhase,omitempty"`
+
+	// LastSuccessfulBackup is the name of the most recent completed SiteBackup
+	// +optional
+	LastSuccessfulBackup string `json:"lastSuccessfulBackup,omitempty"`
+
+	// LastSuccessfulBackupTime is when the most recent completed SiteBackup finished
+	// +optional
+	LastSuccessfulBackupTime *metav1.Time `json:"lastSuccessfulBackupTime,omitempty"`
+
+	// NextScheduledBackupTime is the earliest next run of the site's scheduled backups
+	// +optional
+	NextScheduledBackupTime *metav1.Time `json:"nextScheduledBackupTime,omitempty"`
+
+	// Schedules lists the scheduled SiteBackups of the site
+	// +optional
+	Schedules []string `json:"schedules,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -17,29 +17,140 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // FrappeWorkpaceSpec defines the desired state of FrappeWorkpace
+// A FrappeWorkpace is a tenant: a set of namespaces with defaults and quotas for the
+// benches and sites created in them.
 type FrappeWorkpaceSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Namespaces belonging to the tenant; missing namespaces are created
+	// A namespace can belong to only one FrappeWorkpace.
+	// +kubebuilder:validation:MinItems=1
+	Namespaces []string `json:"namespaces"`
+
+	// BenchTemplate seeds a FrappeBench in every tenant namespace
+	// +optional
+	BenchTemplate *WorkpaceBenchTemplate `json:"benchTemplate,omitempty"`
+
+	// DBConfig is the database configuration of new sites that do not set dbConfig
+	// +optional
+	DBConfig *DatabaseConfig `json:"dbConfig,omitempty"`
+
+	// DomainSuffix gives new sites without a domain the domain <siteName><domainSuffix>
+	// (e.g. ".acme.example.com")
+	// +optional
+	DomainSuffix string `json:"domainSuffix,omitempty"`
+
+	// TLS is the TLS configuration of new sites that do not enable TLS
+	// +optional
+	TLS *TLSConfig `json:"tls,omitempty"`
+
+	// IngressClassName of new sites that do not set one
+	// +optional
+	IngressClassName string `json:"ingressClassName,omitempty"`
+
+	// Quota limits what the tenant can use
+	// +optional
+	Quota *WorkpaceQuota `json:"quota,omitempty"`
+}
+
+// WorkpaceBenchTemplate is the FrappeBench created in every tenant namespace
+// The bench is only created from the template; later changes are made on the bench itself.
+type WorkpaceBenchTemplate struct {
+	// Name of the FrappeBench, also the benchRef given to new sites without one
+	// +kubebuilder:default=bench
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Spec of the FrappeBench
+	Spec FrappeBenchSpec `json:"spec"`
+}
+
+// WorkpaceQuota limits the sites and compute of a tenant
+type WorkpaceQuota struct {
+	// MaxSites is the number of FrappeSites the tenant may run across its namespaces
+	// Sites beyond the limit, newest first, stay Pending.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxSites *int32 `json:"maxSites,omitempty"`
+
+	// CPU is the total CPU the tenant's pods may request, split evenly across its namespaces
+	// +optional
+	CPU *resource.Quantity `json:"cpu,omitempty"`
 
-	// Foo is an example field of FrappeWorkpace. Edit frappeworkpace_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Memory is the total memory the tenant's pods may request, split evenly across its namespaces
+	// +optional
+	Memory *resource.Quantity `json:"memory,omitempty"`
+}
+
+// FrappeWorkpacePhase represents the health of a tenant
+type FrappeWorkpacePhase string
+
+const (
+	// FrappeWorkpacePhasePending - namespaces or benches are being set up
+	FrappeWorkpacePhasePending FrappeWorkpacePhase = "Pending"
+	// FrappeWorkpacePhaseReady - every bench and site of the tenant is ready
+	FrappeWorkpacePhaseReady FrappeWorkpacePhase = "Ready"
+	// FrappeWorkpacePhaseDegraded - some benches or sites are not ready
+	FrappeWorkpacePhaseDegraded FrappeWorkpacePhase = "Degraded"
+	// FrappeWorkpacePhaseFailed - the FrappeWorkpace is invalid
+	FrappeWorkpacePhaseFailed FrappeWorkpacePhase = "Failed"
+)
+
+// WorkpaceResourceCount counts the benches or sites of a tenant by health
+type WorkpaceResourceCount struct {
+	// Total number of objects
+	Total int32 `json:"total"`
+
+	// Ready objects
+	Ready int32 `json:"ready"`
+
+	// Failed objects
+	Failed int32 `json:"failed"`
 }
 
 // FrappeWorkpaceStatus defines the observed state of FrappeWorkpace
 type FrappeWorkpaceStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the tenant
+	// +optional
+	Phase FrappeWorkpacePhase `json:"phase,omitempty"`
+
+	// Benches counts the FrappeBenches in the tenant namespaces
+	// +optional
+	Benches WorkpaceResourceCount `json:"benches,omitempty"`
+
+	// Sites counts the FrappeSites in the tenant namespaces
+	// +optional
+	Sites WorkpaceResourceCount `json:"sites,omitempty"`
+
+	// Unhealthy lists the benches and sites that are not ready, as <kind> <namespace>/<name>: <phase>
+	// +optional
+	Unhealthy []string `json:"unhealthy,omitempty"`
+
+	// QuotaUsed is the CPU and memory requested by the tenant's pods
+	// +optional
+	QuotaUsed corev1.ResourceList `json:"quotaUsed,omitempty"`
+
+	// ObservedGeneration is the generation last reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message provides additional information about the tenant
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Sites",type=integer,JSONPath=`.status.sites.total`
+//+kubebuilder:printcolumn:name="Ready Sites",type=integer,JSONPath=`.status.sites.ready`
+//+kubebuilder:printcolumn:name="Benches",type=integer,JSONPath=`.status.benches.total`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // FrappeWorkpace is the Schema for the frappeworkpaces API
 type FrappeWorkpace struct {
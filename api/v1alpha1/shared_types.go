@@ -17,8 +17,9 @@ type ResourceRequirements struct {
 
 // DatabaseConfig defines database configuration for a Frappe site
 type DatabaseConfig struct {
-	// Provider: mariadb, postgres, sqlite
-	// +kubebuilder:validation:Enum=mariadb;postgres;sqlite
+	// Provider: mariadb, postgres, sqlite, external
+	// external provisions on an unmanaged MariaDB/MySQL server using connectionSecretRef
+	// +kubebuilder:validation:Enum=mariadb;postgres;sqlite;external
 	// +kubebuilder:default=mariadb
 	// +optional
 	Provider string `json:"provider,omitempty"`
@@ -35,7 +36,9 @@ type DatabaseConfig struct {
 	// +optional
 	MariaDBRef *NamespacedName `json:"mariadbRef,omitempty"`
 
-	// PostgresRef references an existing PostgreSQL cluster (future)
+	// PostgresRef references an existing CloudNativePG Cluster (for shared/dedicated modes)
+	// If not specified in shared mode, operator uses the "frappe-postgres" Cluster in the site namespace
+	// If not specified in dedicated mode, operator creates a per-site Cluster
 	// +optional
 	PostgresRef *NamespacedName `json:"postgresRef,omitempty"`
 
@@ -47,15 +50,16 @@ type DatabaseConfig struct {
 	// +optional
 	Resources *ResourceRequirements `json:"resources,omitempty"`
 
-	// Host is the database hostname (legacy, for backward compatibility)
+	// Host is the database hostname (external provider; overrides the secret's host key)
 	// +optional
 	Host string `json:"host,omitempty"`
 
-	// Port is the database port (legacy, for backward compatibility)
+	// Port is the database port (external provider; overrides the secret's port key, default 3306)
 	// +optional
 	Port string `json:"port,omitempty"`
 
-	// ConnectionSecretRef references a Secret containing database credentials (legacy)
+	// ConnectionSecretRef references a Secret with admin credentials for the external provider
+	// Keys: username (default root), password, and optionally host and port
 	// +optional
 	ConnectionSecretRef *corev1.SecretReference `json:"connectionSecretRef,omitempty"`
 }
@@ -306,7 +310,8 @@ type FPMRepository struct {
 	Priority int `json:"priority,omitempty"`
 
 	// AuthSecretRef references a secret with FPM authentication credentials
-	// Secret should contain keys: username, password
+	// Secret should contain keys: username, password, or token for token-based auth
+	// Namespace defaults to the bench namespace
 	// +optional
 	AuthSecretRef *corev1.SecretReference `json:"authSecretRef,omitempty"`
 }
@@ -383,3 +388,33 @@ type WorkerAutoscalingConfig struct {
 	// +optional
 	Default *WorkerAutoscaling `json:"default,omitempty"`
 }
+
+// FilesStorage keeps the public and private files of sites in an S3-compatible
+// bucket (AWS S3, MinIO, ...) instead of the bench sites PVC. The bench needs the
+// frappe_s3_attachment app (https://github.com/zerodha/frappe-attachments-s3).
+type FilesStorage struct {
+	// Endpoint URL of the S3 API, leave empty for AWS S3
+	// Example: "http://minio.minio.svc:9000"
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Bucket holding the files
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Bucket string `json:"bucket"`
+
+	// Region of the bucket
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Prefix is prepended to every object key; files of a site are stored
+	// under <prefix>/<siteName>/
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// CredentialsSecretRef references a Secret in the site namespace with
+	// accessKeyId and secretAccessKey keys
+	// If not set, frappe_s3_attachment uses the default AWS credential chain of the bench pods
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
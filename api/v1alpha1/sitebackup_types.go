@@ -17,29 +17,219 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteBackupSpec defines the desired state of SiteBackup
 type SiteBackupSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite to back up
+	// The SiteBackup must live in the namespace of the site's bench
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// IncludePublicFiles adds the public files tarball to the backup
+	// +optional
+	IncludePublicFiles bool `json:"includePublicFiles,omitempty"`
+
+	// IncludePrivateFiles adds the private files tarball to the backup
+	// +optional
+	IncludePrivateFiles bool `json:"includePrivateFiles,omitempty"`
+
+	// Destination is where the backup artifacts are written
+	// Defaults to the site's private/backups folder on the bench PVC
+	// +optional
+	Destination *BackupDestination `json:"destination,omitempty"`
+
+	// Schedule in cron format (e.g. "0 2 * * *")
+	// When set, this SiteBackup does not back up itself but creates a child
+	// SiteBackup on every scheduled run
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+
+	// Suspend stops creating new scheduled backups
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
 
-	// Foo is an example field of SiteBackup. Edit sitebackup_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Retention prunes the child backups of a scheduled SiteBackup, together with their artifacts
+	// A child backup is kept if any of the rules selects it
+	// +optional
+	Retention *BackupRetention `json:"retention,omitempty"`
+}
+
+// BackupRetention defines how many scheduled backups to keep
+type BackupRetention struct {
+	// KeepLast keeps the N most recent backups
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepLast int32 `json:"keepLast,omitempty"`
+
+	// KeepDaily keeps the most recent backup of each of the last N days that have backups
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepDaily int32 `json:"keepDaily,omitempty"`
+
+	// KeepWeekly keeps the most recent backup of each of the last N weeks that have backups
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepWeekly int32 `json:"keepWeekly,omitempty"`
+
+	// KeepMonthly keeps the most recent backup of each of the last N months that have backups
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepMonthly int32 `json:"keepMonthly,omitempty"`
+}
+
+// BackupDestination defines where backup artifacts are stored
+type BackupDestination struct {
+	// Type of destination: pvc or s3
+	// +kubebuilder:validation:Enum=pvc;s3
+	// +kubebuilder:validation:Required
+	Type string `json:"type"`
+
+	// PVC destination, required when type is pvc
+	// +optional
+	PVC *PVCBackupDestination `json:"pvc,omitempty"`
+
+	// S3 destination, required when type is s3
+	// +optional
+	S3 *S3BackupDestination `json:"s3,omitempty"`
+}
+
+// PVCBackupDestination stores backups on a PersistentVolumeClaim
+type PVCBackupDestination struct {
+	// ClaimName of the PVC in the backup's namespace
+	// +kubebuilder:validation:Required
+	ClaimName string `json:"claimName"`
+
+	// Path is the directory inside the PVC to write backups under
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// S3BackupDestination stores backups in an S3-compatible bucket (AWS S3, MinIO, ...)
+type S3BackupDestination struct {
+	// Endpoint URL of the S3 API, leave empty for AWS S3
+	// Example: "http://minio.minio.svc:9000"
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Bucket to upload backups to
+	// +kubebuilder:validation:Required
+	Bucket string `json:"bucket"`
+
+	// Region of the bucket
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Prefix is prepended to every object key
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// ForcePathStyle uses path-style addressing, needed by most MinIO setups
+	// +optional
+	ForcePathStyle bool `json:"forcePathStyle,omitempty"`
+
+	// CredentialsSecretRef references a Secret with accessKeyId and secretAccessKey keys
+	// If not set, the default AWS credential chain is used (e.g. IRSA)
+	// +optional
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// SiteBackupPhase represents the phase of a SiteBackup
+type SiteBackupPhase string
+
+const (
+	// SiteBackupPhasePending - waiting for the site to be ready
+	SiteBackupPhasePending SiteBackupPhase = "Pending"
+	// SiteBackupPhaseRunning - the backup Job is running
+	SiteBackupPhaseRunning SiteBackupPhase = "Running"
+	// SiteBackupPhaseCompleted - artifacts were written to the destination
+	SiteBackupPhaseCompleted SiteBackupPhase = "Completed"
+	// SiteBackupPhaseFailed - the backup could not be taken
+	SiteBackupPhaseFailed SiteBackupPhase = "Failed"
+	// SiteBackupPhaseScheduled - a scheduled SiteBackup is creating backups on its schedule
+	SiteBackupPhaseScheduled SiteBackupPhase = "Scheduled"
+)
+
+// BackupArtifact describes a single file produced by a backup
+type BackupArtifact struct {
+	// Type of artifact: database, public-files, private-files or site-config
+	Type string `json:"type"`
+
+	// Path of the artifact at the destination (e.g. s3://bucket/key or pvc://claim/path)
+	Path string `json:"path"`
+
+	// Size in bytes
+	Size int64 `json:"size"`
+
+	// Checksum of the artifact (sha256:<hex>)
+	Checksum string `json:"checksum"`
 }
 
 // SiteBackupStatus defines the observed state of SiteBackup
 type SiteBackupStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the backup
+	// +optional
+	Phase SiteBackupPhase `json:"phase,omitempty"`
+
+	// JobName of the Job that takes the backup
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// Location is the destination directory holding the artifacts
+	// +optional
+	Location string `json:"location,omitempty"`
+
+	// Artifacts written by the backup
+	// +optional
+	Artifacts []BackupArtifact `json:"artifacts,omitempty"`
+
+	// Size is the total size of all artifacts in bytes
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// Checksum of the SHA256SUMS manifest stored next to the artifacts (sha256:<hex>)
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
+
+	// FrappeVersion the bench was running when the backup was taken
+	// +optional
+	FrappeVersion string `json:"frappeVersion,omitempty"`
+
+	// StartTime is when the backup Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the backup finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message provides additional information about the backup
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastScheduleTime is when the last child backup was created (scheduled backups only)
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// NextScheduleTime is when the next child backup is due (scheduled backups only)
+	// +optional
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+
+	// LastSuccessfulBackup is the name of the most recent completed child backup (scheduled backups only)
+	// +optional
+	LastSuccessfulBackup string `json:"lastSuccessfulBackup,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.size`
+//+kubebuilder:printcolumn:name="Completed",type=date,JSONPath=`.status.completionTime`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // SiteBackup is the Schema for the sitebackups API
 type SiteBackup struct {
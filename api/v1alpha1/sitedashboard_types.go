@@ -20,26 +20,93 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteDashboardSpec defines the desired state of SiteDashboard
 type SiteDashboardSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite the dashboard is created on
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// DashboardName is the name of the Dashboard document
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	DashboardName string `json:"dashboardName"`
+
+	// Charts shown on the dashboard, in this order
+	// +optional
+	Charts []DashboardChartRef `json:"charts,omitempty"`
+
+	// IsDefault makes this the dashboard opened from the Dashboard view
+	// +optional
+	IsDefault bool `json:"isDefault,omitempty"`
+
+	// Module the dashboard belongs to
+	// +optional
+	Module string `json:"module,omitempty"`
+}
+
+// DashboardChartRef references a chart by SiteDashboardChart or by Dashboard Chart name
+// Exactly one of siteDashboardChart or chartName must be set.
+type DashboardChartRef struct {
+	// SiteDashboardChart is the name of a SiteDashboardChart in the SiteDashboard namespace
+	// +optional
+	SiteDashboardChart string `json:"siteDashboardChart,omitempty"`
+
+	// ChartName is a Dashboard Chart already on the site, e.g. one shipped by an app
+	// +optional
+	ChartName string `json:"chartName,omitempty"`
 
-	// Foo is an example field of SiteDashboard. Edit sitedashboard_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Width of the chart on the dashboard
+	// +kubebuilder:validation:Enum=Half;Full
+	// +kubebuilder:default=Half
+	// +optional
+	Width string `json:"width,omitempty"`
 }
 
+// SiteDashboardPhase represents the phase of a SiteDashboard
+type SiteDashboardPhase string
+
+const (
+	// SiteDashboardPhasePending - waiting for the site to be ready or for charts to resolve
+	SiteDashboardPhasePending SiteDashboardPhase = "Pending"
+	// SiteDashboardPhaseSynced - the dashboard on the site matches the spec
+	SiteDashboardPhaseSynced SiteDashboardPhase = "Synced"
+	// SiteDashboardPhaseFailed - the site rejected the dashboard or the SiteDashboard is invalid
+	SiteDashboardPhaseFailed SiteDashboardPhase = "Failed"
+)
+
 // SiteDashboardStatus defines the observed state of SiteDashboard
 type SiteDashboardStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the SiteDashboard
+	// +optional
+	Phase SiteDashboardPhase `json:"phase,omitempty"`
+
+	// DashboardName is the name of the Dashboard document on the site
+	// +optional
+	DashboardName string `json:"dashboardName,omitempty"`
+
+	// UnresolvedDependencies lists the charts that are missing or not yet synced
+	// +optional
+	UnresolvedDependencies []string `json:"unresolvedDependencies,omitempty"`
+
+	// LastSyncTime is when the dashboard was last compared with the site
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// ObservedGeneration is the generation last synced to the site
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message provides additional information about the SiteDashboard
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Dashboard",type=string,JSONPath=`.spec.dashboardName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // SiteDashboard is the Schema for the sitedashboards API
 type SiteDashboard struct {
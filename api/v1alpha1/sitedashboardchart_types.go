@@ -20,26 +20,151 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteDashboardChartSpec defines the desired state of SiteDashboardChart
+// A chart is either a time series (timeseries set) or grouped by a field (groupByField set).
 type SiteDashboardChartSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite the chart is created on
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// ChartName is the name of the Dashboard Chart document
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	ChartName string `json:"chartName"`
+
+	// DocumentType is the source DocType (e.g. "Sales Invoice")
+	// +kubebuilder:validation:Required
+	DocumentType string `json:"documentType"`
+
+	// AggregateFunction applied to the matching documents
+	// +kubebuilder:validation:Enum=Count;Sum;Average
+	// +kubebuilder:default=Count
+	// +optional
+	AggregateFunction string `json:"aggregateFunction,omitempty"`
+
+	// ValueField is the numeric field summed or averaged; required for Sum and Average
+	// +optional
+	ValueField string `json:"valueField,omitempty"`
+
+	// GroupByField groups the documents by the values of this field
+	// +optional
+	GroupByField string `json:"groupByField,omitempty"`
+
+	// NumberOfGroups limits a grouped chart to the largest groups; 0 shows all
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	NumberOfGroups int32 `json:"numberOfGroups,omitempty"`
+
+	// Timeseries plots the aggregate over time
+	// +optional
+	Timeseries *ChartTimeseries `json:"timeseries,omitempty"`
+
+	// Filters applied to the source documents
+	// +optional
+	Filters []ChartFilter `json:"filters,omitempty"`
+
+	// Type of the chart
+	// +kubebuilder:validation:Enum=Line;Bar;Percentage;Pie;Donut;Heatmap
+	// +kubebuilder:default=Line
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// Color of the chart as a hex code (e.g. "#449CF0")
+	// +optional
+	Color string `json:"color,omitempty"`
+
+	// Public charts are visible to every user allowed to read the source DocType
+	// +kubebuilder:default=true
+	// +optional
+	Public *bool `json:"public,omitempty"`
+
+	// Module the chart belongs to
+	// +optional
+	Module string `json:"module,omitempty"`
+}
 
-	// Foo is an example field of SiteDashboardChart. Edit sitedashboardchart_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+// ChartTimeseries configures a time series chart
+type ChartTimeseries struct {
+	// BasedOn is the date or datetime field placing documents in time (e.g. "posting_date")
+	// +kubebuilder:validation:Required
+	BasedOn string `json:"basedOn"`
+
+	// Interval of the data points
+	// +kubebuilder:validation:Enum=Yearly;Quarterly;Monthly;Weekly;Daily
+	// +kubebuilder:default=Monthly
+	// +optional
+	Interval string `json:"interval,omitempty"`
+
+	// Timespan covered by the chart
+	// +kubebuilder:validation:Enum="Last Year";"Last Quarter";"Last Month";"Last Week"
+	// +kubebuilder:default="Last Year"
+	// +optional
+	Timespan string `json:"timespan,omitempty"`
 }
 
+// ChartFilter is a condition on a field of the source DocType
+type ChartFilter struct {
+	// Field of the source DocType
+	// +kubebuilder:validation:Required
+	Field string `json:"field"`
+
+	// Operator of the condition
+	// +kubebuilder:validation:Enum="=";"!=";">";"<";">=";"<=";"like";"not like";"in";"not in";"is"
+	// +kubebuilder:default="="
+	// +optional
+	Operator string `json:"operator,omitempty"`
+
+	// Value compared with; a comma separated list for "in" and "not in", "set" or "not set" for "is"
+	// +optional
+	Value string `json:"value,omitempty"`
+}
+
+// SiteDashboardChartPhase represents the phase of a SiteDashboardChart
+type SiteDashboardChartPhase string
+
+const (
+	// SiteDashboardChartPhasePending - waiting for the site to be ready or for dependencies to resolve
+	SiteDashboardChartPhasePending SiteDashboardChartPhase = "Pending"
+	// SiteDashboardChartPhaseSynced - the chart on the site matches the spec
+	SiteDashboardChartPhaseSynced SiteDashboardChartPhase = "Synced"
+	// SiteDashboardChartPhaseFailed - the site rejected the chart or the SiteDashboardChart is invalid
+	SiteDashboardChartPhaseFailed SiteDashboardChartPhase = "Failed"
+)
+
 // SiteDashboardChartStatus defines the observed state of SiteDashboardChart
 type SiteDashboardChartStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the SiteDashboardChart
+	// +optional
+	Phase SiteDashboardChartPhase `json:"phase,omitempty"`
+
+	// ChartName is the name of the Dashboard Chart document on the site
+	// +optional
+	ChartName string `json:"chartName,omitempty"`
+
+	// UnresolvedDependencies lists the DocTypes and fields the chart needs that the site does not have
+	// +optional
+	UnresolvedDependencies []string `json:"unresolvedDependencies,omitempty"`
+
+	// LastSyncTime is when the chart was last compared with the site
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// ObservedGeneration is the generation last synced to the site
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message provides additional information about the SiteDashboardChart
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Chart",type=string,JSONPath=`.spec.chartName`
+//+kubebuilder:printcolumn:name="DocType",type=string,JSONPath=`.spec.documentType`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // SiteDashboardChart is the Schema for the sitedashboardcharts API
 type SiteDashboardChart struct {
@@ -20,26 +20,191 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteJobSpec defines the desired state of SiteJob
+// Exactly one of command, python or method must be set
 type SiteJobSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite to run against
+	// The SiteJob must live in the namespace of the site's bench
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// Command is a bench subcommand with its arguments, run as bench --site <site> <command...>
+	// Example: ["migrate"], ["clear-cache"], ["execute", "frappe.utils.scheduler.enable_scheduler"]
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Python source run with the site connected, like a console script
+	// frappe is imported and the session user is Administrator; the transaction is
+	// committed when the script finishes without raising
+	// +optional
+	Python string `json:"python,omitempty"`
+
+	// Method calls a whitelisted method as Administrator
+	// +optional
+	Method *SiteJobMethod `json:"method,omitempty"`
+
+	// ActiveDeadlineSeconds limits how long the Job may run
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+
+	// Schedule in cron format (e.g. "30 1 * * *")
+	// When set, the SiteJob runs on every scheduled time instead of once
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+
+	// Suspend stops starting new scheduled runs; running ones are not affected
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// ConcurrencyPolicy decides what happens when a run is due while the previous one is still running
+	// Allow runs both, Forbid skips the new run, Replace stops the running one and starts the new one
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	// +kubebuilder:default=Forbid
+	// +optional
+	ConcurrencyPolicy SiteJobConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+
+	// StartingDeadlineSeconds skips a run that could not be started within this many seconds of its scheduled time
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	StartingDeadlineSeconds *int64 `json:"startingDeadlineSeconds,omitempty"`
+
+	// SuccessfulJobsHistoryLimit is the number of succeeded runs to keep
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=3
+	// +optional
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
 
-	// Foo is an example field of SiteJob. Edit sitejob_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// FailedJobsHistoryLimit is the number of failed runs to keep
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	// +optional
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+}
+
+// SiteJobConcurrencyPolicy describes how concurrent scheduled runs are handled
+type SiteJobConcurrencyPolicy string
+
+const (
+	// SiteJobConcurrencyAllow allows runs to overlap
+	SiteJobConcurrencyAllow SiteJobConcurrencyPolicy = "Allow"
+	// SiteJobConcurrencyForbid skips a run while the previous one is still running
+	SiteJobConcurrencyForbid SiteJobConcurrencyPolicy = "Forbid"
+	// SiteJobConcurrencyReplace stops the running run and starts the new one
+	SiteJobConcurrencyReplace SiteJobConcurrencyPolicy = "Replace"
+)
+
+// SiteJobMethod is a whitelisted method call
+type SiteJobMethod struct {
+	// Name is the dotted path of the method (e.g. "frappe.client.get_count")
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Kwargs are passed to the method as keyword arguments, as form values would be over REST
+	// +optional
+	Kwargs map[string]string `json:"kwargs,omitempty"`
+}
+
+// SiteJobPhase represents the phase of a SiteJob
+type SiteJobPhase string
+
+const (
+	// SiteJobPhasePending - waiting for the site to be ready
+	SiteJobPhasePending SiteJobPhase = "Pending"
+	// SiteJobPhaseRunning - the Job is running
+	SiteJobPhaseRunning SiteJobPhase = "Running"
+	// SiteJobPhaseSucceeded - the command exited with code 0
+	SiteJobPhaseSucceeded SiteJobPhase = "Succeeded"
+	// SiteJobPhaseFailed - the command failed or the SiteJob is invalid
+	SiteJobPhaseFailed SiteJobPhase = "Failed"
+	// SiteJobPhaseScheduled - a scheduled SiteJob is running its command on its schedule
+	SiteJobPhaseScheduled SiteJobPhase = "Scheduled"
+)
+
+// SiteJobRun is one run of a scheduled SiteJob
+type SiteJobRun struct {
+	// JobName of the Job for this run
+	JobName string `json:"jobName"`
+
+	// Phase of the run: Running, Succeeded or Failed
+	Phase SiteJobPhase `json:"phase"`
+
+	// ScheduledTime is the scheduled time this run was started for
+	// +optional
+	ScheduledTime *metav1.Time `json:"scheduledTime,omitempty"`
+
+	// StartTime is when the Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the run finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// ExitCode of the command
+	// +optional
+	ExitCode *int32 `json:"exitCode,omitempty"`
+
+	// LogTail is the end of the command output, truncated to a few KB
+	// +optional
+	LogTail string `json:"logTail,omitempty"`
 }
 
 // SiteJobStatus defines the observed state of SiteJob
 type SiteJobStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the SiteJob
+	// +optional
+	Phase SiteJobPhase `json:"phase,omitempty"`
+
+	// JobName of the Job running the command
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// ExitCode of the command
+	// +optional
+	ExitCode *int32 `json:"exitCode,omitempty"`
+
+	// StartTime is when the Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the command finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// LogTail is the end of the command output, truncated to a few KB
+	// +optional
+	LogTail string `json:"logTail,omitempty"`
+
+	// Message provides additional information about the SiteJob
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// LastScheduleTime is when the last run was due (scheduled SiteJobs only)
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// NextScheduleTime is when the next run is due (scheduled SiteJobs only)
+	// +optional
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+
+	// LastSuccessfulTime is when the last successful run finished (scheduled SiteJobs only)
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+
+	// History lists the retained runs, newest first (scheduled SiteJobs only)
+	// +optional
+	History []SiteJobRun `json:"history,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Exit Code",type=integer,JSONPath=`.status.exitCode`
+//+kubebuilder:printcolumn:name="Completed",type=date,JSONPath=`.status.completionTime`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // SiteJob is the Schema for the sitejobs API
 type SiteJob struct {
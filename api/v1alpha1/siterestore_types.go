@@ -0,0 +1,159 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SiteRestoreSpec defines the desired state of SiteRestore
+type SiteRestoreSpec struct {
+	// SiteRef references the FrappeSite to restore into
+	// The SiteRestore must live in the namespace of the site's bench
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// Source of the backup to restore
+	// +kubebuilder:validation:Required
+	Source RestoreSource `json:"source"`
+
+	// Migrate controls whether bench migrate runs after the restore
+	// Auto migrates when the backup was taken on an older or unknown Frappe version
+	// +kubebuilder:validation:Enum=Auto;Always;Never
+	// +kubebuilder:default=Auto
+	// +optional
+	Migrate RestoreMigratePolicy `json:"migrate,omitempty"`
+}
+
+// RestoreSource points at a SiteBackup or at raw backup artifacts
+// Set either backupRef or database
+type RestoreSource struct {
+	// BackupRef references a completed SiteBackup in the same namespace
+	// +optional
+	BackupRef *corev1.LocalObjectReference `json:"backupRef,omitempty"`
+
+	// Database dump to restore: an http(s) URL, or a path inside claimName
+	// +optional
+	Database string `json:"database,omitempty"`
+
+	// PublicFiles tarball to restore: an http(s) URL, or a path inside claimName
+	// +optional
+	PublicFiles string `json:"publicFiles,omitempty"`
+
+	// PrivateFiles tarball to restore: an http(s) URL, or a path inside claimName
+	// +optional
+	PrivateFiles string `json:"privateFiles,omitempty"`
+
+	// ClaimName of a PVC holding the raw artifacts
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
+
+	// FrappeVersion the raw artifacts were taken on, used by migrate Auto
+	// +optional
+	FrappeVersion string `json:"frappeVersion,omitempty"`
+}
+
+// RestoreMigratePolicy controls bench migrate after a restore
+type RestoreMigratePolicy string
+
+const (
+	// RestoreMigrateAuto migrates when the backup comes from an older or unknown Frappe version
+	RestoreMigrateAuto RestoreMigratePolicy = "Auto"
+	// RestoreMigrateAlways always migrates after the restore
+	RestoreMigrateAlways RestoreMigratePolicy = "Always"
+	// RestoreMigrateNever never migrates after the restore
+	RestoreMigrateNever RestoreMigratePolicy = "Never"
+)
+
+// SiteRestorePhase represents the phase of a SiteRestore
+type SiteRestorePhase string
+
+const (
+	// SiteRestorePhasePending - waiting for the site or the backup to be ready
+	SiteRestorePhasePending SiteRestorePhase = "Pending"
+	// SiteRestorePhaseRunning - the restore Job is running
+	SiteRestorePhaseRunning SiteRestorePhase = "Running"
+	// SiteRestorePhaseCompleted - the site was restored
+	SiteRestorePhaseCompleted SiteRestorePhase = "Completed"
+	// SiteRestorePhaseFailed - the restore failed, the site stays in maintenance mode
+	SiteRestorePhaseFailed SiteRestorePhase = "Failed"
+)
+
+// SiteRestoreStatus defines the observed state of SiteRestore
+type SiteRestoreStatus struct {
+	// Phase of the restore
+	// +optional
+	Phase SiteRestorePhase `json:"phase,omitempty"`
+
+	// JobName of the Job that runs the restore
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// SourceVersion is the Frappe version the backup was taken on, if known
+	// +optional
+	SourceVersion string `json:"sourceVersion,omitempty"`
+
+	// TargetVersion is the Frappe version of the site's bench
+	// +optional
+	TargetVersion string `json:"targetVersion,omitempty"`
+
+	// Migrated indicates that bench migrate runs after the restore
+	// +optional
+	Migrated bool `json:"migrated,omitempty"`
+
+	// StartTime is when the restore Job was created
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the restore finished
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message provides additional information about the restore
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.source.backupRef.name`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// SiteRestore is the Schema for the siterestores API
+type SiteRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SiteRestoreSpec   `json:"spec,omitempty"`
+	Status SiteRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SiteRestoreList contains a list of SiteRestore
+type SiteRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SiteRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SiteRestore{}, &SiteRestoreList{})
+}
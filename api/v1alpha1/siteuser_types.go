@@ -17,29 +17,153 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteUserSpec defines the desired state of SiteUser
 type SiteUserSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite the user belongs to
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// Email of the user, also the name of the Frappe User document
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=3
+	Email string `json:"email"`
+
+	// FirstName of the user
+	// +kubebuilder:validation:Required
+	FirstName string `json:"firstName"`
+
+	// LastName of the user
+	// +optional
+	LastName string `json:"lastName,omitempty"`
+
+	// Roles assigned to the user (e.g. "System Manager")
+	// The user's roles are replaced by this list; ignored when roleProfile is set
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// RoleProfile assigns the roles of an existing Role Profile
+	// +optional
+	RoleProfile string `json:"roleProfile,omitempty"`
+
+	// ModuleProfile restricts the modules of the user to an existing Module Profile
+	// +optional
+	ModuleProfile string `json:"moduleProfile,omitempty"`
+
+	// UserType is "System User" or "Website User"
+	// +kubebuilder:validation:Enum="System User";"Website User"
+	// +kubebuilder:default="System User"
+	// +optional
+	UserType string `json:"userType,omitempty"`
 
-	// Foo is an example field of SiteUser. Edit siteuser_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Enabled controls whether the user can log in
+	// +kubebuilder:default=true
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// PasswordSecretRef references a Secret in the SiteUser namespace whose "password" key
+	// holds the user's password. The password is set whenever the Secret changes.
+	// Without it the user has no password and must use a login link or SSO.
+	// +optional
+	PasswordSecretRef *corev1.LocalObjectReference `json:"passwordSecretRef,omitempty"`
+
+	// APIKey issues an API key and secret for the user into a Secret
+	// +optional
+	APIKey *SiteUserAPIKey `json:"apiKey,omitempty"`
 }
 
+// SiteUserAPIKey configures API key issuance and rotation
+// The key pair is rotated on the schedule, and whenever the
+// vyogo.tech/rotate-api-key annotation of the SiteUser changes.
+type SiteUserAPIKey struct {
+	// SecretName is the Secret in the SiteUser namespace receiving the "api_key" and "api_secret" keys
+	// +kubebuilder:validation:Required
+	SecretName string `json:"secretName"`
+
+	// RotationSchedule in cron format (e.g. "0 3 1 * *")
+	// +optional
+	RotationSchedule string `json:"rotationSchedule,omitempty"`
+}
+
+// SiteUserPhase represents the phase of a SiteUser
+type SiteUserPhase string
+
+const (
+	// SiteUserPhasePending - waiting for the site to be ready
+	SiteUserPhasePending SiteUserPhase = "Pending"
+	// SiteUserPhaseReady - the user matches the spec
+	SiteUserPhaseReady SiteUserPhase = "Ready"
+	// SiteUserPhaseFailed - the site rejected the user or the SiteUser is invalid
+	SiteUserPhaseFailed SiteUserPhase = "Failed"
+)
+
 // SiteUserStatus defines the observed state of SiteUser
 type SiteUserStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the SiteUser
+	// +optional
+	Phase SiteUserPhase `json:"phase,omitempty"`
+
+	// UserName is the name of the User document on the site
+	// +optional
+	UserName string `json:"userName,omitempty"`
+
+	// Enabled reports whether the user is enabled on the site
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// LastSyncTime is when the user was last synced with the site
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// ObservedGeneration is the generation last synced to the site
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// PasswordSecretVersion is the resourceVersion of the password Secret last applied
+	// +optional
+	PasswordSecretVersion string `json:"passwordSecretVersion,omitempty"`
+
+	// APIKey reports the issued API key
+	// +optional
+	APIKey *SiteUserAPIKeyStatus `json:"apiKey,omitempty"`
+
+	// Message provides additional information about the SiteUser
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// SiteUserAPIKeyStatus describes the API key issued for the user
+type SiteUserAPIKeyStatus struct {
+	// SecretName is the Secret holding the current key pair
+	SecretName string `json:"secretName"`
+
+	// Key is the API key (the public half of the pair)
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// LastRotationTime is when the current key pair was issued
+	// +optional
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+
+	// NextRotationTime is when the next scheduled rotation is due
+	// +optional
+	NextRotationTime *metav1.Time `json:"nextRotationTime,omitempty"`
+
+	// RotationTrigger is the value of the rotate-api-key annotation the current pair was issued for
+	// +optional
+	RotationTrigger string `json:"rotationTrigger,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Email",type=string,JSONPath=`.spec.email`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // SiteUser is the Schema for the siteusers API
 type SiteUser struct {
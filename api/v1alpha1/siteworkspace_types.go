@@ -20,26 +20,191 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
-
 // SiteWorkspaceSpec defines the desired state of SiteWorkspace
 type SiteWorkspaceSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// SiteRef references the FrappeSite the workspace is created on
+	// +kubebuilder:validation:Required
+	SiteRef *NamespacedName `json:"siteRef"`
+
+	// Title shown in the Desk sidebar
+	// The Workspace document is named after it; private workspaces are named <title>-<forUser>
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Title string `json:"title"`
+
+	// Module the workspace belongs to (e.g. "Selling")
+	// +optional
+	Module string `json:"module,omitempty"`
+
+	// Icon name from the Frappe icon set (e.g. "sell")
+	// +optional
+	Icon string `json:"icon,omitempty"`
+
+	// ParentPage nests the workspace under another workspace in the sidebar
+	// +optional
+	ParentPage string `json:"parentPage,omitempty"`
+
+	// Public workspaces are visible to every user with one of the roles;
+	// private ones only to forUser
+	// +kubebuilder:default=true
+	// +optional
+	Public *bool `json:"public,omitempty"`
+
+	// ForUser owns a private workspace; required when public is false
+	// +optional
+	ForUser string `json:"forUser,omitempty"`
+
+	// Roles allowed to see a public workspace; empty means everyone
+	// +optional
+	Roles []string `json:"roles,omitempty"`
+
+	// NumberCards shown at the top of the workspace, by Number Card name
+	// +optional
+	NumberCards []WorkspaceWidgetRef `json:"numberCards,omitempty"`
+
+	// Charts shown below the number cards, by Dashboard Chart name
+	// +optional
+	Charts []WorkspaceWidgetRef `json:"charts,omitempty"`
+
+	// Shortcuts shown as buttons below the charts
+	// +optional
+	Shortcuts []WorkspaceShortcut `json:"shortcuts,omitempty"`
+
+	// Cards are groups of links shown at the bottom of the workspace
+	// +optional
+	Cards []WorkspaceCard `json:"cards,omitempty"`
+}
+
+// WorkspaceWidgetRef references a Number Card or Dashboard Chart
+type WorkspaceWidgetRef struct {
+	// Name of the Number Card or Dashboard Chart document
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Label shown on the workspace; defaults to the name
+	// +optional
+	Label string `json:"label,omitempty"`
+}
+
+// WorkspaceShortcut is a shortcut button
+type WorkspaceShortcut struct {
+	// Label of the button
+	// +kubebuilder:validation:Required
+	Label string `json:"label"`
+
+	// Type of the target
+	// +kubebuilder:validation:Enum=DocType;Report;Page;Dashboard;URL
+	// +kubebuilder:default=DocType
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// LinkTo is the name of the target DocType, Report, Page or Dashboard
+	// +optional
+	LinkTo string `json:"linkTo,omitempty"`
+
+	// URL opened by URL shortcuts
+	// +optional
+	URL string `json:"url,omitempty"`
 
-	// Foo is an example field of SiteWorkspace. Edit siteworkspace_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// DocView opens a DocType in this view (e.g. "List", "Report Builder", "Kanban", "New")
+	// +optional
+	DocView string `json:"docView,omitempty"`
+
+	// Color of the count badge (e.g. "Blue")
+	// +optional
+	Color string `json:"color,omitempty"`
+}
+
+// WorkspaceCard is a titled group of links
+type WorkspaceCard struct {
+	// Label of the card
+	// +kubebuilder:validation:Required
+	Label string `json:"label"`
+
+	// Links in the card
+	// +optional
+	Links []WorkspaceLink `json:"links,omitempty"`
+}
+
+// WorkspaceLink is a link in a card
+type WorkspaceLink struct {
+	// Label of the link
+	// +kubebuilder:validation:Required
+	Label string `json:"label"`
+
+	// Type of the target
+	// +kubebuilder:validation:Enum=DocType;Report;Page
+	// +kubebuilder:default=DocType
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// LinkTo is the name of the target DocType, Report or Page
+	// +kubebuilder:validation:Required
+	LinkTo string `json:"linkTo"`
+
+	// IsQueryReport marks Report targets that are query or script reports
+	// +optional
+	IsQueryReport bool `json:"isQueryReport,omitempty"`
+
+	// Dependencies are DocTypes that must have records before the link is highlighted
+	// +optional
+	Dependencies []string `json:"dependencies,omitempty"`
+
+	// OnlyFor shows the link only for companies in this country
+	// +optional
+	OnlyFor string `json:"onlyFor,omitempty"`
 }
 
+// SiteWorkspacePhase represents the phase of a SiteWorkspace
+type SiteWorkspacePhase string
+
+const (
+	// SiteWorkspacePhasePending - waiting for the site to be ready
+	SiteWorkspacePhasePending SiteWorkspacePhase = "Pending"
+	// SiteWorkspacePhaseSynced - the workspace on the site matches the spec
+	SiteWorkspacePhaseSynced SiteWorkspacePhase = "Synced"
+	// SiteWorkspacePhaseFailed - the site rejected the workspace or the SiteWorkspace is invalid
+	SiteWorkspacePhaseFailed SiteWorkspacePhase = "Failed"
+)
+
 // SiteWorkspaceStatus defines the observed state of SiteWorkspace
 type SiteWorkspaceStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Phase of the SiteWorkspace
+	// +optional
+	Phase SiteWorkspacePhase `json:"phase,omitempty"`
+
+	// WorkspaceName is the name of the Workspace document on the site
+	// +optional
+	WorkspaceName string `json:"workspaceName,omitempty"`
+
+	// LastSyncTime is when the workspace was last compared with the site
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// LastDriftTime is when changes made on the site were last reverted
+	// +optional
+	LastDriftTime *metav1.Time `json:"lastDriftTime,omitempty"`
+
+	// DriftedFields lists the fields that had been changed on the site at LastDriftTime
+	// +optional
+	DriftedFields []string `json:"driftedFields,omitempty"`
+
+	// ObservedGeneration is the generation last synced to the site
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message provides additional information about the SiteWorkspace
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Site",type=string,JSONPath=`.spec.siteRef.name`
+//+kubebuilder:printcolumn:name="Workspace",type=string,JSONPath=`.status.workspaceName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Last Drift",type=date,JSONPath=`.status.lastDriftTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // SiteWorkspace is the Schema for the siteworkspaces API
 type SiteWorkspace struct {
@@ -21,8 +21,8 @@ limitations under the License.
 package v1alpha1
 
 import (
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -41,6 +41,244 @@ func (in *AppSource) DeepCopy() *AppSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupArtifact) DeepCopyInto(out *BackupArtifact) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupArtifact.
+func (in *BackupArtifact) DeepCopy() *BackupArtifact {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupArtifact)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupDestination) DeepCopyInto(out *BackupDestination) {
+	*out = *in
+	if in.PVC != nil {
+		in, out := &in.PVC, &out.PVC
+		*out = new(PVCBackupDestination)
+		**out = **in
+	}
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(S3BackupDestination)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupDestination.
+func (in *BackupDestination) DeepCopy() *BackupDestination {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupDestination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupRetention) DeepCopyInto(out *BackupRetention) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupRetention.
+func (in *BackupRetention) DeepCopy() *BackupRetention {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupRetention)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchAppStatus) DeepCopyInto(out *BenchAppStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchAppStatus.
+func (in *BenchAppStatus) DeepCopy() *BenchAppStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchAppStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchImageBuildStatus) DeepCopyInto(out *BenchImageBuildStatus) {
+	*out = *in
+	if in.Lock != nil {
+		in, out := &in.Lock, &out.Lock
+		*out = new(BenchLock)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchImageBuildStatus.
+func (in *BenchImageBuildStatus) DeepCopy() *BenchImageBuildStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchImageBuildStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchLock) DeepCopyInto(out *BenchLock) {
+	*out = *in
+	if in.Apps != nil {
+		in, out := &in.Apps, &out.Apps
+		*out = make([]LockedApp, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchLock.
+func (in *BenchLock) DeepCopy() *BenchLock {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchLock)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchStorage) DeepCopyInto(out *BenchStorage) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Migration != nil {
+		in, out := &in.Migration, &out.Migration
+		*out = new(StorageMigration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchStorage.
+func (in *BenchStorage) DeepCopy() *BenchStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchStorageStatus) DeepCopyInto(out *BenchStorageStatus) {
+	*out = *in
+	if in.Migration != nil {
+		in, out := &in.Migration, &out.Migration
+		*out = new(StorageMigrationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchStorageStatus.
+func (in *BenchStorageStatus) DeepCopy() *BenchStorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchStorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BenchUpgradeStatus) DeepCopyInto(out *BenchUpgradeStatus) {
+	*out = *in
+	if in.Sites != nil {
+		in, out := &in.Sites, &out.Sites
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MigratedSites != nil {
+		in, out := &in.MigratedSites, &out.MigratedSites
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RestoredSites != nil {
+		in, out := &in.RestoredSites, &out.RestoredSites
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lock != nil {
+		in, out := &in.Lock, &out.Lock
+		*out = new(BenchLock)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BenchUpgradeStatus.
+func (in *BenchUpgradeStatus) DeepCopy() *BenchUpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BenchUpgradeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ChartFilter) DeepCopyInto(out *ChartFilter) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ChartFilter.
+func (in *ChartFilter) DeepCopy() *ChartFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(ChartFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ChartTimeseries) DeepCopyInto(out *ChartTimeseries) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ChartTimeseries.
+func (in *ChartTimeseries) DeepCopy() *ChartTimeseries {
+	if in == nil {
+		return nil
+	}
+	out := new(ChartTimeseries)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ComponentReplicas) DeepCopyInto(out *ComponentReplicas) {
 	*out = *in
@@ -106,6 +344,21 @@ func (in *ComponentResources) DeepCopy() *ComponentResources {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DashboardChartRef) DeepCopyInto(out *DashboardChartRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DashboardChartRef.
+func (in *DashboardChartRef) DeepCopy() *DashboardChartRef {
+	if in == nil {
+		return nil
+	}
+	out := new(DashboardChartRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DatabaseConfig) DeepCopyInto(out *DatabaseConfig) {
 	*out = *in
@@ -131,7 +384,7 @@ func (in *DatabaseConfig) DeepCopyInto(out *DatabaseConfig) {
 	}
 	if in.ConnectionSecretRef != nil {
 		in, out := &in.ConnectionSecretRef, &out.ConnectionSecretRef
-		*out = new(corev1.SecretReference)
+		*out = new(v1.SecretReference)
 		**out = **in
 	}
 }
@@ -171,6 +424,21 @@ func (in *DomainConfig) DeepCopy() *DomainConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FPMBinary) DeepCopyInto(out *FPMBinary) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FPMBinary.
+func (in *FPMBinary) DeepCopy() *FPMBinary {
+	if in == nil {
+		return nil
+	}
+	out := new(FPMBinary)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FPMConfig) DeepCopyInto(out *FPMConfig) {
 	*out = *in
@@ -198,7 +466,7 @@ func (in *FPMRepository) DeepCopyInto(out *FPMRepository) {
 	*out = *in
 	if in.AuthSecretRef != nil {
 		in, out := &in.AuthSecretRef, &out.AuthSecretRef
-		*out = new(corev1.SecretReference)
+		*out = new(v1.SecretReference)
 		**out = **in
 	}
 }
@@ -213,6 +481,26 @@ func (in *FPMRepository) DeepCopy() *FPMRepository {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FilesStorage) DeepCopyInto(out *FilesStorage) {
+	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FilesStorage.
+func (in *FilesStorage) DeepCopy() *FilesStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(FilesStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FrappeBench) DeepCopyInto(out *FrappeBench) {
 	*out = *in
@@ -300,6 +588,11 @@ func (in *FrappeBenchSpec) DeepCopyInto(out *FrappeBenchSpec) {
 		*out = new(RedisConfig)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(BenchStorage)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.DomainConfig != nil {
 		in, out := &in.DomainConfig, &out.DomainConfig
 		*out = new(DomainConfig)
@@ -320,6 +613,16 @@ func (in *FrappeBenchSpec) DeepCopyInto(out *FrappeBenchSpec) {
 		*out = new(WorkerAutoscalingConfig)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ImageBuild != nil {
+		in, out := &in.ImageBuild, &out.ImageBuild
+		*out = new(ImageBuildConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FilesStorage != nil {
+		in, out := &in.FilesStorage, &out.FilesStorage
+		*out = new(FilesStorage)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeBenchSpec.
@@ -337,7 +640,7 @@ func (in *FrappeBenchStatus) DeepCopyInto(out *FrappeBenchStatus) {
 	*out = *in
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]v1.Condition, len(*in))
+		*out = make([]metav1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -347,6 +650,16 @@ func (in *FrappeBenchStatus) DeepCopyInto(out *FrappeBenchStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Apps != nil {
+		in, out := &in.Apps, &out.Apps
+		*out = make([]BenchAppStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lock != nil {
+		in, out := &in.Lock, &out.Lock
+		*out = new(BenchLock)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.FPMRepositories != nil {
 		in, out := &in.FPMRepositories, &out.FPMRepositories
 		*out = make([]string, len(*in))
@@ -359,6 +672,26 @@ func (in *FrappeBenchStatus) DeepCopyInto(out *FrappeBenchStatus) {
 			(*out)[key] = val
 		}
 	}
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(BenchUpgradeStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImageBuild != nil {
+		in, out := &in.ImageBuild, &out.ImageBuild
+		*out = new(BenchImageBuildStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(BenchStorageStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AssetsTrees != nil {
+		in, out := &in.AssetsTrees, &out.AssetsTrees
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeBenchStatus.
@@ -377,7 +710,7 @@ func (in *FrappeSite) DeepCopyInto(out *FrappeSite) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeSite.
@@ -440,7 +773,7 @@ func (in *FrappeSiteSpec) DeepCopyInto(out *FrappeSiteSpec) {
 	}
 	if in.AdminPasswordSecretRef != nil {
 		in, out := &in.AdminPasswordSecretRef, &out.AdminPasswordSecretRef
-		*out = new(corev1.SecretReference)
+		*out = new(v1.SecretReference)
 		**out = **in
 	}
 	in.DBConfig.DeepCopyInto(&out.DBConfig)
@@ -450,6 +783,16 @@ func (in *FrappeSiteSpec) DeepCopyInto(out *FrappeSiteSpec) {
 		*out = new(IngressConfig)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Apps != nil {
+		in, out := &in.Apps, &out.Apps
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FilesStorage != nil {
+		in, out := &in.FilesStorage, &out.FilesStorage
+		*out = new(FilesStorage)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeSiteSpec.
@@ -465,6 +808,28 @@ func (in *FrappeSiteSpec) DeepCopy() *FrappeSiteSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FrappeSiteStatus) DeepCopyInto(out *FrappeSiteStatus) {
 	*out = *in
+	if in.Apps != nil {
+		in, out := &in.Apps, &out.Apps
+		*out = make([]SiteAppStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = new(SiteBackupSummary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FilesStorage != nil {
+		in, out := &in.FilesStorage, &out.FilesStorage
+		*out = new(SiteFilesStorageStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeSiteStatus.
@@ -482,8 +847,8 @@ func (in *FrappeWorkpace) DeepCopyInto(out *FrappeWorkpace) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeWorkpace.
@@ -539,6 +904,31 @@ func (in *FrappeWorkpaceList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FrappeWorkpaceSpec) DeepCopyInto(out *FrappeWorkpaceSpec) {
 	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.BenchTemplate != nil {
+		in, out := &in.BenchTemplate, &out.BenchTemplate
+		*out = new(WorkpaceBenchTemplate)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DBConfig != nil {
+		in, out := &in.DBConfig, &out.DBConfig
+		*out = new(DatabaseConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(TLSConfig)
+		**out = **in
+	}
+	if in.Quota != nil {
+		in, out := &in.Quota, &out.Quota
+		*out = new(WorkpaceQuota)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeWorkpaceSpec.
@@ -554,6 +944,20 @@ func (in *FrappeWorkpaceSpec) DeepCopy() *FrappeWorkpaceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FrappeWorkpaceStatus) DeepCopyInto(out *FrappeWorkpaceStatus) {
 	*out = *in
+	out.Benches = in.Benches
+	out.Sites = in.Sites
+	if in.Unhealthy != nil {
+		in, out := &in.Unhealthy, &out.Unhealthy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.QuotaUsed != nil {
+		in, out := &in.QuotaUsed, &out.QuotaUsed
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FrappeWorkpaceStatus.
@@ -586,12 +990,38 @@ func (in *GitConfig) DeepCopy() *GitConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageBuildConfig) DeepCopyInto(out *ImageBuildConfig) {
+	*out = *in
+	if in.PushSecretRef != nil {
+		in, out := &in.PushSecretRef, &out.PushSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.FPM != nil {
+		in, out := &in.FPM, &out.FPM
+		*out = new(FPMBinary)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageBuildConfig.
+func (in *ImageBuildConfig) DeepCopy() *ImageBuildConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageBuildConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImageConfig) DeepCopyInto(out *ImageConfig) {
 	*out = *in
 	if in.PullSecrets != nil {
 		in, out := &in.PullSecrets, &out.PullSecrets
-		*out = make([]corev1.LocalObjectReference, len(*in))
+		*out = make([]v1.LocalObjectReference, len(*in))
 		copy(*out, *in)
 	}
 }
@@ -638,6 +1068,26 @@ func (in *IngressConfig) DeepCopy() *IngressConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LockedApp) DeepCopyInto(out *LockedApp) {
+	*out = *in
+	if in.RequiredApps != nil {
+		in, out := &in.RequiredApps, &out.RequiredApps
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LockedApp.
+func (in *LockedApp) DeepCopy() *LockedApp {
+	if in == nil {
+		return nil
+	}
+	out := new(LockedApp)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NamespacedName) DeepCopyInto(out *NamespacedName) {
 	*out = *in
@@ -653,6 +1103,21 @@ func (in *NamespacedName) DeepCopy() *NamespacedName {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PVCBackupDestination) DeepCopyInto(out *PVCBackupDestination) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PVCBackupDestination.
+func (in *PVCBackupDestination) DeepCopy() *PVCBackupDestination {
+	if in == nil {
+		return nil
+	}
+	out := new(PVCBackupDestination)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RedisConfig) DeepCopyInto(out *RedisConfig) {
 	*out = *in
@@ -673,7 +1138,7 @@ func (in *RedisConfig) DeepCopyInto(out *RedisConfig) {
 	}
 	if in.ConnectionSecretRef != nil {
 		in, out := &in.ConnectionSecretRef, &out.ConnectionSecretRef
-		*out = new(corev1.SecretReference)
+		*out = new(v1.SecretReference)
 		**out = **in
 	}
 }
@@ -693,14 +1158,14 @@ func (in *ResourceRequirements) DeepCopyInto(out *ResourceRequirements) {
 	*out = *in
 	if in.Requests != nil {
 		in, out := &in.Requests, &out.Requests
-		*out = make(corev1.ResourceList, len(*in))
+		*out = make(v1.ResourceList, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val.DeepCopy()
 		}
 	}
 	if in.Limits != nil {
 		in, out := &in.Limits, &out.Limits
-		*out = make(corev1.ResourceList, len(*in))
+		*out = make(v1.ResourceList, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val.DeepCopy()
 		}
@@ -717,13 +1182,68 @@ func (in *ResourceRequirements) DeepCopy() *ResourceRequirements {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestoreSource) DeepCopyInto(out *RestoreSource) {
+	*out = *in
+	if in.BackupRef != nil {
+		in, out := &in.BackupRef, &out.BackupRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestoreSource.
+func (in *RestoreSource) DeepCopy() *RestoreSource {
+	if in == nil {
+		return nil
+	}
+	out := new(RestoreSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3BackupDestination) DeepCopyInto(out *S3BackupDestination) {
+	*out = *in
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3BackupDestination.
+func (in *S3BackupDestination) DeepCopy() *S3BackupDestination {
+	if in == nil {
+		return nil
+	}
+	out := new(S3BackupDestination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteAppStatus) DeepCopyInto(out *SiteAppStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteAppStatus.
+func (in *SiteAppStatus) DeepCopy() *SiteAppStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteAppStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteBackup) DeepCopyInto(out *SiteBackup) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteBackup.
@@ -779,6 +1299,21 @@ func (in *SiteBackupList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteBackupSpec) DeepCopyInto(out *SiteBackupSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Destination != nil {
+		in, out := &in.Destination, &out.Destination
+		*out = new(BackupDestination)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Retention != nil {
+		in, out := &in.Retention, &out.Retention
+		*out = new(BackupRetention)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteBackupSpec.
@@ -794,6 +1329,27 @@ func (in *SiteBackupSpec) DeepCopy() *SiteBackupSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteBackupStatus) DeepCopyInto(out *SiteBackupStatus) {
 	*out = *in
+	if in.Artifacts != nil {
+		in, out := &in.Artifacts, &out.Artifacts
+		*out = make([]BackupArtifact, len(*in))
+		copy(*out, *in)
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextScheduleTime != nil {
+		in, out := &in.NextScheduleTime, &out.NextScheduleTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteBackupStatus.
@@ -806,13 +1362,41 @@ func (in *SiteBackupStatus) DeepCopy() *SiteBackupStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteBackupSummary) DeepCopyInto(out *SiteBackupSummary) {
+	*out = *in
+	if in.LastSuccessfulBackupTime != nil {
+		in, out := &in.LastSuccessfulBackupTime, &out.LastSuccessfulBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextScheduledBackupTime != nil {
+		in, out := &in.NextScheduledBackupTime, &out.NextScheduledBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Schedules != nil {
+		in, out := &in.Schedules, &out.Schedules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteBackupSummary.
+func (in *SiteBackupSummary) DeepCopy() *SiteBackupSummary {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteBackupSummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteDashboard) DeepCopyInto(out *SiteDashboard) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboard.
@@ -838,8 +1422,8 @@ func (in *SiteDashboardChart) DeepCopyInto(out *SiteDashboardChart) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboardChart.
@@ -895,6 +1479,26 @@ func (in *SiteDashboardChartList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteDashboardChartSpec) DeepCopyInto(out *SiteDashboardChartSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Timeseries != nil {
+		in, out := &in.Timeseries, &out.Timeseries
+		*out = new(ChartTimeseries)
+		**out = **in
+	}
+	if in.Filters != nil {
+		in, out := &in.Filters, &out.Filters
+		*out = make([]ChartFilter, len(*in))
+		copy(*out, *in)
+	}
+	if in.Public != nil {
+		in, out := &in.Public, &out.Public
+		*out = new(bool)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboardChartSpec.
@@ -910,6 +1514,15 @@ func (in *SiteDashboardChartSpec) DeepCopy() *SiteDashboardChartSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteDashboardChartStatus) DeepCopyInto(out *SiteDashboardChartStatus) {
 	*out = *in
+	if in.UnresolvedDependencies != nil {
+		in, out := &in.UnresolvedDependencies, &out.UnresolvedDependencies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboardChartStatus.
@@ -957,6 +1570,16 @@ func (in *SiteDashboardList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteDashboardSpec) DeepCopyInto(out *SiteDashboardSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Charts != nil {
+		in, out := &in.Charts, &out.Charts
+		*out = make([]DashboardChartRef, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboardSpec.
@@ -972,6 +1595,15 @@ func (in *SiteDashboardSpec) DeepCopy() *SiteDashboardSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteDashboardStatus) DeepCopyInto(out *SiteDashboardStatus) {
 	*out = *in
+	if in.UnresolvedDependencies != nil {
+		in, out := &in.UnresolvedDependencies, &out.UnresolvedDependencies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteDashboardStatus.
@@ -984,13 +1616,32 @@ func (in *SiteDashboardStatus) DeepCopy() *SiteDashboardStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteFilesStorageStatus) DeepCopyInto(out *SiteFilesStorageStatus) {
+	*out = *in
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteFilesStorageStatus.
+func (in *SiteFilesStorageStatus) DeepCopy() *SiteFilesStorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteFilesStorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteJob) DeepCopyInto(out *SiteJob) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteJob.
@@ -1043,9 +1694,98 @@ func (in *SiteJobList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteJobMethod) DeepCopyInto(out *SiteJobMethod) {
+	*out = *in
+	if in.Kwargs != nil {
+		in, out := &in.Kwargs, &out.Kwargs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteJobMethod.
+func (in *SiteJobMethod) DeepCopy() *SiteJobMethod {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteJobMethod)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteJobRun) DeepCopyInto(out *SiteJobRun) {
+	*out = *in
+	if in.ScheduledTime != nil {
+		in, out := &in.ScheduledTime, &out.ScheduledTime
+		*out = (*in).DeepCopy()
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ExitCode != nil {
+		in, out := &in.ExitCode, &out.ExitCode
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteJobRun.
+func (in *SiteJobRun) DeepCopy() *SiteJobRun {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteJobRun)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteJobSpec) DeepCopyInto(out *SiteJobSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Method != nil {
+		in, out := &in.Method, &out.Method
+		*out = new(SiteJobMethod)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ActiveDeadlineSeconds != nil {
+		in, out := &in.ActiveDeadlineSeconds, &out.ActiveDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.StartingDeadlineSeconds != nil {
+		in, out := &in.StartingDeadlineSeconds, &out.StartingDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.SuccessfulJobsHistoryLimit != nil {
+		in, out := &in.SuccessfulJobsHistoryLimit, &out.SuccessfulJobsHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.FailedJobsHistoryLimit != nil {
+		in, out := &in.FailedJobsHistoryLimit, &out.FailedJobsHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteJobSpec.
@@ -1061,6 +1801,38 @@ func (in *SiteJobSpec) DeepCopy() *SiteJobSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteJobStatus) DeepCopyInto(out *SiteJobStatus) {
 	*out = *in
+	if in.ExitCode != nil {
+		in, out := &in.ExitCode, &out.ExitCode
+		*out = new(int32)
+		**out = **in
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextScheduleTime != nil {
+		in, out := &in.NextScheduleTime, &out.NextScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessfulTime != nil {
+		in, out := &in.LastSuccessfulTime, &out.LastSuccessfulTime
+		*out = (*in).DeepCopy()
+	}
+	if in.History != nil {
+		in, out := &in.History, &out.History
+		*out = make([]SiteJobRun, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteJobStatus.
@@ -1073,13 +1845,116 @@ func (in *SiteJobStatus) DeepCopy() *SiteJobStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteRestore) DeepCopyInto(out *SiteRestore) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteRestore.
+func (in *SiteRestore) DeepCopy() *SiteRestore {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteRestore)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SiteRestore) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteRestoreList) DeepCopyInto(out *SiteRestoreList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SiteRestore, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteRestoreList.
+func (in *SiteRestoreList) DeepCopy() *SiteRestoreList {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteRestoreList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SiteRestoreList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteRestoreSpec) DeepCopyInto(out *SiteRestoreSpec) {
+	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	in.Source.DeepCopyInto(&out.Source)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteRestoreSpec.
+func (in *SiteRestoreSpec) DeepCopy() *SiteRestoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteRestoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteRestoreStatus) DeepCopyInto(out *SiteRestoreStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteRestoreStatus.
+func (in *SiteRestoreStatus) DeepCopy() *SiteRestoreStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteRestoreStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteUser) DeepCopyInto(out *SiteUser) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteUser.
@@ -1100,6 +1975,44 @@ func (in *SiteUser) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteUserAPIKey) DeepCopyInto(out *SiteUserAPIKey) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteUserAPIKey.
+func (in *SiteUserAPIKey) DeepCopy() *SiteUserAPIKey {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteUserAPIKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteUserAPIKeyStatus) DeepCopyInto(out *SiteUserAPIKeyStatus) {
+	*out = *in
+	if in.LastRotationTime != nil {
+		in, out := &in.LastRotationTime, &out.LastRotationTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextRotationTime != nil {
+		in, out := &in.NextRotationTime, &out.NextRotationTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteUserAPIKeyStatus.
+func (in *SiteUserAPIKeyStatus) DeepCopy() *SiteUserAPIKeyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteUserAPIKeyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteUserList) DeepCopyInto(out *SiteUserList) {
 	*out = *in
@@ -1135,6 +2048,31 @@ func (in *SiteUserList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteUserSpec) DeepCopyInto(out *SiteUserSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Roles != nil {
+		in, out := &in.Roles, &out.Roles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PasswordSecretRef != nil {
+		in, out := &in.PasswordSecretRef, &out.PasswordSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.APIKey != nil {
+		in, out := &in.APIKey, &out.APIKey
+		*out = new(SiteUserAPIKey)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteUserSpec.
@@ -1150,6 +2088,15 @@ func (in *SiteUserSpec) DeepCopy() *SiteUserSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteUserStatus) DeepCopyInto(out *SiteUserStatus) {
 	*out = *in
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.APIKey != nil {
+		in, out := &in.APIKey, &out.APIKey
+		*out = new(SiteUserAPIKeyStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteUserStatus.
@@ -1167,8 +2114,8 @@ func (in *SiteWorkspace) DeepCopyInto(out *SiteWorkspace) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteWorkspace.
@@ -1224,6 +2171,43 @@ func (in *SiteWorkspaceList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteWorkspaceSpec) DeepCopyInto(out *SiteWorkspaceSpec) {
 	*out = *in
+	if in.SiteRef != nil {
+		in, out := &in.SiteRef, &out.SiteRef
+		*out = new(NamespacedName)
+		**out = **in
+	}
+	if in.Public != nil {
+		in, out := &in.Public, &out.Public
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Roles != nil {
+		in, out := &in.Roles, &out.Roles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NumberCards != nil {
+		in, out := &in.NumberCards, &out.NumberCards
+		*out = make([]WorkspaceWidgetRef, len(*in))
+		copy(*out, *in)
+	}
+	if in.Charts != nil {
+		in, out := &in.Charts, &out.Charts
+		*out = make([]WorkspaceWidgetRef, len(*in))
+		copy(*out, *in)
+	}
+	if in.Shortcuts != nil {
+		in, out := &in.Shortcuts, &out.Shortcuts
+		*out = make([]WorkspaceShortcut, len(*in))
+		copy(*out, *in)
+	}
+	if in.Cards != nil {
+		in, out := &in.Cards, &out.Cards
+		*out = make([]WorkspaceCard, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteWorkspaceSpec.
@@ -1239,6 +2223,19 @@ func (in *SiteWorkspaceSpec) DeepCopy() *SiteWorkspaceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SiteWorkspaceStatus) DeepCopyInto(out *SiteWorkspaceStatus) {
 	*out = *in
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastDriftTime != nil {
+		in, out := &in.LastDriftTime, &out.LastDriftTime
+		*out = (*in).DeepCopy()
+	}
+	if in.DriftedFields != nil {
+		in, out := &in.DriftedFields, &out.DriftedFields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteWorkspaceStatus.
@@ -1251,6 +2248,44 @@ func (in *SiteWorkspaceStatus) DeepCopy() *SiteWorkspaceStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageMigration) DeepCopyInto(out *StorageMigration) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageMigration.
+func (in *StorageMigration) DeepCopy() *StorageMigration {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageMigration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageMigrationStatus) DeepCopyInto(out *StorageMigrationStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageMigrationStatus.
+func (in *StorageMigrationStatus) DeepCopy() *StorageMigrationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageMigrationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TLSConfig) DeepCopyInto(out *TLSConfig) {
 	*out = *in
@@ -1360,3 +2395,136 @@ func (in *WorkerScalingStatus) DeepCopy() *WorkerScalingStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkpaceBenchTemplate) DeepCopyInto(out *WorkpaceBenchTemplate) {
+	*out = *in
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkpaceBenchTemplate.
+func (in *WorkpaceBenchTemplate) DeepCopy() *WorkpaceBenchTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkpaceBenchTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkpaceQuota) DeepCopyInto(out *WorkpaceQuota) {
+	*out = *in
+	if in.MaxSites != nil {
+		in, out := &in.MaxSites, &out.MaxSites
+		*out = new(int32)
+		**out = **in
+	}
+	if in.CPU != nil {
+		in, out := &in.CPU, &out.CPU
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Memory != nil {
+		in, out := &in.Memory, &out.Memory
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkpaceQuota.
+func (in *WorkpaceQuota) DeepCopy() *WorkpaceQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkpaceQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkpaceResourceCount) DeepCopyInto(out *WorkpaceResourceCount) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkpaceResourceCount.
+func (in *WorkpaceResourceCount) DeepCopy() *WorkpaceResourceCount {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkpaceResourceCount)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceCard) DeepCopyInto(out *WorkspaceCard) {
+	*out = *in
+	if in.Links != nil {
+		in, out := &in.Links, &out.Links
+		*out = make([]WorkspaceLink, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceCard.
+func (in *WorkspaceCard) DeepCopy() *WorkspaceCard {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceCard)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceLink) DeepCopyInto(out *WorkspaceLink) {
+	*out = *in
+	if in.Dependencies != nil {
+		in, out := &in.Dependencies, &out.Dependencies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceLink.
+func (in *WorkspaceLink) DeepCopy() *WorkspaceLink {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceLink)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceShortcut) DeepCopyInto(out *WorkspaceShortcut) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceShortcut.
+func (in *WorkspaceShortcut) DeepCopy() *WorkspaceShortcut {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceShortcut)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkspaceWidgetRef) DeepCopyInto(out *WorkspaceWidgetRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkspaceWidgetRef.
+func (in *WorkspaceWidgetRef) DeepCopy() *WorkspaceWidgetRef {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkspaceWidgetRef)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// secretEnvVar returns an env var read from a Secret key.
+// Passwords, tokens and keys must reach operator Jobs this way and never as a literal
+// Value, otherwise anyone who can read Jobs or Pods can read them.
+func secretEnvVar(name, secretName, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// adminPasswordSecretName returns the name of the generated admin password Secret
+func adminPasswordSecretName(site *vyogotechv1alpha1.FrappeSite) string {
+	return fmt.Sprintf("%s-admin", site.Name)
+}
+
+// ensureAdminPasswordSecret returns the name of a Secret in the site namespace whose
+// "password" key holds the site's Administrator password.
+// A referenced Secret in the site namespace is used as is; one in the operator namespace is
+// copied into <site>-admin because SecretKeyRef cannot cross namespaces. Secrets of other
+// namespaces are refused. Without a reference a random password is generated into <site>-admin.
+func ensureAdminPasswordSecret(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite, generate func() string) (string, error) {
+	logger := log.FromContext(ctx)
+
+	var source *corev1.Secret
+	if ref := site.Spec.AdminPasswordSecretRef; ref != nil {
+		ns := ref.Namespace
+		if ns == "" {
+			ns = site.Namespace
+		}
+		// Sites must not copy passwords out of namespaces of other tenants
+		if ns != site.Namespace && ns != operatorNamespace {
+			return "", fmt.Errorf("adminPasswordSecretRef must be in namespace %s of the site or in %s", site.Namespace, operatorNamespace)
+		}
+		source = &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ns}, source); err != nil {
+			return "", fmt.Errorf("failed to get admin password secret: %w", err)
+		}
+		if _, ok := source.Data["password"]; !ok {
+			return "", fmt.Errorf("admin password secret %s/%s has no password key", ns, ref.Name)
+		}
+		if ns == site.Namespace {
+			return ref.Name, nil
+		}
+	}
+
+	secretName := adminPasswordSecretName(site)
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: secretName, Namespace: site.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to check for generated secret: %w", err)
+	}
+
+	if errors.IsNotFound(err) {
+		password := []byte(generate())
+		if source != nil {
+			password = source.Data["password"]
+		}
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: site.Namespace,
+				Labels: map[string]string{
+					"app":  "frappe",
+					"site": site.Name,
+				},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				"password": password,
+			},
+		}
+		if err := controllerutil.SetControllerReference(site, secret, c.Scheme()); err != nil {
+			return "", err
+		}
+		if err := c.Create(ctx, secret); err != nil {
+			return "", fmt.Errorf("failed to create admin password secret: %w", err)
+		}
+		logger.Info("Created admin password secret", "secret", secretName)
+		return secretName, nil
+	}
+
+	// Keep the copy of a cross-namespace reference in sync
+	if source != nil && string(secret.Data["password"]) != string(source.Data["password"]) {
+		patch := client.MergeFrom(secret.DeepCopy())
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data["password"] = source.Data["password"]
+		if err := c.Patch(ctx, secret, patch); err != nil {
+			return "", fmt.Errorf("failed to update admin password secret: %w", err)
+		}
+	}
+
+	return secretName, nil
+}
+
+// getAdminPassword reads the site's Administrator password from the Secret that
+// ensureAdminPasswordSecret handed to the init Job
+func getAdminPassword(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite) (string, error) {
+	secretName := adminPasswordSecretName(site)
+	if ref := site.Spec.AdminPasswordSecretRef; ref != nil && (ref.Namespace == "" || ref.Namespace == site.Namespace) {
+		secretName = ref.Name
+	}
+
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: secretName, Namespace: site.Namespace}, secret); err != nil {
+		return "", fmt.Errorf("failed to get admin password secret: %w", err)
+	}
+	password := string(secret.Data["password"])
+	if password == "" {
+		return "", fmt.Errorf("admin password secret %s/%s has no password key", site.Namespace, secretName)
+	}
+	return password, nil
+}
+
+// fpmAuthSecretName returns the name of the bench's copy of an FPM repository credentials Secret
+func fpmAuthSecretName(bench *vyogotechv1alpha1.FrappeBench, repo vyogotechv1alpha1.FPMRepository) string {
+	return fmt.Sprintf("%s-fpm-%s", bench.Name, strings.ToLower(repo.Name))
+}
+
+// ensureFPMAuthSecrets returns, for every repository with an authSecretRef, the name of a
+// Secret in the bench namespace holding its credentials, keyed by the repository's index.
+// The Secret must have a token key, or username and password keys.
+// The first operatorRepos repositories come from the operator config: their Secrets are
+// read from the operator namespace by default and copied into <bench>-fpm-<repo>, because
+// Secret volumes cannot cross namespaces. Repositories of the bench spec may only use
+// Secrets in the bench namespace.
+func ensureFPMAuthSecrets(ctx context.Context, c client.Client, bench *vyogotechv1alpha1.FrappeBench, repos []vyogotechv1alpha1.FPMRepository, operatorRepos int) (map[int]string, error) {
+	secrets := map[int]string{}
+	for i, repo := range repos {
+		ref := repo.AuthSecretRef
+		if ref == nil {
+			continue
+		}
+		ns := ref.Namespace
+		if i < operatorRepos {
+			if ns == "" {
+				ns = operatorNamespace
+			}
+			if ns != operatorNamespace && ns != bench.Namespace {
+				return nil, fmt.Errorf("authSecretRef of FPM repository %s in the operator config must be in namespace %s or in the namespace of the bench", repo.Name, operatorNamespace)
+			}
+		} else {
+			if ns == "" {
+				ns = bench.Namespace
+			}
+			if ns != bench.Namespace {
+				return nil, fmt.Errorf("authSecretRef of FPM repository %s must be in namespace %s of the bench", repo.Name, bench.Namespace)
+			}
+		}
+
+		source := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ns}, source); err != nil {
+			if errors.IsNotFound(err) {
+				return nil, fmt.Errorf("credentials secret %s/%s of FPM repository %s not found", ns, ref.Name, repo.Name)
+			}
+			return nil, fmt.Errorf("failed to get credentials secret of FPM repository %s: %w", repo.Name, err)
+		}
+		if len(source.Data["token"]) == 0 && (len(source.Data["username"]) == 0 || len(source.Data["password"]) == 0) {
+			return nil, fmt.Errorf("credentials secret %s/%s of FPM repository %s needs a token key, or username and password keys", ns, ref.Name, repo.Name)
+		}
+		if ns == bench.Namespace {
+			secrets[i] = ref.Name
+			continue
+		}
+
+		name, err := copyFPMAuthSecret(ctx, c, bench, repo, source)
+		if err != nil {
+			return nil, err
+		}
+		secrets[i] = name
+	}
+	return secrets, nil
+}
+
+// copyFPMAuthSecret keeps the bench's copy of an operator credentials Secret in sync
+func copyFPMAuthSecret(ctx context.Context, c client.Client, bench *vyogotechv1alpha1.FrappeBench, repo vyogotechv1alpha1.FPMRepository, source *corev1.Secret) (string, error) {
+	name := fpmAuthSecretName(bench, repo)
+	data := map[string][]byte{}
+	for _, key := range []string{"token", "username", "password"} {
+		if value, ok := source.Data[key]; ok {
+			data[key] = value
+		}
+	}
+
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: bench.Namespace}, secret)
+	if errors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: bench.Namespace,
+				Labels: map[string]string{
+					"app":   "frappe",
+					"bench": bench.Name,
+				},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		if err := controllerutil.SetControllerReference(bench, secret, c.Scheme()); err != nil {
+			return "", err
+		}
+		if err := c.Create(ctx, secret); err != nil {
+			return "", fmt.Errorf("failed to create FPM credentials secret: %w", err)
+		}
+		log.FromContext(ctx).Info("Copied FPM credentials secret", "secret", name, "repository", repo.Name)
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !reflect.DeepEqual(secret.Data, data) {
+		patch := client.MergeFrom(secret.DeepCopy())
+		secret.Data = data
+		if err := c.Patch(ctx, secret, patch); err != nil {
+			return "", fmt.Errorf("failed to update FPM credentials secret: %w", err)
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/database"
+)
+
+// credentialEnvName matches env vars that carry credentials and must use SecretKeyRef
+var credentialEnvName = regexp.MustCompile(`(?i)(PASSWORD|SECRET|TOKEN|API_KEY|ACCESS_KEY)`)
+
+// expectNoLiteralCredentials fails when a container in the pod spec carries a credential
+// as a literal: a credential-named env var with a Value, or any of the given secret
+// values in an env value, command or argument.
+func expectNoLiteralCredentials(spec corev1.PodSpec, secretValues ...string) {
+	containers := append([]corev1.Container{}, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+
+	for _, c := range containers {
+		literals := append([]string{}, c.Command...)
+		literals = append(literals, c.Args...)
+
+		for _, env := range c.Env {
+			if env.Value == "" {
+				continue
+			}
+			Expect(credentialEnvName.MatchString(env.Name)).To(BeFalse(),
+				"container %s passes %s as a literal value", c.Name, env.Name)
+			literals = append(literals, env.Value)
+		}
+
+		for _, literal := range literals {
+			for _, secret := range secretValues {
+				Expect(strings.Contains(literal, secret)).To(BeFalse(),
+					"container %s contains a secret value in its spec", c.Name)
+			}
+		}
+	}
+}
+
+var _ = Describe("Operator Job credentials", func() {
+	const (
+		dbPassword  = "db-password-must-not-leak"
+		s3SecretKey = "s3-secret-must-not-leak"
+	)
+
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		site  *vyogotechv1alpha1.FrappeSite
+	)
+
+	createSecret := func(name string, data map[string]string) {
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			StringData: data,
+		})).To(Succeed())
+	}
+
+	// expectJobsReferenceSecrets checks every Job in the namespace
+	expectJobsReferenceSecrets := func(secretValues ...string) {
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).NotTo(BeEmpty())
+		for _, job := range jobs.Items {
+			By("checking job " + job.Name)
+			expectNoLiteralCredentials(job.Spec.Template.Spec, secretValues...)
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "credentials-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		// The external provider only needs the per-site Secret to hand out credentials
+		createSecret("site-db-password", map[string]string{"username": "site_user", "password": dbPassword})
+		createSecret("s3-credentials", map[string]string{"accessKeyId": "minio", "secretAccessKey": s3SecretKey})
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+				DBConfig: vyogotechv1alpha1.DatabaseConfig{
+					Provider:            "external",
+					ConnectionSecretRef: &corev1.SecretReference{Name: "db-admin"},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+	})
+
+	It("references Secrets for database and admin passwords in the site init Job", func() {
+		r := &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+
+		provider, err := database.NewProvider(site.Spec.DBConfig.Provider, k8sClient, scheme.Scheme)
+		Expect(err).NotTo(HaveOccurred())
+		dbCreds, err := provider.GetCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		dbInfo := &database.DatabaseInfo{Host: "db.example.com", Port: "3306", Name: "_site", Provider: "mariadb"}
+
+		_, err = r.ensureSiteInitialized(ctx, site, bench, site.Spec.SiteName, dbInfo, dbCreds)
+		Expect(err).NotTo(HaveOccurred())
+
+		admin := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: adminPasswordSecretName(site), Namespace: ns}, admin)).To(Succeed())
+		adminPassword := string(admin.Data["password"])
+		Expect(adminPassword).NotTo(BeEmpty())
+
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "site-init", Namespace: ns}, job)).To(Succeed())
+		refs := map[string]string{}
+		for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				refs[env.Name] = env.ValueFrom.SecretKeyRef.Name
+			}
+		}
+		Expect(refs).To(HaveKeyWithValue("DB_PASSWORD", "site-db-password"))
+		Expect(refs).To(HaveKeyWithValue("ADMIN_PASSWORD", adminPasswordSecretName(site)))
+
+		expectJobsReferenceSecrets(dbPassword, adminPassword)
+	})
+
+	It("references Secrets in backup and restore Jobs", func() {
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		backup := &vyogotechv1alpha1.SiteBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteBackupSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+				Destination: &vyogotechv1alpha1.BackupDestination{
+					Type: "s3",
+					S3: &vyogotechv1alpha1.S3BackupDestination{
+						Endpoint:             "http://minio:9000",
+						Bucket:               "backups",
+						CredentialsSecretRef: &corev1.LocalObjectReference{Name: "s3-credentials"},
+					},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, backup)).To(Succeed())
+		backupReconciler := &SiteBackupReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := backupReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(backup)})
+		Expect(err).NotTo(HaveOccurred())
+
+		restore := &vyogotechv1alpha1.SiteRestore{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteRestoreSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+				Source: vyogotechv1alpha1.RestoreSource{
+					Database: "https://backups.example.com/site-database.sql.gz",
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, restore)).To(Succeed())
+		restoreReconciler := &SiteRestoreReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err = restoreReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(restore)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "backup-backup", Namespace: ns}, &batchv1.Job{})).To(Succeed())
+		restoreJob := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "restore-restore", Namespace: ns}, restoreJob)).To(Succeed())
+		// The dump is imported as the site user, the Job gets no database credentials
+		for _, env := range restoreJob.Spec.Template.Spec.Containers[0].Env {
+			Expect(env.Name).NotTo(HavePrefix("DB_USER"))
+			Expect(env.Name).NotTo(HavePrefix("DB_PASSWORD"))
+		}
+
+		expectJobsReferenceSecrets(dbPassword, s3SecretKey)
+	})
+
+	It("references Secrets in the teardown Job", func() {
+		const adminPassword = "admin-password-must-not-leak"
+		createSecret("db-admin", map[string]string{"host": "db.example.com", "username": "admin", "password": adminPassword})
+
+		r := &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		provider, err := database.NewProvider(site.Spec.DBConfig.Provider, k8sClient, scheme.Scheme)
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = r.ensureSiteTeardown(ctx, site, vyogotechv1alpha1.SiteDeletionPolicyDelete, provider)
+		Expect(err).NotTo(HaveOccurred())
+
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "site-drop", Namespace: ns}, job)).To(Succeed())
+		refs := map[string]string{}
+		for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				refs[env.Name] = env.ValueFrom.SecretKeyRef.Name
+			}
+		}
+		Expect(refs).To(HaveKeyWithValue("DB_ROOT_PASSWORD", "db-admin"))
+
+		expectJobsReferenceSecrets(adminPassword)
+	})
+
+	It("references Secrets in site app and SiteJob Jobs", func() {
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		r := &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := r.runSiteAppJob(ctx, site, bench, "erpnext", "install")
+		Expect(err).NotTo(HaveOccurred())
+
+		siteJob := &vyogotechv1alpha1.SiteJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteJobSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+				Command: []string{"clear-cache"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, siteJob)).To(Succeed())
+		siteJobReconciler := &SiteJobReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err = siteJobReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(siteJob)})
+		Expect(err).NotTo(HaveOccurred())
+
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(HaveLen(2))
+
+		expectJobsReferenceSecrets(dbPassword)
+	})
+
+	It("references Secrets in the files storage Job", func() {
+		site.Spec.FilesStorage = &vyogotechv1alpha1.FilesStorage{
+			Endpoint:             "http://minio:9000",
+			Bucket:               "files",
+			CredentialsSecretRef: &corev1.LocalObjectReference{Name: "s3-credentials"},
+		}
+		Expect(k8sClient.Update(ctx, site)).To(Succeed())
+		bench.Status.InstalledApps = []string{filesStorageApp}
+
+		r := &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+
+		expectJobsReferenceSecrets(s3SecretKey)
+	})
+
+	It("mounts FPM credentials as files in bench init and upgrade Jobs", func() {
+		const fpmToken = "fpm-token-must-not-leak"
+		createSecret("fpm-auth", map[string]string{"token": fpmToken})
+		install := benchInstallConfig{
+			FPMRepos: []vyogotechv1alpha1.FPMRepository{
+				{Name: "private", URL: "https://fpm.example.com", AuthSecretRef: &corev1.SecretReference{Name: "fpm-auth"}},
+			},
+			FPMAuthSecrets: map[int]string{0: "fpm-auth"},
+		}
+
+		r := &FrappeBenchReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		Expect(r.ensureBenchInitialized(ctx, bench, install)).To(Succeed())
+
+		bench.Status.Upgrade = &vyogotechv1alpha1.BenchUpgradeStatus{Phase: vyogotechv1alpha1.BenchUpgradePhaseBuilding}
+		_, _, err := r.runUpgradeJob(ctx, bench, upgradeStepBuild, r.getBenchImage(bench), buildAssetsScript, &install)
+		Expect(err).NotTo(HaveOccurred())
+
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(HaveLen(2))
+		for _, job := range jobs.Items {
+			var secrets []string
+			for _, volume := range job.Spec.Template.Spec.Volumes {
+				if volume.Secret != nil {
+					secrets = append(secrets, volume.Secret.SecretName)
+				}
+			}
+			Expect(secrets).To(ConsistOf("fpm-auth"), "job %s", job.Name)
+		}
+
+		expectJobsReferenceSecrets(fpmToken)
+	})
+})
+
+var _ = Describe("FPM repository credentials", func() {
+	var (
+		ctx        context.Context
+		ns         string
+		bench      *vyogotechv1alpha1.FrappeBench
+		secretName string
+	)
+
+	createSecret := func(namespace, name string) {
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string][]byte{"token": []byte("fpm-token")},
+		})).To(Succeed())
+	}
+
+	repo := func(namespace string) vyogotechv1alpha1.FPMRepository {
+		return vyogotechv1alpha1.FPMRepository{
+			Name:          "private",
+			URL:           "https://fpm.example.com",
+			AuthSecretRef: &corev1.SecretReference{Name: secretName, Namespace: namespace},
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "fpm-auth-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+		err := k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: operatorNamespace}})
+		Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		// Unique in the shared operator namespace
+		secretName = ns + "-fpm"
+		createSecret(operatorNamespace, secretName)
+		createSecret(ns, secretName)
+	})
+
+	It("uses the Secret in the bench namespace for bench repositories", func() {
+		secrets, err := ensureFPMAuthSecrets(ctx, k8sClient, bench, []vyogotechv1alpha1.FPMRepository{repo("")}, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secrets).To(Equal(map[int]string{0: secretName}))
+	})
+
+	It("rejects a Secret in another namespace for bench repositories", func() {
+		_, err := ensureFPMAuthSecrets(ctx, k8sClient, bench, []vyogotechv1alpha1.FPMRepository{repo(operatorNamespace)}, 0)
+		Expect(err).To(MatchError(ContainSubstring("must be in namespace " + ns + " of the bench")))
+
+		err = k8sClient.Get(ctx, client.ObjectKey{Name: "bench-fpm-private", Namespace: ns}, &corev1.Secret{})
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("copies the Secret of an operator repository from the operator namespace", func() {
+		repos := []vyogotechv1alpha1.FPMRepository{repo(""), repo("")}
+		repos[1].Name = "bench-repo"
+		secrets, err := ensureFPMAuthSecrets(ctx, k8sClient, bench, repos, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secrets).To(Equal(map[int]string{0: "bench-fpm-private", 1: secretName}))
+
+		copied := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-fpm-private", Namespace: ns}, copied)).To(Succeed())
+		Expect(string(copied.Data["token"])).To(Equal("fpm-token"))
+	})
+
+	It("rejects a Secret outside the operator and bench namespaces for operator repositories", func() {
+		_, err := ensureFPMAuthSecrets(ctx, k8sClient, bench, []vyogotechv1alpha1.FPMRepository{repo("default")}, 1)
+		Expect(err).To(MatchError(ContainSubstring("must be in namespace " + operatorNamespace)))
+	})
+})
+
+var _ = Describe("Admin password Secret", func() {
+	var (
+		ctx  context.Context
+		ns   string
+		site *vyogotechv1alpha1.FrappeSite
+	)
+
+	createSecret := func(namespace, name string) {
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string][]byte{"password": []byte("admin-password")},
+		})).To(Succeed())
+	}
+
+	generate := func() string { return "generated" }
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "admin-password-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+		err := k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: operatorNamespace}})
+		Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: "bench"},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+	})
+
+	It("uses a Secret in the site namespace as is", func() {
+		createSecret(ns, "site-password")
+		site.Spec.AdminPasswordSecretRef = &corev1.SecretReference{Name: "site-password"}
+
+		name, err := ensureAdminPasswordSecret(ctx, k8sClient, site, generate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("site-password"))
+	})
+
+	It("copies a Secret from the operator namespace", func() {
+		// Unique in the shared operator namespace
+		createSecret(operatorNamespace, ns+"-admin")
+		site.Spec.AdminPasswordSecretRef = &corev1.SecretReference{Name: ns + "-admin", Namespace: operatorNamespace}
+
+		name, err := ensureAdminPasswordSecret(ctx, k8sClient, site, generate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("site-admin"))
+
+		copied := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "site-admin", Namespace: ns}, copied)).To(Succeed())
+		Expect(string(copied.Data["password"])).To(Equal("admin-password"))
+	})
+
+	It("refuses a Secret in the namespace of another tenant", func() {
+		other := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "admin-password-"}}
+		Expect(k8sClient.Create(ctx, other)).To(Succeed())
+		createSecret(other.Name, "admin")
+		site.Spec.AdminPasswordSecretRef = &corev1.SecretReference{Name: "admin", Namespace: other.Name}
+
+		_, err := ensureAdminPasswordSecret(ctx, k8sClient, site, generate)
+		Expect(err).To(MatchError(ContainSubstring("must be in namespace " + ns + " of the site or in " + operatorNamespace)))
+
+		err = k8sClient.Get(ctx, client.ObjectKey{Name: "site-admin", Namespace: ns}, &corev1.Secret{})
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,397 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ExternalProvider implements database provisioning against an unmanaged MariaDB/MySQL
+// server, e.g. a cloud managed instance outside the cluster. The operator connects with
+// admin credentials from dbConfig.connectionSecretRef and creates the per-site database
+// and user over SQL.
+type ExternalProvider struct {
+	client client.Client
+	scheme *runtime.Scheme
+	// naming keeps database and user names identical to the mariadb provider
+	naming *MariaDBProviderUnstructured
+}
+
+const (
+	// externalSecretNamespace is the operator namespace, where cluster admins may keep a
+	// connection Secret shared by sites in other namespaces
+	externalSecretNamespace = "frappe-operator-system"
+
+	// externalProvisionedAnnotation on the per-site Secret fingerprints the server, database
+	// and credentials the site was last provisioned with, so the SQL only runs again when
+	// one of them changes
+	externalProvisionedAnnotation = "vyogo.tech/provisioned"
+)
+
+// externalAdmin holds the admin connection read from the connection secret
+type externalAdmin struct {
+	host     string
+	port     string
+	username string
+	password string
+}
+
+// NewExternalProvider creates a new provider for an external database server
+func NewExternalProvider(client client.Client, scheme *runtime.Scheme) Provider {
+	return &ExternalProvider{
+		client: client,
+		scheme: scheme,
+		naming: &MariaDBProviderUnstructured{client: client, scheme: scheme},
+	}
+}
+
+// EnsureDatabase creates the site database, user and grant on the external server
+// It connects only when the site is new or its server, database or credentials changed.
+func (p *ExternalProvider) EnsureDatabase(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*DatabaseInfo, error) {
+	logger := log.FromContext(ctx)
+
+	admin, err := p.getAdmin(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+
+	dbName := p.naming.generateDBName(site)
+	creds, err := p.ensurePasswordSecret(ctx, site)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure password secret: %w", err)
+	}
+
+	info := &DatabaseInfo{
+		Host:     admin.host,
+		Port:     admin.port,
+		Name:     dbName,
+		Provider: "mariadb",
+	}
+
+	secret := &corev1.Secret{}
+	if err := p.client.Get(ctx, types.NamespacedName{Name: creds.SecretName, Namespace: site.Namespace}, secret); err != nil {
+		return nil, err
+	}
+	provisioned := externalProvisionedHash(admin, dbName, creds)
+	if secret.Annotations[externalProvisionedAnnotation] == provisioned {
+		return info, nil
+	}
+
+	logger.Info("Provisioning database on external server",
+		"host", admin.host,
+		"port", admin.port,
+		"dbName", dbName,
+		"dbUser", creds.Username)
+
+	db, err := p.open(admin.host, admin.port, admin.username, admin.password, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// Identifiers come from sanitized names; the password is passed as a parameter
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", quoteIdentifier(dbName)), nil},
+		{"CREATE USER IF NOT EXISTS ?@'%' IDENTIFIED BY ?", []interface{}{creds.Username, creds.Password}},
+		{"ALTER USER ?@'%' IDENTIFIED BY ?", []interface{}{creds.Username, creds.Password}},
+		{fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO ?@'%%'", quoteIdentifier(dbName)), []interface{}{creds.Username}},
+	}
+	for _, stmt := range statements {
+		if _, err := db.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return nil, fmt.Errorf("failed to provision database on %s: %w", admin.host, err)
+		}
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[externalProvisionedAnnotation] = provisioned
+	if err := p.client.Patch(ctx, secret, patch); err != nil {
+		return nil, fmt.Errorf("failed to record provisioning on secret %s: %w", secret.Name, err)
+	}
+
+	return info, nil
+}
+
+// IsReady connects to the site database with the site credentials
+func (p *ExternalProvider) IsReady(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	admin, err := p.getAdmin(ctx, site)
+	if err != nil {
+		return false, err
+	}
+
+	creds, err := p.GetCredentials(ctx, site)
+	if err != nil {
+		// Secret not created yet, EnsureDatabase will create it
+		return false, nil
+	}
+
+	db, err := p.open(admin.host, admin.port, creds.Username, creds.Password, p.naming.generateDBName(site))
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		logger.Info("External database not reachable with site credentials yet", "host", admin.host, "error", err.Error())
+		return false, nil
+	}
+
+	logger.Info("All database resources ready")
+	return true, nil
+}
+
+// GetCredentials retrieves the site credentials from the per-site secret
+func (p *ExternalProvider) GetCredentials(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*DatabaseCredentials, error) {
+	secret := &corev1.Secret{}
+	secretKey := types.NamespacedName{
+		Name:      fmt.Sprintf("%s-db-password", site.Name),
+		Namespace: site.Namespace,
+	}
+	if err := p.client.Get(ctx, secretKey, secret); err != nil {
+		return nil, fmt.Errorf("failed to get password secret: %w", err)
+	}
+
+	username, ok := secret.Data["username"]
+	if !ok {
+		return nil, fmt.Errorf("username key not found in secret %s", secret.Name)
+	}
+	password, ok := secret.Data["password"]
+	if !ok {
+		return nil, fmt.Errorf("password key not found in secret %s", secret.Name)
+	}
+
+	return &DatabaseCredentials{
+		Username:   string(username),
+		Password:   string(password),
+		SecretName: secret.Name,
+	}, nil
+}
+
+// Cleanup drops the site database and user and removes the per-site secret
+func (p *ExternalProvider) Cleanup(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) error {
+	logger := log.FromContext(ctx)
+
+	admin, err := p.getAdmin(ctx, site)
+	if err != nil {
+		return err
+	}
+
+	dbName := p.naming.generateDBName(site)
+	dbUser := p.naming.generateDBUser(site)
+	if creds, err := p.GetCredentials(ctx, site); err == nil {
+		dbUser = creds.Username
+	}
+
+	db, err := p.open(admin.host, admin.port, admin.username, admin.password, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	logger.Info("Dropping external database and user", "host", admin.host, "dbName", dbName, "dbUser", dbUser)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(dbName))); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+	if _, err := db.ExecContext(ctx, "DROP USER IF EXISTS ?@'%'", dbUser); err != nil {
+		return fmt.Errorf("failed to drop user %s: %w", dbUser, err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-db-password", site.Name),
+			Namespace: site.Namespace,
+		},
+	}
+	if err := p.client.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete secret %s: %w", secret.Name, err)
+	}
+
+	return nil
+}
+
+// AdminCredentials returns the connection Secret when it lives in the site namespace
+func (p *ExternalProvider) AdminCredentials(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*AdminCredentials, error) {
+	ref := site.Spec.DBConfig.ConnectionSecretRef
+	if ref == nil || (ref.Namespace != "" && ref.Namespace != site.Namespace) {
+		return nil, nil
+	}
+
+	admin, err := p.getAdmin(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminCredentials{
+		Username:    admin.username,
+		SecretName:  ref.Name,
+		PasswordKey: "password",
+	}, nil
+}
+
+// Helper functions
+
+// getAdmin reads the admin connection from dbConfig; host and port on dbConfig take
+// precedence over the host and port keys in the secret, except for a shared secret in
+// the operator namespace, whose password must only ever be sent to its own server
+func (p *ExternalProvider) getAdmin(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*externalAdmin, error) {
+	ref := site.Spec.DBConfig.ConnectionSecretRef
+	if ref == nil || ref.Name == "" {
+		return nil, fmt.Errorf("dbConfig.connectionSecretRef is required for the external provider")
+	}
+
+	ns := ref.Namespace
+	if ns == "" {
+		ns = site.Namespace
+	}
+	// Sites must not borrow admin credentials from namespaces of other tenants
+	if ns != site.Namespace && ns != externalSecretNamespace {
+		return nil, fmt.Errorf("connectionSecretRef must be in namespace %s of the site or in %s", site.Namespace, externalSecretNamespace)
+	}
+
+	secret := &corev1.Secret{}
+	if err := p.client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ns}, secret); err != nil {
+		return nil, fmt.Errorf("failed to get connection secret %s/%s: %w", ns, ref.Name, err)
+	}
+
+	admin := &externalAdmin{
+		host:     string(secret.Data["host"]),
+		port:     string(secret.Data["port"]),
+		username: string(secret.Data["username"]),
+		password: string(secret.Data["password"]),
+	}
+	if ns == externalSecretNamespace && (site.Spec.DBConfig.Host != "" || site.Spec.DBConfig.Port != "") {
+		return nil, fmt.Errorf("dbConfig.host and dbConfig.port cannot be set with connection secret %s/%s, the server is taken from the secret", ns, ref.Name)
+	}
+	if site.Spec.DBConfig.Host != "" {
+		admin.host = site.Spec.DBConfig.Host
+	}
+	if site.Spec.DBConfig.Port != "" {
+		admin.port = site.Spec.DBConfig.Port
+	}
+	if admin.port == "" {
+		admin.port = "3306"
+	}
+	if admin.username == "" {
+		admin.username = "root"
+	}
+
+	if admin.host == "" {
+		return nil, fmt.Errorf("no database host: set dbConfig.host or the host key in secret %s", ref.Name)
+	}
+	if admin.password == "" {
+		return nil, fmt.Errorf("password key not found in connection secret %s", ref.Name)
+	}
+
+	return admin, nil
+}
+
+// externalProvisionedHash fingerprints what EnsureDatabase provisions
+func externalProvisionedHash(admin *externalAdmin, dbName string, creds *DatabaseCredentials) string {
+	sum := sha256.Sum256([]byte(admin.host + "\n" + admin.port + "\n" + dbName + "\n" + creds.Username + "\n" + creds.Password))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (p *ExternalProvider) ensurePasswordSecret(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*DatabaseCredentials, error) {
+	creds, err := p.GetCredentials(ctx, site)
+	if err == nil {
+		return creds, nil
+	}
+
+	passwordSecret := &corev1.Secret{}
+	secretKey := types.NamespacedName{Name: fmt.Sprintf("%s-db-password", site.Name), Namespace: site.Namespace}
+	if err := p.client.Get(ctx, secretKey, passwordSecret); err == nil {
+		return nil, fmt.Errorf("secret %s exists but is missing username or password", secretKey.Name)
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	creds = &DatabaseCredentials{
+		Username:   p.naming.generateDBUser(site),
+		Password:   p.naming.generatePassword(32),
+		SecretName: secretKey.Name,
+	}
+	passwordSecret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretKey.Name,
+			Namespace: secretKey.Namespace,
+		},
+		Type: corev1.SecretTypeBasicAuth,
+		StringData: map[string]string{
+			"username": creds.Username,
+			"password": creds.Password,
+		},
+	}
+	if err := controllerutil.SetControllerReference(site, passwordSecret, p.scheme); err != nil {
+		return nil, err
+	}
+	if err := p.client.Create(ctx, passwordSecret); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// open returns a connection pool to the external server; dbName may be empty
+func (p *ExternalProvider) open(host, port, username, password, dbName string) (*sql.DB, error) {
+	cfg := mysql.NewConfig()
+	cfg.Net = "tcp"
+	cfg.Addr = fmt.Sprintf("%s:%s", host, port)
+	cfg.User = username
+	cfg.Passwd = password
+	cfg.DBName = dbName
+	cfg.Timeout = 10 * time.Second
+	cfg.ReadTimeout = 30 * time.Second
+	cfg.WriteTimeout = 30 * time.Second
+	// CREATE USER and GRANT cannot be server-side prepared, escape parameters client side
+	cfg.InterpolateParams = true
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection settings for %s: %w", cfg.Addr, err)
+	}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("External provider", func() {
+	var (
+		ctx      context.Context
+		scheme   *runtime.Scheme
+		c        client.Client
+		provider *ExternalProvider
+		site     *vyogotechv1alpha1.FrappeSite
+	)
+
+	adminSecret := func(name, namespace string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data: map[string][]byte{
+				// Nothing listens here, any connection attempt fails
+				"host":     []byte("127.0.0.1"),
+				"port":     []byte("1"),
+				"password": []byte("admin-password"),
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(vyogotechv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: "tenant-a", UID: "site-uid"},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				SiteName: "site.example.com",
+				DBConfig: vyogotechv1alpha1.DatabaseConfig{
+					Provider:            "external",
+					ConnectionSecretRef: &corev1.SecretReference{Name: "db-admin"},
+				},
+			},
+		}
+		c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			site,
+			adminSecret("db-admin", "tenant-a"),
+			adminSecret("db-admin", "tenant-b"),
+			adminSecret("shared-db-admin", externalSecretNamespace),
+		).Build()
+		provider = NewExternalProvider(c, scheme).(*ExternalProvider)
+	})
+
+	It("refuses a connection Secret in the namespace of another tenant", func() {
+		site.Spec.DBConfig.ConnectionSecretRef.Namespace = "tenant-b"
+		_, err := provider.getAdmin(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("must be in namespace tenant-a")))
+
+		admin, err := provider.AdminCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin).To(BeNil())
+	})
+
+	It("accepts a connection Secret in the site or the operator namespace", func() {
+		admin, err := provider.getAdmin(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin.username).To(Equal("root"))
+
+		site.Spec.DBConfig.ConnectionSecretRef = &corev1.SecretReference{Name: "shared-db-admin", Namespace: externalSecretNamespace}
+		_, err = provider.getAdmin(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses to send the operator namespace Secret to another server", func() {
+		site.Spec.DBConfig.ConnectionSecretRef = &corev1.SecretReference{Name: "shared-db-admin", Namespace: externalSecretNamespace}
+		site.Spec.DBConfig.Host = "attacker.example.com"
+		_, err := provider.getAdmin(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("dbConfig.host and dbConfig.port cannot be set")))
+
+		site.Spec.DBConfig.Host = ""
+		site.Spec.DBConfig.Port = "3307"
+		_, err = provider.getAdmin(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("dbConfig.host and dbConfig.port cannot be set")))
+
+		// A Secret of the site's own namespace may still be pointed elsewhere
+		site.Spec.DBConfig.ConnectionSecretRef = &corev1.SecretReference{Name: "db-admin"}
+		site.Spec.DBConfig.Host = "db.example.com"
+		admin, err := provider.getAdmin(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin.host).To(Equal("db.example.com"))
+		Expect(admin.port).To(Equal("3307"))
+	})
+
+	It("only connects to the server when the site is not provisioned with its credentials", func() {
+		Expect(c.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "site-db-password", Namespace: site.Namespace},
+			Data:       map[string][]byte{"username": []byte("site_user"), "password": []byte("site-password")},
+		})).To(Succeed())
+
+		// The first call has to provision and fails to connect
+		_, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("failed to provision database")))
+
+		creds, err := provider.GetCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		admin, err := provider.getAdmin(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		dbName := provider.naming.generateDBName(site)
+
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, client.ObjectKey{Name: creds.SecretName, Namespace: site.Namespace}, secret)).To(Succeed())
+		secret.Annotations = map[string]string{externalProvisionedAnnotation: externalProvisionedHash(admin, dbName, creds)}
+		Expect(c.Update(ctx, secret)).To(Succeed())
+
+		info, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Name).To(Equal(dbName))
+
+		// A new password has to be applied on the server
+		secret.Data["password"] = []byte("rotated")
+		Expect(c.Update(ctx, secret)).To(Succeed())
+		_, err = provider.EnsureDatabase(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("failed to provision database")))
+	})
+})
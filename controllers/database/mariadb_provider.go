@@ -244,11 +244,109 @@ func (p *MariaDBProviderUnstructured) GetCredentials(ctx context.Context, site *
 }
 
 // Cleanup removes database resources
+// The Database, User and Grant CRs are created with cleanupPolicy Skip so that garbage
+// collection alone never drops data; here the policy is switched to Delete before the
+// CRs are removed so the MariaDB operator drops the database and user.
 func (p *MariaDBProviderUnstructured) Cleanup(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) error {
-	// Resources will be automatically cleaned up via owner references
+	logger := log.FromContext(ctx)
+
+	resources := []struct {
+		gvk  schema.GroupVersionKind
+		name string
+	}{
+		{GrantGVK, fmt.Sprintf("%s-grant", site.Name)},
+		{UserGVK, fmt.Sprintf("%s-user", site.Name)},
+		{DatabaseGVK, fmt.Sprintf("%s-db", site.Name)},
+	}
+
+	for _, res := range resources {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(res.gvk)
+		err := p.client.Get(ctx, types.NamespacedName{Name: res.name, Namespace: site.Namespace}, obj)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get %s %s: %w", res.gvk.Kind, res.name, err)
+		}
+
+		patch := client.MergeFrom(obj.DeepCopy())
+		if err := unstructured.SetNestedField(obj.Object, "Delete", "spec", "cleanupPolicy"); err != nil {
+			return err
+		}
+		if err := p.client.Patch(ctx, obj, patch); err != nil {
+			return fmt.Errorf("failed to set cleanupPolicy on %s %s: %w", res.gvk.Kind, res.name, err)
+		}
+
+		logger.Info("Deleting MariaDB resource", "kind", res.gvk.Kind, "name", res.name)
+		if err := p.client.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s %s: %w", res.gvk.Kind, res.name, err)
+		}
+	}
+
+	secrets := []string{fmt.Sprintf("%s-db-password", site.Name)}
+
+	// Dedicated instances belong to the site and are removed with it
+	if site.Spec.DBConfig.MariaDBRef == nil && site.Spec.DBConfig.Mode == "dedicated" {
+		mariadb := &unstructured.Unstructured{}
+		mariadb.SetGroupVersionKind(MariaDBGVK)
+		mariadb.SetName(fmt.Sprintf("%s-mariadb", site.Name))
+		mariadb.SetNamespace(site.Namespace)
+		logger.Info("Deleting dedicated MariaDB instance", "mariadb", mariadb.GetName())
+		if err := p.client.Delete(ctx, mariadb); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete dedicated MariaDB: %w", err)
+		}
+		secrets = append(secrets, fmt.Sprintf("%s-mariadb-root", site.Name))
+	}
+
+	for _, name := range secrets {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: site.Namespace,
+			},
+		}
+		if err := p.client.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete secret %s: %w", name, err)
+		}
+	}
+
 	return nil
 }
 
+// AdminCredentials returns the root password Secret of the MariaDB instance when it
+// lives in the site namespace
+func (p *MariaDBProviderUnstructured) AdminCredentials(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*AdminCredentials, error) {
+	mariadbName, mariadbNamespace, err := p.getMariaDBInstance(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	if mariadbNamespace != site.Namespace {
+		return nil, nil
+	}
+
+	mariadb := &unstructured.Unstructured{}
+	mariadb.SetGroupVersionKind(MariaDBGVK)
+	if err := p.client.Get(ctx, types.NamespacedName{Name: mariadbName, Namespace: mariadbNamespace}, mariadb); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	secretName, _, _ := unstructured.NestedString(mariadb.Object, "spec", "rootPasswordSecretKeyRef", "name")
+	key, _, _ := unstructured.NestedString(mariadb.Object, "spec", "rootPasswordSecretKeyRef", "key")
+	if secretName == "" || key == "" {
+		return nil, nil
+	}
+
+	return &AdminCredentials{
+		Username:    "root",
+		SecretName:  secretName,
+		PasswordKey: key,
+	}, nil
+}
+
 // Helper functions
 
 func (p *MariaDBProviderUnstructured) getMariaDBInstance(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (string, string, error) {
@@ -392,9 +490,10 @@ func (p *MariaDBProviderUnstructured) ensureDatabaseCR(ctx context.Context, site
 					"name":      mariadbName,
 					"namespace": mariadbNamespace,
 				},
-				"name":         dbName,
-				"characterSet": "utf8mb4",
-				"collate":      "utf8mb4_unicode_ci",
+				"name":          dbName,
+				"characterSet":  "utf8mb4",
+				"collate":       "utf8mb4_unicode_ci",
+				"cleanupPolicy": "Skip",
 			},
 		},
 	}
@@ -468,6 +567,7 @@ func (p *MariaDBProviderUnstructured) ensureUserCR(ctx context.Context, site *vy
 					"key":  "password",
 				},
 				"maxUserConnections": 100,
+				"cleanupPolicy":      "Skip",
 			},
 		},
 	}
@@ -509,11 +609,12 @@ func (p *MariaDBProviderUnstructured) ensureGrantCR(ctx context.Context, site *v
 					"name":      mariadbName,
 					"namespace": mariadbNamespace,
 				},
-				"privileges":  []string{"ALL PRIVILEGES"},
-				"database":    dbName,
-				"table":       "*",
-				"username":    dbUser,
-				"grantOption": true,
+				"privileges":    []string{"ALL PRIVILEGES"},
+				"database":      dbName,
+				"table":         "*",
+				"username":      dbUser,
+				"grantOption":   true,
+				"cleanupPolicy": "Skip",
 			},
 		},
 	}
@@ -0,0 +1,229 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("PostgreSQL provider", func() {
+	var (
+		ctx      context.Context
+		scheme   *runtime.Scheme
+		c        client.Client
+		provider *PostgresProvider
+		site     *vyogotechv1alpha1.FrappeSite
+	)
+
+	cluster := func(name, namespace string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(PostgresClusterGVK)
+		obj.SetName(name)
+		obj.SetNamespace(namespace)
+		Expect(unstructured.SetNestedField(obj.Object, int64(1), "spec", "instances")).To(Succeed())
+		return obj
+	}
+
+	getCluster := func(name, namespace string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(PostgresClusterGVK)
+		Expect(c.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, obj)).To(Succeed())
+		return obj
+	}
+
+	getDatabase := func(name, namespace string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(PostgresDatabaseGVK)
+		Expect(c.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, obj)).To(Succeed())
+		return obj
+	}
+
+	managedRoles := func(obj *unstructured.Unstructured) []interface{} {
+		roles, _, err := unstructured.NestedSlice(obj.Object, "spec", "managed", "roles")
+		Expect(err).NotTo(HaveOccurred())
+		return roles
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme = runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(vyogotechv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: "tenant-a", UID: "site-uid"},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				SiteName: "Site.Example.com",
+				DBConfig: vyogotechv1alpha1.DatabaseConfig{Provider: "postgres"},
+			},
+		}
+		c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(site).Build()
+		provider = NewPostgresProvider(c, scheme).(*PostgresProvider)
+	})
+
+	It("fails when the shared cluster does not exist", func() {
+		_, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("shared PostgreSQL cluster 'frappe-postgres' not found")))
+	})
+
+	It("declares the site role and database on the shared cluster", func() {
+		Expect(c.Create(ctx, cluster("frappe-postgres", site.Namespace))).To(Succeed())
+
+		info, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Host).To(Equal("frappe-postgres-rw.tenant-a.svc.cluster.local"))
+		Expect(info.Port).To(Equal("5432"))
+		Expect(info.Provider).To(Equal("postgres"))
+		Expect(info.Name).To(MatchRegexp(`^_[0-9a-f]{8}_site_example_com$`))
+
+		dbUser := provider.generateDBUser(site)
+		Expect(dbUser).To(MatchRegexp(`^site_[0-9a-f]{8}$`))
+
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, client.ObjectKey{Name: "site-db-password", Namespace: site.Namespace}, secret)).To(Succeed())
+		Expect(secret.Type).To(Equal(corev1.SecretTypeBasicAuth))
+		Expect(secret.StringData).To(HaveKeyWithValue("username", dbUser))
+		Expect(metav1.IsControlledBy(secret, site)).To(BeTrue())
+
+		roles := managedRoles(getCluster("frappe-postgres", site.Namespace))
+		Expect(roles).To(HaveLen(1))
+		role := roles[0].(map[string]interface{})
+		Expect(role).To(HaveKeyWithValue("name", dbUser))
+		Expect(role).To(HaveKeyWithValue("ensure", "present"))
+		Expect(role).To(HaveKeyWithValue("login", true))
+		Expect(role).To(HaveKeyWithValue("passwordSecret", map[string]interface{}{"name": "site-db-password"}))
+
+		database := getDatabase("site-db", site.Namespace)
+		spec, _, _ := unstructured.NestedMap(database.Object, "spec")
+		Expect(spec).To(HaveKeyWithValue("name", info.Name))
+		Expect(spec).To(HaveKeyWithValue("owner", dbUser))
+		Expect(spec).To(HaveKeyWithValue("cluster", map[string]interface{}{"name": "frappe-postgres"}))
+		Expect(spec).To(HaveKeyWithValue("databaseReclaimPolicy", "retain"))
+		Expect(metav1.IsControlledBy(database, site)).To(BeTrue())
+
+		// A second pass leaves the role list alone
+		_, err = provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(managedRoles(getCluster("frappe-postgres", site.Namespace))).To(HaveLen(1))
+	})
+
+	It("keeps the roles of other sites on a shared cluster", func() {
+		shared := cluster("frappe-postgres", site.Namespace)
+		Expect(unstructured.SetNestedSlice(shared.Object, []interface{}{
+			map[string]interface{}{"name": "other_site", "ensure": "present", "login": true},
+		}, "spec", "managed", "roles")).To(Succeed())
+		Expect(c.Create(ctx, shared)).To(Succeed())
+
+		_, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		roles := managedRoles(getCluster("frappe-postgres", site.Namespace))
+		Expect(roles).To(HaveLen(2))
+		Expect(roles[0]).To(HaveKeyWithValue("name", "other_site"))
+
+		// Cleanup marks only the site role absent and removes its database
+		Expect(provider.Cleanup(ctx, site)).To(Succeed())
+		roles = managedRoles(getCluster("frappe-postgres", site.Namespace))
+		Expect(roles).To(HaveLen(2))
+		Expect(roles[0]).To(HaveKeyWithValue("ensure", "present"))
+		Expect(roles[1]).To(HaveKeyWithValue("name", provider.generateDBUser(site)))
+		Expect(roles[1]).To(HaveKeyWithValue("ensure", "absent"))
+		Expect(roles[1]).To(HaveKeyWithValue("passwordSecret", map[string]interface{}{"name": "site-db-password"}))
+
+		database := &unstructured.Unstructured{}
+		database.SetGroupVersionKind(PostgresDatabaseGVK)
+		err = c.Get(ctx, client.ObjectKey{Name: "site-db", Namespace: site.Namespace}, database)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("creates a dedicated cluster owned by the site", func() {
+		size := resource.MustParse("20Gi")
+		site.Spec.DBConfig.Mode = "dedicated"
+		site.Spec.DBConfig.StorageSize = &size
+
+		_, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+
+		dedicated := getCluster("site-postgres", site.Namespace)
+		Expect(metav1.IsControlledBy(dedicated, site)).To(BeTrue())
+		storage, _, _ := unstructured.NestedString(dedicated.Object, "spec", "storage", "size")
+		Expect(storage).To(Equal("20Gi"))
+		Expect(managedRoles(dedicated)).To(HaveLen(1))
+
+		getDatabase("site-db", site.Namespace)
+	})
+
+	It("mirrors the role secret next to a cluster in another namespace", func() {
+		site.Spec.DBConfig.PostgresRef = &vyogotechv1alpha1.NamespacedName{Name: "pg", Namespace: "databases"}
+		Expect(c.Create(ctx, cluster("pg", "databases"))).To(Succeed())
+
+		info, err := provider.EnsureDatabase(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Host).To(Equal("pg-rw.databases.svc.cluster.local"))
+
+		mirror := &corev1.Secret{}
+		Expect(c.Get(ctx, client.ObjectKey{Name: "tenant-a-site-db-password", Namespace: "databases"}, mirror)).To(Succeed())
+		Expect(mirror.Labels).To(HaveKeyWithValue("site-namespace", "tenant-a"))
+
+		role := managedRoles(getCluster("pg", "databases"))[0].(map[string]interface{})
+		Expect(role).To(HaveKeyWithValue("passwordSecret", map[string]interface{}{"name": "tenant-a-site-db-password"}))
+
+		// Owner references cannot cross namespaces
+		database := getDatabase("tenant-a-site-db", "databases")
+		Expect(database.GetOwnerReferences()).To(BeEmpty())
+	})
+
+	It("returns the superuser Secret of a cluster in the site namespace", func() {
+		admin, err := provider.AdminCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin).To(BeNil())
+
+		Expect(c.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "frappe-postgres-superuser", Namespace: site.Namespace},
+			Data:       map[string][]byte{"password": []byte("secret")},
+		})).To(Succeed())
+		admin, err = provider.AdminCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin.Username).To(Equal("postgres"))
+		Expect(admin.SecretName).To(Equal("frappe-postgres-superuser"))
+		Expect(admin.PasswordKey).To(Equal("password"))
+
+		// The superuser of a cluster in another namespace is never handed out
+		site.Spec.DBConfig.PostgresRef = &vyogotechv1alpha1.NamespacedName{Name: "frappe-postgres", Namespace: "databases"}
+		Expect(c.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "frappe-postgres-superuser", Namespace: "databases"},
+			Data:       map[string][]byte{"password": []byte("secret")},
+		})).To(Succeed())
+		admin, err = provider.AdminCredentials(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(admin).To(BeNil())
+	})
+})
@@ -38,6 +38,11 @@ type Provider interface {
 
 	// Cleanup removes database resources (on site deletion)
 	Cleanup(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) error
+
+	// AdminCredentials returns the server admin credentials for bench commands that need
+	// root access, such as drop-site. Returns nil when no admin Secret exists in the site
+	// namespace; Secrets of other namespaces are never handed to site Jobs.
+	AdminCredentials(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*AdminCredentials, error)
 }
 
 // DatabaseInfo contains database connection information
@@ -55,6 +60,13 @@ type DatabaseCredentials struct {
 	SecretName string
 }
 
+// AdminCredentials points at a Secret in the site namespace holding a database admin password
+type AdminCredentials struct {
+	Username    string
+	SecretName  string
+	PasswordKey string
+}
+
 // NewProvider returns the appropriate provider based on config
 func NewProvider(providerType string, client client.Client, scheme *runtime.Scheme) (Provider, error) {
 	if providerType == "" {
@@ -65,11 +77,13 @@ func NewProvider(providerType string, client client.Client, scheme *runtime.Sche
 	case "mariadb":
 		return NewMariaDBProvider(client, scheme), nil
 	case "postgres":
-		return nil, fmt.Errorf("PostgreSQL provider not yet implemented - planned for v1.1.0")
+		return NewPostgresProvider(client, scheme), nil
 	case "sqlite":
 		return NewSQLiteProvider(client, scheme), nil
+	case "external":
+		return NewExternalProvider(client, scheme), nil
 	default:
-		return nil, fmt.Errorf("unsupported database provider: %s (supported: mariadb, postgres, sqlite)", providerType)
+		return nil, fmt.Errorf("unsupported database provider: %s (supported: mariadb, postgres, sqlite, external)", providerType)
 	}
 }
 
@@ -75,6 +75,11 @@ func (p *SQLiteProvider) Cleanup(ctx context.Context, site *vyogotechv1alpha1.Fr
 	return nil
 }
 
+// AdminCredentials for SQLite - there is no database server
+func (p *SQLiteProvider) AdminCredentials(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (*AdminCredentials, error) {
+	return nil, nil
+}
+
 // Note: SQLite support requires Frappe v16 or later
 // This provider is a placeholder for future implementation when Frappe v16 is widely adopted
 // Current implementation (v1.0.0) focuses on MariaDB for production use cases
@@ -0,0 +1,258 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fpm is a client for the HTTP index of an FPM (Frappe Package Manager) repository,
+// used by the operator to check apps before it launches Jobs that install them.
+//
+// The index serves:
+//
+//	GET /api/v1/search?q=<query>                      {"packages": [Package...]}
+//	GET /api/v1/packages/<org>/<name>                 Package with all its versions
+//	GET /api/v1/packages/<org>/<name>/<version>       Release
+package fpm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the package or version does not exist in the repository
+var ErrNotFound = errors.New("package not found")
+
+// ErrNoMatchingVersion is returned by Resolve when no release satisfies the constraint
+var ErrNoMatchingVersion = errors.New("no matching version")
+
+// IsNotFound reports whether err means the package, version or a matching version does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrNoMatchingVersion)
+}
+
+// Error is a non-2xx response from the repository
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("FPM repository returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsUnauthorized reports whether the repository rejected the credentials
+func IsUnauthorized(err error) bool {
+	var repoErr *Error
+	return errors.As(err, &repoErr) && (repoErr.StatusCode == http.StatusUnauthorized || repoErr.StatusCode == http.StatusForbidden)
+}
+
+// Credentials authenticates against a private repository, with either a token
+// or a username and password
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Package is an app published in the repository
+type Package struct {
+	Org           string    `json:"org"`
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty"`
+	LatestVersion string    `json:"latestVersion,omitempty"`
+	Versions      []Release `json:"versions,omitempty"`
+}
+
+// Release is one published version of a package
+type Release struct {
+	Version string `json:"version"`
+	// Checksum of the package archive, "sha256:<hex>"
+	Checksum string `json:"checksum,omitempty"`
+	// Frappe is the constraint on the Frappe framework version the release supports
+	Frappe string `json:"frappe,omitempty"`
+	// RequiredApps are the apps the release depends on, as "org/name" or "org/name<constraint>"
+	RequiredApps []string `json:"requiredApps,omitempty"`
+}
+
+// Client talks to one FPM repository
+type Client struct {
+	baseURL     string
+	http        *http.Client
+	credentials *Credentials
+}
+
+// NewClient returns a client for the repository at baseURL (e.g. https://fpm.company.com)
+// credentials may be nil for public repositories.
+func NewClient(baseURL string, credentials *Credentials) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		credentials: credentials,
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Search returns the packages whose org, name or description match query
+func (c *Client) Search(ctx context.Context, query string) ([]Package, error) {
+	out := struct {
+		Packages []Package `json:"packages"`
+	}{}
+	if err := c.get(ctx, "/api/v1/search?"+url.Values{"q": {query}}.Encode(), &out); err != nil {
+		return nil, err
+	}
+	return out.Packages, nil
+}
+
+// GetPackage returns a package with all its published versions
+func (c *Client) GetPackage(ctx context.Context, org, name string) (*Package, error) {
+	pkg := &Package{}
+	if err := c.get(ctx, packagePath(org, name), pkg); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// Resolve returns the highest release of a package that satisfies constraint
+// (see ParseConstraint); an empty constraint or "latest" picks the newest release.
+func (c *Client) Resolve(ctx context.Context, org, name, constraint string) (*Release, error) {
+	parsed, err := ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := c.GetPackage(ctx, org, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Release
+	var bestVersion Version
+	for i := range pkg.Versions {
+		v, err := ParseVersion(pkg.Versions[i].Version)
+		if err != nil || !parsed.Check(v) {
+			continue
+		}
+		if best == nil || v.Compare(bestVersion) > 0 {
+			best, bestVersion = &pkg.Versions[i], v
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%s/%s %q (available: %s): %w",
+			org, name, constraint, strings.Join(availableVersions(pkg), ", "), ErrNoMatchingVersion)
+	}
+	return best, nil
+}
+
+// Checksum returns the checksum of the archive of one release, "sha256:<hex>"
+func (c *Client) Checksum(ctx context.Context, org, name, version string) (string, error) {
+	release := &Release{}
+	if err := c.get(ctx, packagePath(org, name)+"/"+url.PathEscape(version), release); err != nil {
+		return "", err
+	}
+	if release.Checksum == "" {
+		return "", fmt.Errorf("repository has no checksum for %s/%s %s", org, name, version)
+	}
+	return release.Checksum, nil
+}
+
+func packagePath(org, name string) string {
+	return "/api/v1/packages/" + url.PathEscape(org) + "/" + url.PathEscape(name)
+}
+
+// availableVersions lists the versions of a package from oldest to newest, for error messages
+func availableVersions(pkg *Package) []string {
+	versions := make([]string, 0, len(pkg.Versions))
+	for _, release := range pkg.Versions {
+		versions = append(versions, release.Version)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, errA := ParseVersion(versions[i])
+		b, errB := ParseVersion(versions[j])
+		if errA != nil || errB != nil {
+			return versions[i] < versions[j]
+		}
+		return a.Compare(b) < 0
+	})
+	if len(versions) == 0 {
+		return []string{"none"}
+	}
+	return versions
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if creds := c.credentials; creds != nil {
+		if creds.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+creds.Token)
+		} else if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", req.URL.Path, ErrNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// parseError extracts the message of an error response, {"error": "..."} or plain text
+func parseError(statusCode int, body []byte) error {
+	repoErr := &Error{StatusCode: statusCode}
+	parsed := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	switch {
+	case json.Unmarshal(body, &parsed) == nil && parsed.Error != "":
+		repoErr.Message = parsed.Error
+	case parsed.Message != "":
+		repoErr.Message = parsed.Message
+	case len(strings.TrimSpace(string(body))) > 0:
+		repoErr.Message = strings.TrimSpace(string(body))
+	default:
+		repoErr.Message = http.StatusText(statusCode)
+	}
+	if len(repoErr.Message) > 500 {
+		repoErr.Message = repoErr.Message[:500] + "..."
+	}
+	return repoErr
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeRepository serves an FPM index from memory and records the Authorization header it received
+type fakeRepository struct {
+	packages      map[string]Package
+	requireAuth   string
+	authorization string
+}
+
+func (f *fakeRepository) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.authorization = r.Header.Get("Authorization")
+	if f.requireAuth != "" && f.authorization != f.requireAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error": "invalid credentials"}`))
+		return
+	}
+
+	if r.URL.Path == "/api/v1/search" {
+		query := r.URL.Query().Get("q")
+		matches := []Package{}
+		for _, pkg := range f.packages {
+			if strings.Contains(pkg.Org+"/"+pkg.Name+" "+pkg.Description, query) {
+				matches = append(matches, Package{Org: pkg.Org, Name: pkg.Name, Description: pkg.Description})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"packages": matches})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/packages/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	pkg, ok := f.packages[parts[0]+"/"+parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		_ = json.NewEncoder(w).Encode(pkg)
+		return
+	}
+	for _, release := range pkg.Versions {
+		if release.Version == parts[2] {
+			_ = json.NewEncoder(w).Encode(release)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+var _ = Describe("Client", func() {
+	var (
+		ctx    context.Context
+		repo   *fakeRepository
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		repo = &fakeRepository{packages: map[string]Package{
+			"frappe/hrms": {
+				Org:         "frappe",
+				Name:        "hrms",
+				Description: "Human resources",
+				Versions: []Release{
+					{Version: "14.3.0", Checksum: "sha256:aaa", Frappe: ">=14, <15"},
+					{Version: "15.0.0", Checksum: "sha256:bbb", Frappe: ">=15, <16", RequiredApps: []string{"frappe/erpnext>=15"}},
+					{Version: "15.2.1", Checksum: "sha256:ccc", Frappe: ">=15, <16", RequiredApps: []string{"frappe/erpnext>=15"}},
+					{Version: "16.0.0-beta.1", Checksum: "sha256:ddd"},
+				},
+			},
+			"frappe/erpnext": {
+				Org:         "frappe",
+				Name:        "erpnext",
+				Description: "ERP",
+				Versions:    []Release{{Version: "15.10.0", Checksum: "sha256:eee"}},
+			},
+		}}
+		server = httptest.NewServer(repo)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("searches packages", func() {
+		packages, err := NewClient(server.URL, nil).Search(ctx, "hrms")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packages).To(HaveLen(1))
+		Expect(packages[0].Org).To(Equal("frappe"))
+		Expect(packages[0].Name).To(Equal("hrms"))
+	})
+
+	DescribeTable("resolves version constraints",
+		func(constraint, expected string) {
+			release, err := NewClient(server.URL, nil).Resolve(ctx, "frappe", "hrms", constraint)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(release.Version).To(Equal(expected))
+		},
+		Entry("latest", "latest", "15.2.1"),
+		Entry("empty", "", "15.2.1"),
+		Entry("exact", "15.0.0", "15.0.0"),
+		Entry("exact with v prefix", "v14.3.0", "14.3.0"),
+		Entry("major only", "14", "14.3.0"),
+		Entry("wildcard", "15.x", "15.2.1"),
+		Entry("range", ">=14, <15.1", "15.0.0"),
+		Entry("caret", "^14.0", "14.3.0"),
+		Entry("tilde", "~15.0.0", "15.0.0"),
+		Entry("alternatives", "14.x || 15.0.0", "15.0.0"),
+		Entry("prerelease named explicitly", "16.0.0-beta.1", "16.0.0-beta.1"),
+	)
+
+	It("reports the available versions when nothing matches", func() {
+		_, err := NewClient(server.URL, nil).Resolve(ctx, "frappe", "hrms", ">=17")
+		Expect(err).To(MatchError(ErrNoMatchingVersion))
+		Expect(IsNotFound(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("14.3.0, 15.0.0, 15.2.1, 16.0.0-beta.1"))
+	})
+
+	It("reports unknown packages as not found", func() {
+		_, err := NewClient(server.URL, nil).Resolve(ctx, "frappe", "payroll", "latest")
+		Expect(IsNotFound(err)).To(BeTrue())
+	})
+
+	It("rejects invalid constraints", func() {
+		_, err := NewClient(server.URL, nil).Resolve(ctx, "frappe", "hrms", ">=fifteen")
+		Expect(err).To(HaveOccurred())
+		Expect(IsNotFound(err)).To(BeFalse())
+	})
+
+	It("returns the dependency metadata of a release", func() {
+		release, err := NewClient(server.URL, nil).Resolve(ctx, "frappe", "hrms", "^15")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(release.Frappe).To(Equal(">=15, <16"))
+		Expect(release.RequiredApps).To(ConsistOf("frappe/erpnext>=15"))
+	})
+
+	It("fetches the checksum of a release", func() {
+		client := NewClient(server.URL, nil)
+		checksum, err := client.Checksum(ctx, "frappe", "hrms", "15.0.0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checksum).To(Equal("sha256:bbb"))
+
+		_, err = client.Checksum(ctx, "frappe", "hrms", "9.9.9")
+		Expect(IsNotFound(err)).To(BeTrue())
+	})
+
+	It("authenticates with a token or a username and password", func() {
+		repo.requireAuth = "Bearer s3cret"
+		_, err := NewClient(server.URL, nil).GetPackage(ctx, "frappe", "hrms")
+		Expect(IsUnauthorized(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("invalid credentials"))
+
+		_, err = NewClient(server.URL, &Credentials{Token: "s3cret"}).GetPackage(ctx, "frappe", "hrms")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _ = NewClient(server.URL, &Credentials{Username: "ci", Password: "pw"}).GetPackage(ctx, "frappe", "hrms")
+		Expect(repo.authorization).To(HavePrefix("Basic "))
+	})
+})
+
+var _ = DescribeTable("Constraint.Allows",
+	func(constraint string, major int, expected bool) {
+		c, err := ParseConstraint(constraint)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Allows(Version{Major: major}, Version{Major: major + 1})).To(Equal(expected))
+	},
+	Entry("range containing the major", ">=15, <16", 15, true),
+	Entry("range below the major", ">=15, <16", 14, false),
+	Entry("lower bound inside the major", ">=15.2", 15, true),
+	Entry("exclusive upper bound at the major", "<15", 15, false),
+	Entry("exact version", "15.3.1", 15, true),
+	Entry("alternatives", "14.x || 16.x", 15, false),
+	Entry("any", "*", 14, true),
+)
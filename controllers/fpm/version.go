@@ -0,0 +1,274 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fpm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version as used by Frappe apps (e.g. "15.2.1" or "v15.0.0-beta.1")
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// ParseVersion parses a version, with an optional "v" prefix and missing minor or patch
+// numbers defaulting to 0
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	raw := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(raw, '+'); i >= 0 {
+		raw = raw[:i]
+	}
+	if i := strings.IndexByte(raw, '-'); i >= 0 {
+		v.Prerelease = raw[i+1:]
+		raw = raw[:i]
+	}
+
+	parts := strings.Split(raw, ".")
+	if raw == "" || len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 when v is lower than, equal to or higher than o
+// A prerelease is lower than the release it precedes.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	case v.Prerelease < o.Prerelease:
+		return -1
+	}
+	return 1
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Constraint is a version requirement such as "15.0.0", ">=15.0.0, <16", "^15.1", "~15.1.2",
+// "15.x" or "*". Comparisons separated by commas or spaces must all hold; alternatives
+// are separated by "||". An empty constraint or "latest" matches any release.
+type Constraint struct {
+	raw    string
+	groups [][]comparison
+}
+
+type comparison struct {
+	op      string
+	version Version
+}
+
+// ParseConstraint parses a version constraint
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{raw: s}
+	s = strings.TrimSpace(s)
+	if s == "" || s == "latest" {
+		s = "*"
+	}
+
+	for _, alternative := range strings.Split(s, "||") {
+		var group []comparison
+		fields := strings.FieldsFunc(alternative, func(r rune) bool { return r == ',' || r == ' ' })
+		// Allow a space between an operator and its version (">= 15")
+		for i := 0; i < len(fields); i++ {
+			term := fields[i]
+			if strings.Trim(term, "=<>!~^") == "" && i+1 < len(fields) {
+				term += fields[i+1]
+				i++
+			}
+			comparisons, err := parseTerm(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version constraint %q: %w", c.raw, err)
+			}
+			group = append(group, comparisons...)
+		}
+		if len(group) == 0 {
+			return nil, fmt.Errorf("invalid version constraint %q", c.raw)
+		}
+		c.groups = append(c.groups, group)
+	}
+	return c, nil
+}
+
+// parseTerm expands one term into plain comparisons
+func parseTerm(term string) ([]comparison, error) {
+	op := term[:len(term)-len(strings.TrimLeft(term, "=<>!~^"))]
+	rest := strings.TrimPrefix(term[len(op):], "v")
+
+	if rest == "*" || rest == "x" || rest == "X" {
+		return []comparison{{op: "*"}}, nil
+	}
+
+	// Wildcards ("15.x", "15.1.*") and partial versions without an operator are ranges
+	parts := strings.Split(rest, ".")
+	wildcard := -1
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			wildcard = i
+			break
+		}
+	}
+	if wildcard >= 0 {
+		parts = parts[:wildcard]
+		if op != "" && op != "=" && op != "==" {
+			return nil, fmt.Errorf("wildcard %q cannot be combined with %s", term, op)
+		}
+		op = "~partial"
+	} else if op == "" && len(parts) < 3 && !strings.Contains(rest, "-") {
+		op = "~partial"
+	}
+
+	v, err := ParseVersion(strings.Join(parts, "."))
+	if err != nil {
+		if wildcard == 0 {
+			return []comparison{{op: "*"}}, nil
+		}
+		return nil, err
+	}
+
+	switch op {
+	case "", "=", "==":
+		return []comparison{{op: "=", version: v}}, nil
+	case "!=", ">", ">=", "<", "<=":
+		return []comparison{{op: op, version: v}}, nil
+	case "^":
+		upper := Version{Major: v.Major + 1}
+		if v.Major == 0 {
+			upper = Version{Minor: v.Minor + 1}
+		}
+		return []comparison{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	case "~":
+		return []comparison{{op: ">=", version: v}, {op: "<", version: Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+	case "~partial":
+		upper := Version{Major: v.Major + 1}
+		if len(parts) == 2 {
+			upper = Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return []comparison{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
+
+// Check reports whether v satisfies the constraint
+// Prereleases only match comparisons that name a prerelease of the same version.
+func (c *Constraint) Check(v Version) bool {
+	for _, group := range c.groups {
+		if groupMatches(group, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func groupMatches(group []comparison, v Version) bool {
+	prereleaseAllowed := v.Prerelease == ""
+	for _, cmp := range group {
+		if cmp.op == "*" {
+			continue
+		}
+		if v.Prerelease != "" && cmp.version.Prerelease != "" &&
+			cmp.version.Major == v.Major && cmp.version.Minor == v.Minor && cmp.version.Patch == v.Patch {
+			prereleaseAllowed = true
+		}
+
+		d := v.Compare(cmp.version)
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = d == 0
+		case "!=":
+			ok = d != 0
+		case ">":
+			ok = d > 0
+		case ">=":
+			ok = d >= 0
+		case "<":
+			ok = d < 0
+		case "<=":
+			ok = d <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return prereleaseAllowed
+}
+
+func (c *Constraint) String() string {
+	return c.raw
+}
+
+// Allows reports whether some version from lower (inclusive) to upper (exclusive)
+// satisfies the constraint, e.g. whether ">=15.2, <16" accepts any 15.x release
+func (c *Constraint) Allows(lower, upper Version) bool {
+	for _, group := range c.groups {
+		if groupAllows(group, lower, upper) {
+			return true
+		}
+	}
+	return false
+}
+
+func groupAllows(group []comparison, lo, hi Version) bool {
+	loIncl, hiIncl := true, false
+	for _, cmp := range group {
+		v := cmp.version
+		switch cmp.op {
+		case ">=", ">", "=":
+			if d := v.Compare(lo); d > 0 || (d == 0 && cmp.op == ">") {
+				lo, loIncl = v, cmp.op != ">"
+			}
+		}
+		switch cmp.op {
+		case "<=", "<", "=":
+			if d := v.Compare(hi); d < 0 || (d == 0 && cmp.op == "<") {
+				hi, hiIncl = v, cmp.op != "<"
+			}
+		}
+	}
+	d := lo.Compare(hi)
+	return d < 0 || (d == 0 && loIncl && hiIncl)
+}
@@ -1,230 +1,265 @@
 package controllers
 
 import (
-	"context"
 	"fmt"
-	"os/exec"
+	"sort"
 	"strings"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
-	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-// FPMManager handles FPM CLI operations
-type FPMManager struct {
-	fpmPath string
-}
+// FPMManager generates the parts of the bench init script that run the fpm CLI
+// The CLI only exists in bench images; the operator itself talks to repositories
+// through the fpm package.
+type FPMManager struct{}
 
 // NewFPMManager creates a new FPM manager instance
-func NewFPMManager(fpmPath string) *FPMManager {
-	if fpmPath == "" {
-		fpmPath = "/usr/local/bin/fpm" // Default path
-	}
-	return &FPMManager{fpmPath: fpmPath}
+func NewFPMManager() *FPMManager {
+	return &FPMManager{}
 }
 
-// ConfigureRepositories configures FPM repositories
-func (m *FPMManager) ConfigureRepositories(ctx context.Context, repos []vyogotechv1alpha1.FPMRepository) error {
-	logger := log.FromContext(ctx)
-
-	for _, repo := range repos {
-		logger.Info("Configuring FPM repository", "name", repo.Name, "url", repo.URL, "priority", repo.Priority)
-
-		args := []string{"repo", "add", repo.Name, repo.URL}
-		if repo.Priority != 0 {
-			args = append(args, "--priority", fmt.Sprintf("%d", repo.Priority))
-		}
-
-		cmd := exec.CommandContext(ctx, m.fpmPath, args...)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			logger.Error(err, "Failed to add FPM repository", "name", repo.Name, "output", string(output))
-			return fmt.Errorf("failed to add repo %s: %w (output: %s)", repo.Name, err, string(output))
-		}
-
-		logger.Info("FPM repository added successfully", "name", repo.Name)
-	}
-
-	return nil
-}
-
-// SetDefaultRepository sets the default repository for publishing
-func (m *FPMManager) SetDefaultRepository(ctx context.Context, repoName string) error {
-	logger := log.FromContext(ctx)
-
-	if repoName == "" {
-		return nil // No default to set
-	}
-
-	logger.Info("Setting default FPM repository", "name", repoName)
-
-	cmd := exec.CommandContext(ctx, m.fpmPath, "repo", "default", repoName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(err, "Failed to set default FPM repository", "name", repoName, "output", string(output))
-		return fmt.Errorf("failed to set default repo %s: %w (output: %s)", repoName, err, string(output))
-	}
-
-	logger.Info("Default FPM repository set successfully", "name", repoName)
-	return nil
-}
-
-// InstallApp installs an app using FPM
-func (m *FPMManager) InstallApp(ctx context.Context, org, name, version, benchPath string) error {
-	logger := log.FromContext(ctx)
-
-	packageID := fmt.Sprintf("%s/%s==%s", org, name, version)
-	logger.Info("Installing FPM package", "package", packageID, "benchPath", benchPath)
-
-	cmd := exec.CommandContext(ctx, m.fpmPath, "install", packageID, "--bench-path", benchPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(err, "Failed to install FPM package", "package", packageID, "output", string(output))
-		return fmt.Errorf("failed to install %s: %w (output: %s)", packageID, err, string(output))
-	}
-
-	logger.Info("FPM package installed successfully", "package", packageID)
-	return nil
-}
-
-// GetApp downloads a package from repository to local store
-func (m *FPMManager) GetApp(ctx context.Context, repoName, org, appName, version string) error {
-	logger := log.FromContext(ctx)
-
-	identifier := fmt.Sprintf("%s/%s/%s", repoName, org, appName)
-	if version != "" && version != "latest" {
-		identifier = fmt.Sprintf("%s:%s", identifier, version)
-	}
-
-	logger.Info("Downloading FPM package to local store", "identifier", identifier)
-
-	cmd := exec.CommandContext(ctx, m.fpmPath, "get-app", identifier)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(err, "Failed to download FPM package", "identifier", identifier, "output", string(output))
-		return fmt.Errorf("failed to get-app %s: %w (output: %s)", identifier, err, string(output))
-	}
-
-	logger.Info("FPM package downloaded successfully", "identifier", identifier)
-	return nil
-}
-
-// SearchPackage searches for packages in configured repositories
-func (m *FPMManager) SearchPackage(ctx context.Context, query string) (string, error) {
-	logger := log.FromContext(ctx)
-
-	logger.Info("Searching for FPM packages", "query", query)
-
-	args := []string{"search"}
-	if query != "" {
-		args = append(args, query)
-	}
-
-	cmd := exec.CommandContext(ctx, m.fpmPath, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(err, "Failed to search FPM packages", "query", query, "output", string(output))
-		return "", fmt.Errorf("failed to search %s: %w (output: %s)", query, err, string(output))
-	}
-
-	return string(output), nil
-}
-
-// GenerateFPMConfigScript generates a bash script to configure FPM
-func (m *FPMManager) GenerateFPMConfigScript(repos []vyogotechv1alpha1.FPMRepository, defaultRepo string) string {
+// GenerateFPMConfigScript generates the bench init script section that configures FPM
+// authDirs maps the index of a repository to the directory its credentials Secret is
+// mounted at; the credentials are read from there by fpm and never appear in the script.
+func (m *FPMManager) GenerateFPMConfigScript(repos []vyogotechv1alpha1.FPMRepository, defaultRepo string, authDirs map[int]string) string {
 	var script strings.Builder
 
-	script.WriteString("#!/bin/bash\n")
-	script.WriteString("set -e\n\n")
 	script.WriteString("echo 'Configuring FPM repositories...'\n\n")
 
-	for _, repo := range repos {
+	for i, repo := range repos {
 		priority := repo.Priority
 		if priority == 0 {
 			priority = 50 // Default priority
 		}
 
-		script.WriteString(fmt.Sprintf("# Add repository: %s\n", repo.Name))
-		script.WriteString(fmt.Sprintf("fpm repo add %s %s --priority %d || echo 'Repository %s may already exist'\n\n",
-			repo.Name, repo.URL, priority, repo.Name))
+		script.WriteString(fmt.Sprintf("# Add repository: %q\n", repo.Name))
+		script.WriteString(fmt.Sprintf("fpm repo add %s %s --priority %d || echo 'Repository may already exist'\n",
+			shellQuote(repo.Name), shellQuote(repo.URL), priority))
+
+		if dir, ok := authDirs[i]; ok {
+			script.WriteString(fmt.Sprintf("if [ -f %s/token ]; then\n", shellQuote(dir)))
+			script.WriteString(fmt.Sprintf("  fpm repo login %s --token-stdin < %s/token || echo 'Could not log in to repository'\n", shellQuote(repo.Name), shellQuote(dir)))
+			script.WriteString("else\n")
+			script.WriteString(fmt.Sprintf("  fpm repo login %s --username \"$(cat %s/username)\" --password-stdin < %s/password || echo 'Could not log in to repository'\n",
+				shellQuote(repo.Name), shellQuote(dir), shellQuote(dir)))
+			script.WriteString("fi\n")
+		}
+		script.WriteString("\n")
 	}
 
 	if defaultRepo != "" {
-		script.WriteString(fmt.Sprintf("# Set default repository for publishing\n"))
-		script.WriteString(fmt.Sprintf("fpm repo default %s || echo 'Could not set default repository'\n\n", defaultRepo))
+		script.WriteString("# Set default repository for publishing\n")
+		script.WriteString(fmt.Sprintf("fpm repo default %s || echo 'Could not set default repository'\n\n", shellQuote(defaultRepo)))
 	}
 
-	script.WriteString("echo 'FPM configuration complete'\n")
-	script.WriteString("fpm repo list || echo 'Could not list repositories'\n")
+	script.WriteString("fpm repo list || echo 'Could not list repositories'\n\n")
 
 	return script.String()
 }
 
-// GenerateAppInstallScript generates a bash script to install apps
-func (m *FPMManager) GenerateAppInstallScript(apps []vyogotechv1alpha1.AppSource, gitEnabled bool, benchPath string) string {
+// GenerateAppInstallScript generates the bench init script section that installs apps
+// Apps are installed in the order of lock (may be nil), at its fpm versions and Git commits.
+// Every app is attempted and recorded with report(); a failed app does not stop the
+// others and makes the script exit non-zero at the end (see appInstallReportPrologue).
+func (m *FPMManager) GenerateAppInstallScript(apps []vyogotechv1alpha1.AppSource, lock *vyogotechv1alpha1.BenchLock, gitEnabled bool, benchPath string) string {
 	var script strings.Builder
 
-	script.WriteString("#!/bin/bash\n")
-	script.WriteString("set -e\n\n")
-	script.WriteString(fmt.Sprintf("BENCH_PATH=%s\n", benchPath))
-	script.WriteString("cd $BENCH_PATH\n\n")
+	script.WriteString(fmt.Sprintf("cd %s\n\n", shellQuote(benchPath)))
 	script.WriteString("echo 'Installing apps...'\n\n")
 
-	for _, app := range apps {
-		script.WriteString(fmt.Sprintf("# Install app: %s (source: %s)\n", app.Name, app.Source))
+	for _, app := range lockOrder(apps, lock) {
+		var pin vyogotechv1alpha1.LockedApp
+		if locked := findLockedApp(lock, app.Name); locked != nil && lockedAppMatches(*locked, app) {
+			pin = *locked
+		}
+
+		name := shellQuote(app.Name)
+		report := func(state vyogotechv1alpha1.BenchAppState, message string) string {
+			return fmt.Sprintf("report %s %s %s %s %s", name, shellQuote(app.Source), shellQuote(app.Version), state, shellQuote(message))
+		}
+
+		script.WriteString(fmt.Sprintf("# Install app: %q (source: %q)\n", app.Name, app.Source))
 
 		switch app.Source {
 		case "fpm":
-			if app.Org == "" || app.Version == "" {
-				script.WriteString(fmt.Sprintf("echo 'Warning: FPM app %s missing org or version, skipping'\n\n", app.Name))
+			version := app.Version
+			if pin.Version != "" {
+				version = pin.Version
+			}
+			if app.Org == "" || version == "" {
+				script.WriteString(report(vyogotechv1alpha1.BenchAppStateFailed, "org and version are required for fpm apps") + "\n\n")
 				continue
 			}
-			packageID := fmt.Sprintf("%s/%s==%s", app.Org, app.Name, app.Version)
-			script.WriteString(fmt.Sprintf("echo 'Installing FPM package: %s'\n", packageID))
-			script.WriteString(fmt.Sprintf("fpm install %s --bench-path $BENCH_PATH || {\n", packageID))
-			script.WriteString(fmt.Sprintf("  echo 'Error: Failed to install FPM package %s'\n", packageID))
-			script.WriteString("  exit 1\n")
-			script.WriteString("}\n\n")
+			packageID := shellQuote(fmt.Sprintf("%s/%s==%s", app.Org, app.Name, version))
+			script.WriteString("if ! command -v fpm >/dev/null; then\n")
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateFailed, "fpm CLI not found in the bench image") + "\n")
+			script.WriteString(fmt.Sprintf("elif fpm install %s --bench-path \"$BENCH_PATH\"; then\n", packageID))
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateInstalled, "") + "\n")
+			script.WriteString("else\n")
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateFailed, "fpm install failed, see the init Job logs") + "\n")
+			script.WriteString("fi\n\n")
 
 		case "git":
 			if !gitEnabled {
-				script.WriteString(fmt.Sprintf("echo 'Skipping Git app %s: Git is disabled in this environment'\n\n", app.Name))
+				script.WriteString(report(vyogotechv1alpha1.BenchAppStateSkipped, "Git is disabled for this bench") + "\n\n")
 				continue
 			}
 			if app.GitURL == "" {
-				script.WriteString(fmt.Sprintf("echo 'Warning: Git app %s missing gitUrl, skipping'\n\n", app.Name))
+				script.WriteString(report(vyogotechv1alpha1.BenchAppStateFailed, "gitUrl is required for git apps") + "\n\n")
 				continue
 			}
-			script.WriteString(fmt.Sprintf("echo 'Installing Git app: %s from %s'\n", app.Name, app.GitURL))
-			script.WriteString(fmt.Sprintf("bench get-app %s", app.GitURL))
+			getApp := fmt.Sprintf("bench get-app --overwrite %s", shellQuote(app.GitURL))
 			if app.GitBranch != "" {
-				script.WriteString(fmt.Sprintf(" --branch %s", app.GitBranch))
+				getApp += fmt.Sprintf(" --branch %s", shellQuote(app.GitBranch))
 			}
-			script.WriteString(" || {\n")
-			script.WriteString(fmt.Sprintf("  echo 'Error: Failed to install Git app %s'\n", app.Name))
-			script.WriteString("  exit 1\n")
-			script.WriteString("}\n\n")
+			installed := report(vyogotechv1alpha1.BenchAppStateInstalled, "")
+			if pin.GitCommit != "" {
+				// Check out the locked commit instead of the branch head
+				installed = fmt.Sprintf("if %s; then\n", gitCheckoutCommand(app.Name, pin.GitCommit)) +
+					"    " + installed + "\n" +
+					"  else\n" +
+					"    " + report(vyogotechv1alpha1.BenchAppStateFailed, fmt.Sprintf("locked commit %s is not available", pin.GitCommit)) + "\n" +
+					"  fi"
+			}
+			script.WriteString(fmt.Sprintf("if %s; then\n", getApp))
+			script.WriteString("  " + installed + "\n")
+			script.WriteString("else\n")
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateFailed, "bench get-app failed, see the init Job logs") + "\n")
+			script.WriteString("fi\n\n")
 
 		case "image":
-			script.WriteString(fmt.Sprintf("echo 'App %s expected to be pre-installed in container image'\n", app.Name))
-			script.WriteString(fmt.Sprintf("if [ ! -d \"apps/%s\" ]; then\n", app.Name))
-			script.WriteString(fmt.Sprintf("  echo 'Warning: App %s not found in image'\n", app.Name))
+			script.WriteString(fmt.Sprintf("if [ -d apps/%s ]; then\n", name))
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateInstalled, "") + "\n")
+			script.WriteString("else\n")
+			script.WriteString("  " + report(vyogotechv1alpha1.BenchAppStateFailed, "app not found in the bench image") + "\n")
 			script.WriteString("fi\n\n")
 
 		default:
-			script.WriteString(fmt.Sprintf("echo 'Warning: Unknown source type \"%s\" for app %s, skipping'\n\n", app.Source, app.Name))
+			script.WriteString(report(vyogotechv1alpha1.BenchAppStateFailed, fmt.Sprintf("unknown source %q", app.Source)) + "\n\n")
 		}
 	}
 
-	script.WriteString("echo 'Generating apps.txt...'\n")
-	script.WriteString("ls -1 apps/ | grep -v '__pycache__' > sites/apps.txt || echo 'frappe' > sites/apps.txt\n\n")
+	return script.String()
+}
 
-	script.WriteString("echo 'Building production assets...'\n")
-	script.WriteString("bench build --production || {\n")
-	script.WriteString("  echo 'Warning: Asset build failed, continuing anyway'\n")
-	script.WriteString("}\n\n")
+// gitCheckoutCommand checks out commit in apps/<name>. bench get-app clones the app
+// shallow with its remote named upstream, so the commit is fetched from there first.
+func gitCheckoutCommand(name, commit string) string {
+	app, sha := shellQuote(name), shellQuote(commit)
+	return fmt.Sprintf("git -C apps/%s fetch -q --depth 1 upstream %s && git -C apps/%s checkout -q %s", app, sha, app, sha)
+}
 
-	script.WriteString("echo 'App installation complete'\n")
+// appInstallReportPrologue defines report(), which records the result of each app, and
+// writes the results as JSON to the termination message when the script exits. For
+// installed apps it adds what apps/<name> declares: version, Git commit, required_apps
+// and the Frappe versions it supports. Details are dropped to stay within the 4KiB
+// termination message, and apps beyond it are left out with "truncated" set.
+const appInstallReportPrologue = `REPORT=/tmp/app-install-report
+: > "$REPORT"
+APPS_FAILED=0
+
+report() {
+  printf '%s\t%s\t%s\t%s\t%s\n' "$1" "$2" "$3" "$4" "$5" >> "$REPORT"
+  if [ "$4" = "Failed" ]; then
+    APPS_FAILED=1
+  fi
+}
 
-	return script.String()
+write_report() {
+  python3 - "$REPORT" "$BENCH_PATH/apps" <<'PY'
+import ast, json, os, re, subprocess, sys
+
+def inspect(apps_dir, name):
+    info = {}
+    path = os.path.join(apps_dir, name)
+    try:
+        with open(os.path.join(path, name, "__init__.py")) as f:
+            m = re.search(r"__version__\s*=\s*[\"']([^\"']+)", f.read())
+            if m:
+                info["installedVersion"] = m.group(1)
+    except OSError:
+        pass
+    if os.path.isdir(os.path.join(path, ".git")):
+        try:
+            info["gitCommit"] = subprocess.check_output(["git", "-C", path, "rev-parse", "HEAD"], text=True).strip()
+        except Exception:
+            pass
+    try:
+        with open(os.path.join(path, name, "hooks.py")) as f:
+            for node in ast.parse(f.read()).body:
+                if isinstance(node, ast.Assign) and any(getattr(t, "id", None) == "required_apps" for t in node.targets):
+                    info["requiredApps"] = [str(a) for a in ast.literal_eval(node.value)]
+    except Exception:
+        pass
+    try:
+        with open(os.path.join(path, "pyproject.toml")) as f:
+            section = re.search(r"^\[tool\.bench\.frappe-dependencies\]$(.*?)(?=^\[|\Z)", f.read(), re.M | re.S)
+        if section:
+            m = re.search(r"^\s*frappe\s*=\s*[\"']([^\"']+)", section.group(1), re.M)
+            if m:
+                info["frappe"] = m.group(1)
+    except OSError:
+        pass
+    return info
+
+apps = []
+with open(sys.argv[1]) as f:
+    for line in f:
+        name, source, version, state, message = line.rstrip("\n").split("\t", 4)
+        app = {"name": name, "source": source, "version": version, "state": state, "message": message}
+        if state == "Installed":
+            app.update(inspect(sys.argv[2], name))
+        apps.append(app)
+report = {"frappe": inspect(sys.argv[2], "frappe").get("installedVersion", ""), "apps": apps}
+
+# Termination messages are limited to 4KiB. Messages are capped per app, then the details
+# are dropped from every app, least needed first; apps that still do not fit are left out
+# and the report is marked truncated.
+for app in apps:
+    app["message"] = app["message"][:200]
+for keys in (("requiredApps", "frappe"), ("message",), ("installedVersion",), ("gitCommit",)):
+    if len(json.dumps(report)) <= 4000:
+        break
+    for app in apps:
+        for key in keys:
+            app.pop(key, None)
+while len(json.dumps(report)) > 4000:
+    report["truncated"] = True
+    apps.pop()
+with open(os.environ.get("TERMINATION_LOG", "/dev/termination-log"), "w") as f:
+    f.write(json.dumps(report))
+PY
+}
+trap write_report EXIT
+
+`
+
+// lockOrder returns apps in the install order of lock; apps the lock does not know
+// keep their spec order after the others
+func lockOrder(apps []vyogotechv1alpha1.AppSource, lock *vyogotechv1alpha1.BenchLock) []vyogotechv1alpha1.AppSource {
+	if lock == nil {
+		return apps
+	}
+	position := make(map[string]int, len(lock.Apps))
+	for i, locked := range lock.Apps {
+		position[locked.Name] = i
+	}
+	ordered := append([]vyogotechv1alpha1.AppSource(nil), apps...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		pi, ok := position[ordered[i].Name]
+		if !ok {
+			pi = len(lock.Apps)
+		}
+		pj, ok := position[ordered[j].Name]
+		if !ok {
+			pj = len(lock.Apps)
+		}
+		return pi < pj
+	})
+	return ordered
+}
+
+// shellQuote quotes s as a single bash word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
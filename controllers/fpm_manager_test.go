@@ -0,0 +1,131 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Git app install", func() {
+	var (
+		dir     string
+		gitURL  string
+		commits []string
+	)
+
+	// git runs git in dir and returns its trimmed output
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+
+		// A remote with two commits on main; the app is locked to the first one
+		work := filepath.Join(dir, "work")
+		Expect(os.MkdirAll(work, 0o755)).To(Succeed())
+		git(work, "init", "-q", "-b", "main")
+		commits = nil
+		for _, content := range []string{"1", "2"} {
+			Expect(os.WriteFile(filepath.Join(work, "VERSION"), []byte(content), 0o644)).To(Succeed())
+			git(work, "add", "VERSION")
+			git(work, "commit", "-q", "-m", "version "+content)
+			commits = append(commits, git(work, "rev-parse", "HEAD"))
+		}
+		git(dir, "clone", "-q", "--bare", work, filepath.Join(dir, "myapp.git"))
+		gitURL = "file://" + filepath.Join(dir, "myapp.git")
+
+		Expect(os.MkdirAll(filepath.Join(dir, "bench", "apps"), 0o755)).To(Succeed())
+	})
+
+	// bench get-app replaced by the shallow clone it makes
+	const benchStub = `bench() { git clone -q --depth 1 --origin upstream --branch "$5" "$3" apps/myapp; }` + "\n"
+
+	// lockedApp returns the app and a lock pinning it to commit
+	lockedApp := func(commit string) (vyogotechv1alpha1.AppSource, *vyogotechv1alpha1.BenchLock) {
+		app := vyogotechv1alpha1.AppSource{Name: "myapp", Source: "git", GitURL: gitURL, GitBranch: "main"}
+		return app, &vyogotechv1alpha1.BenchLock{Apps: []vyogotechv1alpha1.LockedApp{
+			{Name: app.Name, Source: app.Source, GitURL: app.GitURL, GitBranch: app.GitBranch, GitCommit: commit},
+		}}
+	}
+
+	// install runs the install script for the app locked to commit and returns the reported app
+	install := func(commit string) benchInitAppReport {
+		app, lock := lockedApp(commit)
+		benchDir := filepath.Join(dir, "bench")
+		script := appInstallReportPrologue + benchStub +
+			NewFPMManager().GenerateAppInstallScript([]vyogotechv1alpha1.AppSource{app}, lock, true, benchDir)
+
+		log := filepath.Join(dir, "termination-log")
+		cmd := exec.Command("bash")
+		cmd.Stdin = strings.NewReader(script)
+		cmd.Env = append(os.Environ(), "BENCH_PATH="+benchDir, "TERMINATION_LOG="+log)
+		out, err := cmd.CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+
+		message, err := os.ReadFile(log)
+		Expect(err).NotTo(HaveOccurred())
+		report := &benchInitReport{}
+		Expect(json.Unmarshal(message, report)).To(Succeed())
+		Expect(report.Apps).To(HaveLen(1))
+		return report.Apps[0]
+	}
+
+	It("checks out the locked commit behind the branch head", func() {
+		app := install(commits[0])
+		Expect(app.State).To(Equal(vyogotechv1alpha1.BenchAppStateInstalled), app.Message)
+		Expect(app.GitCommit).To(Equal(commits[0]))
+	})
+
+	It("checks out the locked commit in the bench image", func() {
+		app, lock := lockedApp(commits[0])
+		dockerfile := renderBenchDockerfile("frappe:test", nil, []vyogotechv1alpha1.AppSource{app}, lock, benchInstallConfig{}, "")
+		start := "# Git app: \"myapp\"\nRUN <<\"SCRIPT\"\n"
+		Expect(dockerfile).To(ContainSubstring(start))
+		script := dockerfile[strings.Index(dockerfile, start)+len(start):]
+		script = script[:strings.Index(script, "SCRIPT\n")]
+
+		benchDir := filepath.Join(dir, "bench")
+		cmd := exec.Command("bash")
+		cmd.Stdin = strings.NewReader(benchStub + script)
+		cmd.Dir = benchDir
+		out, err := cmd.CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+		Expect(git(filepath.Join(benchDir, "apps", "myapp"), "rev-parse", "HEAD")).To(Equal(commits[0]))
+	})
+
+	It("fails the app when the locked commit does not exist", func() {
+		app := install(strings.Repeat("0", 40))
+		Expect(app.State).To(Equal(vyogotechv1alpha1.BenchAppStateFailed))
+		Expect(app.Message).To(ContainSubstring("is not available"))
+	})
+})
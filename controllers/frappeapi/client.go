@@ -0,0 +1,284 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package frappeapi is a minimal client for the Frappe REST API
+// (https://frappeframework.com/docs/user/en/api/rest) used by the site-level controllers.
+package frappeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the requested document does not exist
+var ErrNotFound = errors.New("document not found")
+
+// IsNotFound reports whether err means the document does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// Error is a non-2xx response from the site
+type Error struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("frappe API returned %d %s: %s", e.StatusCode, e.Type, e.Message)
+	}
+	return fmt.Sprintf("frappe API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to one site of a bench
+// Requests are sent to baseURL with the Host header set to the site name, so the
+// bench's nginx or gunicorn routes them to the right site.
+type Client struct {
+	baseURL  string
+	siteName string
+	http     *http.Client
+	token    string
+}
+
+// NewClient returns a client for siteName reachable at baseURL (e.g. http://bench-nginx.ns.svc:8080)
+func NewClient(baseURL, siteName string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return &Client{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		siteName: siteName,
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Login starts a session for user; the session cookie is kept for later requests
+func (c *Client) Login(ctx context.Context, user, password string) error {
+	form := url.Values{"usr": {user}, "pwd": {password}}
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/method/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, nil)
+}
+
+// UseToken authenticates requests with an API key and secret instead of a session
+func (c *Client) UseToken(apiKey, apiSecret string) {
+	c.token = fmt.Sprintf("token %s:%s", apiKey, apiSecret)
+}
+
+// GetDoc fetches a document into out
+func (c *Client) GetDoc(ctx context.Context, doctype, name string, out interface{}) error {
+	req, err := c.newRequest(ctx, http.MethodGet, resourcePath(doctype, name), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+// GetList fetches the given fields of the documents matching filters into out
+// filters uses the Frappe list form: [][]interface{}{{"fieldname", "=", "value"}}.
+func (c *Client) GetList(ctx context.Context, doctype string, fields []string, filters [][]interface{}, out interface{}) error {
+	query := url.Values{"limit_page_length": {"0"}}
+	if len(fields) > 0 {
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		query.Set("fields", string(encoded))
+	}
+	if len(filters) > 0 {
+		encoded, err := json.Marshal(filters)
+		if err != nil {
+			return err
+		}
+		query.Set("filters", string(encoded))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, resourcePath(doctype, "")+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+// InsertDoc creates a document and decodes the created document into out (may be nil)
+func (c *Client) InsertDoc(ctx context.Context, doctype string, doc map[string]interface{}, out interface{}) error {
+	return c.sendJSON(ctx, http.MethodPost, resourcePath(doctype, ""), doc, out)
+}
+
+// UpdateDoc sets fields on a document and decodes the saved document into out (may be nil)
+func (c *Client) UpdateDoc(ctx context.Context, doctype, name string, fields map[string]interface{}, out interface{}) error {
+	return c.sendJSON(ctx, http.MethodPut, resourcePath(doctype, name), fields, out)
+}
+
+// DeleteDoc deletes a document; a missing document is not an error
+func (c *Client) DeleteDoc(ctx context.Context, doctype, name string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, resourcePath(doctype, name), nil)
+	if err != nil {
+		return err
+	}
+	if err := c.do(req, nil); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Call posts args to a whitelisted method and decodes its "message" into out (may be nil)
+func (c *Client) Call(ctx context.Context, method string, args map[string]interface{}, out interface{}) error {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	return c.sendJSON(ctx, http.MethodPost, "/api/method/"+method, args, out)
+}
+
+func (c *Client) sendJSON(ctx context.Context, method, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, method, path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = c.siteName
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+	return req, nil
+}
+
+// do sends the request and decodes "data" (resources) or "message" (methods) into out
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, ErrNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseError(resp.StatusCode, body)
+	}
+
+	if out == nil {
+		return nil
+	}
+	envelope := struct {
+		Data    json.RawMessage `json:"data"`
+		Message json.RawMessage `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", req.URL.Path, err)
+	}
+	payload := envelope.Data
+	if len(payload) == 0 {
+		payload = envelope.Message
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(payload, out)
+}
+
+// parseError extracts the exception type and message Frappe puts in error responses
+func parseError(statusCode int, body []byte) error {
+	apiErr := &Error{StatusCode: statusCode}
+	parsed := struct {
+		ExcType        string `json:"exc_type"`
+		Exception      string `json:"exception"`
+		Message        string `json:"message"`
+		ServerMessages string `json:"_server_messages"`
+	}{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		apiErr.Message = truncate(string(body), 200)
+		return apiErr
+	}
+
+	apiErr.Type = parsed.ExcType
+	switch {
+	case parsed.Exception != "":
+		apiErr.Message = parsed.Exception
+	case parsed.Message != "":
+		apiErr.Message = parsed.Message
+	case parsed.ServerMessages != "":
+		apiErr.Message = serverMessage(parsed.ServerMessages)
+	default:
+		apiErr.Message = http.StatusText(statusCode)
+	}
+	apiErr.Message = truncate(apiErr.Message, 500)
+	return apiErr
+}
+
+// serverMessage returns the first message of a _server_messages payload, a JSON list of JSON objects
+func serverMessage(raw string) string {
+	var messages []string
+	if err := json.Unmarshal([]byte(raw), &messages); err != nil || len(messages) == 0 {
+		return raw
+	}
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal([]byte(messages[0]), &msg); err != nil || msg.Message == "" {
+		return messages[0]
+	}
+	return msg.Message
+}
+
+func resourcePath(doctype, name string) string {
+	p := "/api/resource/" + url.PathEscape(doctype)
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package frappeapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// ChangedFields returns the fields of desired whose value differs in current, a document
+// fetched with GetDoc into a map. Child tables are compared row by row on the fields set
+// in the desired rows only, so the fields Frappe adds (name, idx, owner, ...) are ignored.
+// Null, empty strings and zero are treated as equal.
+func ChangedFields(desired, current map[string]interface{}) ([]string, error) {
+	normalized, err := toJSONMap(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for field, want := range normalized {
+		if !valuesEqual(want, current[field]) {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// toJSONMap round-trips v through JSON so its values have the types of a decoded document
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func valuesEqual(want, have interface{}) bool {
+	switch w := want.(type) {
+	case []interface{}:
+		h, _ := have.([]interface{})
+		if len(w) != len(h) {
+			return false
+		}
+		for i := range w {
+			if !valuesEqual(w[i], h[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		h, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !valuesEqual(v, h[k]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if isEmpty(want) && isEmpty(have) {
+		return true
+	}
+	return reflect.DeepEqual(want, have)
+}
+
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	}
+	return false
+}
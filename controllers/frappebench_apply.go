@@ -0,0 +1,250 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+// The apply helpers below create bench-owned objects or patch them back to the
+// desired state, so spec changes propagate and out-of-band edits are reverted.
+// Pod templates and Service ports are owned as a whole: removed entries are
+// dropped and entries added on the cluster are reverted. Only the defaults the
+// API server fills in and the labels and annotations of the object itself are
+// left alone, so an unchanged bench sends no patch at all.
+
+// restartedAtAnnotation is set on pod templates by kubectl rollout restart
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// applyDeployment creates or patches a Deployment to match desired
+// When preserveReplicas is set, replicas are only set on creation (e.g. KEDA-managed workers)
+func (r *FrappeBenchReconciler) applyDeployment(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, desired *appsv1.Deployment, preserveReplicas bool) error {
+	logger := log.FromContext(ctx)
+
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		},
+	}
+
+	op, err := controllerutil.CreateOrPatch(ctx, r.Client, deploy, func() error {
+		deploy.Labels = mergeStringMaps(deploy.Labels, desired.Labels)
+		deploy.Annotations = mergeStringMaps(deploy.Annotations, desired.Annotations)
+		if deploy.CreationTimestamp.IsZero() || !preserveReplicas {
+			deploy.Spec.Replicas = desired.Spec.Replicas
+		}
+		deploy.Spec.Selector = desired.Spec.Selector
+		deploy.Spec.Template = mergePodTemplate(deploy.Spec.Template, desired.Spec.Template)
+		return controllerutil.SetControllerReference(bench, deploy, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+
+	if op != controllerutil.OperationResultNone {
+		logger.Info("Reconciled Deployment", "deployment", deploy.Name, "operation", op)
+	}
+	return nil
+}
+
+// applyStatefulSet creates or patches a StatefulSet to match desired
+func (r *FrappeBenchReconciler) applyStatefulSet(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, desired *appsv1.StatefulSet) error {
+	logger := log.FromContext(ctx)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		},
+	}
+
+	op, err := controllerutil.CreateOrPatch(ctx, r.Client, sts, func() error {
+		sts.Labels = mergeStringMaps(sts.Labels, desired.Labels)
+		sts.Annotations = mergeStringMaps(sts.Annotations, desired.Annotations)
+		sts.Spec.Replicas = desired.Spec.Replicas
+		// ServiceName and Selector are immutable, only set them on creation
+		if sts.CreationTimestamp.IsZero() {
+			sts.Spec.ServiceName = desired.Spec.ServiceName
+			sts.Spec.Selector = desired.Spec.Selector
+			sts.Spec.VolumeClaimTemplates = desired.Spec.VolumeClaimTemplates
+		}
+		sts.Spec.Template = mergePodTemplate(sts.Spec.Template, desired.Spec.Template)
+		return controllerutil.SetControllerReference(bench, sts, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+
+	if op != controllerutil.OperationResultNone {
+		logger.Info("Reconciled StatefulSet", "statefulset", sts.Name, "operation", op)
+	}
+	return nil
+}
+
+// applyService creates or patches a Service to match desired
+// ClusterIP and other allocated fields are kept as assigned by the API server
+func (r *FrappeBenchReconciler) applyService(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, desired *corev1.Service) error {
+	logger := log.FromContext(ctx)
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		},
+	}
+
+	op, err := controllerutil.CreateOrPatch(ctx, r.Client, svc, func() error {
+		svc.Labels = mergeStringMaps(svc.Labels, desired.Labels)
+		svc.Annotations = mergeStringMaps(svc.Annotations, desired.Annotations)
+		if desired.Spec.Type != "" {
+			svc.Spec.Type = desired.Spec.Type
+		}
+		svc.Spec.Selector = desired.Spec.Selector
+		if ports := defaultServicePorts(desired.Spec.Ports, svc.Spec.Ports, svc.Spec.Type); !equality.Semantic.DeepEqual(ports, svc.Spec.Ports) {
+			svc.Spec.Ports = ports
+		}
+		return controllerutil.SetControllerReference(bench, svc, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+
+	if op != controllerutil.OperationResultNone {
+		logger.Info("Reconciled Service", "service", svc.Name, "operation", op)
+	}
+	return nil
+}
+
+// applyLabels patches the object's labels if any of the given labels drifted
+func (r *FrappeBenchReconciler) applyLabels(ctx context.Context, obj client.Object, labels map[string]string) error {
+	drifted := false
+	current := obj.GetLabels()
+	for k, v := range labels {
+		if current[k] != v {
+			drifted = true
+			break
+		}
+	}
+	if !drifted {
+		return nil
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	obj.SetLabels(mergeStringMaps(current, labels))
+	return r.Patch(ctx, obj, patch)
+}
+
+// mergePodTemplate returns desired, keeping the rollout restart annotation of
+// kubectl so it doesn't trigger another rollout.
+// current is returned as is when it is in sync with desired, so the defaults
+// the API server filled in (terminationMessagePath, imagePullPolicy, dnsPolicy,
+// probe timeouts, ...) don't show up as a diff.
+func mergePodTemplate(current, desired corev1.PodTemplateSpec) corev1.PodTemplateSpec {
+	result := *desired.DeepCopy()
+	if restartedAt, ok := current.Annotations[restartedAtAnnotation]; ok {
+		result.Annotations = mergeStringMaps(result.Annotations, map[string]string{restartedAtAnnotation: restartedAt})
+	}
+	if podTemplateInSync(current, result) {
+		return current
+	}
+	return result
+}
+
+// podTemplateInSync reports whether current matches desired on every field the
+// operator owns. Fields the API server never defaults must be equal; lists whose
+// entries get defaults must have the same length and match on what desired sets.
+func podTemplateInSync(current, desired corev1.PodTemplateSpec) bool {
+	semantic := equality.Semantic
+	if !semantic.DeepEqual(current.Labels, desired.Labels) ||
+		!semantic.DeepEqual(current.Annotations, desired.Annotations) ||
+		!semantic.DeepEqual(current.Spec.NodeSelector, desired.Spec.NodeSelector) ||
+		!semantic.DeepEqual(current.Spec.Tolerations, desired.Spec.Tolerations) ||
+		!semantic.DeepEqual(current.Spec.Affinity, desired.Spec.Affinity) ||
+		!semantic.DeepEqual(current.Spec.ImagePullSecrets, desired.Spec.ImagePullSecrets) ||
+		len(current.Spec.Volumes) != len(desired.Spec.Volumes) ||
+		len(current.Spec.InitContainers) != len(desired.Spec.InitContainers) ||
+		len(current.Spec.Containers) != len(desired.Spec.Containers) {
+		return false
+	}
+
+	containers := append(append([]corev1.Container{}, current.Spec.InitContainers...), current.Spec.Containers...)
+	wanted := append(append([]corev1.Container{}, desired.Spec.InitContainers...), desired.Spec.Containers...)
+	for i := range wanted {
+		c, d := containers[i], wanted[i]
+		if c.Name != d.Name ||
+			!semantic.DeepEqual(c.Command, d.Command) ||
+			!semantic.DeepEqual(c.Args, d.Args) ||
+			!semantic.DeepEqual(c.Env, d.Env) ||
+			!semantic.DeepEqual(c.EnvFrom, d.EnvFrom) ||
+			!semantic.DeepEqual(c.Resources, d.Resources) ||
+			!semantic.DeepEqual(c.VolumeMounts, d.VolumeMounts) ||
+			len(c.Ports) != len(d.Ports) {
+			return false
+		}
+	}
+
+	return semantic.DeepDerivative(desired, current)
+}
+
+// defaultServicePorts returns desired with the fields the API server defaults or
+// allocates (protocol, targetPort, nodePort) taken over from current
+func defaultServicePorts(desired, current []corev1.ServicePort, serviceType corev1.ServiceType) []corev1.ServicePort {
+	allocatesNodePorts := serviceType == corev1.ServiceTypeNodePort || serviceType == corev1.ServiceTypeLoadBalancer
+	ports := make([]corev1.ServicePort, len(desired))
+	for i, port := range desired {
+		if port.Protocol == "" {
+			port.Protocol = corev1.ProtocolTCP
+		}
+		if port.TargetPort.IntVal == 0 && port.TargetPort.StrVal == "" {
+			port.TargetPort = intstr.FromInt32(port.Port)
+		}
+		for _, assigned := range current {
+			if allocatesNodePorts && port.NodePort == 0 && assigned.Name == port.Name && assigned.Port == port.Port {
+				port.NodePort = assigned.NodePort
+			}
+		}
+		ports[i] = port
+	}
+	return ports
+}
+
+// mergeStringMaps returns a copy of base with overrides applied on top
+func mergeStringMaps(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return base
+	}
+	result := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range overrides {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Bench component apply", func() {
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		r     *FrappeBenchReconciler
+	)
+
+	// ensureComponents runs every apply path of the bench components once
+	ensureComponents := func() {
+		Expect(r.ensureRedis(ctx, bench)).To(Succeed())
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		Expect(r.ensureNginx(ctx, bench)).To(Succeed())
+		Expect(r.ensureSocketIO(ctx, bench)).To(Succeed())
+		Expect(r.ensureScheduler(ctx, bench)).To(Succeed())
+		Expect(r.ensureWorkers(ctx, bench)).To(Succeed())
+	}
+
+	// resourceVersions returns the resourceVersion of every bench-owned workload and Service
+	resourceVersions := func() map[string]string {
+		versions := map[string]string{}
+		deployments := &appsv1.DeploymentList{}
+		Expect(k8sClient.List(ctx, deployments, client.InNamespace(ns))).To(Succeed())
+		for _, d := range deployments.Items {
+			versions["deployment/"+d.Name] = d.ResourceVersion
+		}
+		statefulSets := &appsv1.StatefulSetList{}
+		Expect(k8sClient.List(ctx, statefulSets, client.InNamespace(ns))).To(Succeed())
+		for _, s := range statefulSets.Items {
+			versions["statefulset/"+s.Name] = s.ResourceVersion
+		}
+		services := &corev1.ServiceList{}
+		Expect(k8sClient.List(ctx, services, client.InNamespace(ns))).To(Succeed())
+		for _, s := range services.Items {
+			versions["service/"+s.Name] = s.ResourceVersion
+		}
+		return versions
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "apply-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+		r = &FrappeBenchReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("does not patch components again when nothing changed", func() {
+		ensureComponents()
+		before := resourceVersions()
+		Expect(before).To(HaveKey("deployment/bench-gunicorn"))
+		Expect(before).To(HaveKey("service/bench-gunicorn"))
+
+		// Count the writes of the second pass, the API server hides no-op patches
+		watchClient, err := client.NewWithWatch(cfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).NotTo(HaveOccurred())
+		var writes []string
+		r.Client = interceptor.NewClient(watchClient, interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				writes = append(writes, obj.GetName())
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				writes = append(writes, obj.GetName())
+				return c.Update(ctx, obj, opts...)
+			},
+		})
+
+		ensureComponents()
+		Expect(writes).To(BeEmpty())
+		Expect(resourceVersions()).To(Equal(before))
+	})
+
+	It("keeps annotations of others and reverts drift of managed fields", func() {
+		ensureComponents()
+
+		deploy := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		image := deploy.Spec.Template.Spec.Containers[0].Image
+		patch := client.MergeFrom(deploy.DeepCopy())
+		deploy.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "now"}
+		deploy.Spec.Template.Spec.Containers[0].Image = "example.com/other:latest"
+		Expect(k8sClient.Patch(ctx, deploy, patch)).To(Succeed())
+
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal(image))
+		Expect(deploy.Spec.Template.Annotations).To(HaveKeyWithValue("kubectl.kubernetes.io/restartedAt", "now"))
+	})
+
+	It("drops fields removed from the desired state", func() {
+		bench.Spec.ComponentResources = &vyogotechv1alpha1.ComponentResources{
+			Gunicorn: &vyogotechv1alpha1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")},
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			},
+		}
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+
+		deploy := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Resources.Limits).To(HaveKey(corev1.ResourceCPU))
+
+		bench.Spec.ComponentResources.Gunicorn.Limits = nil
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Resources.Limits).To(BeEmpty())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Resources.Requests).To(HaveKey(corev1.ResourceCPU))
+	})
+
+	It("reverts labels, node selectors, tolerations, env and ports added on the cluster", func() {
+		ensureComponents()
+
+		deploy := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		want := deploy.Spec.Template.DeepCopy()
+		patch := client.MergeFrom(deploy.DeepCopy())
+		deploy.Spec.Template.Labels["team"] = "ops"
+		deploy.Spec.Template.Annotations = map[string]string{"example.com/owner": "ops"}
+		deploy.Spec.Template.Spec.NodeSelector = map[string]string{"disktype": "ssd"}
+		deploy.Spec.Template.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}
+		deploy.Spec.Template.Spec.Containers[0].Env = append(deploy.Spec.Template.Spec.Containers[0].Env,
+			corev1.EnvVar{Name: "DEBUG", Value: "1"})
+		Expect(k8sClient.Patch(ctx, deploy, patch)).To(Succeed())
+
+		svc := &corev1.Service{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, svc)).To(Succeed())
+		wantPorts := svc.Spec.Ports
+		svcPatch := client.MergeFrom(svc.DeepCopy())
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Name: "debug", Port: 5678})
+		Expect(k8sClient.Patch(ctx, svc, svcPatch)).To(Succeed())
+
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(deploy.Spec.Template.Labels).To(Equal(want.Labels))
+		Expect(deploy.Spec.Template.Annotations).To(BeEmpty())
+		Expect(deploy.Spec.Template.Spec.NodeSelector).To(BeEmpty())
+		Expect(deploy.Spec.Template.Spec.Tolerations).To(BeEmpty())
+		Expect(deploy.Spec.Template.Spec.Containers[0].Env).To(Equal(want.Spec.Containers[0].Env))
+
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, svc)).To(Succeed())
+		Expect(svc.Spec.Ports).To(Equal(wantPorts))
+	})
+})
@@ -0,0 +1,484 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	// benchPath is where the Frappe images keep the bench
+	benchPath = "/home/frappe/frappe-bench"
+
+	// benchInitHashAnnotation records the apps, repositories and image an init Job was built from
+	benchInitHashAnnotation = "vyogo.tech/init-hash"
+
+	// benchConditionAppsReady reports whether every app in spec.apps is installed on the bench
+	benchConditionAppsReady = "AppsReady"
+
+	// benchConditionFPMAuthReady reports whether the credentials of every authenticated FPM repository are available
+	benchConditionFPMAuthReady = "FPMAuthReady"
+
+	// fpmAuthDir is where init Jobs mount the credentials Secrets of FPM repositories
+	fpmAuthDir = "/etc/fpm-auth"
+)
+
+// benchInstallConfig is what the bench installs its apps with
+type benchInstallConfig struct {
+	// GitEnabled allows apps with source git
+	GitEnabled bool
+
+	// FPMRepos are the operator and bench FPM repositories, in search order
+	FPMRepos []vyogotechv1alpha1.FPMRepository
+
+	// OperatorFPMRepos is the number of FPMRepos, first in the list, from the operator config
+	OperatorFPMRepos int
+
+	// FPMAuthSecrets maps the index of a repository in FPMRepos to the Secret in the
+	// bench namespace holding its credentials
+	FPMAuthSecrets map[int]string
+}
+
+// fpmAuthVolumes mounts the credentials Secret of each authenticated FPM repository
+// read-only at <fpmAuthDir>/<index>
+func fpmAuthVolumes(install benchInstallConfig) ([]corev1.Volume, []corev1.VolumeMount, map[int]string) {
+	indexes := make([]int, 0, len(install.FPMAuthSecrets))
+	for i := range install.FPMAuthSecrets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	dirs := map[int]string{}
+	for _, i := range indexes {
+		name := fmt.Sprintf("fpm-auth-%d", i)
+		dirs[i] = fmt.Sprintf("%s/%d", fpmAuthDir, i)
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: install.FPMAuthSecrets[i]},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: dirs[i], ReadOnly: true})
+	}
+	return volumes, mounts, dirs
+}
+
+// benchInitReport is the termination message written by the bench init Job
+type benchInitReport struct {
+	// Frappe is the framework version found on the bench
+	Frappe string               `json:"frappe,omitempty"`
+	Apps   []benchInitAppReport `json:"apps"`
+	// Truncated is set when apps were left out to fit the termination message
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// benchInitAppReport is the result for one app, with what the Job found in apps/<name>
+type benchInitAppReport struct {
+	vyogotechv1alpha1.BenchAppStatus
+	InstalledVersion string   `json:"installedVersion,omitempty"`
+	GitCommit        string   `json:"gitCommit,omitempty"`
+	RequiredApps     []string `json:"requiredApps,omitempty"`
+	Frappe           string   `json:"frappe,omitempty"`
+}
+
+// benchInstallsApps reports whether the bench installs apps at runtime (from fpm or git)
+// rather than only using the apps baked into its image
+func benchInstallsApps(bench *vyogotechv1alpha1.FrappeBench) bool {
+	// Built images already contain the apps
+	if bench.Spec.ImageBuild != nil {
+		return false
+	}
+	for _, app := range bench.Spec.Apps {
+		if app.Source == "fpm" || app.Source == "git" {
+			return true
+		}
+	}
+	return false
+}
+
+// benchAppsTree is the directory on the sites PVC holding the assets, apps and Python env
+// of the bench for an image. Each image gets its own tree so an upgrade never mixes the
+// apps installed or assets built for the old image with the new one.
+func benchAppsTree(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return ".bench/" + hex.EncodeToString(sum[:])[:12]
+}
+
+// benchVolumeMounts returns the mounts of a bench container running image: the sites PVC
+// and, once the tree of that image has been built, sites/assets from that tree so a build
+// for a new image never replaces the assets the running pods serve and, when the bench
+// installs apps at runtime, the apps and env tree for that image. Until then sites/assets
+// stays the directory of the sites PVC, which benches built before per-image trees serve.
+func benchVolumeMounts(bench *vyogotechv1alpha1.FrappeBench, image string) []corev1.VolumeMount {
+	if !containsString(bench.Status.AssetsTrees, benchAppsTree(image)) {
+		return []corev1.VolumeMount{
+			{
+				Name:      "sites",
+				MountPath: benchPath + "/sites",
+			},
+		}
+	}
+	return benchBuildVolumeMounts(bench, image)
+}
+
+// benchBuildVolumeMounts returns the mounts of a Job that builds the tree of image; the
+// Job must run benchTreeContainer first so the kubelet does not create the tree as root
+func benchBuildVolumeMounts(bench *vyogotechv1alpha1.FrappeBench, image string) []corev1.VolumeMount {
+	tree := benchAppsTree(image)
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "sites",
+			MountPath: benchPath + "/sites",
+		},
+		{
+			Name:      "sites",
+			MountPath: benchPath + "/sites/assets",
+			SubPath:   tree + "/assets",
+		},
+	}
+	if !benchInstallsApps(bench) {
+		return mounts
+	}
+
+	return append(mounts,
+		corev1.VolumeMount{Name: "sites", MountPath: benchPath + "/apps", SubPath: tree + "/apps"},
+		corev1.VolumeMount{Name: "sites", MountPath: benchPath + "/env", SubPath: tree + "/env"},
+	)
+}
+
+// benchTreeContainer creates the tree of image on the sites PVC as the frappe user and,
+// when the bench installs apps at runtime, copies the apps and env of the image into it
+// the first time the image is used, so runtime installs start from what the image ships
+func benchTreeContainer(bench *vyogotechv1alpha1.FrappeBench, image string) corev1.Container {
+	script := `#!/bin/bash
+set -e
+
+TREE="` + benchPath + `/sites/$APPS_TREE"
+mkdir -p "$TREE/assets"
+if [ "$SEED_APPS" != "true" ]; then
+  exit 0
+fi
+if [ -f "$TREE/.seeded" ]; then
+  echo "Apps tree $APPS_TREE already seeded"
+  exit 0
+fi
+
+echo "Seeding apps tree $APPS_TREE from the image..."
+mkdir -p "$TREE/apps" "$TREE/env"
+cp -a ` + benchPath + `/apps/. "$TREE/apps/"
+cp -a ` + benchPath + `/env/. "$TREE/env/"
+touch "$TREE/.seeded"
+`
+
+	uid := int64(1000)
+	return corev1.Container{
+		Name:    "prepare-tree",
+		Image:   image,
+		Command: []string{"bash", "-c"},
+		Args:    []string{script},
+		Env: []corev1.EnvVar{
+			{Name: "APPS_TREE", Value: benchAppsTree(image)},
+			{Name: "SEED_APPS", Value: fmt.Sprintf("%t", benchInstallsApps(bench))},
+		},
+		SecurityContext: &corev1.SecurityContext{RunAsUser: &uid},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "sites",
+				MountPath: benchPath + "/sites",
+			},
+		},
+	}
+}
+
+// markBenchAssetsTree records that the tree of image has been built. Trees of images the
+// bench neither runs nor upgrades from or to are forgotten.
+func markBenchAssetsTree(bench *vyogotechv1alpha1.FrappeBench, image string) {
+	keep := map[string]bool{benchAppsTree(bench.Status.CurrentImage): true}
+	if upgrade := bench.Status.Upgrade; upgrade != nil && !isBenchUpgradeFinished(upgrade) {
+		keep[benchAppsTree(upgrade.FromImage)] = true
+		keep[benchAppsTree(upgrade.ToImage)] = true
+	}
+
+	tree := benchAppsTree(image)
+	trees := []string{tree}
+	for _, built := range bench.Status.AssetsTrees {
+		if keep[built] && built != tree {
+			trees = append(trees, built)
+		}
+	}
+	bench.Status.AssetsTrees = trees
+}
+
+// benchInitScript builds the init Job script: configure FPM, install spec.apps as pinned
+// by lock (may be nil), write apps.txt and common_site_config.json, then build assets
+func (r *FrappeBenchReconciler) benchInitScript(bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig, lock *vyogotechv1alpha1.BenchLock) string {
+	apps := r.benchApps(bench)
+
+	manager := NewFPMManager()
+	var script strings.Builder
+
+	script.WriteString("#!/bin/bash\nset -e\n\n")
+	script.WriteString(fmt.Sprintf("BENCH_PATH=%s\ncd \"$BENCH_PATH\"\n\n", benchPath))
+	script.WriteString("echo \"Configuring Frappe bench...\"\n\n")
+	script.WriteString(appInstallReportPrologue)
+
+	if benchUsesFPM(apps) && len(install.FPMRepos) > 0 {
+		defaultRepo := ""
+		if bench.Spec.FPMConfig != nil {
+			defaultRepo = bench.Spec.FPMConfig.DefaultRepo
+		}
+		_, _, authDirs := fpmAuthVolumes(install)
+		script.WriteString(manager.GenerateFPMConfigScript(install.FPMRepos, defaultRepo, authDirs))
+	}
+	script.WriteString(manager.GenerateAppInstallScript(apps, lock, install.GitEnabled, benchPath))
+
+	script.WriteString(fmt.Sprintf(`# Create apps.txt from the installed apps
+ls -1 apps > sites/apps.txt
+
+# Create or update common_site_config.json
+cat > sites/common_site_config.json <<EOF
+{
+  "redis_cache": "redis://%s-redis-cache:6379",
+  "redis_queue": "redis://%s-redis-queue:6379",
+  "socketio_port": 9000
+}
+EOF
+
+echo "Building assets for production..."
+bench build --production
+
+if [ "$APPS_FAILED" = 1 ]; then
+  echo "Some apps failed to install"
+  exit 1
+fi
+
+echo "Bench configuration complete"
+`, bench.Name, bench.Name))
+
+	return script.String()
+}
+
+func benchUsesFPM(apps []vyogotechv1alpha1.AppSource) bool {
+	for _, app := range apps {
+		if app.Source == "fpm" {
+			return true
+		}
+	}
+	return false
+}
+
+// benchInitHash fingerprints everything the init Job is built from, so a change to the
+// apps, repositories, Git setting, running image or the path it builds assets into re-runs it
+func benchInitHash(image, script string) string {
+	sum := sha256.Sum256([]byte(image + "\n" + benchAppsTree(image) + "/assets\n" + script))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// readBenchInitReport reads the per-app results the init container left in its termination message
+func (r *FrappeBenchReconciler) readBenchInitReport(ctx context.Context, job *batchv1.Job) (*benchInitReport, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, err
+	}
+
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "bench-init" || status.State.Terminated == nil || status.State.Terminated.Message == "" {
+				continue
+			}
+			report := &benchInitReport{}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), report); err != nil {
+				return nil, fmt.Errorf("invalid report in the termination message of pod %s: %w", pod.Name, err)
+			}
+			return report, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no terminated pod found for job %s", job.Name)
+}
+
+// updateBenchApps records the outcome of the init Job in the bench status
+// While the Job runs the previous results are kept, since those apps are still installed.
+func (r *FrappeBenchReconciler) updateBenchApps(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
+	// Apps that cannot be resolved keep the condition ensureBenchInitialized set
+	if cond := meta.FindStatusCondition(bench.Status.Conditions, benchConditionAppsReady); cond != nil &&
+		(cond.Reason == benchReasonAppsUnavailable || cond.Reason == benchReasonDependencyConflict) {
+		return nil
+	}
+
+	job, err := r.currentInitJob(ctx, bench)
+	if err != nil || job == nil {
+		return err
+	}
+
+	if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "InitRunning",
+			Message: fmt.Sprintf("Init job %s is installing apps", job.Name),
+		})
+		return nil
+	}
+
+	report, err := r.readBenchInitReport(ctx, job)
+	if err != nil {
+		// The pod may already be gone; keep the last known results
+		if job.Status.Failed > 0 {
+			meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+				Type:    benchConditionAppsReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "InitFailed",
+				Message: fmt.Sprintf("Init job %s failed, see its logs", job.Name),
+			})
+			return nil
+		}
+		// Every app was installed or skipped, but which ones is unknown
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionUnknown,
+			Reason:  "ReportUnavailable",
+			Message: fmt.Sprintf("Init job %s succeeded but its app report cannot be read: %v", job.Name, err),
+		})
+		return nil
+	}
+
+	apps := make([]vyogotechv1alpha1.BenchAppStatus, 0, len(report.Apps))
+	installed := make([]string, 0, len(report.Apps))
+	var failed []string
+	for _, app := range report.Apps {
+		apps = append(apps, app.BenchAppStatus)
+		switch app.State {
+		case vyogotechv1alpha1.BenchAppStateInstalled:
+			installed = append(installed, app.Name)
+		case vyogotechv1alpha1.BenchAppStateFailed, vyogotechv1alpha1.BenchAppStateSkipped:
+			failed = append(failed, app.Name)
+		}
+	}
+	bench.Status.Apps = apps
+	bench.Status.InstalledApps = installed
+
+	// Git and image apps only declare their dependencies once installed
+	mergeBenchInitReport(bench.Status.Lock, report)
+	var conflicts []string
+	if bench.Status.Lock != nil {
+		conflicts = checkBenchLock(bench.Status.Lock)
+	}
+
+	switch {
+	case len(conflicts) > 0:
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  benchReasonDependencyConflict,
+			Message: strings.Join(conflicts, "; "),
+		})
+	case len(failed) > 0:
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "AppInstallFailed",
+			Message: fmt.Sprintf("apps not installed: %s", strings.Join(failed, ", ")),
+		})
+	case job.Status.Failed > 0:
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "InitFailed",
+			Message: fmt.Sprintf("Init job %s failed after installing apps, see its logs", job.Name),
+		})
+	case report.Truncated:
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionUnknown,
+			Reason:  "ReportTruncated",
+			Message: fmt.Sprintf("Init job %s succeeded, its app report only lists %d of the apps", job.Name, len(report.Apps)),
+		})
+	default:
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionAppsReady,
+			Status:  metav1.ConditionTrue,
+			Reason:  "AppsInstalled",
+			Message: fmt.Sprintf("%d app(s) installed", len(installed)),
+		})
+	}
+	return nil
+}
+
+// currentInitJob returns the bench init Job, or nil if there is none or it is being replaced
+func (r *FrappeBenchReconciler) currentInitJob(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-init", bench.Name), Namespace: bench.Namespace}, job)
+	if errors.IsNotFound(err) || (err == nil && !job.DeletionTimestamp.IsZero()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// resolveFPMAuth looks up the credentials of the authenticated FPM repositories the bench
+// installs from and reports them in the FPMAuthReady condition
+func (r *FrappeBenchReconciler) resolveFPMAuth(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install *benchInstallConfig) error {
+	if !benchUsesFPM(bench.Spec.Apps) {
+		meta.RemoveStatusCondition(&bench.Status.Conditions, benchConditionFPMAuthReady)
+		return nil
+	}
+
+	secrets, err := ensureFPMAuthSecrets(ctx, r.Client, bench, install.FPMRepos, install.OperatorFPMRepos)
+	if err != nil {
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionFPMAuthReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "SecretUnavailable",
+			Message: err.Error(),
+		})
+		return err
+	}
+	install.FPMAuthSecrets = secrets
+
+	if len(secrets) == 0 {
+		meta.RemoveStatusCondition(&bench.Status.Conditions, benchConditionFPMAuthReady)
+		return nil
+	}
+	meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+		Type:    benchConditionFPMAuthReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "CredentialsAvailable",
+		Message: fmt.Sprintf("credentials for %d FPM repository(ies) mounted into init Jobs", len(secrets)),
+	})
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Bench app report", func() {
+	Describe("write_report", func() {
+		// writeReport runs the report prologue with the given report() calls and returns
+		// the termination message it writes
+		writeReport := func(calls string) string {
+			dir := GinkgoT().TempDir()
+			Expect(os.MkdirAll(filepath.Join(dir, "apps"), 0o755)).To(Succeed())
+			log := filepath.Join(dir, "termination-log")
+
+			cmd := exec.Command("bash")
+			cmd.Stdin = strings.NewReader(appInstallReportPrologue + calls)
+			cmd.Env = append(os.Environ(), "BENCH_PATH="+dir, "TERMINATION_LOG="+log)
+			out, err := cmd.CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(out))
+
+			message, err := os.ReadFile(log)
+			Expect(err).NotTo(HaveOccurred())
+			return string(message)
+		}
+
+		It("reports every app of a small bench", func() {
+			message := writeReport("report erpnext git version-15 Installed ''\nreport hrms git '' Failed 'bench get-app failed'\n")
+
+			report := &benchInitReport{}
+			Expect(json.Unmarshal([]byte(message), report)).To(Succeed())
+			Expect(report.Truncated).To(BeFalse())
+			Expect(report.Apps).To(HaveLen(2))
+			Expect(report.Apps[1].Message).To(Equal("bench get-app failed"))
+		})
+
+		It("stays within the termination message limit for many apps", func() {
+			var calls strings.Builder
+			for i := 0; i < 200; i++ {
+				fmt.Fprintf(&calls, "report app_%d git version-15 Failed '%s'\n", i, strings.Repeat("x", 1000))
+			}
+			message := writeReport(calls.String())
+			Expect(len(message)).To(BeNumerically("<=", 4096))
+
+			report := &benchInitReport{}
+			Expect(json.Unmarshal([]byte(message), report)).To(Succeed())
+			Expect(report.Truncated).To(BeTrue())
+			Expect(report.Apps).NotTo(BeEmpty())
+			Expect(report.Apps[0].Name).To(Equal("app_0"))
+			Expect(report.Apps[0].Message).To(BeEmpty())
+		})
+	})
+
+	Describe("updateBenchApps", func() {
+		var (
+			ctx   context.Context
+			ns    string
+			bench *vyogotechv1alpha1.FrappeBench
+			r     *FrappeBenchReconciler
+		)
+
+		BeforeEach(func() {
+			ctx = context.Background()
+
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "bench-apps-"}}
+			Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+			ns = namespace.Name
+
+			bench = &vyogotechv1alpha1.FrappeBench{
+				ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+				Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+			}
+			Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+			r = &FrappeBenchReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		})
+
+		// finishInit creates the succeeded init Job and, unless message is empty, its pod
+		// terminated with message
+		finishInit := func(message string) {
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "bench-init", Namespace: ns},
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyNever,
+							Containers:    []corev1.Container{{Name: "bench-init", Image: "busybox"}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, job)).To(Succeed())
+			now := metav1.Now()
+			job.Status.StartTime = &now
+			job.Status.CompletionTime = &now
+			job.Status.Succeeded = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+			Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+			if message == "" {
+				return
+			}
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "bench-init-abcde", Namespace: ns, Labels: map[string]string{"job-name": job.Name}},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{{Name: "bench-init", Image: "busybox"}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pod.Status.Phase = corev1.PodSucceeded
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+				Name:  "bench-init",
+				Image: "busybox",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+			}}
+			Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+		}
+
+		appsReady := func() *metav1.Condition {
+			Expect(r.updateBenchApps(ctx, bench)).To(Succeed())
+			return meta.FindStatusCondition(bench.Status.Conditions, benchConditionAppsReady)
+		}
+
+		It("records the reported apps", func() {
+			finishInit(`{"frappe":"15.1.0","apps":[{"name":"erpnext","source":"git","state":"Installed"}]}`)
+
+			Expect(appsReady().Status).To(Equal(metav1.ConditionTrue))
+			Expect(bench.Status.InstalledApps).To(ConsistOf("erpnext"))
+		})
+
+		It("reports a truncated report as unknown", func() {
+			finishInit(`{"apps":[{"name":"erpnext","source":"git","state":"Installed"}],"truncated":true}`)
+
+			cond := appsReady()
+			Expect(cond.Status).To(Equal(metav1.ConditionUnknown))
+			Expect(cond.Reason).To(Equal("ReportTruncated"))
+			Expect(bench.Status.InstalledApps).To(ConsistOf("erpnext"))
+		})
+
+		It("does not leave the apps running when the report cannot be parsed", func() {
+			finishInit(`{"apps":[{"name":"erpn`)
+
+			cond := appsReady()
+			Expect(cond.Status).To(Equal(metav1.ConditionUnknown))
+			Expect(cond.Reason).To(Equal("ReportUnavailable"))
+			Expect(cond.Message).To(ContainSubstring("invalid report"))
+		})
+
+		It("does not leave the apps running when the pod is gone", func() {
+			finishInit("")
+
+			cond := appsReady()
+			Expect(cond.Status).To(Equal(metav1.ConditionUnknown))
+			Expect(cond.Reason).To(Equal("ReportUnavailable"))
+		})
+	})
+})
@@ -20,11 +20,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -45,7 +47,10 @@ type FrappeBenchReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappebenches,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappebenches/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappebenches/finalizers,verbs=update
-//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch
 //+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
@@ -84,16 +89,18 @@ func (r *FrappeBenchReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	logger.Info("Git configuration", "enabled", gitEnabled)
 
 	// Merge FPM repositories
-	fpmRepos, err := r.mergeFPMRepositories(operatorConfig, bench)
+	fpmRepos, operatorRepos, err := r.mergeFPMRepositories(operatorConfig, bench)
 	if err != nil {
 		logger.Error(err, "Failed to merge FPM repositories")
 	}
 	logger.Info("FPM repositories configured", "count", len(fpmRepos))
+	install := benchInstallConfig{GitEnabled: gitEnabled, FPMRepos: fpmRepos, OperatorFPMRepos: operatorRepos}
 
-	// Ensure bench initialization
-	if err := r.ensureBenchInitialized(ctx, bench, gitEnabled, fpmRepos); err != nil {
-		logger.Error(err, "Failed to ensure bench initialized")
-		return ctrl.Result{}, err
+	// Jobs that install apps cannot start without the credentials of private FPM
+	// repositories, so they wait until the Secrets are available
+	authErr := r.resolveFPMAuth(ctx, bench, &install)
+	if authErr != nil {
+		logger.Info("Waiting for FPM repository credentials", "reason", authErr.Error())
 	}
 
 	// Ensure storage
@@ -102,6 +109,60 @@ func (r *FrappeBenchReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, err
 	}
 
+	// The bench is stopped while its sites are copied to another storage class
+	migrating, err := r.reconcileStorageMigration(ctx, bench)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile storage migration")
+		return ctrl.Result{}, err
+	}
+	if migrating {
+		bench.Status.Phase = "MigratingStorage"
+		if err := r.Status().Update(ctx, bench); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// Build the apps into the bench image; the bench waits for its first image
+	if bench.Spec.ImageBuild != nil && authErr == nil {
+		if err := r.reconcileImageBuild(ctx, bench, install); err != nil {
+			logger.Error(err, "Failed to reconcile image build")
+			return ctrl.Result{}, err
+		}
+	}
+	if bench.Spec.ImageBuild != nil && builtBenchImage(bench) == "" {
+		bench.Status.Phase = "Building"
+		requeue := 15 * time.Second
+		if bench.Status.ImageBuild != nil && bench.Status.ImageBuild.Phase == vyogotechv1alpha1.BenchImageBuildPhaseFailed {
+			// Apps may be published later, so they are resolved again
+			bench.Status.Phase = "Failed"
+			requeue = 5 * time.Minute
+		}
+		if err := r.Status().Update(ctx, bench); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: requeue}, nil
+	}
+
+	// Ensure bench initialization
+	if authErr == nil {
+		if err := r.ensureBenchInitialized(ctx, bench, install); err != nil {
+			logger.Error(err, "Failed to ensure bench initialized")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Drive managed upgrades before the components, which keep running the
+	// current image until every site has migrated
+	upgrading := false
+	if authErr == nil {
+		upgrading, err = r.reconcileUpgrade(ctx, bench, install)
+		if err != nil {
+			logger.Error(err, "Failed to reconcile upgrade")
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Ensure Redis
 	if err := r.ensureRedis(ctx, bench); err != nil {
 		logger.Error(err, "Failed to ensure Redis")
@@ -150,15 +211,34 @@ func (r *FrappeBenchReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, err
 	}
 
+	if upgrading {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+	if authErr != nil {
+		return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
+	// A Pending ReadWriteMany PVC falls back to ReadWriteOnce after storageFallbackTimeout
+	if cond := meta.FindStatusCondition(bench.Status.Conditions, benchConditionStorageReady); cond != nil && cond.Reason == "Pending" {
+		return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
+	// Apps may be published later, so unavailable apps are checked again
+	if cond := meta.FindStatusCondition(bench.Status.Conditions, benchConditionAppsReady); cond != nil &&
+		(cond.Reason == benchReasonAppsUnavailable || cond.Reason == benchReasonDependencyConflict) {
+		return ctrl.Result{RequeueAfter: 5 * time.Minute}, nil
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// operatorNamespace holds the operator config and the Secrets it references
+const operatorNamespace = "frappe-operator-system"
+
 // getOperatorConfig retrieves the operator-level configuration
 func (r *FrappeBenchReconciler) getOperatorConfig(ctx context.Context, namespace string) (*corev1.ConfigMap, error) {
 	configMap := &corev1.ConfigMap{}
 	err := r.Get(ctx, types.NamespacedName{
 		Name:      "frappe-operator-config",
-		Namespace: "frappe-operator-system", // Operator namespace
+		Namespace: operatorNamespace,
 	}, configMap)
 	return configMap, err
 }
@@ -181,8 +261,9 @@ func (r *FrappeBenchReconciler) isGitEnabled(operatorConfig *corev1.ConfigMap, b
 	return false
 }
 
-// mergeFPMRepositories merges operator-level and bench-level FPM repositories
-func (r *FrappeBenchReconciler) mergeFPMRepositories(operatorConfig *corev1.ConfigMap, bench *vyogotechv1alpha1.FrappeBench) ([]vyogotechv1alpha1.FPMRepository, error) {
+// mergeFPMRepositories merges operator-level and bench-level FPM repositories, and returns
+// how many of them, first in the list, come from the operator config
+func (r *FrappeBenchReconciler) mergeFPMRepositories(operatorConfig *corev1.ConfigMap, bench *vyogotechv1alpha1.FrappeBench) ([]vyogotechv1alpha1.FPMRepository, int, error) {
 	var repos []vyogotechv1alpha1.FPMRepository
 
 	// Add operator-level repositories
@@ -195,87 +276,121 @@ func (r *FrappeBenchReconciler) mergeFPMRepositories(operatorConfig *corev1.Conf
 		}
 	}
 
+	operatorRepos := len(repos)
+
 	// Add bench-level repositories
 	if bench.Spec.FPMConfig != nil {
 		repos = append(repos, bench.Spec.FPMConfig.Repositories...)
 	}
 
-	return repos, nil
+	return repos, operatorRepos, nil
 }
 
 // ensureBenchInitialized creates a job to initialize the Frappe bench
-func (r *FrappeBenchReconciler) ensureBenchInitialized(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, gitEnabled bool, fpmRepos []vyogotechv1alpha1.FPMRepository) error {
+// The Job installs spec.apps and is re-run whenever its script or the running image changes.
+func (r *FrappeBenchReconciler) ensureBenchInitialized(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig) error {
 	logger := log.FromContext(ctx)
 
 	jobName := fmt.Sprintf("%s-init", bench.Name)
-	job := &batchv1.Job{}
+	image := r.getRunningImage(bench)
 
-	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: bench.Namespace}, job)
+	// Resolve the apps before touching the Job, so a bench that cannot be built keeps
+	// its current Job and lock
+	lock, problems, err := r.resolveBenchLock(ctx, bench, install, r.benchApps(bench), bench.Status.Lock, runningFrappeVersion(bench))
+	if err != nil {
+		return err
+	}
+	reason := benchReasonAppsUnavailable
+	if len(problems) == 0 {
+		problems, reason = checkBenchLock(lock), benchReasonDependencyConflict
+	}
+	if len(problems) > 0 {
+		logger.Info("Not initializing bench, apps cannot be resolved", "reason", reason, "problems", problems)
+		setBenchAppsUnresolved(bench, reason, problems)
+		return nil
+	}
+	if cond := meta.FindStatusCondition(bench.Status.Conditions, benchConditionAppsReady); cond != nil &&
+		(cond.Reason == benchReasonAppsUnavailable || cond.Reason == benchReasonDependencyConflict) {
+		meta.RemoveStatusCondition(&bench.Status.Conditions, benchConditionAppsReady)
+	}
+	bench.Status.Lock = lock
+
+	// What the Job reports about itself is left out of the hash, or recording it would re-run the Job
+	initScript := r.benchInitScript(bench, install, lock)
+	hash := benchInitHash(image, r.benchInitScript(bench, install, benchLockInputs(lock)))
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: bench.Namespace}, job)
 	if err == nil {
-		// Job already exists
-		logger.Info("Bench init job already exists", "job", jobName)
+		if job.Annotations[benchInitHashAnnotation] == hash {
+			logger.V(1).Info("Bench init job is up to date", "job", jobName)
+			if job.Status.Succeeded > 0 && !containsString(bench.Status.AssetsTrees, benchAppsTree(image)) {
+				// The components switch to the tree of the image on their next apply
+				logger.Info("Bench assets built", "tree", benchAppsTree(image))
+				markBenchAssetsTree(bench, image)
+			}
+			return nil
+		}
+		// Apps, repositories or image changed: replace the Job once it has finished
+		if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+			logger.Info("Waiting for bench init job before re-running it", "job", jobName)
+			return nil
+		}
+		if job.DeletionTimestamp.IsZero() {
+			logger.Info("Bench apps changed, re-running init job", "job", jobName)
+			return client.IgnoreNotFound(r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+		}
 		return nil
 	}
 	if !errors.IsNotFound(err) {
 		return err
 	}
 
+	// Locked fpm releases must still be the archives they were resolved to
+	problems, err = r.verifyBenchLock(ctx, bench, install, lock)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		logger.Info("Not creating bench init job, locked apps are unavailable", "problems", problems)
+		setBenchAppsUnresolved(bench, benchReasonAppsUnavailable, problems)
+		return nil
+	}
+
 	// Create init job
 	logger.Info("Creating bench init job", "job", jobName)
 
-	// Simplified init script - configure and build assets
-	// The frappe/erpnext image already has apps installed
-	initScript := fmt.Sprintf(`#!/bin/bash
-set -e
-
-cd /home/frappe/frappe-bench
-
-echo "Configuring Frappe bench..."
-
-# Create apps.txt from existing apps
-ls -1 apps > sites/apps.txt
-
-# Create or update common_site_config.json
-cat > sites/common_site_config.json <<EOF
-{
-  "redis_cache": "redis://%s-redis-cache:6379",
-  "redis_queue": "redis://%s-redis-queue:6379",
-  "socketio_port": 9000
-}
-EOF
-
-echo "Building assets for production..."
-bench build --production
-
-echo "Bench configuration complete"
-`, bench.Name, bench.Name)
+	authVolumes, authMounts, _ := fpmAuthVolumes(install)
 
 	// Create the job
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	pvcName := benchSitesClaim(bench)
+	backoffLimit := int32(0)
 	job = &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      jobName,
-			Namespace: bench.Namespace,
+			Name:        jobName,
+			Namespace:   bench.Namespace,
+			Annotations: map[string]string{benchInitHashAnnotation: hash},
 		},
 		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
 			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
 				Spec: corev1.PodSpec{
-					RestartPolicy: corev1.RestartPolicyNever,
+					Affinity:       benchSitesAffinity(bench),
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{benchTreeContainer(bench, image)},
 					Containers: []corev1.Container{
 						{
-							Name:    "bench-init",
-							Image:   r.getBenchImage(bench),
-							Command: []string{"bash", "-c"},
-							Args:    []string{initScript},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
+							Name:         "bench-init",
+							Image:        image,
+							Command:      []string{"bash", "-c"},
+							Args:         []string{initScript},
+							VolumeMounts: append(benchBuildVolumeMounts(bench, image), authMounts...),
 						},
 					},
-					Volumes: []corev1.Volume{
+					Volumes: append([]corev1.Volume{
 						{
 							Name: "sites",
 							VolumeSource: corev1.VolumeSource{
@@ -284,7 +399,7 @@ echo "Bench configuration complete"
 								},
 							},
 						},
-					},
+					}, authVolumes...),
 				},
 			},
 		},
@@ -298,7 +413,16 @@ echo "Bench configuration complete"
 }
 
 // getBenchImage returns the image to use for the bench
+// In image build mode this is the last image built from spec.apps, pinned by digest.
 func (r *FrappeBenchReconciler) getBenchImage(bench *vyogotechv1alpha1.FrappeBench) string {
+	if image := builtBenchImage(bench); image != "" {
+		return image
+	}
+	return benchBaseImage(bench)
+}
+
+// benchBaseImage returns the image from imageConfig, which image builds start from
+func benchBaseImage(bench *vyogotechv1alpha1.FrappeBench) string {
 	if bench.Spec.ImageConfig != nil && bench.Spec.ImageConfig.Repository != "" {
 		image := bench.Spec.ImageConfig.Repository
 		if bench.Spec.ImageConfig.Tag != "" {
@@ -387,10 +511,9 @@ func (r *FrappeBenchReconciler) updateWorkerScalingStatus(ctx context.Context, b
 }
 
 func (r *FrappeBenchReconciler) updateBenchStatus(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, gitEnabled bool, fpmRepos []vyogotechv1alpha1.FPMRepository) error {
-	// Collect installed app names
-	installedApps := make([]string, 0, len(bench.Spec.Apps))
-	for _, app := range bench.Spec.Apps {
-		installedApps = append(installedApps, app.Name)
+	// Installed apps come from the report of the last finished init Job
+	if err := r.updateBenchApps(ctx, bench); err != nil {
+		return err
 	}
 
 	// Collect FPM repository names
@@ -400,8 +523,10 @@ func (r *FrappeBenchReconciler) updateBenchStatus(ctx context.Context, bench *vy
 	}
 
 	bench.Status.Phase = "Ready"
+	if bench.Status.Upgrade != nil && !isBenchUpgradeFinished(bench.Status.Upgrade) {
+		bench.Status.Phase = "Upgrading"
+	}
 	bench.Status.GitEnabled = gitEnabled
-	bench.Status.InstalledApps = installedApps
 	bench.Status.FPMRepositories = repoNames
 	bench.Status.ObservedGeneration = bench.Generation
 
@@ -413,5 +538,9 @@ func (r *FrappeBenchReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.FrappeBench{}).
 		Owns(&batchv1.Job{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
 		Complete(r)
 }
@@ -0,0 +1,428 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	// defaultBuilderImage runs rootless BuildKit without a daemon
+	defaultBuilderImage = "moby/buildkit:v0.16.0-rootless"
+
+	// benchBuildHashAnnotation records the inputs hash the build Job was created for
+	benchBuildHashAnnotation = "vyogo.tech/build-hash"
+
+	// buildContextDir is where the rendered Dockerfile is mounted in the build Job
+	buildContextDir = "/workspace"
+)
+
+// builtBenchImage returns the last image built for the bench (repository@digest), or
+// "" when the bench is not in image build mode or nothing was built yet
+func builtBenchImage(bench *vyogotechv1alpha1.FrappeBench) string {
+	if bench.Spec.ImageBuild == nil || bench.Status.ImageBuild == nil {
+		return ""
+	}
+	return bench.Status.ImageBuild.Image
+}
+
+// reconcileImageBuild builds spec.apps into an image whenever the rendered Dockerfile,
+// builder or repository change. The bench keeps running the last built image until
+// the new one is pushed; the digest change then goes through a managed upgrade.
+func (r *FrappeBenchReconciler) reconcileImageBuild(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig) error {
+	logger := log.FromContext(ctx)
+
+	config := bench.Spec.ImageBuild
+	if bench.Status.ImageBuild == nil {
+		bench.Status.ImageBuild = &vyogotechv1alpha1.BenchImageBuildStatus{}
+	}
+	status := bench.Status.ImageBuild
+
+	apps := r.benchSpecApps(bench)
+	for _, app := range apps {
+		if app.Source == "git" && !install.GitEnabled {
+			failImageBuild(status, fmt.Sprintf("app %s is installed from Git, which is disabled for this bench", app.Name))
+			return nil
+		}
+	}
+
+	lock, problems, err := r.resolveBenchLock(ctx, bench, install, apps, status.Lock, bench.Spec.FrappeVersion)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		problems = checkBenchLock(lock)
+	}
+	if len(problems) > 0 {
+		failImageBuild(status, "apps cannot be resolved: "+strings.Join(problems, "; "))
+		return nil
+	}
+
+	defaultRepo := ""
+	if bench.Spec.FPMConfig != nil {
+		defaultRepo = bench.Spec.FPMConfig.DefaultRepo
+	}
+	dockerfile := renderBenchDockerfile(benchBaseImage(bench), config.FPM, apps, lock, install, defaultRepo)
+	builderImage := config.BuilderImage
+	if builderImage == "" {
+		builderImage = defaultBuilderImage
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%t\n%s", builderImage, config.Repository, config.Insecure, dockerfile)))
+	hash := hex.EncodeToString(sum[:])[:16]
+
+	jobName := fmt.Sprintf("%s-image-build", bench.Name)
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: bench.Namespace}, job)
+	if err == nil {
+		if job.Annotations[benchBuildHashAnnotation] != hash {
+			// Inputs changed: replace the Job once it has finished
+			if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+				logger.Info("Waiting for image build job before starting a new build", "job", jobName)
+				return nil
+			}
+			if job.DeletionTimestamp.IsZero() {
+				logger.Info("Bench image inputs changed, rebuilding", "job", jobName)
+				return client.IgnoreNotFound(r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+			}
+			return nil
+		}
+
+		switch {
+		case job.Status.Succeeded > 0:
+			if status.Phase == vyogotechv1alpha1.BenchImageBuildPhaseSucceeded && status.Hash == hash {
+				return nil
+			}
+			digest, err := r.readImageBuildDigest(ctx, job)
+			if err != nil {
+				failImageBuild(status, fmt.Sprintf("build job %s did not report a digest: %v", jobName, err))
+				return nil
+			}
+			now := metav1.Now()
+			status.Phase = vyogotechv1alpha1.BenchImageBuildPhaseSucceeded
+			status.Hash = hash
+			status.Image = fmt.Sprintf("%s@%s", config.Repository, digest)
+			status.FrappeVersion = bench.Spec.FrappeVersion
+			status.Message = fmt.Sprintf("Built %s:%s", config.Repository, hash)
+			status.CompletionTime = &now
+			logger.Info("Bench image built", "image", status.Image)
+		case job.Status.Failed > 0:
+			if status.Phase != vyogotechv1alpha1.BenchImageBuildPhaseFailed {
+				failImageBuild(status, fmt.Sprintf("build job %s failed, see its logs", jobName))
+			}
+		default:
+			status.Phase = vyogotechv1alpha1.BenchImageBuildPhaseBuilding
+		}
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	if err := r.ensureImageBuildContext(ctx, bench, dockerfile); err != nil {
+		return err
+	}
+
+	logger.Info("Creating image build job", "job", jobName, "image", fmt.Sprintf("%s:%s", config.Repository, hash))
+	job = r.imageBuildJob(bench, jobName, builderImage, hash, install)
+	if err := controllerutil.SetControllerReference(bench, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	status.Phase = vyogotechv1alpha1.BenchImageBuildPhaseBuilding
+	status.Hash = hash
+	status.Lock = lock
+	status.Message = fmt.Sprintf("Building %s:%s", config.Repository, hash)
+	status.StartTime = &now
+	status.CompletionTime = nil
+	return nil
+}
+
+func failImageBuild(status *vyogotechv1alpha1.BenchImageBuildStatus, message string) {
+	now := metav1.Now()
+	status.Phase = vyogotechv1alpha1.BenchImageBuildPhaseFailed
+	status.Message = message
+	status.CompletionTime = &now
+}
+
+// renderBenchDockerfile renders the Dockerfile of a bench image: the base image, with
+// the pinned fpm binary when one is given, then every app in lock order
+func renderBenchDockerfile(base string, fpm *vyogotechv1alpha1.FPMBinary, apps []vyogotechv1alpha1.AppSource, lock *vyogotechv1alpha1.BenchLock, install benchInstallConfig, defaultRepo string) string {
+	var df strings.Builder
+
+	df.WriteString("# syntax=docker/dockerfile:1\n")
+	df.WriteString("# Rendered by frappe-operator from the apps of the FrappeBench\n\n")
+
+	df.WriteString(fmt.Sprintf("FROM %s\n\n", base))
+	usesFPM := benchUsesFPM(apps)
+	if usesFPM && fpm != nil {
+		// BuildKit checks the digest before the binary reaches a layer
+		df.WriteString(fmt.Sprintf("USER root\nADD --checksum=sha256:%s --chmod=755 %s /usr/local/bin/fpm\n", fpm.SHA256, fpm.URL))
+	} else if usesFPM {
+		df.WriteString("RUN command -v fpm >/dev/null || { echo \"fpm CLI not found in the base image, set imageBuild.fpm\" >&2; exit 1; }\n")
+	}
+	df.WriteString(fmt.Sprintf("USER frappe\nWORKDIR %s\n\n", benchPath))
+
+	if usesFPM {
+		// One RUN with a throwaway fpm home, so the repository logins never reach a layer;
+		// credentials are BuildKit secrets mounted where the init script expects them
+		var mounts []string
+		for i := range install.FPMRepos {
+			if _, ok := install.FPMAuthSecrets[i]; !ok {
+				continue
+			}
+			for _, key := range []string{"token", "username", "password"} {
+				mounts = append(mounts, fmt.Sprintf("--mount=type=secret,id=fpm-%d-%s,target=%s/%d/%s,uid=1000,required=false", i, key, fpmAuthDir, i, key))
+			}
+		}
+		_, _, authDirs := fpmAuthVolumes(install)
+
+		df.WriteString("# FPM apps\n")
+		df.WriteString("RUN ")
+		for _, mount := range mounts {
+			df.WriteString(mount + " ")
+		}
+		df.WriteString("<<\"SCRIPT\"\n#!/bin/bash\nset -e\nexport HOME=\"$(mktemp -d)\"\n")
+		df.WriteString(NewFPMManager().GenerateFPMConfigScript(install.FPMRepos, defaultRepo, authDirs))
+		for _, app := range lockOrder(apps, lock) {
+			if app.Source != "fpm" {
+				continue
+			}
+			df.WriteString(fmt.Sprintf("fpm install %s --bench-path %s\n", shellQuote(fmt.Sprintf("%s/%s==%s", app.Org, app.Name, lockedVersion(app, lock))), benchPath))
+		}
+		df.WriteString("rm -rf \"$HOME\"\nSCRIPT\n\n")
+	}
+
+	for _, app := range lockOrder(apps, lock) {
+		name := shellQuote(app.Name)
+		switch app.Source {
+		case "git":
+			df.WriteString(fmt.Sprintf("# Git app: %q\nRUN <<\"SCRIPT\"\n#!/bin/bash\nset -e\n", app.Name))
+			getApp := fmt.Sprintf("bench get-app --overwrite %s", shellQuote(app.GitURL))
+			if app.GitBranch != "" {
+				getApp += fmt.Sprintf(" --branch %s", shellQuote(app.GitBranch))
+			}
+			df.WriteString(getApp + "\n")
+			if locked := findLockedApp(lock, app.Name); locked != nil && locked.GitCommit != "" && lockedAppMatches(*locked, app) {
+				df.WriteString(gitCheckoutCommand(app.Name, locked.GitCommit) + "\n")
+			}
+			df.WriteString("SCRIPT\n\n")
+		case "image":
+			df.WriteString(fmt.Sprintf("# Image app: %q\nRUN <<\"SCRIPT\"\ntest -d apps/%s\nSCRIPT\n\n", app.Name, name))
+		}
+	}
+
+	return df.String()
+}
+
+// lockedVersion returns the version an fpm app is pinned to, or its spec version
+func lockedVersion(app vyogotechv1alpha1.AppSource, lock *vyogotechv1alpha1.BenchLock) string {
+	if locked := findLockedApp(lock, app.Name); locked != nil && locked.Version != "" && lockedAppMatches(*locked, app) {
+		return locked.Version
+	}
+	return app.Version
+}
+
+// ensureImageBuildContext keeps the rendered Dockerfile in the <bench>-image-build ConfigMap
+func (r *FrappeBenchReconciler) ensureImageBuildContext(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, dockerfile string) error {
+	name := fmt.Sprintf("%s-image-build", bench.Name)
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: bench.Namespace}, configMap)
+	if errors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: bench.Namespace,
+				Labels:    r.componentLabels(bench, "image-build"),
+			},
+			Data: map[string]string{"Dockerfile": dockerfile},
+		}
+		if err := controllerutil.SetControllerReference(bench, configMap, r.Scheme); err != nil {
+			return err
+		}
+		return r.Create(ctx, configMap)
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data["Dockerfile"] == dockerfile {
+		return nil
+	}
+	patch := client.MergeFrom(configMap.DeepCopy())
+	configMap.Data = map[string]string{"Dockerfile": dockerfile}
+	return r.Patch(ctx, configMap, patch)
+}
+
+// imageBuildJob runs rootless BuildKit on the rendered Dockerfile and pushes the image
+// tagged with hash; the digest is written to the termination message
+func (r *FrappeBenchReconciler) imageBuildJob(bench *vyogotechv1alpha1.FrappeBench, jobName, builderImage, hash string, install benchInstallConfig) *batchv1.Job {
+	config := bench.Spec.ImageBuild
+
+	output := fmt.Sprintf("type=image,name=%s:%s,push=true", config.Repository, hash)
+	if config.Insecure {
+		output += ",registry.insecure=true"
+	}
+	script := fmt.Sprintf(`set -e
+SECRETS=""
+for dir in %[1]s/*; do
+  [ -d "$dir" ] || continue
+  i=$(basename "$dir")
+  for key in token username password; do
+    if [ -f "$dir/$key" ]; then
+      SECRETS="$SECRETS --secret id=fpm-$i-$key,src=$dir/$key"
+    fi
+  done
+done
+
+buildctl-daemonless.sh build \
+  --frontend dockerfile.v0 \
+  --local context=%[2]s \
+  --local dockerfile=%[2]s \
+  --output %[3]s \
+  --metadata-file /tmp/metadata.json \
+  $SECRETS
+
+DIGEST=$(sed -n 's/.*"containerimage.digest": *"\([^"]*\)".*/\1/p' /tmp/metadata.json | head -n 1)
+if [ -z "$DIGEST" ]; then
+  echo "No image digest in the build metadata"
+  exit 1
+fi
+echo "Pushed %[4]s@$DIGEST"
+printf '{"digest":"%%s"}' "$DIGEST" > /dev/termination-log
+`, fpmAuthDir, buildContextDir, shellQuote(output), config.Repository)
+
+	authVolumes, authMounts, _ := fpmAuthVolumes(install)
+	volumes := append([]corev1.Volume{
+		{
+			Name: "context",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: fmt.Sprintf("%s-image-build", bench.Name)},
+				},
+			},
+		},
+		{
+			Name:         "buildkitd",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		},
+	}, authVolumes...)
+	mounts := append([]corev1.VolumeMount{
+		{Name: "context", MountPath: buildContextDir},
+		{Name: "buildkitd", MountPath: "/home/user/.local/share/buildkit"},
+	}, authMounts...)
+	env := []corev1.EnvVar{{Name: "BUILDKITD_FLAGS", Value: "--oci-worker-no-process-sandbox"}}
+
+	if config.PushSecretRef != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: "docker-config",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: config.PushSecretRef.Name,
+					Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "docker-config", MountPath: "/home/user/.docker", ReadOnly: true})
+		env = append(env, corev1.EnvVar{Name: "DOCKER_CONFIG", Value: "/home/user/.docker"})
+	}
+
+	uid := int64(1000)
+	backoffLimit := int32(0)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        jobName,
+			Namespace:   bench.Namespace,
+			Labels:      r.componentLabels(bench, "image-build"),
+			Annotations: map[string]string{benchBuildHashAnnotation: hash},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:      "build",
+							Image:     builderImage,
+							Command:   []string{"sh", "-c"},
+							Args:      []string{script},
+							Env:       env,
+							Resources: config.Resources,
+							// Rootless BuildKit needs its own user namespaces, which the
+							// default seccomp and AppArmor profiles block
+							SecurityContext: &corev1.SecurityContext{
+								RunAsUser:       &uid,
+								RunAsGroup:      &uid,
+								SeccompProfile:  &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+								AppArmorProfile: &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+							},
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// readImageBuildDigest reads the digest the build container left in its termination message
+func (r *FrappeBenchReconciler) readImageBuildDigest(ctx context.Context, job *batchv1.Job) (string, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return "", err
+	}
+
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "build" || status.State.Terminated == nil || status.State.Terminated.Message == "" {
+				continue
+			}
+			report := struct {
+				Digest string `json:"digest"`
+			}{}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), &report); err != nil {
+				return "", err
+			}
+			if !strings.HasPrefix(report.Digest, "sha256:") {
+				return "", fmt.Errorf("unexpected digest %q", report.Digest)
+			}
+			return report.Digest, nil
+		}
+	}
+
+	return "", fmt.Errorf("no terminated pod found for job %s", job.Name)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Bench image Dockerfile", func() {
+	apps := []vyogotechv1alpha1.AppSource{{Name: "erpnext", Source: "fpm", Org: "frappe", Version: "15.0.0"}}
+
+	It("adds the pinned fpm binary checked against its digest", func() {
+		fpm := &vyogotechv1alpha1.FPMBinary{
+			URL:    "https://example.com/fpm/v1.2.0/fpm-linux-amd64",
+			SHA256: strings.Repeat("ab", 32),
+		}
+		dockerfile := renderBenchDockerfile("frappe:test", fpm, apps, nil, benchInstallConfig{}, "")
+		Expect(dockerfile).To(ContainSubstring("ADD --checksum=sha256:" + fpm.SHA256 + " --chmod=755 " + fpm.URL + " /usr/local/bin/fpm\n"))
+		Expect(dockerfile).NotTo(ContainSubstring("latest"))
+	})
+
+	It("requires fpm in the base image without a pinned binary", func() {
+		dockerfile := renderBenchDockerfile("frappe:test", nil, apps, nil, benchInstallConfig{}, "")
+		Expect(dockerfile).NotTo(ContainSubstring("ADD "))
+		Expect(dockerfile).To(ContainSubstring("RUN command -v fpm"))
+	})
+
+	It("leaves fpm out for benches without fpm apps", func() {
+		fpm := &vyogotechv1alpha1.FPMBinary{URL: "https://example.com/fpm", SHA256: strings.Repeat("ab", 32)}
+		dockerfile := renderBenchDockerfile("frappe:test", fpm, nil, nil, benchInstallConfig{}, "")
+		Expect(dockerfile).NotTo(ContainSubstring("fpm"))
+	})
+})
@@ -0,0 +1,456 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/fpm"
+)
+
+const (
+	// benchReasonAppsUnavailable means an fpm app or a locked version is not in any repository
+	benchReasonAppsUnavailable = "AppsUnavailable"
+	// benchReasonDependencyConflict means the apps cannot be installed together on the bench's Frappe version
+	benchReasonDependencyConflict = "DependencyConflict"
+)
+
+// setBenchAppsUnresolved reports why the apps of the bench cannot be installed
+func setBenchAppsUnresolved(bench *vyogotechv1alpha1.FrappeBench, reason string, problems []string) {
+	meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+		Type:    benchConditionAppsReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: strings.Join(problems, "; "),
+	})
+}
+
+// fpmRepoClient is a configured FPM repository the operator can query
+type fpmRepoClient struct {
+	name     string
+	priority int
+	client   *fpm.Client
+}
+
+// benchSpecApps returns spec.apps, or the legacy appsJSON as image apps
+func (r *FrappeBenchReconciler) benchSpecApps(bench *vyogotechv1alpha1.FrappeBench) []vyogotechv1alpha1.AppSource {
+	if len(bench.Spec.Apps) == 0 && bench.Spec.AppsJSON != "" {
+		return r.parseAppsJSON(bench.Spec.AppsJSON)
+	}
+	return bench.Spec.Apps
+}
+
+// benchApps returns the apps the init Job installs: spec.apps, except that in image
+// build mode every app is already in the image
+func (r *FrappeBenchReconciler) benchApps(bench *vyogotechv1alpha1.FrappeBench) []vyogotechv1alpha1.AppSource {
+	apps := r.benchSpecApps(bench)
+	if bench.Spec.ImageBuild == nil {
+		return apps
+	}
+	built := make([]vyogotechv1alpha1.AppSource, 0, len(apps))
+	for _, app := range apps {
+		built = append(built, vyogotechv1alpha1.AppSource{Name: app.Name, Source: "image", Version: app.Version})
+	}
+	return built
+}
+
+// runningFrappeVersion returns the Frappe version the bench components run
+// Like getRunningImage, it trails spec.frappeVersion while an upgrade is in progress.
+func runningFrappeVersion(bench *vyogotechv1alpha1.FrappeBench) string {
+	if bench.Status.CurrentVersion != "" {
+		return bench.Status.CurrentVersion
+	}
+	return bench.Spec.FrappeVersion
+}
+
+// lockedAppMatches reports whether a lock entry was resolved from this spec.apps entry
+func lockedAppMatches(locked vyogotechv1alpha1.LockedApp, app vyogotechv1alpha1.AppSource) bool {
+	return locked.Name == app.Name && locked.Source == app.Source && locked.Requested == app.Version &&
+		locked.Org == app.Org && locked.GitURL == app.GitURL && locked.GitBranch == app.GitBranch
+}
+
+func findLockedApp(lock *vyogotechv1alpha1.BenchLock, name string) *vyogotechv1alpha1.LockedApp {
+	if lock == nil {
+		return nil
+	}
+	for i := range lock.Apps {
+		if lock.Apps[i].Name == name {
+			return &lock.Apps[i]
+		}
+	}
+	return nil
+}
+
+// resolveBenchLock returns the lock for apps on frappeVersion
+// Entries of the previous lock are kept for unchanged apps entries, so nothing is
+// fetched while the spec is unchanged; other apps are resolved, fpm apps against the
+// repositories. It returns one problem per fpm app no repository can provide, and
+// errors for the Kubernetes API only: an unreachable repository leaves the app to the Job.
+func (r *FrappeBenchReconciler) resolveBenchLock(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig, apps []vyogotechv1alpha1.AppSource, previous *vyogotechv1alpha1.BenchLock, frappeVersion string) (*vyogotechv1alpha1.BenchLock, []string, error) {
+	if previous != nil && previous.FrappeVersion != frappeVersion {
+		previous = nil
+	}
+
+	lock := &vyogotechv1alpha1.BenchLock{FrappeVersion: frappeVersion}
+	if previous != nil {
+		lock.Frappe = previous.Frappe
+	}
+
+	var repos []fpmRepoClient
+	var problems []string
+	changed := previous == nil || len(previous.Apps) != len(apps)
+	for _, app := range apps {
+		if locked := findLockedApp(previous, app.Name); locked != nil && lockedAppMatches(*locked, app) {
+			lock.Apps = append(lock.Apps, *locked)
+			continue
+		}
+		changed = true
+
+		entry := vyogotechv1alpha1.LockedApp{
+			Name:      app.Name,
+			Source:    app.Source,
+			Requested: app.Version,
+			Org:       app.Org,
+			GitURL:    app.GitURL,
+			GitBranch: app.GitBranch,
+		}
+		if app.Source == "fpm" {
+			if repos == nil {
+				var err error
+				if repos, err = r.fpmRepoClients(ctx, bench, install); err != nil {
+					return nil, nil, err
+				}
+			}
+			if problem := resolveFPMApp(ctx, repos, &entry); problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+		lock.Apps = append(lock.Apps, entry)
+	}
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	// Keep the install order of an unchanged lock, it only changes with the apps
+	if changed {
+		orderBenchLock(lock)
+	} else {
+		lock.Apps = previous.Apps
+	}
+	return lock, nil, nil
+}
+
+// fpmRepoClients returns clients for the FPM repositories of the bench, in priority order
+func (r *FrappeBenchReconciler) fpmRepoClients(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig) ([]fpmRepoClient, error) {
+	repos := make([]fpmRepoClient, 0, len(install.FPMRepos))
+	for i, repo := range install.FPMRepos {
+		var creds *fpm.Credentials
+		if secretName, ok := install.FPMAuthSecrets[i]; ok {
+			secret := &corev1.Secret{}
+			if err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: bench.Namespace}, secret); err != nil {
+				return nil, err
+			}
+			creds = &fpm.Credentials{
+				Username: string(secret.Data["username"]),
+				Password: string(secret.Data["password"]),
+				Token:    string(secret.Data["token"]),
+			}
+		}
+		priority := repo.Priority
+		if priority == 0 {
+			priority = 50
+		}
+		repos = append(repos, fpmRepoClient{name: repo.Name, priority: priority, client: fpm.NewClient(repo.URL, creds)})
+	}
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].priority < repos[j].priority })
+	return repos, nil
+}
+
+// resolveFPMApp pins entry to the highest matching release of the first repository that has one
+// It returns a problem when no repository has the app, and leaves entry unpinned for
+// the init Job when none has it but some could not be queried.
+func resolveFPMApp(ctx context.Context, repos []fpmRepoClient, entry *vyogotechv1alpha1.LockedApp) string {
+	logger := log.FromContext(ctx)
+	id := entry.Org + "/" + entry.Name
+
+	if entry.Org == "" {
+		return fmt.Sprintf("%s: org is required for fpm apps", entry.Name)
+	}
+	if _, err := fpm.ParseConstraint(entry.Requested); err != nil {
+		return fmt.Sprintf("%s: %v", id, err)
+	}
+	if len(repos) == 0 {
+		return ""
+	}
+
+	var misses []string
+	inconclusive := false
+	for _, repo := range repos {
+		release, err := repo.client.Resolve(ctx, entry.Org, entry.Name, entry.Requested)
+		switch {
+		case err == nil:
+			logger.V(1).Info("Resolved FPM app", "app", id, "repository", repo.name, "version", release.Version)
+			entry.Repository = repo.name
+			entry.Version = release.Version
+			entry.Checksum = release.Checksum
+			entry.RequiredApps = release.RequiredApps
+			entry.Frappe = release.Frappe
+			return ""
+		case goerrors.Is(err, fpm.ErrNoMatchingVersion):
+			misses = append(misses, fmt.Sprintf("%s: %v", repo.name, err))
+		case fpm.IsNotFound(err):
+			misses = append(misses, fmt.Sprintf("%s: not found", repo.name))
+		case fpm.IsUnauthorized(err):
+			misses = append(misses, fmt.Sprintf("%s: credentials rejected", repo.name))
+		default:
+			logger.Info("Could not query FPM repository", "repository", repo.name, "app", id, "error", err.Error())
+			inconclusive = true
+		}
+	}
+	if inconclusive {
+		return ""
+	}
+	return fmt.Sprintf("%s %q not available (%s)", id, entry.Requested, strings.Join(misses, "; "))
+}
+
+// verifyBenchLock checks that the pinned fpm releases are still published with the same
+// checksum, so a re-run cannot silently install a different archive
+func (r *FrappeBenchReconciler) verifyBenchLock(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig, lock *vyogotechv1alpha1.BenchLock) ([]string, error) {
+	logger := log.FromContext(ctx)
+
+	var repos []fpmRepoClient
+	var problems []string
+	for _, app := range lock.Apps {
+		if app.Source != "fpm" || app.Checksum == "" {
+			continue
+		}
+		if repos == nil {
+			var err error
+			if repos, err = r.fpmRepoClients(ctx, bench, install); err != nil {
+				return nil, err
+			}
+		}
+
+		id := app.Org + "/" + app.Name
+		var repo *fpmRepoClient
+		for i := range repos {
+			if repos[i].name == app.Repository {
+				repo = &repos[i]
+			}
+		}
+		if repo == nil {
+			problems = append(problems, fmt.Sprintf("%s %s is locked to repository %s, which is no longer configured", id, app.Version, app.Repository))
+			continue
+		}
+
+		checksum, err := repo.client.Checksum(ctx, app.Org, app.Name, app.Version)
+		switch {
+		case err == nil && checksum != app.Checksum:
+			problems = append(problems, fmt.Sprintf("%s %s in %s changed checksum from %s to %s", id, app.Version, repo.name, app.Checksum, checksum))
+		case fpm.IsNotFound(err):
+			problems = append(problems, fmt.Sprintf("%s %s is no longer available in %s", id, app.Version, repo.name))
+		case err != nil:
+			logger.Info("Could not verify locked FPM app", "repository", repo.name, "app", id, "error", err.Error())
+		}
+	}
+	return problems, nil
+}
+
+// checkBenchLock checks the dependency graph of the lock: every required app must be in
+// spec.apps at a compatible version, every app must support the bench's Frappe version,
+// and the apps must not require each other in a cycle
+func checkBenchLock(lock *vyogotechv1alpha1.BenchLock) []string {
+	frappe := lock.FrappeVersion
+	if lock.Frappe != "" {
+		frappe = lock.Frappe
+	}
+	frappeLower, frappeUpper, frappeKnown := frappeVersionRange(frappe)
+
+	var conflicts []string
+	for _, app := range lock.Apps {
+		label := app.Name
+		if app.Version != "" {
+			label += " " + app.Version
+		}
+
+		if frappeKnown && app.Frappe != "" {
+			if c, err := fpm.ParseConstraint(app.Frappe); err == nil && !c.Allows(frappeLower, frappeUpper) {
+				conflicts = append(conflicts, fmt.Sprintf("%s requires frappe %s, the bench runs %s", label, app.Frappe, frappe))
+			}
+		}
+
+		for _, required := range app.RequiredApps {
+			name, constraint := parseRequiredApp(required)
+			if name == "frappe" {
+				if c, err := fpm.ParseConstraint(constraint); frappeKnown && constraint != "" && err == nil && !c.Allows(frappeLower, frappeUpper) {
+					conflicts = append(conflicts, fmt.Sprintf("%s requires frappe %s, the bench runs %s", label, constraint, frappe))
+				}
+				continue
+			}
+
+			dep := findLockedApp(lock, name)
+			if dep == nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s requires %s, which is not in spec.apps", label, name))
+				continue
+			}
+			if constraint == "" || dep.Version == "" {
+				continue
+			}
+			c, err := fpm.ParseConstraint(constraint)
+			v, verr := fpm.ParseVersion(dep.Version)
+			if err == nil && verr == nil && !c.Check(v) {
+				conflicts = append(conflicts, fmt.Sprintf("%s requires %s %s, found %s", label, name, constraint, dep.Version))
+			}
+		}
+	}
+
+	if cycle := orderBenchLock(lock.DeepCopy()); len(cycle) > 0 {
+		conflicts = append(conflicts, fmt.Sprintf("dependency cycle between %s", strings.Join(cycle, ", ")))
+	}
+	return conflicts
+}
+
+// orderBenchLock sorts the lock so every app comes after the apps it requires, keeping
+// the spec.apps order otherwise. It returns the apps of a dependency cycle, leaving the
+// lock unsorted.
+func orderBenchLock(lock *vyogotechv1alpha1.BenchLock) []string {
+	placed := map[string]bool{}
+	ordered := make([]vyogotechv1alpha1.LockedApp, 0, len(lock.Apps))
+	for len(ordered) < len(lock.Apps) {
+		progress := false
+		for _, app := range lock.Apps {
+			if placed[app.Name] {
+				continue
+			}
+			ready := true
+			for _, required := range app.RequiredApps {
+				name, _ := parseRequiredApp(required)
+				if name != app.Name && findLockedApp(lock, name) != nil && !placed[name] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				placed[app.Name] = true
+				ordered = append(ordered, app)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, app := range lock.Apps {
+				if !placed[app.Name] {
+					cycle = append(cycle, app.Name)
+				}
+			}
+			return cycle
+		}
+	}
+	lock.Apps = ordered
+	return nil
+}
+
+// parseRequiredApp splits a required_apps entry ("erpnext", "frappe/erpnext" or
+// "erpnext>=15") into the app name and an optional version constraint
+func parseRequiredApp(required string) (string, string) {
+	name, constraint := required, ""
+	if i := strings.IndexAny(required, "<>=!~^ "); i >= 0 {
+		name, constraint = required[:i], strings.TrimSpace(required[i:])
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSpace(name), constraint
+}
+
+// frappeVersionRange returns the Frappe versions a frappeVersion stands for: a branch
+// ("version-15") or major ("15") covers every 15.x release, "v15.3.0" only itself.
+// Branches without a version, such as "develop", are unknown.
+func frappeVersionRange(frappeVersion string) (fpm.Version, fpm.Version, bool) {
+	raw := strings.TrimPrefix(strings.TrimPrefix(frappeVersion, "version-"), "v")
+	v, err := fpm.ParseVersion(raw)
+	if err != nil {
+		return fpm.Version{}, fpm.Version{}, false
+	}
+	switch strings.Count(strings.SplitN(raw, "-", 2)[0], ".") {
+	case 0:
+		return v, fpm.Version{Major: v.Major + 1}, true
+	case 1:
+		return v, fpm.Version{Major: v.Major, Minor: v.Minor + 1}, true
+	}
+	return v, fpm.Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}, true
+}
+
+// mergeBenchInitReport completes the lock with what the init Job found on the bench:
+// the versions and commits it installed and the dependencies the apps declare
+func mergeBenchInitReport(lock *vyogotechv1alpha1.BenchLock, report *benchInitReport) {
+	if lock == nil {
+		return
+	}
+	if report.Frappe != "" {
+		lock.Frappe = report.Frappe
+	}
+	for _, app := range report.Apps {
+		entry := findLockedApp(lock, app.Name)
+		if entry == nil || app.State != vyogotechv1alpha1.BenchAppStateInstalled ||
+			entry.Source != app.Source || entry.Requested != app.Version {
+			continue
+		}
+		if entry.Version == "" {
+			entry.Version = app.InstalledVersion
+		}
+		if entry.Source == "git" && app.GitCommit != "" {
+			entry.GitCommit = app.GitCommit
+		}
+		if len(app.RequiredApps) > 0 {
+			entry.RequiredApps = app.RequiredApps
+		}
+		if app.Frappe != "" {
+			entry.Frappe = app.Frappe
+		}
+	}
+}
+
+// benchLockInputs returns the lock without what the init Job reported itself (Git commits
+// and versions the operator did not resolve), for fingerprinting the init script:
+// recording what a Job installed must not make it run again.
+func benchLockInputs(lock *vyogotechv1alpha1.BenchLock) *vyogotechv1alpha1.BenchLock {
+	if lock == nil {
+		return nil
+	}
+	inputs := lock.DeepCopy()
+	inputs.Frappe = ""
+	for i := range inputs.Apps {
+		inputs.Apps[i].GitCommit = ""
+		if inputs.Apps[i].Source != "fpm" || inputs.Apps[i].Repository == "" {
+			inputs.Apps[i].Version = ""
+		}
+	}
+	return inputs
+}
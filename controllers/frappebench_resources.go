@@ -20,11 +20,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -42,13 +44,31 @@ import (
 func (r *FrappeBenchReconciler) ensureBenchStorage(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
 	logger := log.FromContext(ctx)
 
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	pvcName := benchSitesClaim(bench)
 	pvc := &corev1.PersistentVolumeClaim{}
 
 	err := r.Get(ctx, types.NamespacedName{Name: pvcName, Namespace: bench.Namespace}, pvc)
 	if err == nil {
+		if !pvc.DeletionTimestamp.IsZero() {
+			// A ReadWriteOnce PVC replaces it once it is gone
+			logger.Info("Waiting for sites PVC to be deleted", "pvc", pvcName)
+			return nil
+		}
+		if shouldFallbackStorage(pvc, bench) && time.Since(pvc.CreationTimestamp.Time) > storageFallbackTimeout {
+			// Access modes are immutable, but nothing was written to a claim that never bound
+			logger.Info("ReadWriteMany sites PVC was not provisioned, falling back to ReadWriteOnce", "pvc", pvcName)
+			if err := r.markStorageFallback(ctx, bench); err != nil {
+				return err
+			}
+			return client.IgnoreNotFound(r.Delete(ctx, pvc))
+		}
+
+		// PVC spec is largely immutable once bound, only its labels and size are kept in line
 		logger.V(1).Info("PVC already exists", "pvc", pvcName)
-		return nil
+		if err := r.applyLabels(ctx, pvc, r.benchLabels(bench)); err != nil {
+			return err
+		}
+		return r.reconcileBenchStorageSize(ctx, bench, pvc)
 	}
 
 	if !errors.IsNotFound(err) {
@@ -70,9 +90,23 @@ func (r *FrappeBenchReconciler) ensureBenchStorage(ctx context.Context, bench *v
 
 func (r *FrappeBenchReconciler) createBenchPVC(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, accessMode corev1.PersistentVolumeAccessMode, sc *storagev1.StorageClass) error {
 	logger := log.FromContext(ctx)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
-	storageSize := resource.MustParse("10Gi")
+	pvcName := benchSitesClaim(bench)
+
+	pvc, err := r.newBenchPVC(bench, pvcName, accessMode, sc, benchStorageSize(bench))
+	if err != nil {
+		return err
+	}
 
+	logger.Info("Creating PVC for bench", "pvc", pvcName, "accessMode", accessMode)
+	if err := r.Create(ctx, pvc); err != nil {
+		return err
+	}
+	reportBenchStorage(bench, pvc)
+	return nil
+}
+
+// newBenchPVC returns a sites PVC for the bench
+func (r *FrappeBenchReconciler) newBenchPVC(bench *vyogotechv1alpha1.FrappeBench, pvcName string, accessMode corev1.PersistentVolumeAccessMode, sc *storagev1.StorageClass, storageSize resource.Quantity) (*corev1.PersistentVolumeClaim, error) {
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      pvcName,
@@ -106,11 +140,9 @@ func (r *FrappeBenchReconciler) createBenchPVC(ctx context.Context, bench *vyogo
 	}
 
 	if err := controllerutil.SetControllerReference(bench, pvc, r.Scheme); err != nil {
-		return err
+		return nil, err
 	}
-
-	logger.Info("Creating PVC for bench", "pvc", pvcName, "accessMode", accessMode)
-	return r.Create(ctx, pvc)
+	return pvc, nil
 }
 
 func (r *FrappeBenchReconciler) chooseStorageClass(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) (*storagev1.StorageClass, error) {
@@ -218,13 +250,20 @@ func isDefaultStorageClass(sc *storagev1.StorageClass) bool {
 	return false
 }
 
-func (r *FrappeBenchReconciler) getBenchStorageAccessMode(bench *vyogotechv1alpha1.FrappeBench) corev1.PersistentVolumeAccessMode {
-	if bench.Annotations != nil && bench.Annotations["frappe.tech/storage-fallback"] == "true" {
+// getBenchStorageAccessMode returns the access mode of the sites PVC
+func getBenchStorageAccessMode(bench *vyogotechv1alpha1.FrappeBench) corev1.PersistentVolumeAccessMode {
+	if bench.Status.Storage != nil && bench.Status.Storage.AccessMode != "" {
+		return bench.Status.Storage.AccessMode
+	}
+	if bench.Annotations != nil && (bench.Annotations["frappe.tech/storage-fallback"] == "true" ||
+		bench.Annotations["frappe.tech/storage-access-mode"] == string(corev1.ReadWriteOnce)) {
 		return corev1.ReadWriteOnce
 	}
 	return corev1.ReadWriteMany
 }
 
+// markStorageFallback records that the bench uses a ReadWriteOnce PVC because its
+// ReadWriteMany claim could not be provisioned, so the PVC is created again as ReadWriteOnce
 func (r *FrappeBenchReconciler) markStorageFallback(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
 	logger := log.FromContext(ctx)
 
@@ -234,13 +273,15 @@ func (r *FrappeBenchReconciler) markStorageFallback(ctx context.Context, bench *
 		bench.Annotations = make(map[string]string)
 	}
 	bench.Annotations["frappe.tech/storage-fallback"] = "true"
+	bench.Annotations["frappe.tech/storage-access-mode"] = string(corev1.ReadWriteOnce)
 
 	logger.Info("Marking bench for storage fallback", "bench", bench.Name)
 	return r.Patch(ctx, bench, patch)
 }
 
+// shouldFallbackStorage reports whether pvc is a ReadWriteMany claim that was never bound
 func shouldFallbackStorage(pvc *corev1.PersistentVolumeClaim, bench *vyogotechv1alpha1.FrappeBench) bool {
-	if pvc.Status.Phase != corev1.ClaimPending {
+	if pvc.Status.Phase != corev1.ClaimPending || pvc.Spec.VolumeName != "" {
 		return false
 	}
 	if pvc.Annotations["frappe.tech/requested-access"] != string(corev1.ReadWriteMany) {
@@ -268,23 +309,9 @@ func (r *FrappeBenchReconciler) ensureRedis(ctx context.Context, bench *vyogotec
 }
 
 func (r *FrappeBenchReconciler) ensureRedisService(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, serviceType string) error {
-	logger := log.FromContext(ctx)
-
 	svcName := fmt.Sprintf("%s-%s", bench.Name, serviceType)
-	svc := &corev1.Service{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: svcName, Namespace: bench.Namespace}, svc)
-	if err == nil {
-		return nil
-	}
 
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Redis Service", "service", svcName, "type", serviceType)
-
-	svc = &corev1.Service{
+	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      svcName,
 			Namespace: bench.Namespace,
@@ -303,34 +330,16 @@ func (r *FrappeBenchReconciler) ensureRedisService(ctx context.Context, bench *v
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, svc, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, svc)
+	return r.applyService(ctx, bench, svc)
 }
 
 func (r *FrappeBenchReconciler) ensureRedisStatefulSet(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, role string) error {
-	logger := log.FromContext(ctx)
-
 	stsName := fmt.Sprintf("%s-%s", bench.Name, role)
-	sts := &appsv1.StatefulSet{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: stsName, Namespace: bench.Namespace}, sts)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Redis StatefulSet", "statefulset", stsName)
 
 	replicas := int32(1)
 	redisImage := r.getRedisImage(bench)
 
-	sts = &appsv1.StatefulSet{
+	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      stsName,
 			Namespace: bench.Namespace,
@@ -366,11 +375,7 @@ func (r *FrappeBenchReconciler) ensureRedisStatefulSet(ctx context.Context, benc
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, sts, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, sts)
+	return r.applyStatefulSet(ctx, bench, sts)
 }
 
 // ensureGunicorn ensures the Gunicorn Deployment and Service exist
@@ -382,23 +387,9 @@ func (r *FrappeBenchReconciler) ensureGunicorn(ctx context.Context, bench *vyogo
 }
 
 func (r *FrappeBenchReconciler) ensureGunicornService(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	svcName := fmt.Sprintf("%s-gunicorn", bench.Name)
-	svc := &corev1.Service{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: svcName, Namespace: bench.Namespace}, svc)
-	if err == nil {
-		return nil
-	}
 
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Gunicorn Service", "service", svcName)
-
-	svc = &corev1.Service{
+	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      svcName,
 			Namespace: bench.Namespace,
@@ -416,35 +407,17 @@ func (r *FrappeBenchReconciler) ensureGunicornService(ctx context.Context, bench
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, svc, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, svc)
+	return r.applyService(ctx, bench, svc)
 }
 
 func (r *FrappeBenchReconciler) ensureGunicornDeployment(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	deployName := fmt.Sprintf("%s-gunicorn", bench.Name)
-	deploy := &appsv1.Deployment{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: deployName, Namespace: bench.Namespace}, deploy)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Gunicorn Deployment", "deployment", deployName)
 
 	replicas := r.getGunicornReplicas(bench)
-	image := r.getBenchImage(bench)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	image := r.getRunningImage(bench)
+	pvcName := benchSitesClaim(bench)
 
-	deploy = &appsv1.Deployment{
+	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deployName,
 			Namespace: bench.Namespace,
@@ -457,9 +430,10 @@ func (r *FrappeBenchReconciler) ensureGunicornDeployment(ctx context.Context, be
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: r.componentLabels(bench, "gunicorn"),
+					Labels: withSitesVolumeLabel(bench, r.componentLabels(bench, "gunicorn")),
 				},
 				Spec: corev1.PodSpec{
+					Affinity: benchSitesAffinity(bench),
 					Containers: []corev1.Container{
 						{
 							Name:  "gunicorn",
@@ -471,13 +445,8 @@ func (r *FrappeBenchReconciler) ensureGunicornDeployment(ctx context.Context, be
 									Name:          "http",
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
-							Resources: r.getGunicornResources(bench),
+							VolumeMounts: benchVolumeMounts(bench, image),
+							Resources:    r.getGunicornResources(bench),
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -495,11 +464,7 @@ func (r *FrappeBenchReconciler) ensureGunicornDeployment(ctx context.Context, be
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, deploy, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, deploy)
+	return r.applyDeployment(ctx, bench, deploy, false)
 }
 
 // ensureNginx ensures the NGINX Deployment and Service exist
@@ -511,23 +476,9 @@ func (r *FrappeBenchReconciler) ensureNginx(ctx context.Context, bench *vyogotec
 }
 
 func (r *FrappeBenchReconciler) ensureNginxService(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	svcName := fmt.Sprintf("%s-nginx", bench.Name)
-	svc := &corev1.Service{}
 
-	err := r.Get(ctx, types.NamespacedName{Name: svcName, Namespace: bench.Namespace}, svc)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating NGINX Service", "service", svcName)
-
-	svc = &corev1.Service{
+	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      svcName,
 			Namespace: bench.Namespace,
@@ -545,36 +496,18 @@ func (r *FrappeBenchReconciler) ensureNginxService(ctx context.Context, bench *v
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, svc, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, svc)
+	return r.applyService(ctx, bench, svc)
 }
 
 func (r *FrappeBenchReconciler) ensureNginxDeployment(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	deployName := fmt.Sprintf("%s-nginx", bench.Name)
-	deploy := &appsv1.Deployment{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: deployName, Namespace: bench.Namespace}, deploy)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating NGINX Deployment", "deployment", deployName)
 
 	replicas := r.getNginxReplicas(bench)
-	image := r.getBenchImage(bench)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	image := r.getRunningImage(bench)
+	pvcName := benchSitesClaim(bench)
 	gunicornSvc := fmt.Sprintf("%s-gunicorn", bench.Name)
 
-	deploy = &appsv1.Deployment{
+	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deployName,
 			Namespace: bench.Namespace,
@@ -587,9 +520,10 @@ func (r *FrappeBenchReconciler) ensureNginxDeployment(ctx context.Context, bench
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: r.componentLabels(bench, "nginx"),
+					Labels: withSitesVolumeLabel(bench, r.componentLabels(bench, "nginx")),
 				},
 				Spec: corev1.PodSpec{
+					Affinity: benchSitesAffinity(bench),
 					Containers: []corev1.Container{
 						{
 							Name:  "nginx",
@@ -629,13 +563,8 @@ func (r *FrappeBenchReconciler) ensureNginxDeployment(ctx context.Context, bench
 									Value: "$host",
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
-							Resources: r.getNginxResources(bench),
+							VolumeMounts: benchVolumeMounts(bench, image),
+							Resources:    r.getNginxResources(bench),
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -653,11 +582,7 @@ func (r *FrappeBenchReconciler) ensureNginxDeployment(ctx context.Context, bench
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, deploy, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, deploy)
+	return r.applyDeployment(ctx, bench, deploy, false)
 }
 
 // ensureSocketIO ensures the Socket.IO Deployment and Service exist
@@ -669,23 +594,9 @@ func (r *FrappeBenchReconciler) ensureSocketIO(ctx context.Context, bench *vyogo
 }
 
 func (r *FrappeBenchReconciler) ensureSocketIOService(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	svcName := fmt.Sprintf("%s-socketio", bench.Name)
-	svc := &corev1.Service{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: svcName, Namespace: bench.Namespace}, svc)
-	if err == nil {
-		return nil
-	}
 
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Socket.IO Service", "service", svcName)
-
-	svc = &corev1.Service{
+	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      svcName,
 			Namespace: bench.Namespace,
@@ -703,35 +614,17 @@ func (r *FrappeBenchReconciler) ensureSocketIOService(ctx context.Context, bench
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, svc, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, svc)
+	return r.applyService(ctx, bench, svc)
 }
 
 func (r *FrappeBenchReconciler) ensureSocketIODeployment(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	deployName := fmt.Sprintf("%s-socketio", bench.Name)
-	deploy := &appsv1.Deployment{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: deployName, Namespace: bench.Namespace}, deploy)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Socket.IO Deployment", "deployment", deployName)
 
 	replicas := r.getSocketIOReplicas(bench)
-	image := r.getBenchImage(bench)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	image := r.getRunningImage(bench)
+	pvcName := benchSitesClaim(bench)
 
-	deploy = &appsv1.Deployment{
+	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deployName,
 			Namespace: bench.Namespace,
@@ -744,9 +637,10 @@ func (r *FrappeBenchReconciler) ensureSocketIODeployment(ctx context.Context, be
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: r.componentLabels(bench, "socketio"),
+					Labels: withSitesVolumeLabel(bench, r.componentLabels(bench, "socketio")),
 				},
 				Spec: corev1.PodSpec{
+					Affinity: benchSitesAffinity(bench),
 					Containers: []corev1.Container{
 						{
 							Name:  "socketio",
@@ -761,13 +655,8 @@ func (r *FrappeBenchReconciler) ensureSocketIODeployment(ctx context.Context, be
 									Name:          "socketio",
 								},
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
-							Resources: r.getSocketIOResources(bench),
+							VolumeMounts: benchVolumeMounts(bench, image),
+							Resources:    r.getSocketIOResources(bench),
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -785,36 +674,18 @@ func (r *FrappeBenchReconciler) ensureSocketIODeployment(ctx context.Context, be
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, deploy, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, deploy)
+	return r.applyDeployment(ctx, bench, deploy, false)
 }
 
 // ensureScheduler ensures the Scheduler Deployment exists
 func (r *FrappeBenchReconciler) ensureScheduler(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
-	logger := log.FromContext(ctx)
-
 	deployName := fmt.Sprintf("%s-scheduler", bench.Name)
-	deploy := &appsv1.Deployment{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: deployName, Namespace: bench.Namespace}, deploy)
-	if err == nil {
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Scheduler Deployment", "deployment", deployName)
 
 	replicas := int32(1) // Scheduler should only have 1 replica
-	image := r.getBenchImage(bench)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	image := r.getRunningImage(bench)
+	pvcName := benchSitesClaim(bench)
 
-	deploy = &appsv1.Deployment{
+	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deployName,
 			Namespace: bench.Namespace,
@@ -827,9 +698,10 @@ func (r *FrappeBenchReconciler) ensureScheduler(ctx context.Context, bench *vyog
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: r.componentLabels(bench, "scheduler"),
+					Labels: withSitesVolumeLabel(bench, r.componentLabels(bench, "scheduler")),
 				},
 				Spec: corev1.PodSpec{
+					Affinity: benchSitesAffinity(bench),
 					Containers: []corev1.Container{
 						{
 							Name:  "scheduler",
@@ -838,13 +710,8 @@ func (r *FrappeBenchReconciler) ensureScheduler(ctx context.Context, bench *vyog
 								"bench",
 								"schedule",
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
-							Resources: r.getSchedulerResources(bench),
+							VolumeMounts: benchVolumeMounts(bench, image),
+							Resources:    r.getSchedulerResources(bench),
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -862,11 +729,7 @@ func (r *FrappeBenchReconciler) ensureScheduler(ctx context.Context, bench *vyog
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, deploy, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, deploy)
+	return r.applyDeployment(ctx, bench, deploy, false)
 }
 
 // ensureWorkers ensures all Worker Deployments exist
@@ -913,35 +776,13 @@ func (r *FrappeBenchReconciler) ensureWorkers(ctx context.Context, bench *vyogot
 }
 
 func (r *FrappeBenchReconciler) ensureWorkerDeployment(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, workerType, queue string, replicas int32, resources corev1.ResourceRequirements, config *vyogotechv1alpha1.WorkerAutoscaling, kedaAvailable bool) error {
-	logger := log.FromContext(ctx)
-
 	deployName := fmt.Sprintf("%s-worker-%s", bench.Name, workerType)
-	deploy := &appsv1.Deployment{}
-
-	err := r.Get(ctx, types.NamespacedName{Name: deployName, Namespace: bench.Namespace}, deploy)
 
 	// Determine if this worker is managed by KEDA
 	kedaManaged := kedaAvailable && config.Enabled != nil && *config.Enabled
 
-	if err == nil {
-		// Deployment exists, update it if needed
-		// Only update replicas if NOT managed by KEDA (KEDA controls replicas)
-		if !kedaManaged && *deploy.Spec.Replicas != replicas {
-			logger.Info("Updating worker replicas", "worker", workerType, "oldReplicas", *deploy.Spec.Replicas, "newReplicas", replicas)
-			deploy.Spec.Replicas = &replicas
-			return r.Update(ctx, deploy)
-		}
-		return nil
-	}
-
-	if !errors.IsNotFound(err) {
-		return err
-	}
-
-	logger.Info("Creating Worker Deployment", "deployment", deployName, "queue", queue, "replicas", replicas, "kedaManaged", kedaManaged)
-
-	image := r.getBenchImage(bench)
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	image := r.getRunningImage(bench)
+	pvcName := benchSitesClaim(bench)
 
 	// Add annotations to indicate scaling mode
 	annotations := map[string]string{}
@@ -952,7 +793,7 @@ func (r *FrappeBenchReconciler) ensureWorkerDeployment(ctx context.Context, benc
 		annotations["frappe.io/scaling-mode"] = "static"
 	}
 
-	deploy = &appsv1.Deployment{
+	deploy := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        deployName,
 			Namespace:   bench.Namespace,
@@ -966,9 +807,10 @@ func (r *FrappeBenchReconciler) ensureWorkerDeployment(ctx context.Context, benc
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: r.componentLabels(bench, fmt.Sprintf("worker-%s", workerType)),
+					Labels: withSitesVolumeLabel(bench, r.componentLabels(bench, fmt.Sprintf("worker-%s", workerType))),
 				},
 				Spec: corev1.PodSpec{
+					Affinity: benchSitesAffinity(bench),
 					Containers: []corev1.Container{
 						{
 							Name:  "worker",
@@ -979,13 +821,8 @@ func (r *FrappeBenchReconciler) ensureWorkerDeployment(ctx context.Context, benc
 								"--queue",
 								queue,
 							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
-							Resources: resources,
+							VolumeMounts: benchVolumeMounts(bench, image),
+							Resources:    resources,
 						},
 					},
 					Volumes: []corev1.Volume{
@@ -1003,11 +840,8 @@ func (r *FrappeBenchReconciler) ensureWorkerDeployment(ctx context.Context, benc
 		},
 	}
 
-	if err := controllerutil.SetControllerReference(bench, deploy, r.Scheme); err != nil {
-		return err
-	}
-
-	return r.Create(ctx, deploy)
+	// Only keep replicas in line if NOT managed by KEDA (KEDA controls replicas)
+	return r.applyDeployment(ctx, bench, deploy, kedaManaged)
 }
 
 // Helper functions for getting configuration values
@@ -1381,7 +1215,7 @@ func (r *FrappeBenchReconciler) isKEDAAvailable(ctx context.Context) bool {
 	err := r.Client.List(ctx, list, client.Limit(1))
 
 	// NoMatchError means the CRD doesn't exist
-	if errors.IsNotFound(err) {
+	if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
 		return false
 	}
 
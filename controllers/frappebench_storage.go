@@ -0,0 +1,604 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	// defaultBenchStorageSize is the size of the sites PVC when spec.storage.size is unset
+	defaultBenchStorageSize = "10Gi"
+
+	// benchConditionStorageReady reports whether the sites PVC is bound at the requested size
+	benchConditionStorageReady = "StorageReady"
+
+	// storageMigrationClaimAnnotation records the PVC a storage copy Job copies to
+	storageMigrationClaimAnnotation = "vyogo.tech/storage-migration-claim"
+
+	// kedaPausedReplicasAnnotation pauses a ScaledObject at the given replica count
+	kedaPausedReplicasAnnotation = "autoscaling.keda.sh/paused-replicas"
+
+	// benchConditionSharedStorage reports whether pods mounting the sites PVC can run on any node
+	benchConditionSharedStorage = "SharedStorage"
+
+	// benchSitesVolumeLabel marks the pods that mount the sites PVC of a bench
+	benchSitesVolumeLabel = "vyogo.tech/sites-volume"
+)
+
+// storageFallbackTimeout is how long a ReadWriteMany sites PVC may stay Pending
+// before the bench falls back to ReadWriteOnce; tests shorten it
+var storageFallbackTimeout = 2 * time.Minute
+
+// storageCopyScript copies the old sites PVC, mounted at /source, to the new one at /target.
+// It runs as root so file owners are kept, then hands the volume root to its old owner.
+const storageCopyScript = `set -e
+find /target -mindepth 1 -delete
+cp -a /source/. /target/
+chown "$(stat -c %u:%g /source)" /target
+chmod "$(stat -c %a /source)" /target
+echo "Copied $(du -sh /target | cut -f1) of sites"
+`
+
+// benchSitesClaim returns the name of the PVC the bench mounts as sites/
+// It changes when the sites are migrated to another storage class.
+func benchSitesClaim(bench *vyogotechv1alpha1.FrappeBench) string {
+	if bench.Status.Storage != nil && bench.Status.Storage.ClaimName != "" {
+		return bench.Status.Storage.ClaimName
+	}
+	return fmt.Sprintf("%s-sites", bench.Name)
+}
+
+// withSitesVolumeLabel adds the label benchSitesAffinity selects on to the labels of a pod
+// that mounts the sites PVC of bench
+func withSitesVolumeLabel(bench *vyogotechv1alpha1.FrappeBench, labels map[string]string) map[string]string {
+	return mergeStringMaps(labels, map[string]string{benchSitesVolumeLabel: bench.Name})
+}
+
+// benchSitesAffinity keeps every pod that mounts a ReadWriteOnce sites PVC on the node
+// the volume is attached to, next to the other pods that mount it. Returns nil when the
+// PVC can be mounted from any node.
+func benchSitesAffinity(bench *vyogotechv1alpha1.FrappeBench) *corev1.Affinity {
+	if getBenchStorageAccessMode(bench) != corev1.ReadWriteOnce {
+		return nil
+	}
+	return &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+				{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{benchSitesVolumeLabel: bench.Name},
+					},
+					TopologyKey: corev1.LabelHostname,
+				},
+			},
+		},
+	}
+}
+
+// setBenchSharedStorageCondition reports how pods mounting the sites PVC are scheduled
+func setBenchSharedStorageCondition(bench *vyogotechv1alpha1.FrappeBench) {
+	if getBenchStorageAccessMode(bench) != corev1.ReadWriteOnce {
+		meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+			Type:    benchConditionSharedStorage,
+			Status:  metav1.ConditionTrue,
+			Reason:  "ReadWriteMany",
+			Message: "the sites PVC is ReadWriteMany, bench pods run on any node",
+		})
+		return
+	}
+
+	message := "the sites PVC is ReadWriteOnce, every pod that mounts it is scheduled onto the node the volume is attached to"
+	if bench.Annotations["frappe.tech/storage-fallback"] == "true" {
+		message = "the ReadWriteMany sites PVC could not be provisioned; " + message
+	}
+	meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+		Type:    benchConditionSharedStorage,
+		Status:  metav1.ConditionFalse,
+		Reason:  "CoScheduled",
+		Message: message,
+	})
+}
+
+// benchStorageSize returns the requested size of the sites PVC
+func benchStorageSize(bench *vyogotechv1alpha1.FrappeBench) resource.Quantity {
+	if bench.Spec.Storage != nil && bench.Spec.Storage.Size != nil {
+		return *bench.Spec.Storage.Size
+	}
+	return resource.MustParse(defaultBenchStorageSize)
+}
+
+// reportBenchStorage records the sites PVC in the bench status
+func reportBenchStorage(bench *vyogotechv1alpha1.FrappeBench, pvc *corev1.PersistentVolumeClaim) {
+	if bench.Status.Storage == nil {
+		bench.Status.Storage = &vyogotechv1alpha1.BenchStorageStatus{}
+	}
+	status := bench.Status.Storage
+	status.ClaimName = pvc.Name
+	status.StorageClassName = ""
+	if pvc.Spec.StorageClassName != nil {
+		status.StorageClassName = *pvc.Spec.StorageClassName
+	}
+	status.AccessMode = ""
+	if len(pvc.Spec.AccessModes) > 0 {
+		status.AccessMode = pvc.Spec.AccessModes[0]
+	}
+	status.Capacity = ""
+	if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		status.Capacity = capacity.String()
+	}
+	setBenchSharedStorageCondition(bench)
+}
+
+func setBenchStorageCondition(bench *vyogotechv1alpha1.FrappeBench, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&bench.Status.Conditions, metav1.Condition{
+		Type:    benchConditionStorageReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// reconcileBenchStorageSize expands the sites PVC to spec.storage.size and reports it.
+// Expansion happens online when the StorageClass allows it; PVCs cannot shrink.
+func (r *FrappeBenchReconciler) reconcileBenchStorageSize(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, pvc *corev1.PersistentVolumeClaim) error {
+	logger := log.FromContext(ctx)
+	reportBenchStorage(bench, pvc)
+
+	desired := benchStorageSize(bench)
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	if cmp := desired.Cmp(requested); cmp < 0 {
+		setBenchStorageCondition(bench, metav1.ConditionFalse, "ShrinkUnsupported",
+			fmt.Sprintf("PVC %s is %s, it cannot shrink to %s", pvc.Name, requested.String(), desired.String()))
+		return nil
+	} else if cmp > 0 {
+		allowed, err := r.storageClassAllowsExpansion(ctx, pvc)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			setBenchStorageCondition(bench, metav1.ConditionFalse, "ExpansionUnsupported",
+				fmt.Sprintf("the storage class of PVC %s does not allow volume expansion, it stays at %s", pvc.Name, requested.String()))
+			return nil
+		}
+
+		logger.Info("Expanding sites PVC", "pvc", pvc.Name, "from", requested.String(), "to", desired.String())
+		patch := client.MergeFrom(pvc.DeepCopy())
+		if pvc.Spec.Resources.Requests == nil {
+			pvc.Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = desired
+		if err := r.Patch(ctx, pvc, patch); err != nil {
+			return err
+		}
+		setBenchStorageCondition(bench, metav1.ConditionFalse, "Resizing",
+			fmt.Sprintf("expanding PVC %s from %s to %s", pvc.Name, requested.String(), desired.String()))
+		return nil
+	}
+
+	if pvc.Status.Phase != corev1.ClaimBound {
+		setBenchStorageCondition(bench, metav1.ConditionFalse, "Pending", fmt.Sprintf("PVC %s is not bound yet", pvc.Name))
+		return nil
+	}
+	capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+	if capacity.Cmp(desired) < 0 {
+		// The volume is resized by the CSI driver, the file system when a pod next mounts it
+		message := fmt.Sprintf("expanding PVC %s from %s to %s", pvc.Name, capacity.String(), desired.String())
+		for _, cond := range pvc.Status.Conditions {
+			if cond.Type == corev1.PersistentVolumeClaimFileSystemResizePending && cond.Status == corev1.ConditionTrue {
+				message += ", the file system is resized when a pod mounts it"
+			}
+		}
+		setBenchStorageCondition(bench, metav1.ConditionFalse, "Resizing", message)
+		return nil
+	}
+	setBenchStorageCondition(bench, metav1.ConditionTrue, "Bound", fmt.Sprintf("PVC %s is bound with %s", pvc.Name, capacity.String()))
+	return nil
+}
+
+// storageClassAllowsExpansion reports whether the storage class of pvc has allowVolumeExpansion set
+func (r *FrappeBenchReconciler) storageClassAllowsExpansion(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+	sc := &storagev1.StorageClass{}
+	if err := r.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, sc); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion, nil
+}
+
+// reconcileStorageMigration moves sites/ to a new PVC on the storage class in
+// spec.storage.migration. The components are stopped while the copy runs, so the
+// copy is consistent; they start again on the new PVC, or on the old one if the
+// copy failed. Returns true while the components must stay stopped.
+func (r *FrappeBenchReconciler) reconcileStorageMigration(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	var target *vyogotechv1alpha1.StorageMigration
+	if bench.Spec.Storage != nil {
+		target = bench.Spec.Storage.Migration
+	}
+	if bench.Status.Storage == nil {
+		return false, nil
+	}
+	storage := bench.Status.Storage
+	migration := storage.Migration
+
+	if migration == nil || isStorageMigrationFinished(migration) {
+		if target == nil {
+			// Clearing spec.storage.migration lets a failed migration be tried again
+			if migration != nil && migration.Phase == vyogotechv1alpha1.StorageMigrationPhaseFailed {
+				storage.Migration = nil
+			}
+			return false, nil
+		}
+		if target.StorageClassName == storage.StorageClassName {
+			return false, nil
+		}
+		// Don't retry a failed migration until the target changes again
+		if migration != nil && migration.Phase == vyogotechv1alpha1.StorageMigrationPhaseFailed &&
+			migration.StorageClassName == target.StorageClassName {
+			return false, nil
+		}
+		// Upgrade Jobs use the sites PVC, so the migration waits for the upgrade
+		if bench.Status.Upgrade != nil && !isBenchUpgradeFinished(bench.Status.Upgrade) {
+			logger.Info("Waiting for the bench upgrade before migrating storage")
+			return false, nil
+		}
+		return r.startStorageMigration(ctx, bench, target)
+	}
+
+	logger.Info("Reconciling storage migration", "phase", migration.Phase, "from", migration.FromClaim, "to", migration.ToClaim)
+
+	switch migration.Phase {
+	case vyogotechv1alpha1.StorageMigrationPhaseStopping:
+		stopped, err := r.stopBenchComponents(ctx, bench)
+		if err != nil || !stopped {
+			return true, err
+		}
+		// Site Jobs started before the migration may still write to the old PVC
+		running, err := r.runningSitesVolumeJobs(ctx, bench)
+		if err != nil {
+			return true, err
+		}
+		if len(running) > 0 {
+			migration.Message = fmt.Sprintf("Waiting for Jobs using the sites PVC to finish: %s", strings.Join(running, ", "))
+			return true, nil
+		}
+		migration.Phase = vyogotechv1alpha1.StorageMigrationPhaseCopying
+		migration.Message = fmt.Sprintf("Copying sites from %s to %s", migration.FromClaim, migration.ToClaim)
+
+	case vyogotechv1alpha1.StorageMigrationPhaseCopying:
+		done, failed, err := r.runStorageCopyJob(ctx, bench, migration)
+		if err != nil || !done {
+			return true, err
+		}
+		if failed {
+			// The bench never used the new PVC, so nothing is lost with it; the Job is kept for its logs
+			pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: migration.ToClaim, Namespace: bench.Namespace}}
+			if err := r.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+				return true, err
+			}
+			finishStorageMigration(migration, vyogotechv1alpha1.StorageMigrationPhaseFailed,
+				fmt.Sprintf("copying sites to %s failed, the bench stays on %s", migration.ToClaim, migration.FromClaim))
+			return false, nil
+		}
+
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(ctx, types.NamespacedName{Name: migration.ToClaim, Namespace: bench.Namespace}, pvc); err != nil {
+			return true, err
+		}
+		reportBenchStorage(bench, pvc)
+
+		// Later fallbacks and PVCs follow the access mode of the new PVC. The patch goes
+		// through a copy, since its response would replace the status recorded above.
+		annotated := bench.DeepCopy()
+		patch := client.MergeFrom(bench.DeepCopy())
+		if annotated.Annotations == nil {
+			annotated.Annotations = make(map[string]string)
+		}
+		annotated.Annotations["frappe.tech/storage-access-mode"] = string(storage.AccessMode)
+		delete(annotated.Annotations, "frappe.tech/storage-fallback")
+		if err := r.Patch(ctx, annotated, patch); err != nil {
+			return true, err
+		}
+		bench.ObjectMeta = annotated.ObjectMeta
+
+		finishStorageMigration(migration, vyogotechv1alpha1.StorageMigrationPhaseCompleted,
+			fmt.Sprintf("Moved sites to %s; %s is kept until it is deleted", migration.ToClaim, migration.FromClaim))
+		logger.Info("Storage migration completed", "pvc", migration.ToClaim)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// startStorageMigration creates the new PVC and records the migration in the bench status
+func (r *FrappeBenchReconciler) startStorageMigration(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, target *vyogotechv1alpha1.StorageMigration) (bool, error) {
+	logger := log.FromContext(ctx)
+	storage := bench.Status.Storage
+
+	now := metav1.Now()
+	migration := &vyogotechv1alpha1.StorageMigrationStatus{
+		FromClaim:        storage.ClaimName,
+		ToClaim:          fmt.Sprintf("%s-sites-g%d", bench.Name, bench.Generation),
+		StorageClassName: target.StorageClassName,
+		StartTime:        &now,
+	}
+	storage.Migration = migration
+
+	sc := &storagev1.StorageClass{}
+	if err := r.Get(ctx, types.NamespacedName{Name: target.StorageClassName}, sc); err != nil {
+		if errors.IsNotFound(err) {
+			finishStorageMigration(migration, vyogotechv1alpha1.StorageMigrationPhaseFailed,
+				fmt.Sprintf("storage class %s not found", target.StorageClassName))
+			return false, nil
+		}
+		return false, err
+	}
+
+	accessMode := target.AccessMode
+	if accessMode == "" {
+		accessMode = corev1.ReadWriteOnce
+		if storageClassSupportsRWX(sc) {
+			accessMode = corev1.ReadWriteMany
+		}
+	}
+
+	// The new PVC is at least as large as the old one
+	size := benchStorageSize(bench)
+	current := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, types.NamespacedName{Name: migration.FromClaim, Namespace: bench.Namespace}, current); err != nil {
+		return false, err
+	}
+	if requested, ok := current.Spec.Resources.Requests[corev1.ResourceStorage]; ok && requested.Cmp(size) > 0 {
+		size = requested
+	}
+
+	pvc, err := r.newBenchPVC(bench, migration.ToClaim, accessMode, sc, size)
+	if err != nil {
+		return false, err
+	}
+	if err := r.Create(ctx, pvc); err != nil && !errors.IsAlreadyExists(err) {
+		return false, err
+	}
+
+	logger.Info("Starting storage migration", "from", migration.FromClaim, "to", migration.ToClaim, "storageClass", sc.Name, "accessMode", accessMode)
+	migration.Phase = vyogotechv1alpha1.StorageMigrationPhaseStopping
+	migration.Message = "Stopping bench components"
+	return true, nil
+}
+
+// stopBenchComponents scales the Deployments that mount the sites PVC to zero and
+// pauses their autoscaling. Returns true once no component pod is left.
+// The components are scaled back up by the next reconcile once the migration is over.
+func (r *FrappeBenchReconciler) stopBenchComponents(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) (bool, error) {
+	if r.isKEDAAvailable(ctx) {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(schema.GroupVersionKind{
+			Group:   "keda.sh",
+			Version: "v1alpha1",
+			Kind:    "ScaledObjectList",
+		})
+		if err := r.List(ctx, list, client.InNamespace(bench.Namespace), client.MatchingLabels(r.benchLabels(bench))); err != nil {
+			return false, err
+		}
+		for i := range list.Items {
+			scaledObject := &list.Items[i]
+			if scaledObject.GetAnnotations()[kedaPausedReplicasAnnotation] == "0" {
+				continue
+			}
+			patch := client.MergeFrom(scaledObject.DeepCopy())
+			scaledObject.SetAnnotations(mergeStringMaps(scaledObject.GetAnnotations(), map[string]string{kedaPausedReplicasAnnotation: "0"}))
+			if err := r.Patch(ctx, scaledObject, patch); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	stopped := true
+	for _, name := range benchComponentDeployments(bench) {
+		deploy := &appsv1.Deployment{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: bench.Namespace}, deploy); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if deploy.Spec.Replicas == nil || *deploy.Spec.Replicas != 0 {
+			patch := client.MergeFrom(deploy.DeepCopy())
+			deploy.Spec.Replicas = int32Ptr(0)
+			if err := r.Patch(ctx, deploy, patch); err != nil {
+				return false, err
+			}
+		}
+		if deploy.Status.Replicas > 0 {
+			stopped = false
+		}
+	}
+	return stopped, nil
+}
+
+// runningSitesVolumeJobs returns the names of the unfinished Jobs whose pods mount the
+// sites PVC of bench, found through the label withSitesVolumeLabel puts on their pods
+func (r *FrappeBenchReconciler) runningSitesVolumeJobs(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) ([]string, error) {
+	jobList := &batchv1.JobList{}
+	if err := r.List(ctx, jobList, client.InNamespace(bench.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var running []string
+	for _, job := range jobList.Items {
+		if job.Spec.Template.Labels[benchSitesVolumeLabel] != bench.Name {
+			continue
+		}
+		if !isJobFinished(&job) {
+			running = append(running, job.Name)
+		}
+	}
+	return running, nil
+}
+
+// isJobFinished reports whether the Job completed or failed for good; a Job that is
+// retrying a failed pod is still running
+func isJobFinished(job *batchv1.Job) bool {
+	for _, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// runStorageCopyJob runs the Job that copies the old sites PVC to the new one.
+// Returns whether the Job finished and whether it failed.
+func (r *FrappeBenchReconciler) runStorageCopyJob(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, migration *vyogotechv1alpha1.StorageMigrationStatus) (bool, bool, error) {
+	logger := log.FromContext(ctx)
+
+	jobName := fmt.Sprintf("%s-storage-migrate", bench.Name)
+	job := &batchv1.Job{}
+
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: bench.Namespace}, job)
+	if err == nil {
+		// Left over from an earlier migration and still being deleted
+		if job.Annotations[storageMigrationClaimAnnotation] != migration.ToClaim {
+			if job.DeletionTimestamp.IsZero() {
+				if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+					return false, false, err
+				}
+			}
+			return false, false, nil
+		}
+		if job.Status.Succeeded > 0 {
+			logger.Info("Storage copy job completed", "job", jobName)
+			return true, false, nil
+		}
+		if job.Status.Failed > 0 {
+			logger.Error(nil, "Storage copy job failed", "job", jobName)
+			return true, true, nil
+		}
+		return false, false, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return false, false, err
+	}
+
+	logger.Info("Creating storage copy job", "job", jobName, "from", migration.FromClaim, "to", migration.ToClaim)
+
+	root := int64(0)
+	backoffLimit := int32(0)
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        jobName,
+			Namespace:   bench.Namespace,
+			Labels:      r.componentLabels(bench, "storage-migrate"),
+			Annotations: map[string]string{storageMigrationClaimAnnotation: migration.ToClaim},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:            "copy",
+							Image:           r.getRunningImage(bench),
+							Command:         []string{"bash", "-c"},
+							Args:            []string{storageCopyScript},
+							SecurityContext: &corev1.SecurityContext{RunAsUser: &root},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "source", MountPath: "/source", ReadOnly: true},
+								{Name: "target", MountPath: "/target"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "source",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: migration.FromClaim,
+									ReadOnly:  true,
+								},
+							},
+						},
+						{
+							Name: "target",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: migration.ToClaim,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(bench, job, r.Scheme); err != nil {
+		return false, false, err
+	}
+
+	return false, false, r.Create(ctx, job)
+}
+
+func finishStorageMigration(migration *vyogotechv1alpha1.StorageMigrationStatus, phase vyogotechv1alpha1.StorageMigrationPhase, message string) {
+	now := metav1.Now()
+	migration.Phase = phase
+	migration.Message = message
+	migration.CompletionTime = &now
+}
+
+// benchStorageMigrating reports whether the sites of bench are being moved to another PVC.
+// Jobs that mount the sites PVC must not start until it is over, or what they write to
+// the old PVC after it was copied is lost.
+func benchStorageMigrating(bench *vyogotechv1alpha1.FrappeBench) bool {
+	return bench.Status.Storage != nil && bench.Status.Storage.Migration != nil &&
+		!isStorageMigrationFinished(bench.Status.Storage.Migration)
+}
+
+func isStorageMigrationFinished(migration *vyogotechv1alpha1.StorageMigrationStatus) bool {
+	return migration.Phase == vyogotechv1alpha1.StorageMigrationPhaseCompleted ||
+		migration.Phase == vyogotechv1alpha1.StorageMigrationPhaseFailed
+}
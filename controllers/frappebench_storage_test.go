@@ -0,0 +1,309 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Bench storage", func() {
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		r     *FrappeBenchReconciler
+	)
+
+	// step runs the storage part of a bench reconcile and round-trips the status through the API server
+	step := func() bool {
+		Expect(r.ensureBenchStorage(ctx, bench)).To(Succeed())
+		migrating, err := r.reconcileStorageMigration(ctx, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Status().Update(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(bench), bench)).To(Succeed())
+		return migrating
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "storage-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		// Storage classes are cluster scoped, so they are named after the namespace;
+		// the nfs one is taken to support ReadWriteMany
+		for name, provisioner := range map[string]string{ns + "-old": "example.com/block", ns + "-new": "example.com/block", ns + "-nfs": "example.com/nfs"} {
+			sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: name}, Provisioner: provisioner}
+			Expect(k8sClient.Create(ctx, sc)).To(Succeed())
+			DeferCleanup(func() { Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, sc))).To(Succeed()) })
+		}
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		r = &FrappeBenchReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	// sitesJob creates a running Job whose pods mount the sites PVC of the named bench
+	sitesJob := func(name, benchName string) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{benchSitesVolumeLabel: benchName}},
+					Spec: corev1.PodSpec{
+						RestartPolicy: corev1.RestartPolicyNever,
+						Containers:    []corev1.Container{{Name: "job", Image: "busybox"}},
+					},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, job)).To(Succeed())
+		return job
+	}
+
+	// completeJob marks a Job as succeeded
+	completeJob := func(job *batchv1.Job) {
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		job.Status.CompletionTime = &now
+		job.Status.Succeeded = 1
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	// startMigration moves a new bench on the old storage class into the Stopping phase
+	startMigration := func() {
+		bench.Spec.StorageClassName = ns + "-old"
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+		Expect(step()).To(BeFalse())
+
+		bench.Spec.Storage = &vyogotechv1alpha1.BenchStorage{
+			Migration: &vyogotechv1alpha1.StorageMigration{StorageClassName: ns + "-new"},
+		}
+		Expect(k8sClient.Update(ctx, bench)).To(Succeed())
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseStopping))
+	}
+
+	// sitesClaim returns the sites PVC with the given name
+	sitesClaim := func(name string) *corev1.PersistentVolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: name, Namespace: ns}, pvc)).To(Succeed())
+		return pvc
+	}
+
+	It("falls back to ReadWriteOnce when the ReadWriteMany PVC stays Pending", func() {
+		bench.Spec.StorageClassName = ns + "-nfs"
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		Expect(step()).To(BeFalse())
+		pvc := sitesClaim("bench-sites")
+		Expect(pvc.Spec.AccessModes).To(ConsistOf(corev1.ReadWriteMany))
+
+		// No provisioner binds the claim here
+		pvc.Status.Phase = corev1.ClaimPending
+		Expect(k8sClient.Status().Update(ctx, pvc)).To(Succeed())
+
+		// Within the timeout the bench waits for the claim
+		step()
+		Expect(meta.FindStatusCondition(bench.Status.Conditions, benchConditionStorageReady).Reason).To(Equal("Pending"))
+		Expect(meta.IsStatusConditionTrue(bench.Status.Conditions, benchConditionSharedStorage)).To(BeTrue())
+		Expect(sitesClaim("bench-sites").DeletionTimestamp.IsZero()).To(BeTrue())
+
+		timeout := storageFallbackTimeout
+		storageFallbackTimeout = 0
+		DeferCleanup(func() { storageFallbackTimeout = timeout })
+
+		step()
+		Expect(bench.Annotations).To(HaveKeyWithValue("frappe.tech/storage-fallback", "true"))
+		Expect(bench.Annotations).To(HaveKeyWithValue("frappe.tech/storage-access-mode", string(corev1.ReadWriteOnce)))
+		// Nothing removes the protection finalizer without the PVC controller
+		pvc = &corev1.PersistentVolumeClaim{}
+		if err := k8sClient.Get(ctx, client.ObjectKey{Name: "bench-sites", Namespace: ns}, pvc); err == nil {
+			Expect(pvc.DeletionTimestamp.IsZero()).To(BeFalse())
+			pvc.Finalizers = nil
+			Expect(k8sClient.Update(ctx, pvc)).To(Succeed())
+		}
+
+		step()
+		pvc = sitesClaim("bench-sites")
+		Expect(pvc.Spec.AccessModes).To(ConsistOf(corev1.ReadWriteOnce))
+		Expect(bench.Status.Storage.AccessMode).To(Equal(corev1.ReadWriteOnce))
+		shared := meta.FindStatusCondition(bench.Status.Conditions, benchConditionSharedStorage)
+		Expect(shared.Status).To(Equal(metav1.ConditionFalse))
+		Expect(shared.Reason).To(Equal("CoScheduled"))
+		Expect(shared.Message).To(ContainSubstring("could not be provisioned"))
+		Expect(benchSitesAffinity(bench)).NotTo(BeNil())
+
+		// The ReadWriteOnce claim is not replaced again while it is Pending
+		pvc.Status.Phase = corev1.ClaimPending
+		Expect(k8sClient.Status().Update(ctx, pvc)).To(Succeed())
+		step()
+		Expect(meta.FindStatusCondition(bench.Status.Conditions, benchConditionStorageReady).Reason).To(Equal("Pending"))
+		Expect(sitesClaim("bench-sites").DeletionTimestamp.IsZero()).To(BeTrue())
+	})
+
+	It("moves the sites to the new storage class and then leaves them there", func() {
+		bench.Spec.StorageClassName = ns + "-old"
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Storage.ClaimName).To(Equal("bench-sites"))
+		Expect(bench.Status.Storage.StorageClassName).To(Equal(ns + "-old"))
+
+		bench.Spec.Storage = &vyogotechv1alpha1.BenchStorage{
+			Migration: &vyogotechv1alpha1.StorageMigration{StorageClassName: ns + "-new"},
+		}
+		Expect(k8sClient.Update(ctx, bench)).To(Succeed())
+
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseStopping))
+		toClaim := bench.Status.Storage.Migration.ToClaim
+
+		// No components run here, so they are stopped right away
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseCopying))
+
+		Expect(step()).To(BeTrue())
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-storage-migrate", Namespace: ns}, job)).To(Succeed())
+		completeJob(job)
+
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseCompleted))
+		Expect(bench.Status.Storage.ClaimName).To(Equal(toClaim))
+		Expect(bench.Status.Storage.StorageClassName).To(Equal(ns + "-new"))
+		Expect(bench.Annotations).To(HaveKeyWithValue("frappe.tech/storage-access-mode", string(corev1.ReadWriteOnce)))
+		completed := bench.Status.Storage.DeepCopy()
+
+		// The next reconcile has nothing left to do
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Storage.ClaimName).To(Equal(completed.ClaimName))
+		Expect(bench.Status.Storage.Migration).To(Equal(completed.Migration))
+		claims := &corev1.PersistentVolumeClaimList{}
+		Expect(k8sClient.List(ctx, claims, client.InNamespace(ns))).To(Succeed())
+		Expect(claims.Items).To(HaveLen(2))
+	})
+
+	It("waits for running Jobs on the sites PVC before copying", func() {
+		startMigration()
+
+		backup := sitesJob("site-backup", bench.Name)
+		retrying := sitesJob("site-drop", bench.Name)
+		sitesJob("other-bench-job", "other")
+		// A Job that failed a pod and is retrying has no Failed condition yet
+		retrying.Status.Failed = 1
+		Expect(k8sClient.Status().Update(ctx, retrying)).To(Succeed())
+
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseStopping))
+		Expect(bench.Status.Storage.Migration.Message).To(ContainSubstring("site-backup"))
+		Expect(bench.Status.Storage.Migration.Message).To(ContainSubstring("site-drop"))
+		Expect(bench.Status.Storage.Migration.Message).NotTo(ContainSubstring("other-bench-job"))
+
+		completeJob(backup)
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseStopping))
+
+		now := metav1.Now()
+		retrying.Status.StartTime = &now
+		retrying.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, retrying)).To(Succeed())
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Storage.Migration.Phase).To(Equal(vyogotechv1alpha1.StorageMigrationPhaseCopying))
+	})
+
+	It("holds back site Jobs until the migration is over", func() {
+		startMigration()
+
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		siteJob := &vyogotechv1alpha1.SiteJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteJobSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+				Command: []string{"migrate"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, siteJob)).To(Succeed())
+		backup := &vyogotechv1alpha1.SiteBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: ns},
+			Spec:       vyogotechv1alpha1.SiteBackupSpec{SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name}},
+		}
+		Expect(k8sClient.Create(ctx, backup)).To(Succeed())
+
+		siteJobs := &SiteJobReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		backups := &SiteBackupReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		reconcileAll := func() {
+			_, err := siteJobs.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(siteJob)})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = backups.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(backup)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(siteJob), siteJob)).To(Succeed())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(backup), backup)).To(Succeed())
+		}
+
+		reconcileAll()
+		Expect(siteJob.Status.Phase).To(Equal(vyogotechv1alpha1.SiteJobPhasePending))
+		Expect(siteJob.Status.Message).To(ContainSubstring("storage migration of bench bench"))
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhasePending))
+		Expect(backup.Status.Message).To(ContainSubstring("storage migration of bench bench"))
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(BeEmpty())
+
+		// A failed migration leaves the bench on its old PVC and lets the Jobs run there
+		finishStorageMigration(bench.Status.Storage.Migration, vyogotechv1alpha1.StorageMigrationPhaseFailed, "copy failed")
+		Expect(k8sClient.Status().Update(ctx, bench)).To(Succeed())
+
+		reconcileAll()
+		Expect(siteJob.Status.Phase).To(Equal(vyogotechv1alpha1.SiteJobPhaseRunning))
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseRunning))
+	})
+})
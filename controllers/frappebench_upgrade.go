@@ -0,0 +1,561 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	upgradeStepBackup   = "backup"
+	upgradeStepBuild    = "build"
+	upgradeStepRollback = "rollback"
+
+	// upgradeBackupDir is where the pre-upgrade backup of a site is kept, under
+	// sites/<site>/private/backups, for the rollback to restore from
+	upgradeBackupDir = "pre-upgrade"
+)
+
+// reconcileUpgrade drives a managed upgrade whenever the spec image or Frappe
+// version differs from what the bench is running. Components keep running
+// bench.Status.CurrentImage until every site has migrated, so the upgrade can
+// be rolled back without touching them. Returns true while an upgrade is in progress.
+func (r *FrappeBenchReconciler) reconcileUpgrade(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, install benchInstallConfig) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	targetImage := r.getBenchImage(bench)
+	targetVersion := bench.Spec.FrappeVersion
+	// A built image moves to a new Frappe version only once it is built for it
+	if builtBenchImage(bench) != "" {
+		targetVersion = bench.Status.ImageBuild.FrappeVersion
+	}
+
+	// New bench (or one created before managed upgrades): adopt the spec as running
+	if bench.Status.CurrentImage == "" {
+		bench.Status.CurrentImage = targetImage
+		bench.Status.CurrentVersion = targetVersion
+		return false, nil
+	}
+
+	upgrade := bench.Status.Upgrade
+	if upgrade == nil || isBenchUpgradeFinished(upgrade) {
+		if bench.Status.CurrentImage == targetImage && bench.Status.CurrentVersion == targetVersion {
+			return false, nil
+		}
+		// Don't retry a failed upgrade until the target changes again
+		if upgrade != nil && upgrade.Phase != vyogotechv1alpha1.BenchUpgradePhaseCompleted &&
+			upgrade.ToImage == targetImage && upgrade.ToVersion == targetVersion {
+			return false, nil
+		}
+		return true, r.startUpgrade(ctx, bench, targetImage, targetVersion)
+	}
+
+	logger.Info("Reconciling bench upgrade", "phase", upgrade.Phase, "from", upgrade.FromImage, "to", upgrade.ToImage)
+
+	switch upgrade.Phase {
+	case vyogotechv1alpha1.BenchUpgradePhaseBackingUp:
+		done, failed, err := r.runUpgradeJob(ctx, bench, upgradeStepBackup, upgrade.FromImage, backupSitesScript, nil,
+			corev1.EnvVar{Name: "SITES", Value: strings.Join(upgrade.Sites, " ")},
+			corev1.EnvVar{Name: "BACKUP_DIR", Value: upgradeBackupDir})
+		if err != nil || !done {
+			return true, err
+		}
+		if failed {
+			// Nothing has changed yet, so there is nothing to roll back
+			finishUpgrade(upgrade, vyogotechv1alpha1.BenchUpgradePhaseFailed, "pre-upgrade backup failed, upgrade aborted")
+			return false, nil
+		}
+		upgrade.Phase = vyogotechv1alpha1.BenchUpgradePhaseBuilding
+		upgrade.Message = "Building assets with the new image"
+
+	case vyogotechv1alpha1.BenchUpgradePhaseBuilding:
+		// Apps installed at runtime are installed again into the new image's apps tree
+		script := buildAssetsScript
+		var buildInstall *benchInstallConfig
+		if benchInstallsApps(bench) {
+			if upgrade.Lock == nil {
+				lock, problems, err := r.resolveBenchLock(ctx, bench, install, r.benchApps(bench), bench.Status.Lock, upgrade.ToVersion)
+				if err != nil {
+					return true, err
+				}
+				if len(problems) == 0 {
+					problems = checkBenchLock(lock)
+				}
+				if len(problems) > 0 {
+					// Only the backup has run, so there is nothing to roll back
+					finishUpgrade(upgrade, vyogotechv1alpha1.BenchUpgradePhaseFailed,
+						fmt.Sprintf("apps cannot be installed on %s: %s", upgrade.ToVersion, strings.Join(problems, "; ")))
+					return false, nil
+				}
+				upgrade.Lock = lock
+			}
+			script = r.benchInitScript(bench, install, upgrade.Lock)
+			buildInstall = &install
+		}
+		done, failed, err := r.runUpgradeJob(ctx, bench, upgradeStepBuild, upgrade.ToImage, script, buildInstall)
+		if err != nil || !done {
+			return true, err
+		}
+		if failed {
+			startUpgradeRollback(upgrade, "asset build failed with the new image")
+			return true, nil
+		}
+		markBenchAssetsTree(bench, upgrade.ToImage)
+		upgrade.Phase = vyogotechv1alpha1.BenchUpgradePhaseMigrating
+		upgrade.Message = "Migrating sites"
+
+	case vyogotechv1alpha1.BenchUpgradePhaseMigrating:
+		// Sites are migrated one at a time, in the order they were listed at the start
+		for i, siteName := range upgrade.Sites {
+			if containsString(upgrade.MigratedSites, siteName) {
+				continue
+			}
+
+			step := fmt.Sprintf("migrate-%d", i)
+			done, failed, err := r.runUpgradeJob(ctx, bench, step, upgrade.ToImage, migrateSiteScript, nil,
+				corev1.EnvVar{Name: "SITE_NAME", Value: siteName})
+			if err != nil || !done {
+				return true, err
+			}
+			if failed {
+				upgrade.FailedSite = siteName
+				startUpgradeRollback(upgrade, fmt.Sprintf("migrate failed for site %s", siteName))
+				return true, nil
+			}
+			upgrade.MigratedSites = append(upgrade.MigratedSites, siteName)
+			upgrade.Message = fmt.Sprintf("Migrated %d/%d sites", len(upgrade.MigratedSites), len(upgrade.Sites))
+			return true, nil
+		}
+
+		// Every site is on the new schema, switch the components over
+		bench.Status.CurrentImage = upgrade.ToImage
+		bench.Status.CurrentVersion = upgrade.ToVersion
+		if upgrade.Lock != nil {
+			bench.Status.Lock = upgrade.Lock.DeepCopy()
+		}
+		upgrade.Phase = vyogotechv1alpha1.BenchUpgradePhaseRollingOut
+		upgrade.Message = "Rolling out bench components"
+
+	case vyogotechv1alpha1.BenchUpgradePhaseRollingOut:
+		rolledOut, err := r.benchComponentsRolledOut(ctx, bench)
+		if err != nil || !rolledOut {
+			return true, err
+		}
+		if err := r.deleteUpgradeJobs(ctx, bench); err != nil {
+			return true, err
+		}
+		finishUpgrade(upgrade, vyogotechv1alpha1.BenchUpgradePhaseCompleted,
+			fmt.Sprintf("Upgraded to %s", upgrade.ToImage))
+		logger.Info("Bench upgrade completed", "image", upgrade.ToImage)
+		return false, nil
+
+	case vyogotechv1alpha1.BenchUpgradePhaseRollingBack:
+		// The new image built into its own assets tree, so only the sites touched by
+		// migrate have to go back to the pre-upgrade backup
+		sites := rollbackSites(upgrade)
+		done, failed, err := r.runUpgradeJob(ctx, bench, upgradeStepRollback, upgrade.FromImage, rollbackSitesScript, nil,
+			corev1.EnvVar{Name: "SITES", Value: strings.Join(sites, " ")},
+			corev1.EnvVar{Name: "BACKUP_DIR", Value: upgradeBackupDir})
+		if err != nil || !done {
+			return true, err
+		}
+		if failed {
+			// Sites may be left half restored, the bench must not look healthy
+			finishUpgrade(upgrade, vyogotechv1alpha1.BenchUpgradePhaseFailed,
+				fmt.Sprintf("%s; restoring %s from the pre-upgrade backup also failed, restore them manually from sites/<site>/private/backups/%s",
+					upgrade.Message, strings.Join(sites, ", "), upgradeBackupDir))
+			return false, nil
+		}
+		upgrade.RestoredSites = sites
+		message := upgrade.Message + "; bench rolled back to " + upgrade.FromImage
+		if len(sites) > 0 {
+			message += ", restored " + strings.Join(sites, ", ") + " from the pre-upgrade backup"
+		}
+		finishUpgrade(upgrade, vyogotechv1alpha1.BenchUpgradePhaseRolledBack, message)
+		logger.Info("Bench upgrade rolled back", "image", upgrade.FromImage, "restoredSites", sites)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// startUpgrade records a new upgrade in the bench status
+func (r *FrappeBenchReconciler) startUpgrade(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, targetImage, targetVersion string) error {
+	logger := log.FromContext(ctx)
+
+	sites, err := r.benchSiteNames(ctx, bench)
+	if err != nil {
+		return err
+	}
+
+	// Jobs from a previous upgrade reuse the same names
+	if err := r.deleteUpgradeJobs(ctx, bench); err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	bench.Status.Upgrade = &vyogotechv1alpha1.BenchUpgradeStatus{
+		Phase:       vyogotechv1alpha1.BenchUpgradePhaseBackingUp,
+		FromImage:   bench.Status.CurrentImage,
+		ToImage:     targetImage,
+		FromVersion: bench.Status.CurrentVersion,
+		ToVersion:   targetVersion,
+		Sites:       sites,
+		Message:     fmt.Sprintf("Backing up %d sites", len(sites)),
+		StartTime:   &now,
+	}
+
+	logger.Info("Starting bench upgrade", "from", bench.Status.CurrentImage, "to", targetImage, "sites", sites)
+	return nil
+}
+
+// benchSiteNames lists the Frappe site names of every FrappeSite on the bench
+func (r *FrappeBenchReconciler) benchSiteNames(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) ([]string, error) {
+	siteList := &vyogotechv1alpha1.FrappeSiteList{}
+	if err := r.List(ctx, siteList); err != nil {
+		return nil, err
+	}
+
+	var sites []string
+	for _, site := range siteList.Items {
+		if site.Spec.BenchRef == nil {
+			if err := resolveWorkpaceDefaults(ctx, r.Client, &site); err != nil {
+				return nil, err
+			}
+		}
+		if site.Spec.BenchRef == nil || site.Spec.BenchRef.Name != bench.Name || !site.DeletionTimestamp.IsZero() {
+			continue
+		}
+		benchNamespace := site.Spec.BenchRef.Namespace
+		if benchNamespace == "" {
+			benchNamespace = site.Namespace
+		}
+		if benchNamespace != bench.Namespace {
+			continue
+		}
+		sites = append(sites, site.Spec.SiteName)
+	}
+	return sites, nil
+}
+
+// runUpgradeJob drives a single upgrade step Job
+// install is set for steps that install apps, to mount the FPM repository credentials.
+// Returns done once the Job finished and failed if it did not succeed
+func (r *FrappeBenchReconciler) runUpgradeJob(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench, step, image, script string, install *benchInstallConfig, env ...corev1.EnvVar) (bool, bool, error) {
+	logger := log.FromContext(ctx)
+
+	jobName := fmt.Sprintf("%s-upgrade-%s", bench.Name, step)
+	job := &batchv1.Job{}
+
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: bench.Namespace}, job)
+	if err == nil {
+		// Left over from an earlier upgrade and still being deleted
+		if upgrade := bench.Status.Upgrade; upgrade.StartTime != nil && job.CreationTimestamp.Before(upgrade.StartTime) {
+			if job.DeletionTimestamp.IsZero() {
+				if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+					return false, false, err
+				}
+			}
+			return false, false, nil
+		}
+		if job.Status.Succeeded > 0 {
+			logger.Info("Upgrade job completed", "job", jobName)
+			return true, false, nil
+		}
+		if job.Status.Failed > 0 {
+			logger.Error(nil, "Upgrade job failed", "job", jobName)
+			return true, true, nil
+		}
+		return false, false, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return false, false, err
+	}
+
+	logger.Info("Creating upgrade job", "job", jobName, "image", image)
+
+	pvcName := benchSitesClaim(bench)
+	backoffLimit := int32(0)
+
+	labels := r.componentLabels(bench, "upgrade")
+	labels["upgrade-step"] = step
+
+	// Only the build step fills the tree of its image, the other steps use the tree once built
+	var initContainers []corev1.Container
+	volumeMounts := benchVolumeMounts(bench, image)
+	if step == upgradeStepBuild {
+		initContainers = append(initContainers, benchTreeContainer(bench, image))
+		volumeMounts = benchBuildVolumeMounts(bench, image)
+	}
+	var authVolumes []corev1.Volume
+	var authMounts []corev1.VolumeMount
+	if install != nil {
+		authVolumes, authMounts, _ = fpmAuthVolumes(*install)
+	}
+
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: bench.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:       benchSitesAffinity(bench),
+					RestartPolicy:  corev1.RestartPolicyNever,
+					InitContainers: initContainers,
+					Containers: []corev1.Container{
+						{
+							Name:         "upgrade",
+							Image:        image,
+							Command:      []string{"bash", "-c"},
+							Args:         []string{script},
+							Env:          env,
+							VolumeMounts: append(volumeMounts, authMounts...),
+						},
+					},
+					Volumes: append([]corev1.Volume{
+						{
+							Name: "sites",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: pvcName,
+								},
+							},
+						},
+					}, authVolumes...),
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(bench, job, r.Scheme); err != nil {
+		return false, false, err
+	}
+
+	return false, false, r.Create(ctx, job)
+}
+
+// deleteUpgradeJobs removes all upgrade step Jobs of the bench and their pods
+func (r *FrappeBenchReconciler) deleteUpgradeJobs(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) error {
+	return r.DeleteAllOf(ctx, &batchv1.Job{},
+		client.InNamespace(bench.Namespace),
+		client.MatchingLabels(r.componentLabels(bench, "upgrade")),
+		client.PropagationPolicy(metav1.DeletePropagationBackground))
+}
+
+// benchComponentsRolledOut checks that every bench Deployment finished rolling out
+func (r *FrappeBenchReconciler) benchComponentsRolledOut(ctx context.Context, bench *vyogotechv1alpha1.FrappeBench) (bool, error) {
+	for _, name := range benchComponentDeployments(bench) {
+		deploy := &appsv1.Deployment{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: bench.Namespace}, deploy); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if !deploymentRolledOut(deploy) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deploymentRolledOut mirrors the checks of kubectl rollout status
+func deploymentRolledOut(deploy *appsv1.Deployment) bool {
+	if deploy.Status.ObservedGeneration < deploy.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if deploy.Spec.Replicas != nil {
+		replicas = *deploy.Spec.Replicas
+	}
+	return deploy.Status.UpdatedReplicas >= replicas &&
+		deploy.Status.Replicas == deploy.Status.UpdatedReplicas &&
+		deploy.Status.AvailableReplicas >= deploy.Status.UpdatedReplicas
+}
+
+// benchComponentDeployments returns the names of the Deployments that mount the sites PVC
+func benchComponentDeployments(bench *vyogotechv1alpha1.FrappeBench) []string {
+	return []string{
+		fmt.Sprintf("%s-gunicorn", bench.Name),
+		fmt.Sprintf("%s-nginx", bench.Name),
+		fmt.Sprintf("%s-socketio", bench.Name),
+		fmt.Sprintf("%s-scheduler", bench.Name),
+		fmt.Sprintf("%s-worker-default", bench.Name),
+		fmt.Sprintf("%s-worker-long", bench.Name),
+		fmt.Sprintf("%s-worker-short", bench.Name),
+	}
+}
+
+// getRunningImage returns the image the bench components should run
+// This trails getBenchImage while an upgrade is in progress
+func (r *FrappeBenchReconciler) getRunningImage(bench *vyogotechv1alpha1.FrappeBench) string {
+	if bench.Status.CurrentImage != "" {
+		return bench.Status.CurrentImage
+	}
+	return r.getBenchImage(bench)
+}
+
+func isBenchUpgradeFinished(upgrade *vyogotechv1alpha1.BenchUpgradeStatus) bool {
+	switch upgrade.Phase {
+	case vyogotechv1alpha1.BenchUpgradePhaseCompleted,
+		vyogotechv1alpha1.BenchUpgradePhaseRolledBack,
+		vyogotechv1alpha1.BenchUpgradePhaseFailed:
+		return true
+	}
+	return false
+}
+
+// rollbackSites returns the sites whose database migrate may have changed: the migrated
+// sites and the one that failed midway
+func rollbackSites(upgrade *vyogotechv1alpha1.BenchUpgradeStatus) []string {
+	sites := append([]string{}, upgrade.MigratedSites...)
+	if upgrade.FailedSite != "" && !containsString(sites, upgrade.FailedSite) {
+		sites = append(sites, upgrade.FailedSite)
+	}
+	return sites
+}
+
+func startUpgradeRollback(upgrade *vyogotechv1alpha1.BenchUpgradeStatus, reason string) {
+	upgrade.Phase = vyogotechv1alpha1.BenchUpgradePhaseRollingBack
+	upgrade.Message = reason
+}
+
+func finishUpgrade(upgrade *vyogotechv1alpha1.BenchUpgradeStatus, phase vyogotechv1alpha1.BenchUpgradePhase, message string) {
+	now := metav1.Now()
+	upgrade.Phase = phase
+	upgrade.Message = message
+	upgrade.CompletionTime = &now
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+const backupSitesScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+for site in $SITES; do
+    if [[ ! -d "sites/$site" ]]; then
+        echo "Site $site not provisioned yet, skipping backup"
+        continue
+    fi
+    echo "Backing up $site"
+    # A fixed path, replaced by every upgrade, lets the rollback find this backup
+    backup_path="$PWD/sites/$site/private/backups/$BACKUP_DIR"
+    rm -rf "$backup_path"
+    bench --site "$site" backup --with-files --backup-path "$backup_path"
+done
+
+echo "Pre-upgrade backup complete!"
+`
+
+const buildAssetsScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+# Apps may differ between images
+ls -1 apps > sites/apps.txt
+
+echo "Building assets for production..."
+bench build --production
+
+echo "Asset build complete!"
+`
+
+// rollbackSitesScript restores the sites in $SITES from their pre-upgrade backup with the
+// previous image, importing the dump with the site's own database user
+const rollbackSitesScript = `#!/bin/bash
+set -e
+set -o pipefail
+
+cd /home/frappe/frappe-bench
+` + siteImportFunctions + `
+# The build for the new image rewrote apps.txt
+ls -1 apps > sites/apps.txt
+
+for site in $SITES; do
+    backup_path="sites/$site/private/backups/$BACKUP_DIR"
+    database=$(ls "$backup_path"/*-database.sql.gz 2>/dev/null | head -n 1)
+    if [[ -z "$database" ]]; then
+        echo "Site $site was not provisioned before the upgrade, skipping restore"
+        continue
+    fi
+
+    echo "Restoring $site from $database"
+    bench --site "$site" set-maintenance-mode on
+    import_site_database "$site" "$database"
+    for archive in "$backup_path"/*-files.tar*; do
+        [[ -f "$archive" ]] || continue
+        extract_site_files "$site" "$archive"
+    done
+    bench --site "$site" clear-cache
+    bench --site "$site" set-maintenance-mode off
+done
+
+echo "Rollback complete!"
+`
+
+const migrateSiteScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" ]]; then
+    echo "ERROR: SITE_NAME not set"
+    exit 1
+fi
+
+if [[ ! -d "sites/$SITE_NAME" ]]; then
+    echo "Site $SITE_NAME not provisioned yet, skipping migrate"
+    exit 0
+fi
+
+echo "Migrating $SITE_NAME"
+bench --site "$SITE_NAME" migrate
+
+echo "Migration of $SITE_NAME complete!"
+`
@@ -0,0 +1,267 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Bench upgrade", func() {
+	const (
+		oldImage = "example.com/frappe:v1"
+		newImage = "example.com/frappe:v2"
+	)
+
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		r     *FrappeBenchReconciler
+	)
+
+	// step runs one upgrade reconcile and round-trips the status through the API server
+	step := func() bool {
+		upgrading, err := r.reconcileUpgrade(ctx, bench, benchInstallConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Status().Update(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(bench), bench)).To(Succeed())
+		return upgrading
+	}
+
+	// upgradeJob returns the Job of an upgrade step
+	upgradeJob := func(step string) *batchv1.Job {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-upgrade-" + step, Namespace: ns}, job)).To(Succeed())
+		return job
+	}
+
+	// finishJob marks the Job of an upgrade step as succeeded or failed
+	finishJob := func(step string, succeeded bool) {
+		job := upgradeJob(step)
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		if succeeded {
+			job.Status.Succeeded = 1
+			job.Status.CompletionTime = &now
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		} else {
+			job.Status.Failed = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	// assetsMount returns the sites/assets mount, if any
+	assetsMount := func(mounts []corev1.VolumeMount) *corev1.VolumeMount {
+		for i := range mounts {
+			if mounts[i].MountPath == benchPath+"/sites/assets" {
+				return &mounts[i]
+			}
+		}
+		return nil
+	}
+
+	jobEnv := func(job *batchv1.Job, name string) string {
+		for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+			if env.Name == name {
+				return env.Value
+			}
+		}
+		return ""
+	}
+
+	// migrateFirstSite runs the upgrade up to the migrate of the second site
+	migrateFirstSite := func() {
+		Expect(step()).To(BeTrue())
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseBackingUp))
+		Expect(bench.Status.Upgrade.Sites).To(ConsistOf("a.example.com", "b.example.com"))
+
+		step()
+		backup := upgradeJob(upgradeStepBackup)
+		Expect(backup.Spec.Template.Spec.Containers[0].Image).To(Equal(oldImage))
+		Expect(jobEnv(backup, "BACKUP_DIR")).To(Equal(upgradeBackupDir))
+		finishJob(upgradeStepBackup, true)
+		step()
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseBuilding))
+
+		step()
+		build := upgradeJob(upgradeStepBuild)
+		Expect(build.Spec.Template.Spec.Containers[0].Image).To(Equal(newImage))
+		Expect(build.Spec.Template.Spec.InitContainers).To(HaveLen(1))
+		Expect(build.Spec.Template.Spec.InitContainers[0].Name).To(Equal("prepare-tree"))
+		Expect(upgradeJob(upgradeStepBackup).Spec.Template.Spec.InitContainers).To(BeEmpty())
+		finishJob(upgradeStepBuild, true)
+		step()
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseMigrating))
+		Expect(bench.Status.AssetsTrees).To(ConsistOf(benchAppsTree(newImage)))
+
+		step()
+		finishJob("migrate-0", true)
+		step()
+		Expect(bench.Status.Upgrade.MigratedSites).To(HaveLen(1))
+		step()
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "upgrade-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeBenchSpec{
+				FrappeVersion: "version-15",
+				ImageConfig:   &vyogotechv1alpha1.ImageConfig{Repository: "example.com/frappe", Tag: "v2"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+		bench.Status.CurrentImage = oldImage
+		bench.Status.CurrentVersion = "version-15"
+		Expect(k8sClient.Status().Update(ctx, bench)).To(Succeed())
+
+		for _, name := range []string{"a", "b"} {
+			site := &vyogotechv1alpha1.FrappeSite{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+				Spec: vyogotechv1alpha1.FrappeSiteSpec{
+					BenchRef: &vyogotechv1alpha1.NamespacedName{Name: "bench"},
+					SiteName: name + ".example.com",
+				},
+			}
+			Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		}
+		r = &FrappeBenchReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("restores migrated sites from the pre-upgrade backup when a migrate fails", func() {
+		migrateFirstSite()
+		finishJob("migrate-1", false)
+		step()
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseRollingBack))
+
+		step()
+		rollback := upgradeJob(upgradeStepRollback)
+		Expect(rollback.Spec.Template.Spec.Containers[0].Image).To(Equal(oldImage))
+		Expect(jobEnv(rollback, "SITES")).To(Equal(bench.Status.Upgrade.MigratedSites[0] + " " + bench.Status.Upgrade.FailedSite))
+		Expect(jobEnv(rollback, "BACKUP_DIR")).To(Equal(upgradeBackupDir))
+		finishJob(upgradeStepRollback, true)
+
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseRolledBack))
+		Expect(bench.Status.Upgrade.RestoredSites).To(ConsistOf("a.example.com", "b.example.com"))
+		Expect(bench.Status.CurrentImage).To(Equal(oldImage))
+
+		// A rolled back upgrade is not retried for the same target
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseRolledBack))
+	})
+
+	It("leaves the upgrade Failed when the restore fails", func() {
+		migrateFirstSite()
+		finishJob("migrate-1", false)
+		step()
+		step()
+		finishJob(upgradeStepRollback, false)
+
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseFailed))
+		Expect(bench.Status.Upgrade.Message).To(ContainSubstring("restore them manually"))
+		Expect(bench.Status.Upgrade.RestoredSites).To(BeEmpty())
+	})
+
+	It("switches the components over once every site migrated", func() {
+		migrateFirstSite()
+		finishJob("migrate-1", true)
+		step()
+		Expect(bench.Status.Upgrade.MigratedSites).To(HaveLen(2))
+		step()
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseRollingOut))
+		Expect(bench.Status.CurrentImage).To(Equal(newImage))
+
+		// No bench Deployments exist here, so the rollout is already done
+		Expect(step()).To(BeFalse())
+		Expect(bench.Status.Upgrade.Phase).To(Equal(vyogotechv1alpha1.BenchUpgradePhaseCompleted))
+	})
+
+	It("builds the assets of each image into its own tree", func() {
+		bench.Status.AssetsTrees = []string{benchAppsTree(oldImage), benchAppsTree(newImage)}
+		Expect(assetsMount(benchVolumeMounts(bench, oldImage))).NotTo(BeNil())
+		Expect(assetsMount(benchVolumeMounts(bench, oldImage)).SubPath).To(Equal(benchAppsTree(oldImage) + "/assets"))
+		Expect(assetsMount(benchVolumeMounts(bench, newImage)).SubPath).To(Equal(benchAppsTree(newImage) + "/assets"))
+	})
+
+	It("keeps an existing bench on the assets of its sites PVC until the tree of its image is built", func() {
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		deploy := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(assetsMount(deploy.Spec.Template.Spec.Containers[0].VolumeMounts)).To(BeNil())
+
+		// The init Job creates the tree as the frappe user before mounting it
+		Expect(r.ensureBenchInitialized(ctx, bench, benchInstallConfig{})).To(Succeed())
+		init := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-init", Namespace: ns}, init)).To(Succeed())
+		Expect(init.Spec.Template.Spec.InitContainers).To(HaveLen(1))
+		prepare := init.Spec.Template.Spec.InitContainers[0]
+		Expect(prepare.Name).To(Equal("prepare-tree"))
+		Expect(*prepare.SecurityContext.RunAsUser).To(Equal(int64(1000)))
+		Expect(prepare.Env).To(ContainElement(corev1.EnvVar{Name: "APPS_TREE", Value: benchAppsTree(oldImage)}))
+		Expect(assetsMount(prepare.VolumeMounts)).To(BeNil())
+		Expect(assetsMount(init.Spec.Template.Spec.Containers[0].VolumeMounts).SubPath).To(Equal(benchAppsTree(oldImage) + "/assets"))
+
+		// The components keep their mounts while the tree is built
+		Expect(r.ensureBenchInitialized(ctx, bench, benchInstallConfig{})).To(Succeed())
+		Expect(bench.Status.AssetsTrees).To(BeEmpty())
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(assetsMount(deploy.Spec.Template.Spec.Containers[0].VolumeMounts)).To(BeNil())
+
+		now := metav1.Now()
+		init.Status.StartTime = &now
+		init.Status.CompletionTime = &now
+		init.Status.Succeeded = 1
+		init.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, init)).To(Succeed())
+
+		Expect(r.ensureBenchInitialized(ctx, bench, benchInstallConfig{})).To(Succeed())
+		Expect(bench.Status.AssetsTrees).To(ConsistOf(benchAppsTree(oldImage)))
+		Expect(r.ensureGunicorn(ctx, bench)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "bench-gunicorn", Namespace: ns}, deploy)).To(Succeed())
+		Expect(assetsMount(deploy.Spec.Template.Spec.Containers[0].VolumeMounts).SubPath).To(Equal(benchAppsTree(oldImage) + "/assets"))
+	})
+})
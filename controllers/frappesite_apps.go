@@ -0,0 +1,372 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	siteAppActionInstall   = "install"
+	siteAppActionUninstall = "uninstall"
+
+	// siteConditionAppsReady reports whether the site's apps match spec.apps
+	siteConditionAppsReady = "AppsReady"
+)
+
+// ensureSiteApps converges the apps installed on the site towards spec.apps
+// Apps are installed in spec order and uninstalled in reverse status order,
+// one Job at a time. Returns true once every app operation has finished.
+func (r *FrappeSiteReconciler) ensureSiteApps(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	if err := validateSiteApps(site, bench); err != nil {
+		meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+			Type:    siteConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "UnknownApp",
+			Message: err.Error(),
+		})
+		return false, err
+	}
+
+	desired := make(map[string]bool, len(site.Spec.Apps))
+	for _, app := range site.Spec.Apps {
+		if app == "frappe" {
+			continue
+		}
+		desired[app] = true
+		if findSiteAppStatus(site, app) == nil {
+			site.Status.Apps = append(site.Status.Apps, vyogotechv1alpha1.SiteAppStatus{
+				Name:  app,
+				State: vyogotechv1alpha1.SiteAppStatePending,
+			})
+		}
+	}
+
+	// Install missing apps in the order they are listed
+	for _, app := range site.Spec.Apps {
+		if !desired[app] {
+			continue
+		}
+		status := findSiteAppStatus(site, app)
+		if status.State == vyogotechv1alpha1.SiteAppStateInstalled {
+			continue
+		}
+
+		done, err := r.runSiteAppJob(ctx, site, bench, app, siteAppActionInstall)
+		if err != nil {
+			return false, err
+		}
+		if !done {
+			return false, nil
+		}
+		if status := findSiteAppStatus(site, app); status.State == vyogotechv1alpha1.SiteAppStateFailed {
+			// Later apps may require this one, hold them back until it installs
+			break
+		}
+	}
+
+	// Uninstall apps that are no longer listed, newest first
+	for i := len(site.Status.Apps) - 1; i >= 0; i-- {
+		status := site.Status.Apps[i]
+		if desired[status.Name] {
+			continue
+		}
+
+		if status.State == vyogotechv1alpha1.SiteAppStateFailed || status.State == vyogotechv1alpha1.SiteAppStatePending {
+			// The app never made it onto the site, drop the failed install attempt
+			if err := r.deleteSiteAppJob(ctx, site, status.Name, siteAppActionInstall); err != nil {
+				return false, err
+			}
+			removeSiteAppStatus(site, status.Name)
+			continue
+		}
+
+		done, err := r.runSiteAppJob(ctx, site, bench, status.Name, siteAppActionUninstall)
+		if err != nil {
+			return false, err
+		}
+		if !done {
+			return false, nil
+		}
+	}
+
+	var failed, held []string
+	for _, status := range site.Status.Apps {
+		switch {
+		case status.State == vyogotechv1alpha1.SiteAppStateFailed:
+			failed = append(failed, status.Name)
+		case status.State == vyogotechv1alpha1.SiteAppStatePending && desired[status.Name]:
+			held = append(held, status.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		message := fmt.Sprintf("failed to converge apps: %s", strings.Join(failed, ", "))
+		if len(held) > 0 {
+			message += fmt.Sprintf("; not installing %s until then", strings.Join(held, ", "))
+		}
+		meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+			Type:    siteConditionAppsReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "AppJobFailed",
+			Message: message,
+		})
+		return false, fmt.Errorf("%s", message)
+	}
+
+	meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+		Type:    siteConditionAppsReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AppsInstalled",
+		Message: fmt.Sprintf("%d app(s) installed", len(site.Status.Apps)),
+	})
+
+	logger.V(1).Info("Site apps converged", "apps", site.Spec.Apps)
+	return true, nil
+}
+
+// validateSiteApps checks that every requested app is available on the bench
+func validateSiteApps(site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench) error {
+	available := map[string]bool{"frappe": true}
+	for _, app := range bench.Status.InstalledApps {
+		available[app] = true
+	}
+
+	var missing []string
+	for _, app := range site.Spec.Apps {
+		if !available[app] {
+			missing = append(missing, app)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("apps not installed on bench %s: %s (bench has: %s)",
+			bench.Name, strings.Join(missing, ", "), strings.Join(bench.Status.InstalledApps, ", "))
+	}
+	return nil
+}
+
+// runSiteAppJob drives a single install-app or uninstall-app Job for the site
+// Returns true once the Job has finished, whether it succeeded or failed
+func (r *FrappeSiteReconciler) runSiteAppJob(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench, app, action string) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	jobName := siteAppJobName(site, app, action)
+	job := &batchv1.Job{}
+
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: site.Namespace}, job)
+	if err == nil {
+		if job.Status.Succeeded > 0 {
+			logger.Info("Site app job completed", "job", jobName, "app", app, "action", action)
+			if action == siteAppActionInstall {
+				setSiteAppStatus(site, app, vyogotechv1alpha1.SiteAppStateInstalled, "")
+			} else {
+				removeSiteAppStatus(site, app)
+			}
+			// Remove the finished Job so the same action can run again later
+			if err := r.deleteSiteAppJob(ctx, site, app, action); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if job.Status.Failed > 0 {
+			logger.Error(nil, "Site app job failed", "job", jobName, "app", app, "action", action)
+			setSiteAppStatus(site, app, vyogotechv1alpha1.SiteAppStateFailed,
+				fmt.Sprintf("%s-app job %s failed; delete the Job to retry", action, jobName))
+			return true, nil
+		}
+		return false, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if benchStorageMigrating(bench) {
+		logger.Info("Waiting for the bench storage migration before creating site app job", "job", jobName)
+		return false, nil
+	}
+
+	logger.Info("Creating site app job", "job", jobName, "app", app, "action", action)
+
+	appScript := `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" || -z "$APP_NAME" || -z "$APP_ACTION" ]]; then
+    echo "ERROR: Required environment variables not set"
+    exit 1
+fi
+
+if [[ "$APP_ACTION" == "install" ]]; then
+    echo "Installing $APP_NAME on $SITE_NAME"
+    bench --site "$SITE_NAME" install-app "$APP_NAME"
+elif [[ "$APP_ACTION" == "uninstall" ]]; then
+    echo "Uninstalling $APP_NAME from $SITE_NAME"
+    bench --site "$SITE_NAME" uninstall-app "$APP_NAME" --yes
+else
+    echo "ERROR: Unsupported app action: $APP_ACTION"
+    exit 1
+fi
+
+echo "App $APP_ACTION of $APP_NAME complete!"
+`
+
+	pvcName := benchSitesClaim(bench)
+	backoffLimit := int32(0)
+
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: site.Namespace,
+			Labels: map[string]string{
+				"app":  "frappe",
+				"site": site.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "site-app",
+							Image:        r.getBenchImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{appScript},
+							VolumeMounts: benchVolumeMounts(bench, r.getBenchImage(bench)),
+							Env: []corev1.EnvVar{
+								{
+									Name:  "SITE_NAME",
+									Value: site.Spec.SiteName,
+								},
+								{
+									Name:  "APP_NAME",
+									Value: app,
+								},
+								{
+									Name:  "APP_ACTION",
+									Value: action,
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "sites",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: pvcName,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(site, job, r.Scheme); err != nil {
+		return false, err
+	}
+
+	if err := r.Create(ctx, job); err != nil {
+		return false, err
+	}
+
+	state := vyogotechv1alpha1.SiteAppStateInstalling
+	if action == siteAppActionUninstall {
+		state = vyogotechv1alpha1.SiteAppStateUninstalling
+	}
+	setSiteAppStatus(site, app, state, "")
+
+	return false, nil
+}
+
+// deleteSiteAppJob removes an install-app or uninstall-app Job and its pods
+func (r *FrappeSiteReconciler) deleteSiteAppJob(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, app, action string) error {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      siteAppJobName(site, app, action),
+			Namespace: site.Namespace,
+		},
+	}
+	err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// siteAppJobName returns the Job name for an app action (app names may contain underscores)
+func siteAppJobName(site *vyogotechv1alpha1.FrappeSite, app, action string) string {
+	return fmt.Sprintf("%s-%s-%s", site.Name, action, strings.ReplaceAll(app, "_", "-"))
+}
+
+func findSiteAppStatus(site *vyogotechv1alpha1.FrappeSite, app string) *vyogotechv1alpha1.SiteAppStatus {
+	for i := range site.Status.Apps {
+		if site.Status.Apps[i].Name == app {
+			return &site.Status.Apps[i]
+		}
+	}
+	return nil
+}
+
+func setSiteAppStatus(site *vyogotechv1alpha1.FrappeSite, app string, state vyogotechv1alpha1.SiteAppState, message string) {
+	if status := findSiteAppStatus(site, app); status != nil {
+		status.State = state
+		status.Message = message
+		return
+	}
+	site.Status.Apps = append(site.Status.Apps, vyogotechv1alpha1.SiteAppStatus{
+		Name:    app,
+		State:   state,
+		Message: message,
+	})
+}
+
+func removeSiteAppStatus(site *vyogotechv1alpha1.FrappeSite, app string) {
+	apps := site.Status.Apps[:0]
+	for _, status := range site.Status.Apps {
+		if status.Name != app {
+			apps = append(apps, status)
+		}
+	}
+	site.Status.Apps = apps
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Site apps", func() {
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		site  *vyogotechv1alpha1.FrappeSite
+		r     *FrappeSiteReconciler
+	)
+
+	// appJobs returns the names of the app Jobs of the site
+	appJobs := func() []string {
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		var names []string
+		for _, job := range jobs.Items {
+			if job.DeletionTimestamp == nil {
+				names = append(names, job.Name)
+			}
+		}
+		return names
+	}
+
+	// finishJob marks an app Job as succeeded or failed
+	finishJob := func(name string, succeeded bool) {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: name, Namespace: ns}, job)).To(Succeed())
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		if succeeded {
+			job.Status.CompletionTime = &now
+			job.Status.Succeeded = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		} else {
+			job.Status.Failed = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	appState := func(app string) vyogotechv1alpha1.SiteAppState {
+		status := findSiteAppStatus(site, app)
+		Expect(status).NotTo(BeNil(), "no status for app %s", app)
+		return status.State
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "site-apps-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+			Status:     vyogotechv1alpha1.FrappeBenchStatus{InstalledApps: []string{"erpnext", "hrms"}},
+		}
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+				Apps:     []string{"frappe", "erpnext", "hrms"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		r = &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("installs apps one at a time in the order they are listed", func() {
+		done, err := r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(appJobs()).To(ConsistOf("site-install-erpnext"))
+		Expect(appState("erpnext")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalling))
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStatePending))
+		Expect(findSiteAppStatus(site, "frappe")).To(BeNil())
+
+		// hrms waits while erpnext is still installing
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(appJobs()).To(ConsistOf("site-install-erpnext"))
+
+		finishJob("site-install-erpnext", true)
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(appState("erpnext")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalled))
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalling))
+		Expect(appJobs()).To(ConsistOf("site-install-hrms"))
+
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "site-install-hrms", Namespace: ns}, job)).To(Succeed())
+		env := map[string]string{}
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		Expect(env).To(HaveKeyWithValue("SITE_NAME", "site.example.com"))
+		Expect(env).To(HaveKeyWithValue("APP_NAME", "hrms"))
+		Expect(env).To(HaveKeyWithValue("APP_ACTION", siteAppActionInstall))
+
+		finishJob("site-install-hrms", true)
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeTrue())
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalled))
+		Expect(appJobs()).To(BeEmpty())
+		Expect(meta.IsStatusConditionTrue(site.Status.Conditions, siteConditionAppsReady)).To(BeTrue())
+	})
+
+	It("holds back later apps while an earlier install has failed", func() {
+		_, err := r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+
+		finishJob("site-install-erpnext", false)
+		done, err := r.ensureSiteApps(ctx, site, bench)
+		Expect(err).To(MatchError(ContainSubstring("not installing hrms")))
+		Expect(done).To(BeFalse())
+		Expect(appState("erpnext")).To(Equal(vyogotechv1alpha1.SiteAppStateFailed))
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStatePending))
+
+		cond := meta.FindStatusCondition(site.Status.Conditions, siteConditionAppsReady)
+		Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+		Expect(cond.Reason).To(Equal("AppJobFailed"))
+
+		// The failed Job is kept for inspection and hrms still gets no Job
+		_, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).To(HaveOccurred())
+		Expect(appJobs()).To(ConsistOf("site-install-erpnext"))
+
+		// Dropping the failed app from spec releases the apps behind it
+		site.Spec.Apps = []string{"hrms"}
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalling))
+		Expect(appJobs()).To(ConsistOf("site-install-erpnext", "site-install-hrms"))
+
+		// The failed install attempt is cleaned up once hrms is in
+		finishJob("site-install-hrms", true)
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeTrue())
+		Expect(findSiteAppStatus(site, "erpnext")).To(BeNil())
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalled))
+		Expect(appJobs()).To(BeEmpty())
+	})
+
+	It("uninstalls apps that are no longer listed, newest first", func() {
+		site.Spec.Apps = nil
+		site.Status.Apps = []vyogotechv1alpha1.SiteAppStatus{
+			{Name: "erpnext", State: vyogotechv1alpha1.SiteAppStateInstalled},
+			{Name: "hrms", State: vyogotechv1alpha1.SiteAppStateInstalled},
+		}
+
+		done, err := r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(appJobs()).To(ConsistOf("site-uninstall-hrms"))
+		Expect(appState("hrms")).To(Equal(vyogotechv1alpha1.SiteAppStateUninstalling))
+		Expect(appState("erpnext")).To(Equal(vyogotechv1alpha1.SiteAppStateInstalled))
+
+		finishJob("site-uninstall-hrms", true)
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeFalse())
+		Expect(findSiteAppStatus(site, "hrms")).To(BeNil())
+		Expect(appState("erpnext")).To(Equal(vyogotechv1alpha1.SiteAppStateUninstalling))
+		Expect(appJobs()).To(ConsistOf("site-uninstall-erpnext"))
+
+		finishJob("site-uninstall-erpnext", true)
+		done, err = r.ensureSiteApps(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(done).To(BeTrue())
+		Expect(site.Status.Apps).To(BeEmpty())
+	})
+
+	It("rejects apps the bench does not have", func() {
+		site.Spec.Apps = []string{"erpnext", "lms"}
+
+		done, err := r.ensureSiteApps(ctx, site, bench)
+		Expect(err).To(MatchError(ContainSubstring("lms")))
+		Expect(done).To(BeFalse())
+		Expect(meta.FindStatusCondition(site.Status.Conditions, siteConditionAppsReady).Reason).To(Equal("UnknownApp"))
+		Expect(appJobs()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+// updateBackupSummary fills site.Status.Backups from the SiteBackups referencing the site
+func (r *FrappeSiteReconciler) updateBackupSummary(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) error {
+	backupList := &vyogotechv1alpha1.SiteBackupList{}
+	if err := r.List(ctx, backupList); err != nil {
+		return err
+	}
+
+	summary := &vyogotechv1alpha1.SiteBackupSummary{}
+	var last *vyogotechv1alpha1.SiteBackup
+	found := false
+
+	for i := range backupList.Items {
+		backup := &backupList.Items[i]
+		if !backupReferencesSite(backup, site) {
+			continue
+		}
+		found = true
+
+		// Scheduled backups only create other backups
+		if backup.Spec.Schedule != "" {
+			summary.Schedules = append(summary.Schedules, backup.Name)
+			next := backup.Status.NextScheduleTime
+			if next != nil && (summary.NextScheduledBackupTime == nil || next.Before(summary.NextScheduledBackupTime)) {
+				summary.NextScheduledBackupTime = next.DeepCopy()
+			}
+			continue
+		}
+
+		if last == nil || last.CreationTimestamp.Before(&backup.CreationTimestamp) {
+			last = backup
+		}
+
+		completed := backup.Status.CompletionTime
+		if backup.Status.Phase == vyogotechv1alpha1.SiteBackupPhaseCompleted && completed != nil &&
+			(summary.LastSuccessfulBackupTime == nil || summary.LastSuccessfulBackupTime.Before(completed)) {
+			summary.LastSuccessfulBackup = backup.Name
+			summary.LastSuccessfulBackupTime = completed.DeepCopy()
+		}
+	}
+
+	if !found {
+		site.Status.Backups = nil
+		return nil
+	}
+
+	if last != nil {
+		summary.LastBackup = last.Name
+		summary.LastBackupPhase = last.Status.Phase
+	}
+	site.Status.Backups = summary
+	return nil
+}
+
+// siteForBackup maps a SiteBackup to the FrappeSite it backs up
+func (r *FrappeSiteReconciler) siteForBackup(ctx context.Context, obj client.Object) []reconcile.Request {
+	backup, ok := obj.(*vyogotechv1alpha1.SiteBackup)
+	if !ok || backup.Spec.SiteRef == nil {
+		return nil
+	}
+
+	namespace := backup.Spec.SiteRef.Namespace
+	if namespace == "" {
+		namespace = backup.Namespace
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: backup.Spec.SiteRef.Name, Namespace: namespace}}}
+}
+
+// backupReferencesSite checks whether the backup's siteRef points at the site
+func backupReferencesSite(backup *vyogotechv1alpha1.SiteBackup, site *vyogotechv1alpha1.FrappeSite) bool {
+	if backup.Spec.SiteRef == nil || backup.Spec.SiteRef.Name != site.Name {
+		return false
+	}
+	namespace := backup.Spec.SiteRef.Namespace
+	if namespace == "" {
+		namespace = backup.Namespace
+	}
+	return namespace == site.Namespace
+}
@@ -28,12 +28,14 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
@@ -53,8 +55,11 @@ type FrappeSiteReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites/finalizers,verbs=update
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappebenches,verbs=get;list;watch
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=vyogo.tech,resources=sitebackups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappeworkpaces,verbs=get;list;watch
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses;ingressclasses,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets;services;configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop
 func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -67,36 +72,58 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	logger.Info("Reconciling FrappeSite", "site", site.Name, "siteName", site.Spec.SiteName)
 
+	// Handle deletion
+	if site.GetDeletionTimestamp() != nil {
+		if controllerutil.ContainsFinalizer(site, frappeSiteFinalizer) {
+			return r.handleSiteDeletion(ctx, site)
+		}
+		return ctrl.Result{}, nil
+	}
+
 	// Add finalizer if not present
 	if !controllerutil.ContainsFinalizer(site, frappeSiteFinalizer) {
+		if err := labelWorkpaceSite(ctx, r.Client, site); err != nil {
+			return ctrl.Result{}, err
+		}
 		controllerutil.AddFinalizer(site, frappeSiteFinalizer)
 		if err := r.Update(ctx, site); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
-	// Handle deletion
-	if site.GetDeletionTimestamp() != nil {
-		if controllerutil.ContainsFinalizer(site, frappeSiteFinalizer) {
-			logger.Info("Deleting site", "site", site.Name)
-			// TODO: Implement site deletion job (bench drop-site)
-			controllerutil.RemoveFinalizer(site, frappeSiteFinalizer)
-			if err := r.Update(ctx, site); err != nil {
-				return ctrl.Result{}, err
-			}
-		}
-		return ctrl.Result{}, nil
+	// Fields left empty take the defaults of the FrappeWorkpace owning the namespace
+	if err := resolveWorkpaceDefaults(ctx, r.Client, site); err != nil {
+		return ctrl.Result{}, err
 	}
 
 	// Validate benchRef
 	if site.Spec.BenchRef == nil {
-		logger.Error(nil, "BenchRef is required")
+		logger.Error(nil, "BenchRef is required outside a FrappeWorkpace with a benchTemplate")
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{}, fmt.Errorf("benchRef is required")
 	}
 
+	// Hold the site back if its FrappeWorkpace is at maxSites
+	withinQuota, quotaMessage, err := checkWorkpaceSiteQuota(ctx, r.Client, site)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !withinQuota {
+		logger.Info("Site exceeds workpace quota", "message", quotaMessage)
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhasePending
+		meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+			Type:    siteConditionWithinQuota,
+			Status:  metav1.ConditionFalse,
+			Reason:  "MaxSitesExceeded",
+			Message: quotaMessage,
+		})
+		_ = r.updateSiteStatus(ctx, site)
+		return ctrl.Result{RequeueAfter: workpaceQuotaRetryInterval}, nil
+	}
+	meta.RemoveStatusCondition(&site.Status.Conditions, siteConditionWithinQuota)
+
 	// Get the referenced bench
 	bench := &vyogotechv1alpha1.FrappeBench{}
 	benchKey := types.NamespacedName{
@@ -111,7 +138,7 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		logger.Error(err, "Failed to get referenced bench", "bench", benchKey.Name)
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhasePending
 		site.Status.BenchReady = false
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
 	}
 
@@ -132,7 +159,7 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	if err != nil {
 		logger.Error(err, "Failed to create database provider")
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{}, err
 	}
 
@@ -141,21 +168,21 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	if err != nil {
 		logger.Error(err, "Failed to check database readiness")
 		site.Status.DatabaseReady = false
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{}, err
 	}
 
 	if !dbReady {
 		logger.Info("Database not ready, provisioning...")
 		site.Status.DatabaseReady = false
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 
 		// Ensure database resources are created
 		dbInfo, err := dbProvider.EnsureDatabase(ctx, site)
 		if err != nil {
 			logger.Error(err, "Failed to ensure database")
 			site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
-			_ = r.Status().Update(ctx, site)
+			_ = r.updateSiteStatus(ctx, site)
 			return ctrl.Result{}, err
 		}
 
@@ -183,21 +210,21 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	// Update status with database info
 	site.Status.DatabaseName = dbInfo.Name
 	site.Status.DatabaseCredentialsSecret = dbCreds.SecretName
-	_ = r.Status().Update(ctx, site)
+	_ = r.updateSiteStatus(ctx, site)
 
 	// 1. Ensure site is initialized with database credentials
 	siteReady, err := r.ensureSiteInitialized(ctx, site, bench, domain, dbInfo, dbCreds)
 	if err != nil {
 		logger.Error(err, "Failed to initialize site")
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{}, err
 	}
 
 	if !siteReady {
 		logger.Info("Site initialization in progress", "site", site.Name)
 		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseProvisioning
-		_ = r.Status().Update(ctx, site)
+		_ = r.updateSiteStatus(ctx, site)
 		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
 	}
 
@@ -215,7 +242,42 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 	}
 
-	// 3. Update final status
+	// 3. Converge installed apps on spec.apps
+	appsReady, err := r.ensureSiteApps(ctx, site, bench)
+	if err != nil {
+		logger.Error(err, "Failed to converge site apps")
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
+		_ = r.updateSiteStatus(ctx, site)
+		return ctrl.Result{}, err
+	}
+
+	if !appsReady {
+		logger.Info("Site app installation in progress", "site", site.Name)
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseProvisioning
+		_ = r.updateSiteStatus(ctx, site)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// 4. Move the site's files to the configured files storage
+	filesReady, err := r.ensureFilesStorage(ctx, site, bench)
+	if err != nil {
+		logger.Error(err, "Failed to converge site files storage")
+		return ctrl.Result{}, err
+	}
+
+	if !filesReady {
+		logger.Info("Site files storage change in progress", "site", site.Name)
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseProvisioning
+		_ = r.updateSiteStatus(ctx, site)
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// 5. Update final status
+	if err := r.updateBackupSummary(ctx, site); err != nil {
+		logger.Error(err, "Failed to summarize site backups")
+		// Don't fail the reconciliation, the summary is informational
+	}
+
 	site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
 	site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
 	site.Status.SiteURL = fmt.Sprintf("http://%s", domain)
@@ -223,7 +285,7 @@ func (r *FrappeSiteReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		site.Status.SiteURL = fmt.Sprintf("https://%s", domain)
 	}
 
-	if err := r.Status().Update(ctx, site); err != nil {
+	if err := r.updateSiteStatus(ctx, site); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -299,6 +361,11 @@ func (r *FrappeSiteReconciler) ensureSiteInitialized(ctx context.Context, site *
 		return false, err
 	}
 
+	if benchStorageMigrating(bench) {
+		logger.Info("Waiting for the bench storage migration before creating site initialization job", "job", jobName)
+		return false, nil
+	}
+
 	// Create the initialization job
 	logger.Info("Creating site initialization job",
 		"job", jobName,
@@ -311,72 +378,12 @@ func (r *FrappeSiteReconciler) ensureSiteInitialized(ctx context.Context, site *
 	dbPort := dbInfo.Port
 	dbName := dbInfo.Name
 	dbUser := dbCreds.Username
-	dbPassword := dbCreds.Password
 	dbProvider := dbInfo.Provider
 
-	// Get or generate admin password
-	var adminPassword string
-	var adminPasswordSecret *corev1.Secret
-
-	if site.Spec.AdminPasswordSecretRef != nil {
-		// Fetch from provided secret
-		adminPasswordSecret = &corev1.Secret{}
-		err := r.Get(ctx, types.NamespacedName{
-			Name:      site.Spec.AdminPasswordSecretRef.Name,
-			Namespace: site.Spec.AdminPasswordSecretRef.Namespace,
-		}, adminPasswordSecret)
-		if err != nil {
-			return false, fmt.Errorf("failed to get admin password secret: %w", err)
-		}
-		adminPassword = string(adminPasswordSecret.Data["password"])
-		logger.Info("Using provided admin password", "secret", site.Spec.AdminPasswordSecretRef.Name)
-	} else {
-		// Check if we already generated a secret
-		generatedSecretName := fmt.Sprintf("%s-admin", site.Name)
-		adminPasswordSecret = &corev1.Secret{}
-		err := r.Get(ctx, types.NamespacedName{
-			Name:      generatedSecretName,
-			Namespace: site.Namespace,
-		}, adminPasswordSecret)
-
-		if err != nil && !errors.IsNotFound(err) {
-			return false, fmt.Errorf("failed to check for generated secret: %w", err)
-		}
-
-		if errors.IsNotFound(err) {
-			// Generate new random password
-			adminPassword = r.generatePassword(16)
-
-			// Create secret to store it
-			adminPasswordSecret = &corev1.Secret{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      generatedSecretName,
-					Namespace: site.Namespace,
-					Labels: map[string]string{
-						"app":  "frappe",
-						"site": site.Name,
-					},
-				},
-				Type: corev1.SecretTypeOpaque,
-				Data: map[string][]byte{
-					"password": []byte(adminPassword),
-				},
-			}
-
-			if err := controllerutil.SetControllerReference(site, adminPasswordSecret, r.Scheme); err != nil {
-				return false, err
-			}
-
-			if err := r.Create(ctx, adminPasswordSecret); err != nil {
-				return false, fmt.Errorf("failed to create admin password secret: %w", err)
-			}
-
-			logger.Info("Generated admin password", "secret", generatedSecretName)
-		} else {
-			// Use existing generated password
-			adminPassword = string(adminPasswordSecret.Data["password"])
-			logger.Info("Using existing generated password", "secret", generatedSecretName)
-		}
+	// Get or generate admin password; the Job only references the Secret
+	adminSecretName, err := ensureAdminPasswordSecret(ctx, r.Client, site, func() string { return r.generatePassword(16) })
+	if err != nil {
+		return false, err
 	}
 
 	// Create the init script using environment variables to prevent shell injection
@@ -412,7 +419,6 @@ if [[ "$DB_PROVIDER" == "mariadb" ]] || [[ "$DB_PROVIDER" == "postgres" ]]; then
       --db-password="$DB_PASSWORD" \
       --no-setup-db \
       --admin-password="$ADMIN_PASSWORD" \
-      --install-app=erpnext \
       --verbose
 
 elif [[ "$DB_PROVIDER" == "sqlite" ]]; then
@@ -421,7 +427,6 @@ elif [[ "$DB_PROVIDER" == "sqlite" ]]; then
     bench new-site "$SITE_NAME" \
       --db-type=sqlite \
       --admin-password="$ADMIN_PASSWORD" \
-      --install-app=erpnext \
       --verbose
 
 else
@@ -469,7 +474,7 @@ echo "Site initialization complete!"
 `
 
 	// Get bench PVC name
-	pvcName := fmt.Sprintf("%s-sites", bench.Name)
+	pvcName := benchSitesClaim(bench)
 
 	job = &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -482,20 +487,19 @@ echo "Site initialization complete!"
 		},
 		Spec: batchv1.JobSpec{
 			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
 				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
 					RestartPolicy: corev1.RestartPolicyNever,
 					Containers: []corev1.Container{
 						{
-							Name:    "site-init",
-							Image:   r.getBenchImage(bench),
-							Command: []string{"bash", "-c"},
-							Args:    []string{initScript},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "sites",
-									MountPath: "/home/frappe/frappe-bench/sites",
-								},
-							},
+							Name:         "site-init",
+							Image:        r.getBenchImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{initScript},
+							VolumeMounts: benchVolumeMounts(bench, r.getBenchImage(bench)),
 							Env: []corev1.EnvVar{
 								{
 									Name:  "SITE_NAME",
@@ -525,14 +529,7 @@ echo "Site initialization complete!"
 									Name:  "DB_USER",
 									Value: dbUser,
 								},
-								{
-									Name:  "DB_PASSWORD",
-									Value: dbPassword,
-								},
-								{
-									Name:  "ADMIN_PASSWORD",
-									Value: adminPassword,
-								},
+								secretEnvVar("ADMIN_PASSWORD", adminSecretName, "password"),
 								{
 									Name:  "BENCH_NAME",
 									Value: bench.Name,
@@ -555,6 +552,12 @@ echo "Site initialization complete!"
 		},
 	}
 
+	// SQLite has no database credentials
+	if dbCreds.SecretName != "" {
+		container := &job.Spec.Template.Spec.Containers[0]
+		container.Env = append(container.Env, secretEnvVar("DB_PASSWORD", dbCreds.SecretName, "password"))
+	}
+
 	if err := controllerutil.SetControllerReference(site, job, r.Scheme); err != nil {
 		return false, err
 	}
@@ -689,6 +692,18 @@ func (r *FrappeSiteReconciler) ensureIngress(ctx context.Context, site *vyogotec
 
 // getBenchImage returns the image to use from the bench
 func (r *FrappeSiteReconciler) getBenchImage(bench *vyogotechv1alpha1.FrappeBench) string {
+	return siteJobImage(bench)
+}
+
+// siteJobImage returns the image for Jobs that run bench commands against a site
+func siteJobImage(bench *vyogotechv1alpha1.FrappeBench) string {
+	// Match what the bench components run, which trails the spec during an upgrade
+	if bench.Status.CurrentImage != "" {
+		return bench.Status.CurrentImage
+	}
+	if image := builtBenchImage(bench); image != "" {
+		return image
+	}
 	if bench.Spec.ImageConfig != nil && bench.Spec.ImageConfig.Repository != "" {
 		image := bench.Spec.ImageConfig.Repository
 		if bench.Spec.ImageConfig.Tag != "" {
@@ -725,12 +740,22 @@ func (r *FrappeSiteReconciler) generatePassword(length int) string {
 	return string(password)
 }
 
+// updateSiteStatus writes the status of the site. The spec in memory is kept, the response
+// would otherwise drop the workpace defaults resolved for this reconcile.
+func (r *FrappeSiteReconciler) updateSiteStatus(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) error {
+	spec := site.Spec.DeepCopy()
+	err := r.Status().Update(ctx, site)
+	site.Spec = *spec
+	return err
+}
+
 // SetupWithManager sets up the controller with the Manager
 func (r *FrappeSiteReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.FrappeSite{}).
 		Owns(&batchv1.Job{}).
 		Owns(&networkingv1.Ingress{}).
+		Watches(&vyogotechv1alpha1.SiteBackup{}, handler.EnqueueRequestsFromMapFunc(r.siteForBackup)).
 		Complete(r)
 }
 
@@ -0,0 +1,403 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	// siteConditionFilesStorageReady reports whether the site's files are on the configured backend
+	siteConditionFilesStorageReady = "FilesStorageReady"
+
+	// siteFilesStorageHashAnnotation records the configuration hash the files storage Job was created for
+	siteFilesStorageHashAnnotation = "vyogo.tech/files-storage-hash"
+
+	// filesStorageApp is the Frappe app that stores the files of a site in the bucket,
+	// from https://github.com/zerodha/frappe-attachments-s3
+	filesStorageApp = "frappe_s3_attachment"
+)
+
+// siteFilesStorage returns the files storage of the site, falling back to the bench's
+func siteFilesStorage(site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench) *vyogotechv1alpha1.FilesStorage {
+	if site.Spec.FilesStorage != nil {
+		return site.Spec.FilesStorage
+	}
+	return bench.Spec.FilesStorage
+}
+
+// filesStorageFolder returns the folder of the site's files in the bucket
+func filesStorageFolder(site *vyogotechv1alpha1.FrappeSite, config *vyogotechv1alpha1.FilesStorage) string {
+	return path.Join(strings.Trim(config.Prefix, "/"), site.Spec.SiteName)
+}
+
+// ensureFilesStorage configures frappe_s3_attachment on the site with a Job that installs
+// the app when needed, points its settings at the bucket and moves the existing files.
+// Returns true once no change is in progress; a failed change leaves the site on its
+// previous backend until the Job is deleted or the configuration changes.
+func (r *FrappeSiteReconciler) ensureFilesStorage(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	config := siteFilesStorage(site, bench)
+	if site.Status.FilesStorage == nil {
+		site.Status.FilesStorage = &vyogotechv1alpha1.SiteFilesStorageStatus{Backend: vyogotechv1alpha1.SiteFilesBackendLocal}
+	}
+	status := site.Status.FilesStorage
+
+	if config == nil {
+		if status.Backend == vyogotechv1alpha1.SiteFilesBackendS3 || status.Phase == vyogotechv1alpha1.SiteFilesStoragePhaseMigrating {
+			// frappe_s3_attachment has no way back; the site keeps serving its files from the bucket
+			status.Message = fmt.Sprintf("files storage cannot be removed, %s keeps storing the files of the site in the bucket", filesStorageApp)
+			setFilesStorageCondition(site, metav1.ConditionFalse, "RemovalUnsupported", status.Message)
+			return true, nil
+		}
+		status.Phase = vyogotechv1alpha1.SiteFilesStoragePhaseReady
+		status.Hash = ""
+		status.Location = ""
+		status.Endpoint = ""
+		status.Message = "Files are stored on the bench sites PVC"
+		setFilesStorageCondition(site, metav1.ConditionTrue, "Local", status.Message)
+		return true, nil
+	}
+
+	if !benchHasApp(bench, filesStorageApp) {
+		// The site keeps its current files storage and is not held back
+		status.Message = fmt.Sprintf("app %s is not installed on bench %s, add it to the apps of the bench", filesStorageApp, bench.Name)
+		setFilesStorageCondition(site, metav1.ConditionFalse, "AppNotInstalled", status.Message)
+		return true, nil
+	}
+
+	hash, err := r.filesStorageHash(ctx, site, config)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+		status.Message = fmt.Sprintf("credentials Secret %s not found", config.CredentialsSecretRef.Name)
+		setFilesStorageCondition(site, metav1.ConditionFalse, "SecretNotFound", status.Message)
+		return false, nil
+	}
+
+	if status.Phase == vyogotechv1alpha1.SiteFilesStoragePhaseReady && status.Hash == hash {
+		return true, nil
+	}
+
+	jobName := fmt.Sprintf("%s-files-storage", site.Name)
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: site.Namespace}, job)
+	if err == nil {
+		if job.Annotations[siteFilesStorageHashAnnotation] != hash {
+			// Configuration changed: replace the Job once it has finished
+			if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+				logger.Info("Waiting for files storage job before starting a new one", "job", jobName)
+				return false, nil
+			}
+			if job.DeletionTimestamp.IsZero() {
+				logger.Info("Files storage configuration changed, replacing job", "job", jobName)
+				return false, client.IgnoreNotFound(r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+			}
+			return false, nil
+		}
+
+		switch {
+		case job.Status.Succeeded > 0:
+			migrated, err := r.readFilesStorageResult(ctx, job)
+			if err != nil {
+				logger.Error(err, "Failed to read files storage result", "job", jobName)
+			}
+			now := metav1.Now()
+			status.Phase = vyogotechv1alpha1.SiteFilesStoragePhaseReady
+			status.Hash = hash
+			status.MigratedFiles = migrated
+			status.CompletionTime = &now
+			status.Backend = vyogotechv1alpha1.SiteFilesBackendS3
+			status.Location = fmt.Sprintf("s3://%s/%s/", config.Bucket, filesStorageFolder(site, config))
+			status.Endpoint = config.Endpoint
+			status.Message = fmt.Sprintf("Moved %d file(s) to %s", migrated, status.Location)
+			setFilesStorageCondition(site, metav1.ConditionTrue, "ObjectStorage", status.Message)
+			logger.Info("Site files storage changed", "backend", status.Backend, "files", migrated)
+			return true, nil
+		case job.Status.Failed > 0:
+			if status.Phase != vyogotechv1alpha1.SiteFilesStoragePhaseFailed {
+				now := metav1.Now()
+				status.Phase = vyogotechv1alpha1.SiteFilesStoragePhaseFailed
+				status.Message = fmt.Sprintf("files storage job %s failed, the site still uses %s storage; delete the Job to retry", jobName, status.Backend)
+				status.CompletionTime = &now
+			}
+			setFilesStorageCondition(site, metav1.ConditionFalse, "JobFailed", status.Message)
+			return true, nil
+		default:
+			status.Phase = vyogotechv1alpha1.SiteFilesStoragePhaseMigrating
+			return false, nil
+		}
+	}
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if benchStorageMigrating(bench) {
+		status.Message = fmt.Sprintf("waiting for the storage migration of bench %s", bench.Name)
+		setFilesStorageCondition(site, metav1.ConditionFalse, "StorageMigration", status.Message)
+		return false, nil
+	}
+
+	logger.Info("Creating files storage job", "job", jobName, "bucket", config.Bucket)
+	job = r.filesStorageJob(site, bench, config, jobName, hash)
+	if err := controllerutil.SetControllerReference(site, job, r.Scheme); err != nil {
+		return false, err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return false, err
+	}
+
+	status.Phase = vyogotechv1alpha1.SiteFilesStoragePhaseMigrating
+	status.Hash = hash
+	status.CompletionTime = nil
+	status.Message = fmt.Sprintf("Moving files to s3://%s/%s/", config.Bucket, filesStorageFolder(site, config))
+	setFilesStorageCondition(site, metav1.ConditionFalse, "Migrating", status.Message)
+	return false, nil
+}
+
+// filesStorageHash hashes the files storage configuration of the site. The credentials
+// Secret's resourceVersion is included so rotated keys reach the app settings.
+func (r *FrappeSiteReconciler) filesStorageHash(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, config *vyogotechv1alpha1.FilesStorage) (string, error) {
+	secretVersion := ""
+	if config.CredentialsSecretRef != nil {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Name: config.CredentialsSecretRef.Name, Namespace: site.Namespace}, secret); err != nil {
+			return "", err
+		}
+		secretVersion = fmt.Sprintf("%s@%s", secret.Name, secret.ResourceVersion)
+	}
+	input := fmt.Sprintf("%s\n%s\n%s\n%s\n%s", config.Endpoint, config.Bucket, config.Region,
+		filesStorageFolder(site, config), secretVersion)
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// benchHasApp reports whether app is installed on the bench
+func benchHasApp(bench *vyogotechv1alpha1.FrappeBench, app string) bool {
+	for _, installed := range bench.Status.InstalledApps {
+		if installed == app {
+			return true
+		}
+	}
+	return false
+}
+
+func setFilesStorageCondition(site *vyogotechv1alpha1.FrappeSite, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+		Type:    siteConditionFilesStorageReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// filesStorageJob returns the Job that points frappe_s3_attachment on the site at the
+// bucket and moves the existing files there
+func (r *FrappeSiteReconciler) filesStorageJob(site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench, config *vyogotechv1alpha1.FilesStorage, jobName, hash string) *batchv1.Job {
+	env := []corev1.EnvVar{
+		{Name: "SITE_NAME", Value: site.Spec.SiteName},
+		{Name: "S3_ENDPOINT", Value: config.Endpoint},
+		{Name: "S3_BUCKET", Value: config.Bucket},
+		{Name: "S3_REGION", Value: config.Region},
+		{Name: "S3_FOLDER", Value: filesStorageFolder(site, config)},
+	}
+	if config.CredentialsSecretRef != nil {
+		env = append(env,
+			secretEnvVar("AWS_ACCESS_KEY_ID", config.CredentialsSecretRef.Name, "accessKeyId"),
+			secretEnvVar("AWS_SECRET_ACCESS_KEY", config.CredentialsSecretRef.Name, "secretAccessKey"),
+		)
+	}
+
+	backoffLimit := int32(0)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: site.Namespace,
+			Labels: map[string]string{
+				"app":  "frappe",
+				"site": site.Name,
+			},
+			Annotations: map[string]string{
+				siteFilesStorageHashAnnotation: hash,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "files-storage",
+							Image:        r.getBenchImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{siteFilesStorageScript},
+							Env:          env,
+							VolumeMounts: benchVolumeMounts(bench, r.getBenchImage(bench)),
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "sites",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: benchSitesClaim(bench),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// readFilesStorageResult reads the number of copied files from the termination message
+func (r *FrappeSiteReconciler) readFilesStorageResult(ctx context.Context, job *batchv1.Job) (int32, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return 0, err
+	}
+
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "files-storage" || status.State.Terminated == nil || status.State.Terminated.Message == "" {
+				continue
+			}
+			report := struct {
+				Files int32 `json:"files"`
+			}{}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), &report); err != nil {
+				return 0, err
+			}
+			return report.Files, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no terminated pod found for job %s", job.Name)
+}
+
+// siteFilesStorageScript installs frappe_s3_attachment on the site when it is missing,
+// saves the bucket into its "S3 File Attachment" settings and moves the existing files
+// with the app's migrate_existing_files. The secret key is a Password field, so Frappe
+// stores it encrypted; nothing is written to site_config.json. Reruns after a
+// credentials rotation only save the settings again, moved files are skipped.
+const siteFilesStorageScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" || -z "$S3_BUCKET" || -z "$S3_FOLDER" ]]; then
+    echo "ERROR: Required environment variables not set"
+    exit 1
+fi
+
+set +e
+env/bin/python - <<'PYEOF'
+import os
+import sys
+
+import frappe
+
+frappe.init(site=os.environ["SITE_NAME"], sites_path="sites")
+frappe.connect()
+try:
+    installed = "frappe_s3_attachment" in frappe.get_installed_apps()
+finally:
+    frappe.destroy()
+sys.exit(0 if installed else 3)
+PYEOF
+status=$?
+set -e
+if [[ $status -eq 3 ]]; then
+    echo "Installing frappe_s3_attachment on $SITE_NAME"
+    bench --site "$SITE_NAME" install-app frappe_s3_attachment
+elif [[ $status -ne 0 ]]; then
+    exit $status
+fi
+
+echo "Moving files of $SITE_NAME to s3://$S3_BUCKET/$S3_FOLDER/"
+
+env/bin/python - <<'PYEOF'
+import json
+import os
+
+import frappe
+
+frappe.init(site=os.environ["SITE_NAME"], sites_path="sites")
+frappe.connect()
+try:
+    frappe.set_user("Administrator")
+
+    settings = frappe.get_single("S3 File Attachment")
+    settings.bucket_name = os.environ["S3_BUCKET"]
+    settings.region_name = os.environ.get("S3_REGION", "")
+    settings.endpoint_url = os.environ.get("S3_ENDPOINT", "")
+    settings.folder_name = os.environ["S3_FOLDER"]
+    settings.aws_key = os.environ.get("AWS_ACCESS_KEY_ID", "")
+    settings.aws_secret = os.environ.get("AWS_SECRET_ACCESS_KEY", "")
+    settings.save()
+    frappe.db.commit()
+
+
+    def local_files():
+        return sum(
+            frappe.db.count("File", {"is_folder": 0, "file_url": ("like", pattern)})
+            for pattern in ("/files/%", "/private/files/%")
+        )
+
+
+    before = local_files()
+
+    from frappe_s3_attachment.controller import migrate_existing_files
+
+    migrate_existing_files()
+    frappe.db.commit()
+    moved = before - local_files()
+finally:
+    frappe.destroy()
+
+with open(os.environ.get("TERMINATION_LOG", "/dev/termination-log"), "w") as f:
+    json.dump({"files": moved}, f)
+PYEOF
+
+echo "Files of $SITE_NAME are stored in s3://$S3_BUCKET/$S3_FOLDER/"
+`
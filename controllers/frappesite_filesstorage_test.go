@@ -0,0 +1,183 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Site files storage", func() {
+	var (
+		ctx   context.Context
+		ns    string
+		bench *vyogotechv1alpha1.FrappeBench
+		site  *vyogotechv1alpha1.FrappeSite
+		r     *FrappeSiteReconciler
+	)
+
+	// filesJob returns the files storage Job of the site
+	filesJob := func() *batchv1.Job {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "site-files-storage", Namespace: ns}, job)).To(Succeed())
+		return job
+	}
+
+	jobEnv := func(job *batchv1.Job) map[string]corev1.EnvVar {
+		env := map[string]corev1.EnvVar{}
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e
+		}
+		return env
+	}
+
+	// finishJob marks the files storage Job as succeeded, with the report of its pod
+	finishJob := func(report string) {
+		job := filesJob()
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		job.Status.CompletionTime = &now
+		job.Status.Succeeded = 1
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "site-files-storage-pod", Namespace: ns, Labels: map[string]string{"job-name": job.Name}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "files-storage", Image: "frappe"}}},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "files-storage",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: report}},
+		}}
+		Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "files-storage-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeBenchSpec{
+				FrappeVersion: "version-15",
+				FilesStorage: &vyogotechv1alpha1.FilesStorage{
+					Endpoint:             "http://minio:9000",
+					Bucket:               "files",
+					Region:               "us-east-1",
+					Prefix:               "/dev/",
+					CredentialsSecretRef: &corev1.LocalObjectReference{Name: "s3-credentials"},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "s3-credentials", Namespace: ns},
+			StringData: map[string]string{"accessKeyId": "minio", "secretAccessKey": "minio-secret"},
+		})).To(Succeed())
+
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		r = &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("does not hold the site back when the bench lacks frappe_s3_attachment", func() {
+		ready, err := r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+
+		cond := meta.FindStatusCondition(site.Status.Conditions, siteConditionFilesStorageReady)
+		Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+		Expect(cond.Reason).To(Equal("AppNotInstalled"))
+		Expect(site.Status.FilesStorage.Backend).To(Equal(vyogotechv1alpha1.SiteFilesBackendLocal))
+
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(BeEmpty())
+	})
+
+	It("configures frappe_s3_attachment and reports S3 once the Job succeeded", func() {
+		bench.Status.InstalledApps = []string{"erpnext", filesStorageApp}
+
+		ready, err := r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(site.Status.FilesStorage.Phase).To(Equal(vyogotechv1alpha1.SiteFilesStoragePhaseMigrating))
+		Expect(site.Status.FilesStorage.Backend).To(Equal(vyogotechv1alpha1.SiteFilesBackendLocal))
+
+		job := filesJob()
+		env := jobEnv(job)
+		Expect(env["S3_BUCKET"].Value).To(Equal("files"))
+		Expect(env["S3_ENDPOINT"].Value).To(Equal("http://minio:9000"))
+		Expect(env["S3_REGION"].Value).To(Equal("us-east-1"))
+		Expect(env["S3_FOLDER"].Value).To(Equal("dev/site.example.com"))
+		Expect(env["AWS_SECRET_ACCESS_KEY"].ValueFrom.SecretKeyRef.Name).To(Equal("s3-credentials"))
+		script := job.Spec.Template.Spec.Containers[0].Args[0]
+		Expect(script).To(ContainSubstring(`frappe.get_single("S3 File Attachment")`))
+		Expect(script).To(ContainSubstring("migrate_existing_files()"))
+		Expect(script).NotTo(ContainSubstring("site_config"))
+
+		// Still running
+		ready, err = r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(site.Status.FilesStorage.Backend).To(Equal(vyogotechv1alpha1.SiteFilesBackendLocal))
+
+		finishJob(`{"files": 3}`)
+		ready, err = r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+		status := site.Status.FilesStorage
+		Expect(status.Backend).To(Equal(vyogotechv1alpha1.SiteFilesBackendS3))
+		Expect(status.Phase).To(Equal(vyogotechv1alpha1.SiteFilesStoragePhaseReady))
+		Expect(status.Location).To(Equal("s3://files/dev/site.example.com/"))
+		Expect(status.MigratedFiles).To(BeEquivalentTo(3))
+		Expect(meta.IsStatusConditionTrue(site.Status.Conditions, siteConditionFilesStorageReady)).To(BeTrue())
+
+		// Removing filesStorage keeps the site on the bucket
+		bench.Spec.FilesStorage = nil
+		ready, err = r.ensureFilesStorage(ctx, site, bench)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ready).To(BeTrue())
+		Expect(site.Status.FilesStorage.Backend).To(Equal(vyogotechv1alpha1.SiteFilesBackendS3))
+		Expect(meta.FindStatusCondition(site.Status.Conditions, siteConditionFilesStorageReady).Reason).To(Equal("RemovalUnsupported"))
+	})
+})
@@ -0,0 +1,320 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/database"
+)
+
+const (
+	// siteConditionTeardownSucceeded reports a failed teardown of a deleted site
+	siteConditionTeardownSucceeded = "TeardownSucceeded"
+
+	// siteTeardownBackoffLimit bounds the retries of the drop Job
+	siteTeardownBackoffLimit = int32(2)
+)
+
+// errSiteTeardownFailed is returned once the drop Job has run out of retries
+var errSiteTeardownFailed = goerrors.New("site teardown job failed")
+
+// handleSiteDeletion tears the site down according to its deletion policy
+// and removes the finalizer once teardown has finished
+func (r *FrappeSiteReconciler) handleSiteDeletion(ctx context.Context, site *vyogotechv1alpha1.FrappeSite) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	policy := site.Spec.DeletionPolicy
+	if policy == "" {
+		policy = vyogotechv1alpha1.SiteDeletionPolicyArchive
+	}
+
+	logger.Info("Deleting site", "site", site.Name, "deletionPolicy", policy)
+
+	if err := resolveWorkpaceDefaults(ctx, r.Client, site); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if policy != vyogotechv1alpha1.SiteDeletionPolicyRetain {
+		dbProvider, err := database.NewProvider(site.Spec.DBConfig.Provider, r.Client, r.Scheme)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		done, dropDatabase, err := r.ensureSiteTeardown(ctx, site, policy, dbProvider)
+		if goerrors.Is(err, errSiteTeardownFailed) {
+			// Keep the finalizer so no data is orphaned; the condition tells how to go on
+			site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseFailed
+			return ctrl.Result{}, r.updateSiteStatus(ctx, site)
+		}
+		if err != nil {
+			logger.Error(err, "Site teardown failed")
+			return ctrl.Result{}, err
+		}
+
+		if !done {
+			logger.Info("Site teardown in progress", "site", site.Name)
+			site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseTerminating
+			_ = r.updateSiteStatus(ctx, site)
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+
+		// Drop database resources only after the site folder has been handled,
+		// the archive backup needs the database to still be reachable
+		if dropDatabase {
+			if err := dbProvider.Cleanup(ctx, site); err != nil {
+				logger.Error(err, "Failed to clean up database resources")
+				return ctrl.Result{}, err
+			}
+		} else {
+			logger.Info("Keeping the database of the site, it could not be archived", "site", site.Name)
+		}
+	} else {
+		logger.Info("Retaining site data", "site", site.Name, "siteName", site.Spec.SiteName)
+	}
+
+	// Patched rather than updated, the spec holds the resolved workpace defaults
+	patch := client.MergeFrom(site.DeepCopy())
+	controllerutil.RemoveFinalizer(site, frappeSiteFinalizer)
+	if err := r.Patch(ctx, site, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	logger.Info("Site deleted", "site", site.Name)
+	return ctrl.Result{}, nil
+}
+
+// ensureSiteTeardown creates a Job that drops the site with bench drop-site, which drops
+// its database and moves its folder out of sites/. Without admin credentials in the site
+// namespace the Job only archives or removes the folder, and the database is dropped by
+// the provider's Cleanup. For Archive the Job first backs the site up into its folder, and
+// fails rather than drop a database it could not back up.
+// Returns true once the Job has completed, errSiteTeardownFailed once it has run out of
+// retries, and whether the database may be dropped: a site without a bench cannot be
+// archived, so its database is kept.
+func (r *FrappeSiteReconciler) ensureSiteTeardown(ctx context.Context, site *vyogotechv1alpha1.FrappeSite, policy vyogotechv1alpha1.SiteDeletionPolicy, dbProvider database.Provider) (bool, bool, error) {
+	logger := log.FromContext(ctx)
+
+	archive := policy == vyogotechv1alpha1.SiteDeletionPolicyArchive
+	if site.Spec.BenchRef == nil {
+		return true, !archive, nil
+	}
+
+	bench := &vyogotechv1alpha1.FrappeBench{}
+	benchKey := types.NamespacedName{
+		Name:      site.Spec.BenchRef.Name,
+		Namespace: site.Spec.BenchRef.Namespace,
+	}
+	if benchKey.Namespace == "" {
+		benchKey.Namespace = site.Namespace
+	}
+	if err := r.Get(ctx, benchKey, bench); err != nil {
+		if errors.IsNotFound(err) {
+			// Without a bench there is no sites PVC left to clean up
+			logger.Info("Bench not found, skipping site folder teardown", "bench", benchKey.Name)
+			return true, !archive, nil
+		}
+		return false, false, err
+	}
+
+	jobName := fmt.Sprintf("%s-drop", site.Name)
+	job := &batchv1.Job{}
+
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: site.Namespace}, job)
+	if err == nil {
+		if job.Status.Succeeded > 0 {
+			logger.Info("Site teardown job completed", "job", jobName)
+			return true, true, nil
+		}
+		if job.Status.Failed > siteTeardownBackoffLimit {
+			meta.SetStatusCondition(&site.Status.Conditions, metav1.Condition{
+				Type:   siteConditionTeardownSucceeded,
+				Status: metav1.ConditionFalse,
+				Reason: "JobFailed",
+				Message: fmt.Sprintf("teardown job %s failed %d times; delete the Job to retry, or set spec.deletionPolicy to Retain to remove the site without teardown",
+					jobName, job.Status.Failed),
+			})
+			return false, false, errSiteTeardownFailed
+		}
+		return false, false, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return false, false, err
+	}
+
+	if benchStorageMigrating(bench) {
+		logger.Info("Waiting for the bench storage migration before creating site teardown job", "job", jobName)
+		return false, false, nil
+	}
+
+	admin, err := dbProvider.AdminCredentials(ctx, site)
+	if err != nil {
+		return false, false, err
+	}
+
+	logger.Info("Creating site teardown job", "job", jobName, "deletionPolicy", policy, "dropSite", admin != nil)
+
+	dropScript := `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" || -z "$DELETION_POLICY" ]]; then
+    echo "ERROR: Required environment variables not set"
+    exit 1
+fi
+
+SITE_PATH="sites/$SITE_NAME"
+
+# Archived sites stay on the bench PVC, bench defaults to a path outside of it
+ARCHIVE_PATH="$PWD/sites/archived_sites"
+if [[ "$DELETION_POLICY" != "Archive" ]]; then
+    ARCHIVE_PATH="$PWD/sites/.dropped_sites/${SITE_NAME}-$(date +%Y%m%d%H%M%S)"
+fi
+
+if [[ ! -d "$SITE_PATH" ]]; then
+    if [[ "$DELETION_POLICY" == "Archive" ]] && ! compgen -G "$ARCHIVE_PATH/${SITE_NAME}*" >/dev/null; then
+        # The database is dropped after this Job, it must not go without a backup
+        echo "ERROR: site folder $SITE_PATH not found, the site cannot be archived"
+        exit 1
+    fi
+    echo "Site folder $SITE_PATH not found, nothing to tear down"
+    exit 0
+fi
+
+if [[ "$DELETION_POLICY" == "Archive" ]]; then
+    # The dump ends up in the archived folder, before anything is dropped
+    echo "Backing up site $SITE_NAME before archiving"
+    bench --site "$SITE_NAME" backup --with-files
+    if ! compgen -G "$SITE_PATH/private/backups/*-database.sql.gz" >/dev/null; then
+        echo "ERROR: no database backup of $SITE_NAME found"
+        exit 1
+    fi
+fi
+
+if [[ -n "$DB_ROOT_USER" ]]; then
+    # Backed up above for Archive; a retry must get past a database that is already gone
+    ARGS=(--db-root-username "$DB_ROOT_USER" --db-root-password "$DB_ROOT_PASSWORD" --archived-sites-path "$ARCHIVE_PATH" --no-backup --force)
+    echo "Dropping site $SITE_NAME"
+    bench drop-site "$SITE_NAME" "${ARGS[@]}"
+else
+    # No admin credentials for the site's database server: the operator drops the
+    # database after this Job, only the folder is handled here
+    mkdir -p "$ARCHIVE_PATH"
+    mv "$SITE_PATH" "$ARCHIVE_PATH/${SITE_NAME}-$(date +%Y%m%d%H%M%S)"
+fi
+
+if [[ "$DELETION_POLICY" != "Archive" ]]; then
+    rm -rf "$ARCHIVE_PATH"
+    echo "Site folder $SITE_PATH removed"
+else
+    echo "Site folder archived to $ARCHIVE_PATH"
+fi
+
+echo "Site teardown complete!"
+`
+
+	env := []corev1.EnvVar{
+		{
+			Name:  "SITE_NAME",
+			Value: site.Spec.SiteName,
+		},
+		{
+			Name:  "DELETION_POLICY",
+			Value: string(policy),
+		},
+	}
+	if admin != nil {
+		env = append(env,
+			corev1.EnvVar{Name: "DB_ROOT_USER", Value: admin.Username},
+			secretEnvVar("DB_ROOT_PASSWORD", admin.SecretName, admin.PasswordKey),
+		)
+	}
+
+	backoffLimit := siteTeardownBackoffLimit
+	pvcName := benchSitesClaim(bench)
+
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: site.Namespace,
+			Labels: map[string]string{
+				"app":  "frappe",
+				"site": site.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "site-drop",
+							Image:        r.getBenchImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{dropScript},
+							VolumeMounts: benchVolumeMounts(bench, r.getBenchImage(bench)),
+							Env:          env,
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "sites",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: pvcName,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(site, job, r.Scheme); err != nil {
+		return false, false, err
+	}
+
+	if err := r.Create(ctx, job); err != nil {
+		return false, false, err
+	}
+
+	logger.Info("Site teardown job created", "job", jobName)
+	return false, false, nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Site teardown", func() {
+	var (
+		ctx context.Context
+		ns  string
+		r   *FrappeSiteReconciler
+	)
+
+	// deleteSite creates a site with the finalizer, deletes it and returns it
+	deleteSite := func(policy vyogotechv1alpha1.SiteDeletionPolicy, benchName string) *vyogotechv1alpha1.FrappeSite {
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns, Finalizers: []string{frappeSiteFinalizer}},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef:       &vyogotechv1alpha1.NamespacedName{Name: benchName},
+				SiteName:       "site.example.com",
+				DeletionPolicy: policy,
+				// Nothing listens on the server of the connection Secret, so a
+				// Cleanup of the database shows up as an error
+				DBConfig: vyogotechv1alpha1.DatabaseConfig{
+					Provider:            "external",
+					ConnectionSecretRef: &corev1.SecretReference{Name: "db-admin"},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, site)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(site), site)).To(Succeed())
+		return site
+	}
+
+	// siteGone reports whether the finalizer was removed and the site is gone
+	siteGone := func() bool {
+		err := k8sClient.Get(ctx, client.ObjectKey{Name: "site", Namespace: ns}, &vyogotechv1alpha1.FrappeSite{})
+		return errors.IsNotFound(err)
+	}
+
+	dropJob := func() *batchv1.Job {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "site-drop", Namespace: ns}, job)).To(Succeed())
+		return job
+	}
+
+	finishDropJob := func(succeeded bool) {
+		job := dropJob()
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		if succeeded {
+			job.Status.Succeeded = 1
+			job.Status.CompletionTime = &now
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		} else {
+			job.Status.Failed = siteTeardownBackoffLimit + 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "teardown-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-admin", Namespace: ns},
+			StringData: map[string]string{"host": "127.0.0.1", "port": "1", "username": "root", "password": "admin-password"},
+		})).To(Succeed())
+		Expect(k8sClient.Create(ctx, &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		})).To(Succeed())
+
+		r = &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("leaves the site folder and the database alone with Retain", func() {
+		site := deleteSite(vyogotechv1alpha1.SiteDeletionPolicyRetain, "bench")
+		_, err := r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(siteGone()).To(BeTrue())
+
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(BeEmpty())
+	})
+
+	It("archives the site before its database is dropped", func() {
+		site := deleteSite(vyogotechv1alpha1.SiteDeletionPolicyArchive, "bench")
+		_, err := r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(site.Status.Phase).To(Equal(vyogotechv1alpha1.FrappeSitePhaseTerminating))
+
+		container := dropJob().Spec.Template.Spec.Containers[0]
+		env := map[string]corev1.EnvVar{}
+		for _, e := range container.Env {
+			env[e.Name] = e
+		}
+		Expect(env["DELETION_POLICY"].Value).To(Equal("Archive"))
+		Expect(env["DB_ROOT_USER"].Value).To(Equal("root"))
+		Expect(env["DB_ROOT_PASSWORD"].ValueFrom.SecretKeyRef.Name).To(Equal("db-admin"))
+		Expect(container.VolumeMounts).NotTo(BeEmpty())
+
+		// The database stays while the Job runs
+		_, err = r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(siteGone()).To(BeFalse())
+
+		finishDropJob(true)
+		_, err = r.handleSiteDeletion(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("failed to drop database")))
+		Expect(siteGone()).To(BeFalse())
+	})
+
+	It("keeps the database with Archive when there is no bench to archive the site on", func() {
+		site := deleteSite(vyogotechv1alpha1.SiteDeletionPolicyArchive, "missing")
+		_, err := r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(siteGone()).To(BeTrue())
+	})
+
+	It("drops the database with Delete", func() {
+		site := deleteSite(vyogotechv1alpha1.SiteDeletionPolicyDelete, "missing")
+		_, err := r.handleSiteDeletion(ctx, site)
+		Expect(err).To(MatchError(ContainSubstring("failed to drop database")))
+		Expect(siteGone()).To(BeFalse())
+	})
+
+	It("keeps the finalizer once the drop Job ran out of retries", func() {
+		site := deleteSite(vyogotechv1alpha1.SiteDeletionPolicyDelete, "bench")
+		_, err := r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+
+		finishDropJob(false)
+		_, err = r.handleSiteDeletion(ctx, site)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(site.Status.Phase).To(Equal(vyogotechv1alpha1.FrappeSitePhaseFailed))
+		cond := meta.FindStatusCondition(site.Status.Conditions, siteConditionTeardownSucceeded)
+		Expect(cond.Reason).To(Equal("JobFailed"))
+		Expect(siteGone()).To(BeFalse())
+	})
+
+	Describe("drop script", func() {
+		var benchDir string
+
+		// runDropScript runs the script of the drop Job on benchDir, with bench replaced by
+		// a stub that writes a database backup, and returns whether it succeeded
+		runDropScript := func(policy vyogotechv1alpha1.SiteDeletionPolicy) bool {
+			site := deleteSite(policy, "bench")
+			_, err := r.handleSiteDeletion(ctx, site)
+			Expect(err).NotTo(HaveOccurred())
+			script := dropJob().Spec.Template.Spec.Containers[0].Args[0]
+			script = strings.Replace(script, "cd /home/frappe/frappe-bench", "cd "+benchDir, 1)
+
+			stub := `bench() {
+    if [[ "$3" == "backup" ]]; then
+        mkdir -p "sites/$2/private/backups" && touch "sites/$2/private/backups/20240101_000000-site-database.sql.gz"
+    fi
+}
+`
+			cmd := exec.Command("bash")
+			cmd.Stdin = strings.NewReader(stub + script)
+			// Without admin credentials the folder is archived by the script itself
+			cmd.Env = append(os.Environ(), "SITE_NAME=site.example.com", "DELETION_POLICY="+string(policy))
+			out, err := cmd.CombinedOutput()
+			GinkgoWriter.Println(string(out))
+			return err == nil
+		}
+
+		archived := func() []string {
+			matches, err := filepath.Glob(filepath.Join(benchDir, "sites", "archived_sites", "site.example.com*", "private", "backups", "*-database.sql.gz"))
+			Expect(err).NotTo(HaveOccurred())
+			return matches
+		}
+
+		BeforeEach(func() {
+			benchDir = GinkgoT().TempDir()
+		})
+
+		It("moves the backed up site into the archive", func() {
+			Expect(os.MkdirAll(filepath.Join(benchDir, "sites", "site.example.com"), 0o755)).To(Succeed())
+			Expect(runDropScript(vyogotechv1alpha1.SiteDeletionPolicyArchive)).To(BeTrue())
+			Expect(archived()).To(HaveLen(1))
+			Expect(filepath.Join(benchDir, "sites", "site.example.com")).NotTo(BeADirectory())
+		})
+
+		It("fails to archive a site without a folder", func() {
+			Expect(runDropScript(vyogotechv1alpha1.SiteDeletionPolicyArchive)).To(BeFalse())
+		})
+
+		It("removes the folder with Delete", func() {
+			Expect(os.MkdirAll(filepath.Join(benchDir, "sites", "site.example.com"), 0o755)).To(Succeed())
+			Expect(runDropScript(vyogotechv1alpha1.SiteDeletionPolicyDelete)).To(BeTrue())
+			Expect(archived()).To(BeEmpty())
+			Expect(filepath.Join(benchDir, "sites", "site.example.com")).NotTo(BeADirectory())
+		})
+	})
+})
@@ -18,15 +18,41 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
 )
 
+const (
+	// workpaceLabel marks the namespaces, benches and quotas of a FrappeWorkpace and
+	// the sites that inherited its defaults
+	workpaceLabel = "vyogo.tech/workpace"
+
+	// workpaceQuotaName names the ResourceQuota and LimitRange of a tenant namespace
+	workpaceQuotaName = "frappe-workpace"
+
+	// siteConditionWithinQuota reports whether the site fits the maxSites of its FrappeWorkpace
+	siteConditionWithinQuota = "WithinWorkpaceQuota"
+
+	// workpaceQuotaRetryInterval is how often a site held back by maxSites checks again
+	workpaceQuotaRetryInterval = time.Minute
+)
+
 // FrappeWorkpaceReconciler reconciles a FrappeWorkpace object
 type FrappeWorkpaceReconciler struct {
 	client.Client
@@ -36,27 +62,481 @@ type FrappeWorkpaceReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappeworkpaces,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappeworkpaces/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=frappeworkpaces/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappebenches,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=resourcequotas;limitranges,verbs=get;list;watch;create;update;patch;delete
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the FrappeWorkpace object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile sets up the namespaces of a tenant, seeds its bench and quotas, and
+// aggregates the health of its benches and sites
 func (r *FrappeWorkpaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	wp := &vyogotechv1alpha1.FrappeWorkpace{}
+	if err := r.Get(ctx, req.NamespacedName, wp); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Namespaces, benches and sites are left in place when the tenant is deleted;
+	// the ResourceQuotas and LimitRanges are owned by the FrappeWorkpace and garbage collected.
+	if wp.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.validateNamespaces(ctx, wp); err != nil {
+		return r.setFailed(ctx, wp, err.Error())
+	}
+
+	for _, ns := range wp.Spec.Namespaces {
+		if err := r.ensureNamespace(ctx, wp, ns); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.ensureBench(ctx, wp, ns); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.ensureQuota(ctx, wp, ns); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.updateStatus(ctx, wp); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	logger.V(1).Info("FrappeWorkpace reconciled", "phase", wp.Status.Phase, "sites", wp.Status.Sites.Total)
+	return ctrl.Result{}, nil
+}
+
+// validateNamespaces rejects namespaces already claimed by another FrappeWorkpace
+func (r *FrappeWorkpaceReconciler) validateNamespaces(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace) error {
+	list := &vyogotechv1alpha1.FrappeWorkpaceList{}
+	if err := r.List(ctx, list); err != nil {
+		return err
+	}
+
+	for _, other := range list.Items {
+		if other.Name == wp.Name || other.CreationTimestamp.After(wp.CreationTimestamp.Time) {
+			continue
+		}
+		for _, ns := range wp.Spec.Namespaces {
+			if containsNamespace(other.Spec.Namespaces, ns) {
+				return fmt.Errorf("namespace %s already belongs to FrappeWorkpace %s", ns, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureNamespace creates the namespace if missing and labels it with the tenant
+// Namespaces are never deleted by the operator.
+func (r *FrappeWorkpaceReconciler) ensureNamespace(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace, name string) error {
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, types.NamespacedName{Name: name}, ns)
+	if errors.IsNotFound(err) {
+		ns = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{workpaceLabel: wp.Name},
+			},
+		}
+		log.FromContext(ctx).Info("Creating workpace namespace", "namespace", name)
+		return r.Create(ctx, ns)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ns.Labels[workpaceLabel] == wp.Name {
+		return nil
+	}
+	patch := client.MergeFrom(ns.DeepCopy())
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	ns.Labels[workpaceLabel] = wp.Name
+	return r.Patch(ctx, ns, patch)
+}
+
+// ensureBench creates the bench template in the namespace if it does not exist yet
+// The bench is not owned by the FrappeWorkpace so that deleting the tenant keeps its sites running.
+func (r *FrappeWorkpaceReconciler) ensureBench(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace, ns string) error {
+	if wp.Spec.BenchTemplate == nil {
+		return nil
+	}
+
+	name := workpaceBenchName(wp)
+	bench := &vyogotechv1alpha1.FrappeBench{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, bench)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	bench = &vyogotechv1alpha1.FrappeBench{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels:    map[string]string{workpaceLabel: wp.Name},
+		},
+		Spec: *wp.Spec.BenchTemplate.Spec.DeepCopy(),
+	}
+	log.FromContext(ctx).Info("Creating workpace bench", "namespace", ns, "bench", name)
+	return r.Create(ctx, bench)
+}
+
+// ensureQuota maintains the ResourceQuota and LimitRange that hold the namespace to its share
+// of the tenant's CPU and memory. The LimitRange gives containers without requests a default
+// so that the quota does not reject them.
+func (r *FrappeWorkpaceReconciler) ensureQuota(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace, ns string) error {
+	hard := workpaceNamespaceQuota(wp)
+	key := types.NamespacedName{Name: workpaceQuotaName, Namespace: ns}
+
+	quota := &corev1.ResourceQuota{}
+	err := r.Get(ctx, key, quota)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	if len(hard) == 0 {
+		if exists && metav1.IsControlledBy(quota, wp) {
+			if err := r.Delete(ctx, quota); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		limits := &corev1.LimitRange{}
+		if err := r.Get(ctx, key, limits); err == nil && metav1.IsControlledBy(limits, wp) {
+			if err := r.Delete(ctx, limits); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !exists {
+		quota = &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      workpaceQuotaName,
+				Namespace: ns,
+				Labels:    map[string]string{workpaceLabel: wp.Name},
+			},
+			Spec: corev1.ResourceQuotaSpec{Hard: hard},
+		}
+		if err := controllerutil.SetControllerReference(wp, quota, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, quota); err != nil {
+			return err
+		}
+	} else if !resourceListsEqual(quota.Spec.Hard, hard) {
+		patch := client.MergeFrom(quota.DeepCopy())
+		quota.Spec.Hard = hard
+		if err := r.Patch(ctx, quota, patch); err != nil {
+			return err
+		}
+	}
+
+	defaults := workpaceDefaultRequests(hard)
+	limits := &corev1.LimitRange{}
+	err = r.Get(ctx, key, limits)
+	if errors.IsNotFound(err) {
+		limits = &corev1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      workpaceQuotaName,
+				Namespace: ns,
+				Labels:    map[string]string{workpaceLabel: wp.Name},
+			},
+			Spec: corev1.LimitRangeSpec{
+				Limits: []corev1.LimitRangeItem{{Type: corev1.LimitTypeContainer, DefaultRequest: defaults}},
+			},
+		}
+		if err := controllerutil.SetControllerReference(wp, limits, r.Scheme); err != nil {
+			return err
+		}
+		return r.Create(ctx, limits)
+	}
+	if err != nil {
+		return err
+	}
+	if len(limits.Spec.Limits) == 1 && resourceListsEqual(limits.Spec.Limits[0].DefaultRequest, defaults) {
+		return nil
+	}
+	patch := client.MergeFrom(limits.DeepCopy())
+	limits.Spec.Limits = []corev1.LimitRangeItem{{Type: corev1.LimitTypeContainer, DefaultRequest: defaults}}
+	return r.Patch(ctx, limits, patch)
+}
+
+// updateStatus counts the benches and sites of the tenant and sums its quota usage
+func (r *FrappeWorkpaceReconciler) updateStatus(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace) error {
+	var benches, sites vyogotechv1alpha1.WorkpaceResourceCount
+	var unhealthy []string
+	used := corev1.ResourceList{}
+
+	for _, ns := range wp.Spec.Namespaces {
+		benchList := &vyogotechv1alpha1.FrappeBenchList{}
+		if err := r.List(ctx, benchList, client.InNamespace(ns)); err != nil {
+			return err
+		}
+		for _, bench := range benchList.Items {
+			benches.Total++
+			switch bench.Status.Phase {
+			case "Ready", "Upgrading":
+				benches.Ready++
+			default:
+				if bench.Status.Phase == "Failed" {
+					benches.Failed++
+				}
+				unhealthy = append(unhealthy, fmt.Sprintf("FrappeBench %s/%s: %s", ns, bench.Name, defaultString(bench.Status.Phase, "Pending")))
+			}
+		}
 
-	// TODO(user): your logic here
+		siteList := &vyogotechv1alpha1.FrappeSiteList{}
+		if err := r.List(ctx, siteList, client.InNamespace(ns)); err != nil {
+			return err
+		}
+		for _, site := range siteList.Items {
+			sites.Total++
+			switch site.Status.Phase {
+			case vyogotechv1alpha1.FrappeSitePhaseReady:
+				sites.Ready++
+			default:
+				if site.Status.Phase == vyogotechv1alpha1.FrappeSitePhaseFailed {
+					sites.Failed++
+				}
+				phase := defaultString(string(site.Status.Phase), string(vyogotechv1alpha1.FrappeSitePhasePending))
+				unhealthy = append(unhealthy, fmt.Sprintf("FrappeSite %s/%s: %s", ns, site.Name, phase))
+			}
+		}
 
+		quota := &corev1.ResourceQuota{}
+		err := r.Get(ctx, types.NamespacedName{Name: workpaceQuotaName, Namespace: ns}, quota)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		for name, qty := range quota.Status.Used {
+			total := used[name]
+			total.Add(qty)
+			used[name] = total
+		}
+	}
+
+	wp.Status.Benches = benches
+	wp.Status.Sites = sites
+	wp.Status.Unhealthy = unhealthy
+	wp.Status.QuotaUsed = nil
+	if len(used) > 0 {
+		wp.Status.QuotaUsed = used
+	}
+	wp.Status.ObservedGeneration = wp.Generation
+
+	switch {
+	case benches.Total == 0 && sites.Total == 0:
+		wp.Status.Phase = vyogotechv1alpha1.FrappeWorkpacePhasePending
+		wp.Status.Message = "No benches or sites in the workpace namespaces yet"
+	case len(unhealthy) > 0:
+		wp.Status.Phase = vyogotechv1alpha1.FrappeWorkpacePhaseDegraded
+		wp.Status.Message = fmt.Sprintf("%d bench(es) or site(s) not ready", len(unhealthy))
+	default:
+		wp.Status.Phase = vyogotechv1alpha1.FrappeWorkpacePhaseReady
+		wp.Status.Message = fmt.Sprintf("%d bench(es) and %d site(s) ready", benches.Ready, sites.Ready)
+	}
+	if wp.Spec.Quota != nil && wp.Spec.Quota.MaxSites != nil && sites.Total > *wp.Spec.Quota.MaxSites {
+		wp.Status.Message += fmt.Sprintf("; %d site(s) over the limit of %d", sites.Total-*wp.Spec.Quota.MaxSites, *wp.Spec.Quota.MaxSites)
+	}
+
+	return r.Status().Update(ctx, wp)
+}
+
+func (r *FrappeWorkpaceReconciler) setFailed(ctx context.Context, wp *vyogotechv1alpha1.FrappeWorkpace, message string) (ctrl.Result, error) {
+	wp.Status.Phase = vyogotechv1alpha1.FrappeWorkpacePhaseFailed
+	wp.Status.Message = message
+	wp.Status.ObservedGeneration = wp.Generation
+	if err := r.Status().Update(ctx, wp); err != nil {
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
 
+// workpaceBenchName returns the name of the bench seeded from the template
+func workpaceBenchName(wp *vyogotechv1alpha1.FrappeWorkpace) string {
+	return defaultString(wp.Spec.BenchTemplate.Name, "bench")
+}
+
+// workpaceNamespaceQuota splits the tenant's CPU and memory evenly across its namespaces
+func workpaceNamespaceQuota(wp *vyogotechv1alpha1.FrappeWorkpace) corev1.ResourceList {
+	hard := corev1.ResourceList{}
+	if wp.Spec.Quota == nil || len(wp.Spec.Namespaces) == 0 {
+		return hard
+	}
+
+	n := int64(len(wp.Spec.Namespaces))
+	if cpu := wp.Spec.Quota.CPU; cpu != nil {
+		hard[corev1.ResourceRequestsCPU] = *resource.NewMilliQuantity(cpu.MilliValue()/n, resource.DecimalSI)
+	}
+	if memory := wp.Spec.Quota.Memory; memory != nil {
+		hard[corev1.ResourceRequestsMemory] = *resource.NewQuantity(memory.Value()/n, resource.BinarySI)
+	}
+	return hard
+}
+
+// workpaceDefaultRequests returns the requests given to containers that set none:
+// a tenth of the namespace quota
+func workpaceDefaultRequests(hard corev1.ResourceList) corev1.ResourceList {
+	defaults := corev1.ResourceList{}
+	if cpu, ok := hard[corev1.ResourceRequestsCPU]; ok {
+		defaults[corev1.ResourceCPU] = *resource.NewMilliQuantity(cpu.MilliValue()/10, resource.DecimalSI)
+	}
+	if memory, ok := hard[corev1.ResourceRequestsMemory]; ok {
+		defaults[corev1.ResourceMemory] = *resource.NewQuantity(memory.Value()/10, resource.BinarySI)
+	}
+	return defaults
+}
+
+func resourceListsEqual(a, b corev1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, qty := range a {
+		other, ok := b[name]
+		if !ok || qty.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNamespace(namespaces []string, ns string) bool {
+	for _, n := range namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// workpaceForNamespace returns the FrappeWorkpace that owns the namespace, or nil
+// When two workpaces claim a namespace the oldest wins, matching validateNamespaces.
+func workpaceForNamespace(ctx context.Context, c client.Client, ns string) (*vyogotechv1alpha1.FrappeWorkpace, error) {
+	list := &vyogotechv1alpha1.FrappeWorkpaceList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+
+	var owner *vyogotechv1alpha1.FrappeWorkpace
+	for i := range list.Items {
+		wp := &list.Items[i]
+		if wp.GetDeletionTimestamp() != nil || !containsNamespace(wp.Spec.Namespaces, ns) {
+			continue
+		}
+		if owner == nil || wp.CreationTimestamp.Before(&owner.CreationTimestamp) {
+			owner = wp
+		}
+	}
+	return owner, nil
+}
+
+// labelWorkpaceSite labels a new site with the FrappeWorkpace owning its namespace
+func labelWorkpaceSite(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite) error {
+	wp, err := workpaceForNamespace(ctx, c, site.Namespace)
+	if err != nil || wp == nil {
+		return err
+	}
+	if site.Labels == nil {
+		site.Labels = map[string]string{}
+	}
+	site.Labels[workpaceLabel] = wp.Name
+	return nil
+}
+
+// resolveWorkpaceDefaults fills the fields the site leaves empty from the FrappeWorkpace
+// owning its namespace. Only the site in memory is changed, the stored spec keeps what the
+// user wrote, so the site must not be written back with Update afterwards.
+func resolveWorkpaceDefaults(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite) error {
+	wp, err := workpaceForNamespace(ctx, c, site.Namespace)
+	if err != nil || wp == nil {
+		return err
+	}
+	applyWorkpaceDefaults(wp, &site.Spec)
+	return nil
+}
+
+// applyWorkpaceDefaults fills the fields spec leaves empty from the workpace
+func applyWorkpaceDefaults(wp *vyogotechv1alpha1.FrappeWorkpace, spec *vyogotechv1alpha1.FrappeSiteSpec) {
+	if spec.BenchRef == nil && wp.Spec.BenchTemplate != nil {
+		spec.BenchRef = &vyogotechv1alpha1.NamespacedName{Name: workpaceBenchName(wp)}
+	}
+	if wp.Spec.DBConfig != nil && spec.DBConfig.Provider == "" {
+		spec.DBConfig = *wp.Spec.DBConfig.DeepCopy()
+	}
+	if spec.Domain == "" && wp.Spec.DomainSuffix != "" {
+		spec.Domain = spec.SiteName + wp.Spec.DomainSuffix
+	}
+	if wp.Spec.TLS != nil && spec.TLS == (vyogotechv1alpha1.TLSConfig{}) {
+		spec.TLS = *wp.Spec.TLS
+	}
+	if spec.IngressClassName == "" {
+		spec.IngressClassName = wp.Spec.IngressClassName
+	}
+}
+
+// checkWorkpaceSiteQuota reports whether the site fits the maxSites of its FrappeWorkpace.
+// The tenant's sites are ranked by age and the newest ones beyond the limit are held back;
+// sites that are already Ready are never held back.
+func checkWorkpaceSiteQuota(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite) (bool, string, error) {
+	wp, err := workpaceForNamespace(ctx, c, site.Namespace)
+	if err != nil || wp == nil || wp.Spec.Quota == nil || wp.Spec.Quota.MaxSites == nil {
+		return true, "", err
+	}
+	if site.Status.Phase == vyogotechv1alpha1.FrappeSitePhaseReady {
+		return true, "", nil
+	}
+
+	var sites []vyogotechv1alpha1.FrappeSite
+	for _, ns := range wp.Spec.Namespaces {
+		list := &vyogotechv1alpha1.FrappeSiteList{}
+		if err := c.List(ctx, list, client.InNamespace(ns)); err != nil {
+			return false, "", err
+		}
+		for _, s := range list.Items {
+			if s.GetDeletionTimestamp() == nil {
+				sites = append(sites, s)
+			}
+		}
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if !sites[i].CreationTimestamp.Equal(&sites[j].CreationTimestamp) {
+			return sites[i].CreationTimestamp.Before(&sites[j].CreationTimestamp)
+		}
+		return sites[i].Namespace+"/"+sites[i].Name < sites[j].Namespace+"/"+sites[j].Name
+	})
+
+	max := int(*wp.Spec.Quota.MaxSites)
+	for i, s := range sites {
+		if s.UID == site.UID {
+			if i < max {
+				return true, "", nil
+			}
+			return false, fmt.Sprintf("FrappeWorkpace %s allows %d site(s) and has %d", wp.Name, max, len(sites)), nil
+		}
+	}
+	return true, "", nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *FrappeWorkpaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.FrappeWorkpace{}).
+		Owns(&corev1.ResourceQuota{}).
+		Owns(&corev1.LimitRange{}).
+		Watches(&vyogotechv1alpha1.FrappeSite{}, handler.EnqueueRequestsFromMapFunc(r.workpaceForObject)).
+		Watches(&vyogotechv1alpha1.FrappeBench{}, handler.EnqueueRequestsFromMapFunc(r.workpaceForObject)).
 		Complete(r)
 }
+
+// workpaceForObject maps a bench or site to the FrappeWorkpace owning its namespace
+func (r *FrappeWorkpaceReconciler) workpaceForObject(ctx context.Context, obj client.Object) []reconcile.Request {
+	wp, err := workpaceForNamespace(ctx, r.Client, obj.GetNamespace())
+	if err != nil || wp == nil {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: wp.Name}}}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("FrappeWorkpace", func() {
+	var (
+		ctx        context.Context
+		namespaces []string
+		wp         *vyogotechv1alpha1.FrappeWorkpace
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespaces = nil
+		for i := 0; i < 2; i++ {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "workpace-"}}
+			Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+			namespaces = append(namespaces, namespace.Name)
+		}
+
+		wp = &vyogotechv1alpha1.FrappeWorkpace{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "tenant-"},
+			Spec: vyogotechv1alpha1.FrappeWorkpaceSpec{
+				Namespaces: namespaces,
+				BenchTemplate: &vyogotechv1alpha1.WorkpaceBenchTemplate{
+					Name: "bench",
+					Spec: vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+				},
+				DomainSuffix:     ".acme.example.com",
+				IngressClassName: "nginx",
+			},
+		}
+	})
+
+	createSite := func(name, ns string) *vyogotechv1alpha1.FrappeSite {
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeSiteSpec{SiteName: name + ".example.com"},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		return site
+	}
+
+	Describe("site defaults", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Create(ctx, wp)).To(Succeed())
+		})
+
+		It("resolves the defaults on every reconcile without writing them to the site", func() {
+			site := createSite("shop", namespaces[0])
+
+			r := &FrappeSiteReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			// The template bench does not exist, so the site waits for it
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(site)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(site), site)).To(Succeed())
+			Expect(site.Labels).To(HaveKeyWithValue(workpaceLabel, wp.Name))
+			Expect(site.Status.Phase).To(Equal(vyogotechv1alpha1.FrappeSitePhasePending))
+			Expect(site.Spec.BenchRef).To(BeNil())
+			Expect(site.Spec.Domain).To(BeEmpty())
+			Expect(site.Spec.IngressClassName).To(BeEmpty())
+
+			Expect(resolveWorkpaceDefaults(ctx, k8sClient, site)).To(Succeed())
+			Expect(site.Spec.BenchRef.Name).To(Equal("bench"))
+			Expect(site.Spec.Domain).To(Equal("shop.example.com.acme.example.com"))
+			Expect(site.Spec.IngressClassName).To(Equal("nginx"))
+		})
+
+		It("keeps the fields set on the site", func() {
+			site := createSite("shop", namespaces[0])
+			site.Spec.BenchRef = &vyogotechv1alpha1.NamespacedName{Name: "other"}
+			site.Spec.Domain = "shop.example.org"
+
+			Expect(resolveWorkpaceDefaults(ctx, k8sClient, site)).To(Succeed())
+			Expect(site.Spec.BenchRef.Name).To(Equal("other"))
+			Expect(site.Spec.Domain).To(Equal("shop.example.org"))
+		})
+
+		It("resolves the template bench of a site for the site API", func() {
+			site := createSite("shop", namespaces[0])
+			bench := &vyogotechv1alpha1.FrappeBench{
+				ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: namespaces[0]},
+				Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+			}
+			Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+			_, found, err := getSiteAndBench(ctx, k8sClient, &vyogotechv1alpha1.NamespacedName{Name: site.Name}, site.Namespace)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).NotTo(BeNil())
+			Expect(found.Name).To(Equal("bench"))
+		})
+	})
+
+	Describe("quota", func() {
+		It("holds back the newest sites beyond maxSites", func() {
+			maxSites := int32(2)
+			wp.Spec.Quota = &vyogotechv1alpha1.WorkpaceQuota{MaxSites: &maxSites}
+			Expect(k8sClient.Create(ctx, wp)).To(Succeed())
+
+			// Created within the same second, the sites are ranked by namespace and name
+			var sites []*vyogotechv1alpha1.FrappeSite
+			for _, name := range []string{"a", "b", "c"} {
+				sites = append(sites, createSite(name, namespaces[0]))
+			}
+
+			for i, site := range sites {
+				within, message, err := checkWorkpaceSiteQuota(ctx, k8sClient, site)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(within).To(Equal(i < 2), site.Name)
+				if !within {
+					Expect(message).To(ContainSubstring("allows 2 site(s) and has 3"))
+				}
+			}
+
+			// A site that is already Ready keeps running
+			sites[2].Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+			within, _, err := checkWorkpaceSiteQuota(ctx, k8sClient, sites[2])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(within).To(BeTrue())
+		})
+
+		It("splits the CPU and memory quota across the namespaces", func() {
+			cpu := resource.MustParse("2")
+			memory := resource.MustParse("4Gi")
+			wp.Spec.Quota = &vyogotechv1alpha1.WorkpaceQuota{CPU: &cpu, Memory: &memory}
+			Expect(k8sClient.Create(ctx, wp)).To(Succeed())
+
+			r := &FrappeWorkpaceReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(wp)})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, ns := range namespaces {
+				key := client.ObjectKey{Name: workpaceQuotaName, Namespace: ns}
+				quota := &corev1.ResourceQuota{}
+				Expect(k8sClient.Get(ctx, key, quota)).To(Succeed())
+				Expect(quota.Spec.Hard.Name(corev1.ResourceRequestsCPU, resource.DecimalSI).String()).To(Equal("1"))
+				Expect(quota.Spec.Hard.Name(corev1.ResourceRequestsMemory, resource.BinarySI).String()).To(Equal("2Gi"))
+
+				limits := &corev1.LimitRange{}
+				Expect(k8sClient.Get(ctx, key, limits)).To(Succeed())
+				Expect(limits.Spec.Limits[0].DefaultRequest.Cpu().String()).To(Equal("100m"))
+			}
+
+			// Removing the quota deletes the ResourceQuotas and LimitRanges
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(wp), wp)).To(Succeed())
+			wp.Spec.Quota = nil
+			Expect(k8sClient.Update(ctx, wp)).To(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(wp)})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, ns := range namespaces {
+				key := client.ObjectKey{Name: workpaceQuotaName, Namespace: ns}
+				Expect(errors.IsNotFound(k8sClient.Get(ctx, key, &corev1.ResourceQuota{}))).To(BeTrue())
+				Expect(errors.IsNotFound(k8sClient.Get(ctx, key, &corev1.LimitRange{}))).To(BeTrue())
+			}
+		})
+	})
+})
@@ -0,0 +1,157 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
+)
+
+// siteSyncInterval is how often objects managed through the REST API are re-checked for changes made on the site
+const siteSyncInterval = 10 * time.Minute
+
+// siteAPIBaseURL returns the in-cluster URL of the bench's gunicorn Service
+func siteAPIBaseURL(bench *vyogotechv1alpha1.FrappeBench) string {
+	return fmt.Sprintf("http://%s-gunicorn.%s.svc.cluster.local:8000", bench.Name, bench.Namespace)
+}
+
+// newSiteAPIClient returns a REST API client logged in to the site as Administrator
+func newSiteAPIClient(ctx context.Context, c client.Client, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench) (*frappeapi.Client, error) {
+	password, err := getAdminPassword(ctx, c, site)
+	if err != nil {
+		return nil, err
+	}
+
+	api := frappeapi.NewClient(siteAPIBaseURL(bench), site.Spec.SiteName)
+	if err := api.Login(ctx, "Administrator", password); err != nil {
+		return nil, fmt.Errorf("failed to log in to site %s: %w", site.Spec.SiteName, err)
+	}
+	return api, nil
+}
+
+// checkSiteRefNamespace rejects a siteRef to another namespace. The operator logs in to
+// the site as Administrator, so only objects next to the site may manage it.
+func checkSiteRefNamespace(kind string, siteRef *vyogotechv1alpha1.NamespacedName, namespace string) error {
+	if siteRef.Namespace != "" && siteRef.Namespace != namespace {
+		return fmt.Errorf("%s must be in namespace %s of site %s", kind, siteRef.Namespace, siteRef.Name)
+	}
+	return nil
+}
+
+// newSiteAPIClientForCleanup returns a client for the site of siteRef, or nil when the
+// site is gone or being deleted and there is nothing left to clean up on it
+func newSiteAPIClientForCleanup(ctx context.Context, c client.Client, siteRef *vyogotechv1alpha1.NamespacedName, namespace string) (*frappeapi.Client, error) {
+	// Nothing was ever created on a site in another namespace
+	if checkSiteRefNamespace("", siteRef, namespace) != nil {
+		return nil, nil
+	}
+	site, bench, err := getSiteAndBench(ctx, c, siteRef, namespace)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bench == nil || !site.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return newSiteAPIClient(ctx, c, site, bench)
+}
+
+// upsertDoc creates the document, or overwrites it with desired when fields differ
+// It returns the fields that differed, nil when the document was created or unchanged.
+func upsertDoc(ctx context.Context, api *frappeapi.Client, doctype, name string, desired map[string]interface{}) ([]string, error) {
+	logger := log.FromContext(ctx)
+
+	current := map[string]interface{}{}
+	err := api.GetDoc(ctx, doctype, name, &current)
+	if frappeapi.IsNotFound(err) {
+		logger.Info("Creating document", "doctype", doctype, "name", name)
+		return nil, api.InsertDoc(ctx, doctype, desired, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := frappeapi.ChangedFields(desired, current)
+	if err != nil || len(changed) == 0 {
+		return nil, err
+	}
+	logger.Info("Updating document", "doctype", doctype, "name", name, "fields", changed)
+	return changed, api.UpdateDoc(ctx, doctype, name, desired, nil)
+}
+
+// siteAPIPhase is the part of the phase an object managed through the REST API shares
+// with the others
+type siteAPIPhase int
+
+const (
+	siteAPIPending siteAPIPhase = iota
+	siteAPIFailed
+)
+
+// siteAPIStatus writes the Pending and Failed status of an object managed through the REST API
+type siteAPIStatus struct {
+	client client.Client
+	obj    client.Object
+	// set records phase and message, and the dependencies that are missing, in the status of obj
+	set func(phase siteAPIPhase, message string, missing []string)
+}
+
+// apiError records an error from the site; errors returned by Frappe are not retried until the next sync
+func (s siteAPIStatus) apiError(ctx context.Context, err error) (ctrl.Result, error) {
+	var apiErr *frappeapi.Error
+	if !goerrors.As(err, &apiErr) {
+		return ctrl.Result{}, err
+	}
+	if err := s.setFailed(ctx, err.Error()); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: siteSyncInterval}, nil
+}
+
+// setPending records why the object is waiting
+func (s siteAPIStatus) setPending(ctx context.Context, message string) (ctrl.Result, error) {
+	return s.setPendingOn(ctx, message, nil)
+}
+
+// setPendingOn records the dependencies the object is waiting for; they are looked up again every minute
+func (s siteAPIStatus) setPendingOn(ctx context.Context, message string, missing []string) (ctrl.Result, error) {
+	s.set(siteAPIPending, message, missing)
+	if err := s.client.Status().Update(ctx, s.obj); err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(missing) > 0 {
+		return ctrl.Result{RequeueAfter: dependencyRetryInterval}, nil
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+func (s siteAPIStatus) setFailed(ctx context.Context, message string) error {
+	s.set(siteAPIFailed, message, nil)
+	return s.client.Status().Update(ctx, s.obj)
+}
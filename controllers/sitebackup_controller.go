@@ -18,11 +18,25 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
 )
@@ -33,30 +47,490 @@ type SiteBackupReconciler struct {
 	Scheme *runtime.Scheme
 }
 
+// backupJobResult is the termination message written by the backup Job
+type backupJobResult struct {
+	Location  string                             `json:"location"`
+	Checksum  string                             `json:"checksum"`
+	Artifacts []vyogotechv1alpha1.BackupArtifact `json:"artifacts"`
+}
+
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitebackups,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitebackups/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitebackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteBackup object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile runs a one-off backup Job for the SiteBackup and records its artifacts
 func (r *SiteBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	backup := &vyogotechv1alpha1.SiteBackup{}
+	if err := r.Get(ctx, req.NamespacedName, backup); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteBackup")
+		return ctrl.Result{}, err
+	}
+
+	if !backup.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(backup, siteBackupFinalizer) {
+			return r.handleBackupDeletion(ctx, backup)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if backup.Spec.Schedule != "" {
+		return r.reconcileSchedule(ctx, backup)
+	}
+
+	// A backup is taken once, finished backups are never re-run
+	if backup.Status.Phase == vyogotechv1alpha1.SiteBackupPhaseCompleted ||
+		backup.Status.Phase == vyogotechv1alpha1.SiteBackupPhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Reconciling SiteBackup", "name", backup.Name, "namespace", backup.Namespace)
+
+	if backup.Spec.SiteRef == nil {
+		return ctrl.Result{}, r.setFailed(ctx, backup, "siteRef is required")
+	}
+
+	site, bench, err := r.getSiteAndBench(ctx, backup)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.setPending(ctx, backup, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.setFailed(ctx, backup, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+
+	if bench.Namespace != backup.Namespace {
+		return ctrl.Result{}, r.setFailed(ctx, backup,
+			fmt.Sprintf("SiteBackup must be in namespace %s of bench %s", bench.Namespace, bench.Name))
+	}
+	if err := validateBackupDestination(backup.Spec.Destination); err != nil {
+		return ctrl.Result{}, r.setFailed(ctx, backup, err.Error())
+	}
+
+	jobName := fmt.Sprintf("%s-backup", backup.Name)
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: backup.Namespace}, job)
+	if errors.IsNotFound(err) {
+		if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+			return r.setPending(ctx, backup, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+		}
+		if benchStorageMigrating(bench) {
+			return r.setPending(ctx, backup, fmt.Sprintf("waiting for the storage migration of bench %s", bench.Name))
+		}
+
+		job, err = r.buildBackupJob(backup, site, bench, jobName)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		logger.Info("Creating backup job", "job", jobName, "site", site.Spec.SiteName)
+		if err := r.Create(ctx, job); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		now := metav1.Now()
+		backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseRunning
+		backup.Status.JobName = jobName
+		backup.Status.StartTime = &now
+		backup.Status.FrappeVersion = bench.Status.CurrentVersion
+		if backup.Status.FrappeVersion == "" {
+			backup.Status.FrappeVersion = bench.Spec.FrappeVersion
+		}
+		backup.Status.Message = "Backup job created"
+		return ctrl.Result{}, r.Status().Update(ctx, backup)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if job.Status.Failed > 0 {
+		logger.Error(nil, "Backup job failed", "job", jobName)
+		return ctrl.Result{}, r.setFailed(ctx, backup, fmt.Sprintf("backup job %s failed", jobName))
+	}
+	if job.Status.Succeeded == 0 {
+		// Job completion triggers a reconcile through Owns
+		return ctrl.Result{}, nil
+	}
+
+	result, err := r.readBackupResult(ctx, job)
+	if err != nil {
+		return ctrl.Result{}, r.setFailed(ctx, backup, fmt.Sprintf("backup finished but its result could not be read: %v", err))
+	}
+
+	now := metav1.Now()
+	backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseCompleted
+	backup.Status.Location = result.Location
+	backup.Status.Artifacts = result.Artifacts
+	backup.Status.Checksum = result.Checksum
+	backup.Status.Size = 0
+	for _, artifact := range result.Artifacts {
+		backup.Status.Size += artifact.Size
+	}
+	backup.Status.CompletionTime = &now
+	backup.Status.Message = fmt.Sprintf("Backup of %s completed", site.Spec.SiteName)
+
+	logger.Info("Backup completed", "location", result.Location, "size", backup.Status.Size)
+	return ctrl.Result{}, r.Status().Update(ctx, backup)
+}
+
+// getSiteAndBench returns the FrappeSite referenced by the backup and its bench
+// The bench is nil if the site does not reference one
+func (r *SiteBackupReconciler) getSiteAndBench(ctx context.Context, backup *vyogotechv1alpha1.SiteBackup) (*vyogotechv1alpha1.FrappeSite, *vyogotechv1alpha1.FrappeBench, error) {
+	return getSiteAndBench(ctx, r.Client, backup.Spec.SiteRef, backup.Namespace)
+}
+
+// getSiteAndBench resolves a siteRef (defaulting to namespace) to the site, with its workpace
+// defaults, and its bench. The bench is nil if the site does not reference one
+func getSiteAndBench(ctx context.Context, c client.Client, siteRef *vyogotechv1alpha1.NamespacedName, namespace string) (*vyogotechv1alpha1.FrappeSite, *vyogotechv1alpha1.FrappeBench, error) {
+	siteNamespace := siteRef.Namespace
+	if siteNamespace == "" {
+		siteNamespace = namespace
+	}
+
+	site := &vyogotechv1alpha1.FrappeSite{}
+	if err := c.Get(ctx, types.NamespacedName{Name: siteRef.Name, Namespace: siteNamespace}, site); err != nil {
+		return nil, nil, err
+	}
+	if err := resolveWorkpaceDefaults(ctx, c, site); err != nil {
+		return nil, nil, err
+	}
+	if site.Spec.BenchRef == nil {
+		return site, nil, nil
+	}
+
+	benchNamespace := site.Spec.BenchRef.Namespace
+	if benchNamespace == "" {
+		benchNamespace = site.Namespace
+	}
+
+	bench := &vyogotechv1alpha1.FrappeBench{}
+	if err := c.Get(ctx, types.NamespacedName{Name: site.Spec.BenchRef.Name, Namespace: benchNamespace}, bench); err != nil {
+		return nil, nil, err
+	}
+
+	return site, bench, nil
+}
+
+// validateBackupDestination checks that the destination block matches its type
+func validateBackupDestination(dest *vyogotechv1alpha1.BackupDestination) error {
+	if dest == nil {
+		return nil
+	}
+	switch dest.Type {
+	case "pvc":
+		if dest.PVC == nil || dest.PVC.ClaimName == "" {
+			return fmt.Errorf("destination.pvc.claimName is required for pvc destinations")
+		}
+	case "s3":
+		if dest.S3 == nil || dest.S3.Bucket == "" {
+			return fmt.Errorf("destination.s3.bucket is required for s3 destinations")
+		}
+	default:
+		return fmt.Errorf("unsupported backup destination type: %s", dest.Type)
+	}
+	return nil
+}
+
+// buildBackupJob returns the Job that runs bench backup and ships the artifacts
+func (r *SiteBackupReconciler) buildBackupJob(backup *vyogotechv1alpha1.SiteBackup, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench, jobName string) (*batchv1.Job, error) {
+	withFiles := backup.Spec.IncludePublicFiles || backup.Spec.IncludePrivateFiles
+
+	env := []corev1.EnvVar{
+		{Name: "SITE_NAME", Value: site.Spec.SiteName},
+		{Name: "WITH_FILES", Value: strconv.FormatBool(withFiles)},
+		{Name: "INCLUDE_PUBLIC_FILES", Value: strconv.FormatBool(backup.Spec.IncludePublicFiles)},
+		{Name: "INCLUDE_PRIVATE_FILES", Value: strconv.FormatBool(backup.Spec.IncludePrivateFiles)},
+	}
+
+	return r.buildBackupStorageJob(backup, site, bench, jobName, siteBackupScript, env)
+}
 
-	// TODO(user): your logic here
+// buildBackupStorageJob returns a Job with the bench PVC and the backup's
+// destination wired up through BACKUP_DIR, BACKUP_LOCATION and the S3 variables
+func (r *SiteBackupReconciler) buildBackupStorageJob(backup *vyogotechv1alpha1.SiteBackup, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench, jobName, script string, env []corev1.EnvVar) (*batchv1.Job, error) {
+	siteName := site.Spec.SiteName
 
-	return ctrl.Result{}, nil
+	volumeMounts := benchVolumeMounts(bench, siteJobImage(bench))
+	volumes := []corev1.Volume{
+		{
+			Name: "sites",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: benchSitesClaim(bench),
+				},
+			},
+		},
+	}
+
+	dest := backup.Spec.Destination
+	switch {
+	case dest == nil:
+		// Keep the backup next to the site, where bench backup normally writes
+		relDir := path.Join(siteName, "private", "backups", backup.Name)
+		env = append(env,
+			corev1.EnvVar{Name: "BACKUP_DIR", Value: path.Join("/home/frappe/frappe-bench/sites", relDir)},
+			corev1.EnvVar{Name: "BACKUP_LOCATION", Value: fmt.Sprintf("pvc://%s/%s/", benchSitesClaim(bench), relDir)},
+		)
+
+	case dest.Type == "pvc":
+		relDir := path.Join(strings.Trim(dest.PVC.Path, "/"), siteName, backup.Name)
+		env = append(env,
+			corev1.EnvVar{Name: "BACKUP_DIR", Value: path.Join("/backup", relDir)},
+			corev1.EnvVar{Name: "BACKUP_LOCATION", Value: fmt.Sprintf("pvc://%s/%s/", dest.PVC.ClaimName, relDir)},
+		)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "backup", MountPath: "/backup"})
+		volumes = append(volumes, corev1.Volume{
+			Name: "backup",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dest.PVC.ClaimName,
+				},
+			},
+		})
+
+	case dest.Type == "s3":
+		keyPrefix := path.Join(strings.Trim(dest.S3.Prefix, "/"), siteName, backup.Name) + "/"
+		env = append(env,
+			corev1.EnvVar{Name: "BACKUP_DIR", Value: "/backup"},
+			corev1.EnvVar{Name: "BACKUP_LOCATION", Value: fmt.Sprintf("s3://%s/%s", dest.S3.Bucket, keyPrefix)},
+		)
+		env = append(env, s3EnvVars(dest.S3, keyPrefix)...)
+		// Stage artifacts in scratch space before uploading
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "backup", MountPath: "/backup"})
+		volumes = append(volumes, corev1.Volume{
+			Name: "backup",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: backup.Namespace,
+			Labels: map[string]string{
+				"app":    "frappe",
+				"site":   site.Name,
+				"backup": backup.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "backup",
+							Image:        siteJobImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{script},
+							Env:          env,
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(backup, job, r.Scheme); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// s3EnvVars returns the environment for boto3 to reach an S3 destination
+// Credentials are referenced from the Secret, never copied into the Job spec
+func s3EnvVars(s3 *vyogotechv1alpha1.S3BackupDestination, keyPrefix string) []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{Name: "S3_ENDPOINT", Value: s3.Endpoint},
+		{Name: "S3_BUCKET", Value: s3.Bucket},
+		{Name: "S3_REGION", Value: s3.Region},
+		{Name: "S3_KEY_PREFIX", Value: keyPrefix},
+		{Name: "S3_FORCE_PATH_STYLE", Value: strconv.FormatBool(s3.ForcePathStyle)},
+	}
+
+	if s3.CredentialsSecretRef != nil {
+		env = append(env,
+			secretEnvVar("AWS_ACCESS_KEY_ID", s3.CredentialsSecretRef.Name, "accessKeyId"),
+			secretEnvVar("AWS_SECRET_ACCESS_KEY", s3.CredentialsSecretRef.Name, "secretAccessKey"),
+		)
+	}
+	return env
+}
+
+// readBackupResult reads the artifact list the backup container left in its termination message
+func (r *SiteBackupReconciler) readBackupResult(ctx context.Context, job *batchv1.Job) (*backupJobResult, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, err
+	}
+
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "backup" || status.State.Terminated == nil {
+				continue
+			}
+			result := &backupJobResult{}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), result); err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no succeeded pod found for job %s", job.Name)
+}
+
+func (r *SiteBackupReconciler) setPending(ctx context.Context, backup *vyogotechv1alpha1.SiteBackup, message string) (ctrl.Result, error) {
+	backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhasePending
+	backup.Status.Message = message
+	if err := r.Status().Update(ctx, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+func (r *SiteBackupReconciler) setFailed(ctx context.Context, backup *vyogotechv1alpha1.SiteBackup, message string) error {
+	now := metav1.Now()
+	backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseFailed
+	backup.Status.Message = message
+	backup.Status.CompletionTime = &now
+	return r.Status().Update(ctx, backup)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SiteBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.SiteBackup{}).
+		Owns(&batchv1.Job{}).
+		// Wake the scheduled SiteBackup up when one of its children changes
+		Watches(&vyogotechv1alpha1.SiteBackup{}, handler.EnqueueRequestsFromMapFunc(
+			func(ctx context.Context, obj client.Object) []reconcile.Request {
+				parent := obj.GetLabels()[backupScheduleLabel]
+				if parent == "" {
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: parent, Namespace: obj.GetNamespace()}}}
+			})).
 		Complete(r)
 }
+
+// siteBackupScript takes the backup with bench, computes checksums, uploads the
+// artifacts when an S3 bucket is configured and reports them via the termination message
+const siteBackupScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" || -z "$BACKUP_DIR" ]]; then
+    echo "ERROR: Required environment variables not set"
+    exit 1
+fi
+
+mkdir -p "$BACKUP_DIR"
+
+ARGS=(--backup-path "$BACKUP_DIR")
+if [[ "$WITH_FILES" == "true" ]]; then
+    ARGS+=(--with-files)
+fi
+
+echo "Backing up $SITE_NAME to $BACKUP_LOCATION"
+bench --site "$SITE_NAME" backup "${ARGS[@]}"
+
+# bench backup --with-files always writes both tarballs
+if [[ "$INCLUDE_PUBLIC_FILES" != "true" ]]; then
+    find "$BACKUP_DIR" -maxdepth 1 -name '*-files.t*' ! -name '*-private-files.t*' -delete
+fi
+if [[ "$INCLUDE_PRIVATE_FILES" != "true" ]]; then
+    find "$BACKUP_DIR" -maxdepth 1 -name '*-private-files.t*' -delete
+fi
+
+env/bin/python - <<'PYEOF'
+import hashlib
+import json
+import os
+
+backup_dir = os.environ["BACKUP_DIR"]
+location = os.environ["BACKUP_LOCATION"]
+kinds = [
+    ("-private-files.", "private-files"),
+    ("-files.", "public-files"),
+    ("-database.", "database"),
+    ("-site_config_backup.", "site-config"),
+]
+
+artifacts = []
+for name in sorted(os.listdir(backup_dir)):
+    path = os.path.join(backup_dir, name)
+    if name == "SHA256SUMS" or not os.path.isfile(path):
+        continue
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(1 << 20), b""):
+            digest.update(chunk)
+    artifacts.append({
+        "name": name,
+        "type": next((kind for marker, kind in kinds if marker in name), "other"),
+        "size": os.path.getsize(path),
+        "sha256": digest.hexdigest(),
+    })
+
+manifest = "".join("%s  %s\n" % (a["sha256"], a["name"]) for a in artifacts)
+with open(os.path.join(backup_dir, "SHA256SUMS"), "w") as f:
+    f.write(manifest)
+
+if os.environ.get("S3_BUCKET"):
+    import boto3
+    from botocore.config import Config
+
+    addressing = "path" if os.environ.get("S3_FORCE_PATH_STYLE") == "true" else "auto"
+    s3 = boto3.client(
+        "s3",
+        endpoint_url=os.environ.get("S3_ENDPOINT") or None,
+        region_name=os.environ.get("S3_REGION") or None,
+        config=Config(s3={"addressing_style": addressing}),
+    )
+    prefix = os.environ.get("S3_KEY_PREFIX", "")
+    for name in [a["name"] for a in artifacts] + ["SHA256SUMS"]:
+        print("Uploading %s" % name)
+        s3.upload_file(os.path.join(backup_dir, name), os.environ["S3_BUCKET"], prefix + name)
+
+result = {
+    "location": location,
+    "checksum": "sha256:" + hashlib.sha256(manifest.encode()).hexdigest(),
+    "artifacts": [
+        {
+            "type": a["type"],
+            "path": location + a["name"],
+            "size": a["size"],
+            "checksum": "sha256:" + a["sha256"],
+        }
+        for a in artifacts
+    ],
+}
+with open("/dev/termination-log", "w") as f:
+    json.dump(result, f)
+PYEOF
+
+echo "Backup of $SITE_NAME complete!"
+`
@@ -0,0 +1,288 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteBackup", func() {
+	var (
+		ctx context.Context
+		ns  string
+		r   *SiteBackupReconciler
+	)
+
+	// createSite creates a bench and a Ready site on it in namespace
+	createSite := func(namespace string) {
+		bench := &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: namespace},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: namespace},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+	}
+
+	createBackup := func(dest *vyogotechv1alpha1.BackupDestination) *vyogotechv1alpha1.SiteBackup {
+		backup := &vyogotechv1alpha1.SiteBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteBackupSpec{
+				SiteRef:             &vyogotechv1alpha1.NamespacedName{Name: "site"},
+				IncludePrivateFiles: true,
+				Destination:         dest,
+			},
+		}
+		Expect(k8sClient.Create(ctx, backup)).To(Succeed())
+		return backup
+	}
+
+	// reconcile runs one reconcile and returns the SiteBackup as stored
+	reconcile := func(backup *vyogotechv1alpha1.SiteBackup) *vyogotechv1alpha1.SiteBackup {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(backup)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(backup), backup)).To(Succeed())
+		return backup
+	}
+
+	backupJob := func() *batchv1.Job {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "nightly-backup", Namespace: ns}, job)).To(Succeed())
+		return job
+	}
+
+	jobEnv := func(job *batchv1.Job) map[string]corev1.EnvVar {
+		env := map[string]corev1.EnvVar{}
+		for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+			env[e.Name] = e
+		}
+		return env
+	}
+
+	jobVolume := func(job *batchv1.Job, name string) *corev1.Volume {
+		for i, volume := range job.Spec.Template.Spec.Volumes {
+			if volume.Name == name {
+				return &job.Spec.Template.Spec.Volumes[i]
+			}
+		}
+		return nil
+	}
+
+	// finishJob marks the backup Job as succeeded, with report as the termination message of its pod
+	finishJob := func(report string) {
+		job := backupJob()
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		job.Status.CompletionTime = &now
+		job.Status.Succeeded = 1
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly-backup-pod", Namespace: ns, Labels: map[string]string{"job-name": job.Name}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "backup", Image: "frappe"}}},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "backup",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: report}},
+		}}
+		Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "site-backup-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		r = &SiteBackupReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("keeps the backup next to the site without a destination", func() {
+		createSite(ns)
+		backup := reconcile(createBackup(nil))
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseRunning))
+		Expect(backup.Status.JobName).To(Equal("nightly-backup"))
+		Expect(backup.Status.FrappeVersion).To(Equal("version-15"))
+
+		env := jobEnv(backupJob())
+		Expect(env["BACKUP_DIR"].Value).To(Equal("/home/frappe/frappe-bench/sites/site.example.com/private/backups/nightly"))
+		Expect(env["BACKUP_LOCATION"].Value).To(Equal("pvc://bench-sites/site.example.com/private/backups/nightly/"))
+		Expect(env["WITH_FILES"].Value).To(Equal("true"))
+		Expect(env["INCLUDE_PUBLIC_FILES"].Value).To(Equal("false"))
+		Expect(env["INCLUDE_PRIVATE_FILES"].Value).To(Equal("true"))
+	})
+
+	It("writes the backup to the destination PVC", func() {
+		createSite(ns)
+		reconcile(createBackup(&vyogotechv1alpha1.BackupDestination{
+			Type: "pvc",
+			PVC:  &vyogotechv1alpha1.PVCBackupDestination{ClaimName: "backups", Path: "/frappe/"},
+		}))
+
+		job := backupJob()
+		env := jobEnv(job)
+		Expect(env["BACKUP_DIR"].Value).To(Equal("/backup/frappe/site.example.com/nightly"))
+		Expect(env["BACKUP_LOCATION"].Value).To(Equal("pvc://backups/frappe/site.example.com/nightly/"))
+		Expect(env).NotTo(HaveKey("S3_BUCKET"))
+		Expect(jobVolume(job, "backup").PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+		Expect(job.Spec.Template.Spec.Containers[0].VolumeMounts).To(ContainElement(
+			corev1.VolumeMount{Name: "backup", MountPath: "/backup"}))
+	})
+
+	It("stages the backup in scratch space and uploads it to S3", func() {
+		createSite(ns)
+		reconcile(createBackup(&vyogotechv1alpha1.BackupDestination{
+			Type: "s3",
+			S3: &vyogotechv1alpha1.S3BackupDestination{
+				Endpoint:             "http://minio:9000",
+				Bucket:               "backups",
+				Region:               "us-east-1",
+				Prefix:               "/frappe/",
+				ForcePathStyle:       true,
+				CredentialsSecretRef: &corev1.LocalObjectReference{Name: "s3-credentials"},
+			},
+		}))
+
+		job := backupJob()
+		env := jobEnv(job)
+		Expect(env["BACKUP_DIR"].Value).To(Equal("/backup"))
+		Expect(env["BACKUP_LOCATION"].Value).To(Equal("s3://backups/frappe/site.example.com/nightly/"))
+		Expect(env["S3_ENDPOINT"].Value).To(Equal("http://minio:9000"))
+		Expect(env["S3_BUCKET"].Value).To(Equal("backups"))
+		Expect(env["S3_REGION"].Value).To(Equal("us-east-1"))
+		Expect(env["S3_KEY_PREFIX"].Value).To(Equal("frappe/site.example.com/nightly/"))
+		Expect(env["S3_FORCE_PATH_STYLE"].Value).To(Equal("true"))
+		Expect(env["AWS_ACCESS_KEY_ID"].ValueFrom.SecretKeyRef.Name).To(Equal("s3-credentials"))
+		Expect(env["AWS_ACCESS_KEY_ID"].ValueFrom.SecretKeyRef.Key).To(Equal("accessKeyId"))
+		Expect(env["AWS_SECRET_ACCESS_KEY"].ValueFrom.SecretKeyRef.Key).To(Equal("secretAccessKey"))
+		Expect(jobVolume(job, "backup").EmptyDir).NotTo(BeNil())
+	})
+
+	It("records the artifacts the Job reported in its termination message", func() {
+		createSite(ns)
+		backup := reconcile(createBackup(nil))
+
+		// Nothing changes while the Job runs
+		backup = reconcile(backup)
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseRunning))
+
+		location := "pvc://bench-sites/site.example.com/private/backups/nightly/"
+		finishJob(`{"location":"` + location + `","checksum":"sha256:abc","artifacts":[` +
+			`{"type":"database","path":"` + location + `db.sql.gz","size":1000,"checksum":"sha256:db"},` +
+			`{"type":"private-files","path":"` + location + `private.tar","size":24,"checksum":"sha256:files"}]}`)
+
+		backup = reconcile(backup)
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseCompleted))
+		Expect(backup.Status.Location).To(Equal(location))
+		Expect(backup.Status.Checksum).To(Equal("sha256:abc"))
+		Expect(backup.Status.Size).To(Equal(int64(1024)))
+		Expect(backup.Status.Artifacts).To(HaveLen(2))
+		Expect(backup.Status.Artifacts[0]).To(Equal(vyogotechv1alpha1.BackupArtifact{
+			Type: "database", Path: location + "db.sql.gz", Size: 1000, Checksum: "sha256:db",
+		}))
+		Expect(backup.Status.CompletionTime).NotTo(BeNil())
+	})
+
+	It("fails when the report of the Job cannot be read", func() {
+		createSite(ns)
+		backup := reconcile(createBackup(nil))
+		finishJob("not json")
+
+		backup = reconcile(backup)
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseFailed))
+		Expect(backup.Status.Message).To(ContainSubstring("result could not be read"))
+	})
+
+	It("fails when the Job fails", func() {
+		createSite(ns)
+		backup := reconcile(createBackup(nil))
+
+		job := backupJob()
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		job.Status.Failed = 1
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+
+		backup = reconcile(backup)
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseFailed))
+		Expect(backup.Status.Message).To(ContainSubstring("nightly-backup failed"))
+	})
+
+	It("refuses a site in another namespace", func() {
+		other := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "site-backup-other-"}}
+		Expect(k8sClient.Create(ctx, other)).To(Succeed())
+		createSite(other.Name)
+
+		backup := createBackup(nil)
+		backup.Spec.SiteRef.Namespace = other.Name
+		Expect(k8sClient.Update(ctx, backup)).To(Succeed())
+
+		backup = reconcile(backup)
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseFailed))
+		Expect(backup.Status.Message).To(ContainSubstring("must be in namespace " + other.Name))
+
+		jobs := &batchv1.JobList{}
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(ns))).To(Succeed())
+		Expect(jobs.Items).To(BeEmpty())
+		Expect(k8sClient.List(ctx, jobs, client.InNamespace(other.Name))).To(Succeed())
+		Expect(jobs.Items).To(BeEmpty())
+	})
+
+	It("waits for the site to be ready", func() {
+		createSite(ns)
+		site := &vyogotechv1alpha1.FrappeSite{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "site", Namespace: ns}, site)).To(Succeed())
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseProvisioning
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		backup := reconcile(createBackup(nil))
+		Expect(backup.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhasePending))
+		Expect(backup.Status.Message).To(ContainSubstring("waiting for site"))
+	})
+})
@@ -0,0 +1,361 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+const (
+	// siteBackupFinalizer removes the stored artifacts of scheduled backups when they are pruned
+	siteBackupFinalizer = "vyogo.tech/sitebackup-finalizer"
+
+	// backupScheduleLabel links a child backup to the scheduled SiteBackup that created it
+	backupScheduleLabel = "backup-schedule"
+)
+
+// reconcileSchedule creates child SiteBackups on the parent's cron schedule and
+// prunes them according to its retention. Children are not owned by the parent,
+// so deleting a schedule keeps the backups it already took.
+func (r *SiteBackupReconciler) reconcileSchedule(ctx context.Context, parent *vyogotechv1alpha1.SiteBackup) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	sched, err := cron.ParseStandard(parent.Spec.Schedule)
+	if err != nil {
+		parent.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseFailed
+		parent.Status.Message = fmt.Sprintf("invalid schedule %q: %v", parent.Spec.Schedule, err)
+		parent.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.Status().Update(ctx, parent)
+	}
+
+	childList := &vyogotechv1alpha1.SiteBackupList{}
+	if err := r.List(ctx, childList, client.InNamespace(parent.Namespace), client.MatchingLabels{backupScheduleLabel: parent.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	children := childList.Items
+
+	// Newest first
+	sort.Slice(children, func(i, j int) bool {
+		return children[j].CreationTimestamp.Before(&children[i].CreationTimestamp)
+	})
+
+	active := false
+	parent.Status.LastSuccessfulBackup = ""
+	for _, child := range children {
+		switch child.Status.Phase {
+		case "", vyogotechv1alpha1.SiteBackupPhasePending, vyogotechv1alpha1.SiteBackupPhaseRunning:
+			if child.DeletionTimestamp.IsZero() {
+				active = true
+			}
+		case vyogotechv1alpha1.SiteBackupPhaseCompleted:
+			if parent.Status.LastSuccessfulBackup == "" {
+				parent.Status.LastSuccessfulBackup = child.Name
+			}
+		}
+	}
+
+	if parent.Spec.Retention != nil {
+		for i := range children {
+			child := &children[i]
+			if !child.DeletionTimestamp.IsZero() || !shouldPruneBackup(child, children, parent.Spec.Retention) {
+				continue
+			}
+			logger.Info("Pruning scheduled backup", "backup", child.Name, "location", child.Status.Location)
+			if err := r.Delete(ctx, child); err != nil && !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	now := time.Now()
+	missedRun, nextRun := getBackupScheduleTimes(parent, sched, now)
+
+	parent.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseScheduled
+	if parent.Spec.Suspend {
+		parent.Status.Message = "Schedule suspended"
+		parent.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.Status().Update(ctx, parent)
+	}
+
+	if !missedRun.IsZero() {
+		scheduledAt := metav1.NewTime(missedRun)
+		if active {
+			// Never run two backups of the same schedule at once, skip this run
+			logger.Info("Skipping scheduled backup, previous backup still running", "scheduledAt", missedRun)
+			parent.Status.Message = fmt.Sprintf("Skipped run at %s, previous backup still running", missedRun.UTC().Format(time.RFC3339))
+		} else {
+			child := newScheduledBackup(parent, missedRun)
+			logger.Info("Creating scheduled backup", "backup", child.Name, "scheduledAt", missedRun)
+			if err := r.Create(ctx, child); err != nil && !errors.IsAlreadyExists(err) {
+				return ctrl.Result{}, err
+			}
+			parent.Status.Message = fmt.Sprintf("Created backup %s", child.Name)
+		}
+		parent.Status.LastScheduleTime = &scheduledAt
+	}
+
+	next := metav1.NewTime(nextRun)
+	parent.Status.NextScheduleTime = &next
+
+	if err := r.Status().Update(ctx, parent); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: nextRun.Sub(now)}, nil
+}
+
+// getBackupScheduleTimes returns the latest run that is due but has not been
+// created yet (zero if none) and the next run after now
+func getBackupScheduleTimes(parent *vyogotechv1alpha1.SiteBackup, sched cron.Schedule, now time.Time) (time.Time, time.Time) {
+	return getScheduleTimes(parent.CreationTimestamp, parent.Status.LastScheduleTime, sched, now)
+}
+
+// getScheduleTimes returns the latest run after lastSchedule (or created) that is
+// due, zero if none, and the next run after now
+func getScheduleTimes(created metav1.Time, lastSchedule *metav1.Time, sched cron.Schedule, now time.Time) (time.Time, time.Time) {
+	earliest := created.Time
+	if lastSchedule != nil {
+		earliest = lastSchedule.Time
+	}
+
+	// Only the most recent missed run is taken, older ones are skipped. Like CronJob, it is
+	// searched for backwards from now, so a long outage does not walk every missed run.
+	// The window doubles until it holds a run or reaches earliest.
+	var missed time.Time
+	for window := time.Minute; missed.IsZero(); window *= 2 {
+		start := now.Add(-window)
+		if !start.After(earliest) {
+			start = earliest
+		}
+		for t := sched.Next(start); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+			missed = t
+		}
+		if start.Equal(earliest) {
+			break
+		}
+	}
+
+	return missed, sched.Next(now)
+}
+
+// newScheduledBackup returns the child SiteBackup for a scheduled run
+func newScheduledBackup(parent *vyogotechv1alpha1.SiteBackup, scheduledAt time.Time) *vyogotechv1alpha1.SiteBackup {
+	labels := map[string]string{
+		backupScheduleLabel: parent.Name,
+	}
+	if parent.Spec.SiteRef != nil {
+		labels["site"] = parent.Spec.SiteRef.Name
+	}
+
+	child := &vyogotechv1alpha1.SiteBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       fmt.Sprintf("%s-%d", parent.Name, scheduledAt.Unix()),
+			Namespace:  parent.Namespace,
+			Labels:     labels,
+			Finalizers: []string{siteBackupFinalizer},
+		},
+		Spec: vyogotechv1alpha1.SiteBackupSpec{
+			IncludePublicFiles:  parent.Spec.IncludePublicFiles,
+			IncludePrivateFiles: parent.Spec.IncludePrivateFiles,
+		},
+	}
+	if parent.Spec.SiteRef != nil {
+		child.Spec.SiteRef = parent.Spec.SiteRef.DeepCopy()
+	}
+	if parent.Spec.Destination != nil {
+		child.Spec.Destination = parent.Spec.Destination.DeepCopy()
+	}
+	return child
+}
+
+// shouldPruneBackup decides whether retention drops a child backup
+// Running backups are never pruned, failed ones are pruned once a later backup completed
+func shouldPruneBackup(backup *vyogotechv1alpha1.SiteBackup, children []vyogotechv1alpha1.SiteBackup, retention *vyogotechv1alpha1.BackupRetention) bool {
+	switch backup.Status.Phase {
+	case vyogotechv1alpha1.SiteBackupPhaseCompleted:
+		if retention.KeepLast == 0 && retention.KeepDaily == 0 && retention.KeepWeekly == 0 && retention.KeepMonthly == 0 {
+			return false
+		}
+		return !keptByRetention(children, retention)[backup.Name]
+	case vyogotechv1alpha1.SiteBackupPhaseFailed:
+		for _, child := range children {
+			if child.Status.Phase == vyogotechv1alpha1.SiteBackupPhaseCompleted &&
+				backup.CreationTimestamp.Before(&child.CreationTimestamp) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keptByRetention returns the names of the completed backups selected by any retention rule
+// children must be sorted newest first
+func keptByRetention(children []vyogotechv1alpha1.SiteBackup, retention *vyogotechv1alpha1.BackupRetention) map[string]bool {
+	var completed []vyogotechv1alpha1.SiteBackup
+	for _, child := range children {
+		if child.Status.Phase == vyogotechv1alpha1.SiteBackupPhaseCompleted {
+			completed = append(completed, child)
+		}
+	}
+
+	keep := make(map[string]bool)
+	for i := 0; i < len(completed) && i < int(retention.KeepLast); i++ {
+		keep[completed[i].Name] = true
+	}
+
+	// Keep the newest backup of each of the last N periods that have backups
+	keepPeriods := func(n int32, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, backup := range completed {
+			if len(seen) >= int(n) {
+				return
+			}
+			key := period(backup.CreationTimestamp.UTC())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[backup.Name] = true
+		}
+	}
+
+	keepPeriods(retention.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(retention.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(retention.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	return keep
+}
+
+// handleBackupDeletion removes the artifacts of a backup before letting it go
+func (r *SiteBackupReconciler) handleBackupDeletion(ctx context.Context, backup *vyogotechv1alpha1.SiteBackup) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	done, err := r.ensureArtifactsDeleted(ctx, backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	logger.Info("Removing finalizer from SiteBackup", "backup", backup.Name)
+	controllerutil.RemoveFinalizer(backup, siteBackupFinalizer)
+	return ctrl.Result{}, r.Update(ctx, backup)
+}
+
+// ensureArtifactsDeleted runs a Job that removes the backup's artifacts from its destination
+// Returns true once there is nothing left to wait for
+func (r *SiteBackupReconciler) ensureArtifactsDeleted(ctx context.Context, backup *vyogotechv1alpha1.SiteBackup) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	// Nothing was written yet
+	if backup.Status.JobName == "" || backup.Spec.SiteRef == nil {
+		return true, nil
+	}
+
+	site, bench, err := r.getSiteAndBench(ctx, backup)
+	if err != nil || bench == nil {
+		if err == nil || errors.IsNotFound(err) {
+			logger.Info("Site or bench is gone, leaving backup artifacts in place", "location", backup.Status.Location)
+			return true, nil
+		}
+		return false, err
+	}
+
+	jobName := fmt.Sprintf("%s-prune", backup.Name)
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: backup.Namespace}, job)
+	if err == nil {
+		if job.Status.Succeeded > 0 {
+			logger.Info("Backup artifacts deleted", "location", backup.Status.Location)
+			return true, nil
+		}
+		if job.Status.Failed > 0 {
+			// Don't block deletion forever, the artifacts have to be cleaned up by hand
+			logger.Error(nil, "Failed to delete backup artifacts", "job", jobName, "location", backup.Status.Location)
+			return true, nil
+		}
+		return false, nil
+	}
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	job, err = r.buildBackupStorageJob(backup, site, bench, jobName, pruneBackupScript, nil)
+	if err != nil {
+		return false, err
+	}
+
+	logger.Info("Creating backup prune job", "job", jobName, "location", backup.Status.Location)
+	return false, r.Create(ctx, job)
+}
+
+const pruneBackupScript = `#!/bin/bash
+set -e
+
+cd /home/frappe/frappe-bench
+
+echo "Deleting backup artifacts at $BACKUP_LOCATION"
+
+if [[ -n "$S3_BUCKET" ]]; then
+    env/bin/python - <<'PYEOF'
+import os
+
+import boto3
+from botocore.config import Config
+
+addressing = "path" if os.environ.get("S3_FORCE_PATH_STYLE") == "true" else "auto"
+s3 = boto3.client(
+    "s3",
+    endpoint_url=os.environ.get("S3_ENDPOINT") or None,
+    region_name=os.environ.get("S3_REGION") or None,
+    config=Config(s3={"addressing_style": addressing}),
+)
+bucket = os.environ["S3_BUCKET"]
+paginator = s3.get_paginator("list_objects_v2")
+for page in paginator.paginate(Bucket=bucket, Prefix=os.environ["S3_KEY_PREFIX"]):
+    objects = [{"Key": obj["Key"]} for obj in page.get("Contents", [])]
+    if objects:
+        s3.delete_objects(Bucket=bucket, Delete={"Objects": objects})
+PYEOF
+else
+    rm -rf "$BACKUP_DIR"
+fi
+
+echo "Backup artifacts deleted!"
+`
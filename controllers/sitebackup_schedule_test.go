@@ -0,0 +1,202 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("Backup schedule", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	})
+
+	Describe("getScheduleTimes", func() {
+		schedule := func(spec string) cron.Schedule {
+			sched, err := cron.ParseStandard(spec)
+			Expect(err).NotTo(HaveOccurred())
+			return sched
+		}
+
+		It("returns no missed run before the first one is due", func() {
+			created := metav1.NewTime(now.Add(-10 * time.Minute))
+			missed, next := getScheduleTimes(created, nil, schedule("0 * * * *"), now)
+			Expect(missed.IsZero()).To(BeTrue())
+			Expect(next).To(Equal(time.Date(2026, 3, 10, 13, 0, 0, 0, time.UTC)))
+		})
+
+		It("returns the latest due run after the last schedule", func() {
+			created := metav1.NewTime(now.Add(-48 * time.Hour))
+			last := metav1.NewTime(time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC))
+			missed, _ := getScheduleTimes(created, &last, schedule("0 * * * *"), now)
+			Expect(missed).To(Equal(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)))
+		})
+
+		It("returns the last run before now after a long outage", func() {
+			// Far more than a thousand runs were missed
+			last := metav1.NewTime(now.Add(-365 * 24 * time.Hour))
+			missed, next := getScheduleTimes(last, &last, schedule("* * * * *"), now)
+			Expect(missed).To(Equal(now))
+			Expect(next).To(Equal(now.Add(time.Minute)))
+		})
+
+		It("finds a rare run far back", func() {
+			created := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			missed, _ := getScheduleTimes(created, nil, schedule("0 0 1 1 *"), now)
+			Expect(missed).To(Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+		})
+
+		It("does not return a run at or before the last schedule", func() {
+			last := metav1.NewTime(time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+			missed, _ := getScheduleTimes(last, &last, schedule("0 * * * *"), now)
+			Expect(missed.IsZero()).To(BeTrue())
+		})
+	})
+
+	Describe("retention", func() {
+		backup := func(name string, created time.Time, phase vyogotechv1alpha1.SiteBackupPhase) vyogotechv1alpha1.SiteBackup {
+			return vyogotechv1alpha1.SiteBackup{
+				ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(created)},
+				Status:     vyogotechv1alpha1.SiteBackupStatus{Phase: phase},
+			}
+		}
+
+		// Newest first, as reconcileSchedule sorts them
+		var children []vyogotechv1alpha1.SiteBackup
+
+		BeforeEach(func() {
+			completed := vyogotechv1alpha1.SiteBackupPhaseCompleted
+			children = []vyogotechv1alpha1.SiteBackup{
+				backup("mar-10-late", time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC), completed),
+				backup("mar-10-failed", time.Date(2026, 3, 10, 6, 0, 0, 0, time.UTC), vyogotechv1alpha1.SiteBackupPhaseFailed),
+				backup("mar-10-early", time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), completed),
+				backup("mar-09", time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC), completed),
+				backup("mar-02", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), completed),
+				backup("feb-01", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), completed),
+				backup("running", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), vyogotechv1alpha1.SiteBackupPhaseRunning),
+			}
+		})
+
+		pruned := func(retention *vyogotechv1alpha1.BackupRetention) []string {
+			var names []string
+			for i := range children {
+				if shouldPruneBackup(&children[i], children, retention) {
+					names = append(names, children[i].Name)
+				}
+			}
+			return names
+		}
+
+		It("keeps the last N completed backups", func() {
+			Expect(pruned(&vyogotechv1alpha1.BackupRetention{KeepLast: 2})).To(
+				ConsistOf("mar-10-failed", "mar-09", "mar-02", "feb-01"))
+		})
+
+		It("keeps the newest backup of each period", func() {
+			Expect(pruned(&vyogotechv1alpha1.BackupRetention{KeepDaily: 2})).To(
+				ConsistOf("mar-10-failed", "mar-10-early", "mar-02", "feb-01"))
+			Expect(pruned(&vyogotechv1alpha1.BackupRetention{KeepWeekly: 2, KeepMonthly: 2})).To(
+				ConsistOf("mar-10-failed", "mar-10-early", "mar-09"))
+		})
+
+		It("keeps every completed backup without retention rules", func() {
+			Expect(pruned(&vyogotechv1alpha1.BackupRetention{})).To(ConsistOf("mar-10-failed"))
+		})
+	})
+
+	Describe("reconcileSchedule", func() {
+		var (
+			ctx    context.Context
+			ns     string
+			parent *vyogotechv1alpha1.SiteBackup
+			r      *SiteBackupReconciler
+		)
+
+		BeforeEach(func() {
+			ctx = context.Background()
+
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "backup-schedule-"}}
+			Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+			ns = namespace.Name
+
+			parent = &vyogotechv1alpha1.SiteBackup{
+				ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: ns},
+				Spec: vyogotechv1alpha1.SiteBackupSpec{
+					SiteRef:  &vyogotechv1alpha1.NamespacedName{Name: "site"},
+					Schedule: "* * * * *",
+				},
+			}
+			Expect(k8sClient.Create(ctx, parent)).To(Succeed())
+			r = &SiteBackupReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		})
+
+		children := func() []vyogotechv1alpha1.SiteBackup {
+			list := &vyogotechv1alpha1.SiteBackupList{}
+			Expect(k8sClient.List(ctx, list, client.InNamespace(ns), client.MatchingLabels{backupScheduleLabel: parent.Name})).To(Succeed())
+			return list.Items
+		}
+
+		It("creates one backup for the latest missed run and skips runs while one is active", func() {
+			last := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+			parent.Status.LastScheduleTime = &last
+			Expect(k8sClient.Status().Update(ctx, parent)).To(Succeed())
+
+			result, err := r.reconcileSchedule(ctx, parent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("<=", time.Minute))
+			Expect(children()).To(HaveLen(1))
+			Expect(parent.Status.Phase).To(Equal(vyogotechv1alpha1.SiteBackupPhaseScheduled))
+			Expect(parent.Status.NextScheduleTime).NotTo(BeNil())
+
+			// The child never ran, so the next due run is skipped
+			earlier := metav1.NewTime(parent.Status.LastScheduleTime.Add(-time.Minute))
+			parent.Status.LastScheduleTime = &earlier
+			Expect(k8sClient.Status().Update(ctx, parent)).To(Succeed())
+			_, err = r.reconcileSchedule(ctx, parent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(children()).To(HaveLen(1))
+			Expect(parent.Status.Message).To(ContainSubstring("previous backup still running"))
+		})
+
+		It("does not create backups while suspended", func() {
+			last := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+			parent.Spec.Suspend = true
+			Expect(k8sClient.Update(ctx, parent)).To(Succeed())
+			parent.Status.LastScheduleTime = &last
+			Expect(k8sClient.Status().Update(ctx, parent)).To(Succeed())
+
+			_, err := r.reconcileSchedule(ctx, parent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(children()).To(BeEmpty())
+			Expect(parent.Status.NextScheduleTime).To(BeNil())
+		})
+	})
+})
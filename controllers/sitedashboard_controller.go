@@ -18,15 +18,27 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
 )
 
+// siteDashboardFinalizer deletes the dashboard from the site when the SiteDashboard is deleted
+const siteDashboardFinalizer = "vyogo.tech/sitedashboard-finalizer"
+
 // SiteDashboardReconciler reconciles a SiteDashboard object
 type SiteDashboardReconciler struct {
 	client.Client
@@ -36,27 +48,239 @@ type SiteDashboardReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboards,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboards/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboards/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboardcharts,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteDashboard object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile resolves the referenced charts and upserts the Dashboard through the REST API
 func (r *SiteDashboardReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	dashboard := &vyogotechv1alpha1.SiteDashboard{}
+	if err := r.Get(ctx, req.NamespacedName, dashboard); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteDashboard")
+		return ctrl.Result{}, err
+	}
+
+	if !dashboard.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(dashboard, siteDashboardFinalizer) {
+			return r.handleDeletion(ctx, dashboard)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(dashboard, siteDashboardFinalizer) {
+		controllerutil.AddFinalizer(dashboard, siteDashboardFinalizer)
+		if err := r.Update(ctx, dashboard); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := validateSiteDashboardSpec(&dashboard.Spec); err != nil {
+		return ctrl.Result{}, r.status(dashboard).setFailed(ctx, err.Error())
+	}
+
+	if err := checkSiteRefNamespace("SiteDashboard", dashboard.Spec.SiteRef, dashboard.Namespace); err != nil {
+		return ctrl.Result{}, r.status(dashboard).setFailed(ctx, err.Error())
+	}
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, dashboard.Spec.SiteRef, dashboard.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.status(dashboard).setPending(ctx, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.status(dashboard).setFailed(ctx, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.status(dashboard).setPending(ctx, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+
+	api, err := newSiteAPIClient(ctx, r.Client, site, bench)
+	if err != nil {
+		return r.status(dashboard).apiError(ctx, err)
+	}
+
+	chartNames, missing, err := r.resolveCharts(ctx, api, dashboard, site)
+	if err != nil {
+		return r.status(dashboard).apiError(ctx, err)
+	}
+	if len(missing) > 0 {
+		return r.status(dashboard).setPendingOn(ctx, "unresolved dependencies: "+strings.Join(missing, ", "), missing)
+	}
+
+	name := dashboard.Spec.DashboardName
+	if dashboard.Status.DashboardName != "" && dashboard.Status.DashboardName != name {
+		if err := api.DeleteDoc(ctx, "Dashboard", dashboard.Status.DashboardName); err != nil {
+			return r.status(dashboard).apiError(ctx, err)
+		}
+		logger.Info("Deleted renamed dashboard", "dashboard", dashboard.Status.DashboardName)
+	}
+
+	if _, err := upsertDoc(ctx, api, "Dashboard", name, desiredDashboardDoc(&dashboard.Spec, chartNames)); err != nil {
+		return r.status(dashboard).apiError(ctx, err)
+	}
+
+	now := metav1.Now()
+	dashboard.Status.Phase = vyogotechv1alpha1.SiteDashboardPhaseSynced
+	dashboard.Status.DashboardName = name
+	dashboard.Status.UnresolvedDependencies = nil
+	dashboard.Status.LastSyncTime = &now
+	dashboard.Status.ObservedGeneration = dashboard.Generation
+	dashboard.Status.Message = "Dashboard is in sync"
+	if err := r.Status().Update(ctx, dashboard); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: siteSyncInterval}, nil
+}
+
+// resolveCharts returns the Dashboard Chart name of each reference, in order, and the references
+// that cannot be resolved: SiteDashboardCharts that are missing, for another site or not synced
+// yet, and chart names that do not exist on the site
+func (r *SiteDashboardReconciler) resolveCharts(ctx context.Context, api *frappeapi.Client, dashboard *vyogotechv1alpha1.SiteDashboard, site *vyogotechv1alpha1.FrappeSite) ([]string, []string, error) {
+	var names, missing []string
+
+	for _, ref := range dashboard.Spec.Charts {
+		if ref.ChartName != "" {
+			err := api.GetDoc(ctx, "Dashboard Chart", ref.ChartName, nil)
+			if frappeapi.IsNotFound(err) {
+				missing = append(missing, fmt.Sprintf("Dashboard Chart %q", ref.ChartName))
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, ref.ChartName)
+			continue
+		}
+
+		chart := &vyogotechv1alpha1.SiteDashboardChart{}
+		err := r.Get(ctx, types.NamespacedName{Name: ref.SiteDashboardChart, Namespace: dashboard.Namespace}, chart)
+		if errors.IsNotFound(err) {
+			missing = append(missing, fmt.Sprintf("SiteDashboardChart %s not found", ref.SiteDashboardChart))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		chartSite, _, err := getSiteAndBench(ctx, r.Client, chart.Spec.SiteRef, chart.Namespace)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, nil, err
+		}
+		switch {
+		case chartSite == nil || chartSite.UID != site.UID:
+			missing = append(missing, fmt.Sprintf("SiteDashboardChart %s is not on site %s", chart.Name, site.Name))
+		case chart.Status.Phase != vyogotechv1alpha1.SiteDashboardChartPhaseSynced || chart.Status.ChartName == "":
+			missing = append(missing, fmt.Sprintf("SiteDashboardChart %s is not synced", chart.Name))
+		default:
+			names = append(names, chart.Status.ChartName)
+		}
+	}
+	return names, missing, nil
+}
+
+// handleDeletion deletes the dashboard from the site and removes the finalizer
+func (r *SiteDashboardReconciler) handleDeletion(ctx context.Context, dashboard *vyogotechv1alpha1.SiteDashboard) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if name := dashboard.Status.DashboardName; name != "" {
+		api, err := newSiteAPIClientForCleanup(ctx, r.Client, dashboard.Spec.SiteRef, dashboard.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if api == nil {
+			logger.Info("Site is gone or being deleted, nothing to delete", "dashboard", name)
+		} else {
+			if err := api.DeleteDoc(ctx, "Dashboard", name); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete dashboard %s: %w", name, err)
+			}
+			logger.Info("Deleted dashboard", "dashboard", name)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(dashboard, siteDashboardFinalizer)
+	return ctrl.Result{}, r.Update(ctx, dashboard)
+}
+
+// validateSiteDashboardSpec checks that every chart reference names exactly one chart
+func validateSiteDashboardSpec(spec *vyogotechv1alpha1.SiteDashboardSpec) error {
+	if spec.SiteRef == nil {
+		return fmt.Errorf("siteRef is required")
+	}
+	for i, ref := range spec.Charts {
+		if (ref.SiteDashboardChart == "") == (ref.ChartName == "") {
+			return fmt.Errorf("charts[%d]: exactly one of siteDashboardChart or chartName must be set", i)
+		}
+	}
+	return nil
+}
+
+// desiredDashboardDoc returns the Dashboard document with the charts in spec order
+// Number cards are left alone, they can be added from Desk.
+func desiredDashboardDoc(spec *vyogotechv1alpha1.SiteDashboardSpec, chartNames []string) map[string]interface{} {
+	charts := []map[string]interface{}{}
+	for i, ref := range spec.Charts {
+		charts = append(charts, map[string]interface{}{
+			"chart": chartNames[i],
+			"width": defaultString(ref.Width, "Half"),
+		})
+	}
+
+	isDefault := 0
+	if spec.IsDefault {
+		isDefault = 1
+	}
+
+	return map[string]interface{}{
+		"dashboard_name": spec.DashboardName,
+		"is_default":     isDefault,
+		"module":         spec.Module,
+		"charts":         charts,
+	}
+}
+
+// status returns the status writer of dashboard
+func (r *SiteDashboardReconciler) status(dashboard *vyogotechv1alpha1.SiteDashboard) siteAPIStatus {
+	return siteAPIStatus{client: r.Client, obj: dashboard, set: func(phase siteAPIPhase, message string, missing []string) {
+		dashboard.Status.Phase = vyogotechv1alpha1.SiteDashboardPhaseFailed
+		if phase == siteAPIPending {
+			dashboard.Status.Phase = vyogotechv1alpha1.SiteDashboardPhasePending
+			dashboard.Status.UnresolvedDependencies = missing
+		}
+		dashboard.Status.Message = message
+	}}
+}
 
-	// TODO(user): your logic here
+// dashboardsForChart maps a SiteDashboardChart to the SiteDashboards referencing it
+func (r *SiteDashboardReconciler) dashboardsForChart(ctx context.Context, obj client.Object) []reconcile.Request {
+	dashboards := &vyogotechv1alpha1.SiteDashboardList{}
+	if err := r.List(ctx, dashboards, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
 
-	return ctrl.Result{}, nil
+	var requests []reconcile.Request
+	for _, dashboard := range dashboards.Items {
+		for _, ref := range dashboard.Spec.Charts {
+			if ref.SiteDashboardChart == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&dashboard)})
+				break
+			}
+		}
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SiteDashboardReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.SiteDashboard{}).
+		Watches(&vyogotechv1alpha1.SiteDashboardChart{}, handler.EnqueueRequestsFromMapFunc(r.dashboardsForChart)).
 		Complete(r)
 }
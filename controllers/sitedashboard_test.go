@@ -0,0 +1,84 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteDashboard", func() {
+	var (
+		ctx     context.Context
+		ns      string
+		siteRef *vyogotechv1alpha1.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "sitedashboard-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+		siteRef = &vyogotechv1alpha1.NamespacedName{Name: "site", Namespace: "other"}
+	})
+
+	It("rejects a dashboard for a site in another namespace", func() {
+		dashboard := &vyogotechv1alpha1.SiteDashboard{
+			ObjectMeta: metav1.ObjectMeta{Name: "sales", Namespace: ns},
+			Spec:       vyogotechv1alpha1.SiteDashboardSpec{SiteRef: siteRef, DashboardName: "Sales"},
+		}
+		Expect(k8sClient.Create(ctx, dashboard)).To(Succeed())
+
+		r := &SiteDashboardReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(dashboard)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(dashboard), dashboard)).To(Succeed())
+		Expect(dashboard.Status.Phase).To(Equal(vyogotechv1alpha1.SiteDashboardPhaseFailed))
+		Expect(dashboard.Status.Message).To(Equal("SiteDashboard must be in namespace other of site site"))
+	})
+
+	It("rejects a chart for a site in another namespace", func() {
+		chart := &vyogotechv1alpha1.SiteDashboardChart{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteDashboardChartSpec{
+				SiteRef:      siteRef,
+				ChartName:    "Orders",
+				DocumentType: "Sales Order",
+				GroupByField: "status",
+			},
+		}
+		Expect(k8sClient.Create(ctx, chart)).To(Succeed())
+
+		r := &SiteDashboardChartReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(chart)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(chart), chart)).To(Succeed())
+		Expect(chart.Status.Phase).To(Equal(vyogotechv1alpha1.SiteDashboardChartPhaseFailed))
+		Expect(chart.Status.Message).To(Equal("SiteDashboardChart must be in namespace other of site site"))
+	})
+})
@@ -18,15 +18,37 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
 )
 
+const (
+	// siteDashboardChartFinalizer deletes the chart from the site when the SiteDashboardChart is deleted
+	siteDashboardChartFinalizer = "vyogo.tech/sitedashboardchart-finalizer"
+
+	// dependencyRetryInterval is how often unresolved dependencies are looked up again
+	dependencyRetryInterval = time.Minute
+)
+
+// standardFields are the fields every DocType has without listing them
+var standardFields = []string{
+	"name", "owner", "creation", "modified", "modified_by", "docstatus", "idx",
+	"parent", "parentfield", "parenttype", "_assign", "_comments", "_liked_by", "_user_tags",
+}
+
 // SiteDashboardChartReconciler reconciles a SiteDashboardChart object
 type SiteDashboardChartReconciler struct {
 	client.Client
@@ -36,22 +58,257 @@ type SiteDashboardChartReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboardcharts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboardcharts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitedashboardcharts/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteDashboardChart object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile checks that the source DocType and fields exist on the site and upserts the
+// Dashboard Chart through the REST API
 func (r *SiteDashboardChartReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	chart := &vyogotechv1alpha1.SiteDashboardChart{}
+	if err := r.Get(ctx, req.NamespacedName, chart); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteDashboardChart")
+		return ctrl.Result{}, err
+	}
+
+	if !chart.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(chart, siteDashboardChartFinalizer) {
+			return r.handleDeletion(ctx, chart)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(chart, siteDashboardChartFinalizer) {
+		controllerutil.AddFinalizer(chart, siteDashboardChartFinalizer)
+		if err := r.Update(ctx, chart); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := validateSiteDashboardChartSpec(&chart.Spec); err != nil {
+		return ctrl.Result{}, r.status(chart).setFailed(ctx, err.Error())
+	}
+
+	if err := checkSiteRefNamespace("SiteDashboardChart", chart.Spec.SiteRef, chart.Namespace); err != nil {
+		return ctrl.Result{}, r.status(chart).setFailed(ctx, err.Error())
+	}
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, chart.Spec.SiteRef, chart.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.status(chart).setPending(ctx, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.status(chart).setFailed(ctx, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.status(chart).setPending(ctx, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+
+	api, err := newSiteAPIClient(ctx, r.Client, site, bench)
+	if err != nil {
+		return r.status(chart).apiError(ctx, err)
+	}
+
+	missing, err := missingChartDependencies(ctx, api, &chart.Spec)
+	if err != nil {
+		return r.status(chart).apiError(ctx, err)
+	}
+	if len(missing) > 0 {
+		return r.status(chart).setPendingOn(ctx, "unresolved dependencies: "+strings.Join(missing, ", "), missing)
+	}
+
+	name := chart.Spec.ChartName
+	if chart.Status.ChartName != "" && chart.Status.ChartName != name {
+		if err := api.DeleteDoc(ctx, "Dashboard Chart", chart.Status.ChartName); err != nil {
+			return r.status(chart).apiError(ctx, err)
+		}
+		logger.Info("Deleted renamed dashboard chart", "chart", chart.Status.ChartName)
+	}
+
+	desired, err := desiredDashboardChartDoc(&chart.Spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if _, err := upsertDoc(ctx, api, "Dashboard Chart", name, desired); err != nil {
+		return r.status(chart).apiError(ctx, err)
+	}
+
+	now := metav1.Now()
+	chart.Status.Phase = vyogotechv1alpha1.SiteDashboardChartPhaseSynced
+	chart.Status.ChartName = name
+	chart.Status.UnresolvedDependencies = nil
+	chart.Status.LastSyncTime = &now
+	chart.Status.ObservedGeneration = chart.Generation
+	chart.Status.Message = "Chart is in sync"
+	if err := r.Status().Update(ctx, chart); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: siteSyncInterval}, nil
+}
 
-	// TODO(user): your logic here
+// handleDeletion deletes the chart from the site and removes the finalizer
+// Frappe refuses to delete a chart still used by a dashboard, deletion is retried until it is not.
+func (r *SiteDashboardChartReconciler) handleDeletion(ctx context.Context, chart *vyogotechv1alpha1.SiteDashboardChart) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if name := chart.Status.ChartName; name != "" {
+		api, err := newSiteAPIClientForCleanup(ctx, r.Client, chart.Spec.SiteRef, chart.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if api == nil {
+			logger.Info("Site is gone or being deleted, nothing to delete", "chart", name)
+		} else {
+			if err := api.DeleteDoc(ctx, "Dashboard Chart", name); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete dashboard chart %s: %w", name, err)
+			}
+			logger.Info("Deleted dashboard chart", "chart", name)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(chart, siteDashboardChartFinalizer)
+	return ctrl.Result{}, r.Update(ctx, chart)
+}
+
+// validateSiteDashboardChartSpec checks the field combinations the CRD schema cannot
+func validateSiteDashboardChartSpec(spec *vyogotechv1alpha1.SiteDashboardChartSpec) error {
+	if spec.SiteRef == nil {
+		return fmt.Errorf("siteRef is required")
+	}
+	if (spec.Timeseries == nil) == (spec.GroupByField == "") {
+		return fmt.Errorf("exactly one of timeseries or groupByField must be set")
+	}
+	if aggregate := spec.AggregateFunction; (aggregate == "Sum" || aggregate == "Average") && spec.ValueField == "" {
+		return fmt.Errorf("valueField is required for %s charts", aggregate)
+	}
+	return nil
+}
+
+// missingChartDependencies returns the source DocType and fields the chart uses that the site does not have
+func missingChartDependencies(ctx context.Context, api *frappeapi.Client, spec *vyogotechv1alpha1.SiteDashboardChartSpec) ([]string, error) {
+	doctype := struct {
+		Fields []struct {
+			Fieldname string `json:"fieldname"`
+		} `json:"fields"`
+	}{}
+	err := api.GetDoc(ctx, "DocType", spec.DocumentType, &doctype)
+	if frappeapi.IsNotFound(err) {
+		return []string{fmt.Sprintf("DocType %q", spec.DocumentType)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	customFields := []struct {
+		Fieldname string `json:"fieldname"`
+	}{}
+	filters := [][]interface{}{{"dt", "=", spec.DocumentType}}
+	if err := api.GetList(ctx, "Custom Field", []string{"fieldname"}, filters, &customFields); err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, field := range standardFields {
+		known[field] = true
+	}
+	for _, field := range doctype.Fields {
+		known[field.Fieldname] = true
+	}
+	for _, field := range customFields {
+		known[field.Fieldname] = true
+	}
+
+	used := []string{spec.ValueField, spec.GroupByField}
+	if spec.Timeseries != nil {
+		used = append(used, spec.Timeseries.BasedOn)
+	}
+	for _, filter := range spec.Filters {
+		used = append(used, filter.Field)
+	}
+
+	var missing []string
+	for _, field := range used {
+		if field == "" || known[field] {
+			continue
+		}
+		known[field] = true
+		missing = append(missing, fmt.Sprintf("field %s.%s", spec.DocumentType, field))
+	}
+	return missing, nil
+}
+
+// desiredDashboardChartDoc returns the Dashboard Chart document for the spec
+func desiredDashboardChartDoc(spec *vyogotechv1alpha1.SiteDashboardChartSpec) (map[string]interface{}, error) {
+	aggregate := defaultString(spec.AggregateFunction, "Count")
+
+	filters := [][]interface{}{}
+	for _, filter := range spec.Filters {
+		filters = append(filters, []interface{}{spec.DocumentType, filter.Field, defaultString(filter.Operator, "="), filter.Value, false})
+	}
+	filtersJSON, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	public := 1
+	if spec.Public != nil && !*spec.Public {
+		public = 0
+	}
+
+	doc := map[string]interface{}{
+		"chart_name":                  spec.ChartName,
+		"document_type":               spec.DocumentType,
+		"chart_type":                  aggregate,
+		"value_based_on":              "",
+		"group_by_type":               "",
+		"group_by_based_on":           "",
+		"aggregate_function_based_on": "",
+		"number_of_groups":            0,
+		"timeseries":                  0,
+		"based_on":                    "",
+		"time_interval":               "",
+		"timespan":                    "",
+		"filters_json":                string(filtersJSON),
+		"type":                        defaultString(spec.Type, "Line"),
+		"color":                       spec.Color,
+		"is_public":                   public,
+		"module":                      spec.Module,
+	}
+
+	if spec.GroupByField != "" {
+		doc["chart_type"] = "Group By"
+		doc["group_by_type"] = aggregate
+		doc["group_by_based_on"] = spec.GroupByField
+		doc["aggregate_function_based_on"] = spec.ValueField
+		doc["number_of_groups"] = spec.NumberOfGroups
+	} else {
+		doc["value_based_on"] = spec.ValueField
+		doc["timeseries"] = 1
+		doc["based_on"] = spec.Timeseries.BasedOn
+		doc["time_interval"] = defaultString(spec.Timeseries.Interval, "Monthly")
+		doc["timespan"] = defaultString(spec.Timeseries.Timespan, "Last Year")
+	}
+	return doc, nil
+}
 
-	return ctrl.Result{}, nil
+// status returns the status writer of chart
+func (r *SiteDashboardChartReconciler) status(chart *vyogotechv1alpha1.SiteDashboardChart) siteAPIStatus {
+	return siteAPIStatus{client: r.Client, obj: chart, set: func(phase siteAPIPhase, message string, missing []string) {
+		chart.Status.Phase = vyogotechv1alpha1.SiteDashboardChartPhaseFailed
+		if phase == siteAPIPending {
+			chart.Status.Phase = vyogotechv1alpha1.SiteDashboardChartPhasePending
+			chart.Status.UnresolvedDependencies = missing
+		}
+		chart.Status.Message = message
+	}}
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -18,15 +18,28 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
 )
 
+// siteJobLogTailBytes bounds the log tail kept in status; the kubelet caps
+// termination messages at 4096 bytes
+const siteJobLogTailBytes = 4096
+
 // SiteJobReconciler reconciles a SiteJob object
 type SiteJobReconciler struct {
 	client.Client
@@ -36,27 +49,333 @@ type SiteJobReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitejobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitejobs/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=sitejobs/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteJob object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile runs the SiteJob's command in a Job against the site, once or on its schedule, and records the outcome
 func (r *SiteJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	siteJob := &vyogotechv1alpha1.SiteJob{}
+	if err := r.Get(ctx, req.NamespacedName, siteJob); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteJob")
+		return ctrl.Result{}, err
+	}
+
+	if siteJob.Spec.Schedule != "" {
+		return r.reconcileSchedule(ctx, siteJob)
+	}
+
+	// A SiteJob runs once, finished SiteJobs are never re-run
+	if siteJob.Status.Phase == vyogotechv1alpha1.SiteJobPhaseSucceeded ||
+		siteJob.Status.Phase == vyogotechv1alpha1.SiteJobPhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Reconciling SiteJob", "name", siteJob.Name, "namespace", siteJob.Namespace)
+
+	if err := validateSiteJobSpec(&siteJob.Spec); err != nil {
+		return ctrl.Result{}, r.setFailed(ctx, siteJob, err.Error())
+	}
 
-	// TODO(user): your logic here
+	jobName := fmt.Sprintf("%s-run", siteJob.Name)
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: siteJob.Namespace}, job)
+	if errors.IsNotFound(err) {
+		return r.startSiteJob(ctx, siteJob, jobName)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
-	return ctrl.Result{}, nil
+	if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+		// Job completion triggers a reconcile through Owns
+		return ctrl.Result{}, nil
+	}
+
+	now := metav1.Now()
+	exitCode, logTail, err := readSiteJobResult(ctx, r.Client, job)
+	if err != nil {
+		logger.Error(err, "Failed to read SiteJob result", "job", jobName)
+	}
+	siteJob.Status.ExitCode = exitCode
+	siteJob.Status.LogTail = logTail
+	siteJob.Status.CompletionTime = &now
+
+	if job.Status.Succeeded > 0 {
+		siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseSucceeded
+		siteJob.Status.Message = "Command completed"
+	} else {
+		siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseFailed
+		siteJob.Status.Message = fmt.Sprintf("job %s failed%s", jobName, jobFailureReason(job))
+	}
+
+	logger.Info("SiteJob finished", "phase", siteJob.Status.Phase, "job", jobName)
+	return ctrl.Result{}, r.Status().Update(ctx, siteJob)
+}
+
+// startSiteJob checks the site and creates the Job
+func (r *SiteJobReconciler) startSiteJob(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob, jobName string) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, siteJob.Spec.SiteRef, siteJob.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.setPending(ctx, siteJob, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.setFailed(ctx, siteJob, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if bench.Namespace != siteJob.Namespace {
+		return ctrl.Result{}, r.setFailed(ctx, siteJob,
+			fmt.Sprintf("SiteJob must be in namespace %s of bench %s", bench.Namespace, bench.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.setPending(ctx, siteJob, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+	if benchStorageMigrating(bench) {
+		return r.setPending(ctx, siteJob, fmt.Sprintf("waiting for the storage migration of bench %s", bench.Name))
+	}
+
+	job, err := buildSiteJobJob(siteJob, site, bench, jobName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := controllerutil.SetControllerReference(siteJob, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	logger.Info("Creating site job", "job", jobName, "site", site.Spec.SiteName)
+	if err := r.Create(ctx, job); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseRunning
+	siteJob.Status.JobName = jobName
+	siteJob.Status.StartTime = &now
+	siteJob.Status.Message = "Job created"
+	return ctrl.Result{}, r.Status().Update(ctx, siteJob)
+}
+
+// validateSiteJobSpec checks that exactly one of command, python or method is set
+func validateSiteJobSpec(spec *vyogotechv1alpha1.SiteJobSpec) error {
+	if spec.SiteRef == nil {
+		return fmt.Errorf("siteRef is required")
+	}
+	set := 0
+	if len(spec.Command) > 0 {
+		set++
+	}
+	if spec.Python != "" {
+		set++
+	}
+	if spec.Method != nil {
+		set++
+		if spec.Method.Name == "" {
+			return fmt.Errorf("method.name is required")
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of command, python or method must be set")
+	}
+	return nil
+}
+
+// buildSiteJobJob returns the Job running the SiteJob's command with the bench image
+// on the bench's sites PVC, so it connects with the site's own site_config.json
+func buildSiteJobJob(siteJob *vyogotechv1alpha1.SiteJob, site *vyogotechv1alpha1.FrappeSite, bench *vyogotechv1alpha1.FrappeBench, jobName string) (*batchv1.Job, error) {
+	spec := siteJob.Spec
+
+	env := []corev1.EnvVar{
+		{Name: "SITE_NAME", Value: site.Spec.SiteName},
+	}
+	switch {
+	case len(spec.Command) > 0:
+		env = append(env, corev1.EnvVar{Name: "SITE_JOB_MODE", Value: "command"})
+	case spec.Python != "":
+		env = append(env,
+			corev1.EnvVar{Name: "SITE_JOB_MODE", Value: "python"},
+			corev1.EnvVar{Name: "SITE_JOB_PYTHON", Value: spec.Python},
+		)
+	default:
+		kwargs, err := json.Marshal(spec.Method.Kwargs)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env,
+			corev1.EnvVar{Name: "SITE_JOB_MODE", Value: "method"},
+			corev1.EnvVar{Name: "SITE_JOB_METHOD", Value: spec.Method.Name},
+			corev1.EnvVar{Name: "SITE_JOB_KWARGS", Value: string(kwargs)},
+		)
+	}
+
+	// bash -c <script> <$0> <$1...>: the bench subcommand is passed as positional arguments
+	args := append([]string{siteJobScript, "sitejob"}, spec.Command...)
+
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: siteJob.Namespace,
+			Labels: map[string]string{
+				"app":     "frappe",
+				"site":    site.Name,
+				"sitejob": siteJob.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: spec.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "sitejob",
+							Image:        siteJobImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         args,
+							Env:          env,
+							VolumeMounts: benchVolumeMounts(bench, siteJobImage(bench)),
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "sites",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: benchSitesClaim(bench),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return job, nil
+}
+
+// readSiteJobResult returns the exit code and log tail of the Job's sitejob container
+func readSiteJobResult(ctx context.Context, c client.Client, job *batchv1.Job) (*int32, string, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, "", err
+	}
+
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != "sitejob" || status.State.Terminated == nil {
+				continue
+			}
+			exitCode := status.State.Terminated.ExitCode
+			logTail := status.State.Terminated.Message
+			if len(logTail) > siteJobLogTailBytes {
+				logTail = logTail[len(logTail)-siteJobLogTailBytes:]
+			}
+			return &exitCode, logTail, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("no terminated pod found for job %s", job.Name)
+}
+
+// jobFailureReason returns ": <message>" from the Job's Failed condition, if any
+func jobFailureReason(job *batchv1.Job) string {
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue && cond.Message != "" {
+			return ": " + cond.Message
+		}
+	}
+	return ""
+}
+
+func (r *SiteJobReconciler) setPending(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob, message string) (ctrl.Result, error) {
+	siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhasePending
+	siteJob.Status.Message = message
+	if err := r.Status().Update(ctx, siteJob); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+func (r *SiteJobReconciler) setFailed(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob, message string) error {
+	now := metav1.Now()
+	siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseFailed
+	siteJob.Status.Message = message
+	siteJob.Status.CompletionTime = &now
+	return r.Status().Update(ctx, siteJob)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SiteJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.SiteJob{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
+
+// siteJobScript runs a bench subcommand ("$@"), a Python snippet or a whitelisted
+// method against $SITE_NAME and reports the tail of its output as termination message
+const siteJobScript = `#!/bin/bash
+set -o pipefail
+
+cd /home/frappe/frappe-bench
+
+run() {
+    case "$SITE_JOB_MODE" in
+    command)
+        bench --site "$SITE_NAME" "$@"
+        ;;
+    python|method)
+        cd sites && ../env/bin/python - <<'PYTHON_SCRIPT'
+import json
+import os
+
+import frappe
+
+frappe.init(site=os.environ["SITE_NAME"], sites_path=".")
+frappe.connect()
+try:
+    frappe.set_user("Administrator")
+    if os.environ["SITE_JOB_MODE"] == "python":
+        code = compile(os.environ["SITE_JOB_PYTHON"], "<sitejob>", "exec")
+        exec(code, {"__name__": "__main__", "frappe": frappe})
+    else:
+        method = frappe.get_attr(os.environ["SITE_JOB_METHOD"])
+        # Raises PermissionError for methods that are not whitelisted
+        frappe.is_whitelisted(method)
+        kwargs = json.loads(os.environ.get("SITE_JOB_KWARGS") or "{}") or {}
+        result = frappe.call(method, **kwargs)
+        if result is not None:
+            print(frappe.as_json(result))
+    frappe.db.commit()
+finally:
+    frappe.destroy()
+PYTHON_SCRIPT
+        ;;
+    *)
+        echo "ERROR: unsupported SITE_JOB_MODE: $SITE_JOB_MODE"
+        return 1
+        ;;
+    esac
+}
+
+run "$@" 2>&1 | tee /tmp/sitejob.log
+status=${PIPESTATUS[0]}
+
+tail -c 4000 /tmp/sitejob.log > /dev/termination-log
+exit $status
+`
@@ -0,0 +1,167 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteJob Job", func() {
+	var (
+		bench   *vyogotechv1alpha1.FrappeBench
+		site    *vyogotechv1alpha1.FrappeSite
+		siteJob *vyogotechv1alpha1.SiteJob
+	)
+
+	// build returns the sitejob container of the Job built for siteJob
+	build := func() corev1.Container {
+		Expect(validateSiteJobSpec(&siteJob.Spec)).To(Succeed())
+		job, err := buildSiteJobJob(siteJob, site, bench, "maintenance-run")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Spec.Template.Spec.Containers).To(HaveLen(1))
+		return job.Spec.Template.Spec.Containers[0]
+	}
+
+	envOf := func(container corev1.Container) map[string]string {
+		env := map[string]string{}
+		for _, e := range container.Env {
+			env[e.Name] = e.Value
+		}
+		return env
+	}
+
+	BeforeEach(func() {
+		bench = &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: "default"},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+			Status:     vyogotechv1alpha1.FrappeBenchStatus{CurrentImage: "registry.example.com/bench:1"},
+		}
+		site = &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: "default"},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		siteJob = &vyogotechv1alpha1.SiteJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "maintenance", Namespace: "default"},
+			Spec: vyogotechv1alpha1.SiteJobSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+			},
+		}
+	})
+
+	It("requires exactly one of command, python or method", func() {
+		spec := &siteJob.Spec
+		Expect(validateSiteJobSpec(spec)).To(MatchError("exactly one of command, python or method must be set"))
+
+		spec.Command = []string{"migrate"}
+		Expect(validateSiteJobSpec(spec)).To(Succeed())
+
+		spec.Python = "print(1)"
+		Expect(validateSiteJobSpec(spec)).To(MatchError("exactly one of command, python or method must be set"))
+
+		spec.Command = nil
+		Expect(validateSiteJobSpec(spec)).To(Succeed())
+
+		spec.Method = &vyogotechv1alpha1.SiteJobMethod{Name: "frappe.client.get_count"}
+		Expect(validateSiteJobSpec(spec)).To(MatchError("exactly one of command, python or method must be set"))
+
+		spec.Python = ""
+		Expect(validateSiteJobSpec(spec)).To(Succeed())
+
+		spec.Command = []string{"migrate"}
+		Expect(validateSiteJobSpec(spec)).To(MatchError("exactly one of command, python or method must be set"))
+	})
+
+	It("requires siteRef and a method name", func() {
+		siteJob.Spec.Method = &vyogotechv1alpha1.SiteJobMethod{}
+		Expect(validateSiteJobSpec(&siteJob.Spec)).To(MatchError("method.name is required"))
+
+		siteJob.Spec.SiteRef = nil
+		Expect(validateSiteJobSpec(&siteJob.Spec)).To(MatchError("siteRef is required"))
+	})
+
+	It("passes a command as positional arguments of the script", func() {
+		siteJob.Spec.Command = []string{"execute", "frappe.utils.scheduler.enable_scheduler"}
+
+		container := build()
+		Expect(container.Image).To(Equal("registry.example.com/bench:1"))
+		Expect(container.Command).To(Equal([]string{"bash", "-c"}))
+		Expect(container.Args).To(Equal([]string{siteJobScript, "sitejob", "execute", "frappe.utils.scheduler.enable_scheduler"}))
+
+		env := envOf(container)
+		Expect(env).To(HaveKeyWithValue("SITE_NAME", "site.example.com"))
+		Expect(env).To(HaveKeyWithValue("SITE_JOB_MODE", "command"))
+		Expect(env).NotTo(HaveKey("SITE_JOB_PYTHON"))
+		Expect(env).NotTo(HaveKey("SITE_JOB_METHOD"))
+	})
+
+	It("passes Python source through the environment", func() {
+		siteJob.Spec.Python = "frappe.db.set_single_value('System Settings', 'enable_scheduler', 1)"
+
+		container := build()
+		Expect(container.Args).To(Equal([]string{siteJobScript, "sitejob"}))
+
+		env := envOf(container)
+		Expect(env).To(HaveKeyWithValue("SITE_JOB_MODE", "python"))
+		Expect(env).To(HaveKeyWithValue("SITE_JOB_PYTHON", siteJob.Spec.Python))
+		Expect(env).NotTo(HaveKey("SITE_JOB_METHOD"))
+	})
+
+	It("passes the method and its kwargs as JSON through the environment", func() {
+		siteJob.Spec.Method = &vyogotechv1alpha1.SiteJobMethod{
+			Name:   "frappe.client.get_count",
+			Kwargs: map[string]string{"doctype": "User", "cache": "1"},
+		}
+
+		container := build()
+		Expect(container.Args).To(Equal([]string{siteJobScript, "sitejob"}))
+
+		env := envOf(container)
+		Expect(env).To(HaveKeyWithValue("SITE_JOB_MODE", "method"))
+		Expect(env).To(HaveKeyWithValue("SITE_JOB_METHOD", "frappe.client.get_count"))
+		Expect(env).NotTo(HaveKey("SITE_JOB_PYTHON"))
+
+		kwargs := map[string]string{}
+		Expect(json.Unmarshal([]byte(env["SITE_JOB_KWARGS"]), &kwargs)).To(Succeed())
+		Expect(kwargs).To(Equal(siteJob.Spec.Method.Kwargs))
+	})
+
+	It("runs on the bench sites volume", func() {
+		siteJob.Spec.Command = []string{"migrate"}
+		deadline := int64(600)
+		siteJob.Spec.ActiveDeadlineSeconds = &deadline
+
+		job, err := buildSiteJobJob(siteJob, site, bench, "maintenance-run")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.Labels).To(HaveKeyWithValue("sitejob", "maintenance"))
+		Expect(job.Spec.ActiveDeadlineSeconds).To(Equal(&deadline))
+		Expect(*job.Spec.BackoffLimit).To(BeZero())
+		Expect(job.Spec.Template.Labels).To(HaveKeyWithValue(benchSitesVolumeLabel, bench.Name))
+		Expect(job.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal(benchSitesClaim(bench)))
+	})
+})
@@ -0,0 +1,304 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+// siteJobScheduledAtAnnotation records the scheduled time a run was started for
+const siteJobScheduledAtAnnotation = "vyogo.tech/scheduled-at"
+
+// reconcileSchedule starts a Job for the SiteJob on every scheduled time, applying
+// the concurrency policy, the starting deadline and the history limits. Runs are
+// owned by the SiteJob and listed in its status.
+func (r *SiteJobReconciler) reconcileSchedule(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	sched, err := cron.ParseStandard(siteJob.Spec.Schedule)
+	if err != nil {
+		siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseFailed
+		siteJob.Status.Message = fmt.Sprintf("invalid schedule %q: %v", siteJob.Spec.Schedule, err)
+		siteJob.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.Status().Update(ctx, siteJob)
+	}
+	if err := validateSiteJobSpec(&siteJob.Spec); err != nil {
+		siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseFailed
+		siteJob.Status.Message = err.Error()
+		siteJob.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.Status().Update(ctx, siteJob)
+	}
+
+	runs, err := r.listScheduledRuns(ctx, siteJob)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.pruneScheduledRuns(ctx, siteJob, runs); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	siteJob.Status.Phase = vyogotechv1alpha1.SiteJobPhaseScheduled
+	if siteJob.Spec.Suspend {
+		siteJob.Status.Message = "Schedule suspended"
+		siteJob.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.updateRunHistory(ctx, siteJob)
+	}
+
+	now := time.Now()
+	missedRun, nextRun := getScheduleTimes(siteJob.CreationTimestamp, siteJob.Status.LastScheduleTime, sched, now)
+
+	if !missedRun.IsZero() {
+		message, err := r.startScheduledRun(ctx, siteJob, missedRun, now)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		scheduledAt := metav1.NewTime(missedRun)
+		siteJob.Status.LastScheduleTime = &scheduledAt
+		siteJob.Status.Message = message
+	}
+
+	next := metav1.NewTime(nextRun)
+	siteJob.Status.NextScheduleTime = &next
+
+	if err := r.updateRunHistory(ctx, siteJob); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.V(1).Info("Next scheduled run", "at", nextRun)
+	return ctrl.Result{RequeueAfter: nextRun.Sub(now)}, nil
+}
+
+// startScheduledRun starts the run due at scheduledAt unless the starting deadline,
+// the concurrency policy or the site state says otherwise; it returns a status message
+func (r *SiteJobReconciler) startScheduledRun(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob, scheduledAt, now time.Time) (string, error) {
+	logger := log.FromContext(ctx)
+	at := scheduledAt.UTC().Format(time.RFC3339)
+
+	if deadline := siteJob.Spec.StartingDeadlineSeconds; deadline != nil &&
+		now.Sub(scheduledAt) > time.Duration(*deadline)*time.Second {
+		logger.Info("Skipping scheduled run, starting deadline exceeded", "scheduledAt", scheduledAt)
+		return fmt.Sprintf("Missed run at %s, starting deadline exceeded", at), nil
+	}
+
+	active, err := r.listScheduledRuns(ctx, siteJob)
+	if err != nil {
+		return "", err
+	}
+	var running []batchv1.Job
+	for _, job := range active {
+		if job.Status.Succeeded == 0 && job.Status.Failed == 0 && job.DeletionTimestamp.IsZero() {
+			running = append(running, job)
+		}
+	}
+
+	if len(running) > 0 {
+		switch siteJob.Spec.ConcurrencyPolicy {
+		case vyogotechv1alpha1.SiteJobConcurrencyAllow:
+		case vyogotechv1alpha1.SiteJobConcurrencyReplace:
+			for i := range running {
+				logger.Info("Replacing running scheduled run", "job", running[i].Name)
+				if err := r.Delete(ctx, &running[i], client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+					return "", err
+				}
+			}
+		default:
+			logger.Info("Skipping scheduled run, previous run still running", "scheduledAt", scheduledAt)
+			return fmt.Sprintf("Skipped run at %s, previous run still running", at), nil
+		}
+	}
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, siteJob.Spec.SiteRef, siteJob.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Sprintf("Skipped run at %s: %v", at, err), nil
+		}
+		return "", err
+	}
+	if bench == nil {
+		return fmt.Sprintf("Skipped run at %s: site %s has no benchRef", at, site.Name), nil
+	}
+	if bench.Namespace != siteJob.Namespace {
+		return fmt.Sprintf("Skipped run at %s: SiteJob must be in namespace %s of bench %s", at, bench.Namespace, bench.Name), nil
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return fmt.Sprintf("Skipped run at %s: site %s is not ready", at, site.Name), nil
+	}
+	if benchStorageMigrating(bench) {
+		return fmt.Sprintf("Skipped run at %s: bench %s is migrating its storage", at, bench.Name), nil
+	}
+
+	jobName := fmt.Sprintf("%s-%d", siteJob.Name, scheduledAt.Unix())
+	job, err := buildSiteJobJob(siteJob, site, bench, jobName)
+	if err != nil {
+		return "", err
+	}
+	job.Annotations = map[string]string{siteJobScheduledAtAnnotation: scheduledAt.UTC().Format(time.RFC3339)}
+	if err := controllerutil.SetControllerReference(siteJob, job, r.Scheme); err != nil {
+		return "", err
+	}
+
+	logger.Info("Creating scheduled site job", "job", jobName, "scheduledAt", scheduledAt)
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+	return fmt.Sprintf("Started run %s", jobName), nil
+}
+
+// listScheduledRuns returns the Jobs the SiteJob owns, newest first
+func (r *SiteJobReconciler) listScheduledRuns(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob) ([]batchv1.Job, error) {
+	jobList := &batchv1.JobList{}
+	if err := r.List(ctx, jobList, client.InNamespace(siteJob.Namespace), client.MatchingLabels{"sitejob": siteJob.Name}); err != nil {
+		return nil, err
+	}
+
+	var runs []batchv1.Job
+	for _, job := range jobList.Items {
+		if metav1.IsControlledBy(&job, siteJob) {
+			runs = append(runs, job)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[j].CreationTimestamp.Before(&runs[i].CreationTimestamp)
+	})
+	return runs, nil
+}
+
+// pruneScheduledRuns deletes finished runs beyond the history limits
+func (r *SiteJobReconciler) pruneScheduledRuns(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob, runs []batchv1.Job) error {
+	logger := log.FromContext(ctx)
+
+	successfulLimit, failedLimit := int32(3), int32(1)
+	if siteJob.Spec.SuccessfulJobsHistoryLimit != nil {
+		successfulLimit = *siteJob.Spec.SuccessfulJobsHistoryLimit
+	}
+	if siteJob.Spec.FailedJobsHistoryLimit != nil {
+		failedLimit = *siteJob.Spec.FailedJobsHistoryLimit
+	}
+
+	var succeeded, failed int32
+	for i := range runs {
+		job := &runs[i]
+		if !job.DeletionTimestamp.IsZero() {
+			continue
+		}
+		prune := false
+		switch {
+		case job.Status.Succeeded > 0:
+			succeeded++
+			prune = succeeded > successfulLimit
+		case job.Status.Failed > 0:
+			failed++
+			prune = failed > failedLimit
+		}
+		if !prune {
+			continue
+		}
+		logger.Info("Pruning scheduled run", "job", job.Name)
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateRunHistory lists the retained runs in status and writes it
+// Results of finished runs are read from their pods once and kept from then on
+func (r *SiteJobReconciler) updateRunHistory(ctx context.Context, siteJob *vyogotechv1alpha1.SiteJob) error {
+	runs, err := r.listScheduledRuns(ctx, siteJob)
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]vyogotechv1alpha1.SiteJobRun{}
+	for _, run := range siteJob.Status.History {
+		previous[run.JobName] = run
+	}
+
+	history := []vyogotechv1alpha1.SiteJobRun{}
+	for i := range runs {
+		job := &runs[i]
+		if !job.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		startTime := job.CreationTimestamp
+		run := vyogotechv1alpha1.SiteJobRun{
+			JobName:   job.Name,
+			Phase:     vyogotechv1alpha1.SiteJobPhaseRunning,
+			StartTime: &startTime,
+		}
+		if at, err := time.Parse(time.RFC3339, job.Annotations[siteJobScheduledAtAnnotation]); err == nil {
+			scheduledAt := metav1.NewTime(at)
+			run.ScheduledTime = &scheduledAt
+		}
+
+		finished := job.Status.Succeeded > 0 || job.Status.Failed > 0
+		if finished {
+			run.Phase = vyogotechv1alpha1.SiteJobPhaseFailed
+			if job.Status.Succeeded > 0 {
+				run.Phase = vyogotechv1alpha1.SiteJobPhaseSucceeded
+			}
+			run.CompletionTime = jobFinishTime(job)
+
+			if prev, ok := previous[job.Name]; ok && prev.Phase == run.Phase {
+				run.ExitCode = prev.ExitCode
+				run.LogTail = prev.LogTail
+			} else if exitCode, logTail, err := readSiteJobResult(ctx, r.Client, job); err == nil {
+				run.ExitCode = exitCode
+				run.LogTail = logTail
+			}
+		}
+
+		if run.Phase == vyogotechv1alpha1.SiteJobPhaseSucceeded && run.CompletionTime != nil &&
+			(siteJob.Status.LastSuccessfulTime == nil || siteJob.Status.LastSuccessfulTime.Before(run.CompletionTime)) {
+			siteJob.Status.LastSuccessfulTime = run.CompletionTime
+		}
+		history = append(history, run)
+	}
+
+	siteJob.Status.History = history
+	return r.Status().Update(ctx, siteJob)
+}
+
+// jobFinishTime returns when a finished Job completed or failed
+func jobFinishTime(job *batchv1.Job) *metav1.Time {
+	if job.Status.CompletionTime != nil {
+		return job.Status.CompletionTime
+	}
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			t := cond.LastTransitionTime
+			return &t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteJob schedule", func() {
+	var (
+		ctx     context.Context
+		ns      string
+		siteJob *vyogotechv1alpha1.SiteJob
+		r       *SiteJobReconciler
+	)
+
+	runs := func() []batchv1.Job {
+		list, err := r.listScheduledRuns(ctx, siteJob)
+		Expect(err).NotTo(HaveOccurred())
+		return list
+	}
+
+	// scheduleFrom creates the SiteJob with its last run at lastSchedule
+	scheduleFrom := func(lastSchedule time.Time) {
+		Expect(k8sClient.Create(ctx, siteJob)).To(Succeed())
+		last := metav1.NewTime(lastSchedule)
+		siteJob.Status.LastScheduleTime = &last
+		Expect(k8sClient.Status().Update(ctx, siteJob)).To(Succeed())
+	}
+
+	reconcile := func() {
+		_, err := r.reconcileSchedule(ctx, siteJob)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// rewind makes the latest run due again
+	rewind := func() {
+		earlier := metav1.NewTime(siteJob.Status.LastScheduleTime.Add(-time.Minute))
+		siteJob.Status.LastScheduleTime = &earlier
+		Expect(k8sClient.Status().Update(ctx, siteJob)).To(Succeed())
+	}
+
+	// createRun creates a run in the given phase
+	createRun := func(name string, phase vyogotechv1alpha1.SiteJobPhase) {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: map[string]string{"sitejob": siteJob.Name}},
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						RestartPolicy: corev1.RestartPolicyNever,
+						Containers:    []corev1.Container{{Name: "job", Image: "busybox"}},
+					},
+				},
+			},
+		}
+		Expect(controllerutil.SetControllerReference(siteJob, job, scheme.Scheme)).To(Succeed())
+		Expect(k8sClient.Create(ctx, job)).To(Succeed())
+		if phase == vyogotechv1alpha1.SiteJobPhaseRunning {
+			return
+		}
+
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		if phase == vyogotechv1alpha1.SiteJobPhaseSucceeded {
+			job.Status.Succeeded = 1
+			job.Status.CompletionTime = &now
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		} else {
+			job.Status.Failed = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "sitejob-schedule-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench := &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		siteJob = &vyogotechv1alpha1.SiteJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "cleanup", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteJobSpec{
+				SiteRef:  &vyogotechv1alpha1.NamespacedName{Name: site.Name},
+				Command:  []string{"clear-cache"},
+				Schedule: "* * * * *",
+			},
+		}
+		r = &SiteJobReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("starts a run for the latest due time and lists it in the history", func() {
+		scheduleFrom(time.Now().Add(-10 * time.Minute))
+		reconcile()
+
+		Expect(runs()).To(HaveLen(1))
+		Expect(runs()[0].Name).To(Equal(fmt.Sprintf("cleanup-%d", siteJob.Status.LastScheduleTime.Unix())))
+		Expect(siteJob.Status.Phase).To(Equal(vyogotechv1alpha1.SiteJobPhaseScheduled))
+		Expect(siteJob.Status.NextScheduleTime).NotTo(BeNil())
+		Expect(siteJob.Status.History).To(HaveLen(1))
+		Expect(siteJob.Status.History[0].Phase).To(Equal(vyogotechv1alpha1.SiteJobPhaseRunning))
+	})
+
+	It("skips a run while the previous one is running with Forbid", func() {
+		siteJob.Spec.ConcurrencyPolicy = vyogotechv1alpha1.SiteJobConcurrencyForbid
+		scheduleFrom(time.Now().Add(-10 * time.Minute))
+		reconcile()
+		rewind()
+		reconcile()
+
+		Expect(runs()).To(HaveLen(1))
+		Expect(siteJob.Status.Message).To(ContainSubstring("previous run still running"))
+	})
+
+	It("replaces the running run with Replace", func() {
+		siteJob.Spec.ConcurrencyPolicy = vyogotechv1alpha1.SiteJobConcurrencyReplace
+		scheduleFrom(time.Now().Add(-10 * time.Minute))
+		createRun("cleanup-running", vyogotechv1alpha1.SiteJobPhaseRunning)
+		reconcile()
+
+		names := []string{}
+		for _, job := range runs() {
+			if job.DeletionTimestamp.IsZero() {
+				names = append(names, job.Name)
+			}
+		}
+		Expect(names).To(ConsistOf(fmt.Sprintf("cleanup-%d", siteJob.Status.LastScheduleTime.Unix())))
+	})
+
+	It("skips a run past its starting deadline", func() {
+		siteJob.Spec.Schedule = "0 0 1 1 *"
+		deadline := int64(60)
+		siteJob.Spec.StartingDeadlineSeconds = &deadline
+		scheduleFrom(time.Now().AddDate(-2, 0, 0))
+		reconcile()
+
+		Expect(runs()).To(BeEmpty())
+		Expect(siteJob.Status.Message).To(ContainSubstring("starting deadline exceeded"))
+		Expect(siteJob.Status.LastScheduleTime).NotTo(BeNil())
+	})
+
+	It("keeps finished runs within the history limits", func() {
+		siteJob.Spec.Suspend = true
+		limit := int32(1)
+		siteJob.Spec.SuccessfulJobsHistoryLimit = &limit
+		siteJob.Spec.FailedJobsHistoryLimit = &limit
+		scheduleFrom(time.Now())
+		createRun("cleanup-1", vyogotechv1alpha1.SiteJobPhaseSucceeded)
+		createRun("cleanup-2", vyogotechv1alpha1.SiteJobPhaseSucceeded)
+		createRun("cleanup-3", vyogotechv1alpha1.SiteJobPhaseFailed)
+		createRun("cleanup-4", vyogotechv1alpha1.SiteJobPhaseFailed)
+
+		reconcile()
+
+		var succeeded, failed int
+		for _, job := range runs() {
+			if !job.DeletionTimestamp.IsZero() {
+				continue
+			}
+			if job.Status.Succeeded > 0 {
+				succeeded++
+			} else {
+				failed++
+			}
+		}
+		Expect(succeeded).To(Equal(1))
+		Expect(failed).To(Equal(1))
+		Expect(siteJob.Status.Message).To(Equal("Schedule suspended"))
+		Expect(siteJob.Status.NextScheduleTime).To(BeNil())
+	})
+})
@@ -0,0 +1,579 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+// SiteRestoreReconciler reconciles a SiteRestore object
+type SiteRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// restoreSource is a resolved restore source, ready to be wired into the Job
+type restoreSource struct {
+	env           []corev1.EnvVar
+	volumeMounts  []corev1.VolumeMount
+	volumes       []corev1.Volume
+	sourceVersion string
+}
+
+//+kubebuilder:rbac:groups=vyogo.tech,resources=siterestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=vyogo.tech,resources=siterestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vyogo.tech,resources=siterestores/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches;sitebackups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile runs a one-off restore Job for the SiteRestore
+func (r *SiteRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	restore := &vyogotechv1alpha1.SiteRestore{}
+	if err := r.Get(ctx, req.NamespacedName, restore); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteRestore")
+		return ctrl.Result{}, err
+	}
+
+	// A restore runs once, finished restores are never re-run
+	if restore.Status.Phase == vyogotechv1alpha1.SiteRestorePhaseCompleted ||
+		restore.Status.Phase == vyogotechv1alpha1.SiteRestorePhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Reconciling SiteRestore", "name", restore.Name, "namespace", restore.Namespace)
+
+	if restore.Spec.SiteRef == nil {
+		return ctrl.Result{}, r.setFailed(ctx, restore, "siteRef is required")
+	}
+
+	jobName := fmt.Sprintf("%s-restore", restore.Name)
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: jobName, Namespace: restore.Namespace}, job)
+	if errors.IsNotFound(err) {
+		return r.startRestore(ctx, restore, jobName)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if job.Status.Failed > 0 {
+		logger.Error(nil, "Restore job failed", "job", jobName)
+		return ctrl.Result{}, r.setFailed(ctx, restore,
+			fmt.Sprintf("restore job %s failed, the site may be partially restored; see the Job logs", jobName))
+	}
+	if job.Status.Succeeded == 0 {
+		// Job completion triggers a reconcile through Owns
+		return ctrl.Result{}, nil
+	}
+
+	now := metav1.Now()
+	restore.Status.Phase = vyogotechv1alpha1.SiteRestorePhaseCompleted
+	restore.Status.CompletionTime = &now
+	restore.Status.Message = "Restore completed"
+
+	logger.Info("Restore completed", "site", restore.Spec.SiteRef.Name)
+	return ctrl.Result{}, r.Status().Update(ctx, restore)
+}
+
+// startRestore validates the target and source and creates the restore Job
+func (r *SiteRestoreReconciler) startRestore(ctx context.Context, restore *vyogotechv1alpha1.SiteRestore, jobName string) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, restore.Spec.SiteRef, restore.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.setPending(ctx, restore, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.setFailed(ctx, restore, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if bench.Namespace != restore.Namespace {
+		return ctrl.Result{}, r.setFailed(ctx, restore,
+			fmt.Sprintf("SiteRestore must be in namespace %s of bench %s", bench.Namespace, bench.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.setPending(ctx, restore, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+	if benchStorageMigrating(bench) {
+		return r.setPending(ctx, restore, fmt.Sprintf("waiting for the storage migration of bench %s", bench.Name))
+	}
+
+	source, pending, err := r.resolveRestoreSource(ctx, restore, bench)
+	if err != nil {
+		return ctrl.Result{}, r.setFailed(ctx, restore, err.Error())
+	}
+	if pending != "" {
+		return r.setPending(ctx, restore, pending)
+	}
+
+	targetVersion := bench.Status.CurrentVersion
+	if targetVersion == "" {
+		targetVersion = bench.Spec.FrappeVersion
+	}
+	runMigrate := shouldMigrateAfterRestore(restore.Spec.Migrate, source.sourceVersion, targetVersion)
+
+	// The dump is imported with the site's own database user from site_config.json,
+	// so no database root credentials reach the Job
+	env := append([]corev1.EnvVar{
+		{Name: "SITE_NAME", Value: site.Spec.SiteName},
+		{Name: "RUN_MIGRATE", Value: strconv.FormatBool(runMigrate)},
+	}, source.env...)
+
+	volumeMounts := append(benchVolumeMounts(bench, siteJobImage(bench)), corev1.VolumeMount{
+		Name:      "restore",
+		MountPath: "/restore",
+	})
+	volumeMounts = append(volumeMounts, source.volumeMounts...)
+
+	volumes := append([]corev1.Volume{
+		{
+			Name: "sites",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: benchSitesClaim(bench),
+				},
+			},
+		},
+		{
+			// Scratch space for downloaded artifacts
+			Name: "restore",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}, source.volumes...)
+
+	backoffLimit := int32(0)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: restore.Namespace,
+			Labels: map[string]string{
+				"app":     "frappe",
+				"site":    site.Name,
+				"restore": restore.Name,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: withSitesVolumeLabel(bench, nil),
+				},
+				Spec: corev1.PodSpec{
+					Affinity:      benchSitesAffinity(bench),
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "restore",
+							Image:        siteJobImage(bench),
+							Command:      []string{"bash", "-c"},
+							Args:         []string{siteRestoreScript},
+							Env:          env,
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(restore, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	logger.Info("Creating restore job", "job", jobName, "site", site.Spec.SiteName, "migrate", runMigrate)
+	if err := r.Create(ctx, job); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	restore.Status.Phase = vyogotechv1alpha1.SiteRestorePhaseRunning
+	restore.Status.JobName = jobName
+	restore.Status.StartTime = &now
+	restore.Status.SourceVersion = source.sourceVersion
+	restore.Status.TargetVersion = targetVersion
+	restore.Status.Migrated = runMigrate
+	restore.Status.Message = fmt.Sprintf("Restoring %s", site.Spec.SiteName)
+	return ctrl.Result{}, r.Status().Update(ctx, restore)
+}
+
+// resolveRestoreSource turns the spec source into Job env, mounts and volumes
+// Returns a non-empty pending message when the source is not ready yet
+func (r *SiteRestoreReconciler) resolveRestoreSource(ctx context.Context, restore *vyogotechv1alpha1.SiteRestore, bench *vyogotechv1alpha1.FrappeBench) (*restoreSource, string, error) {
+	spec := restore.Spec.Source
+	source := &restoreSource{}
+
+	if (spec.BackupRef == nil) == (spec.Database == "") {
+		return nil, "", fmt.Errorf("source must set exactly one of backupRef or database")
+	}
+
+	// Raw artifacts: URLs, or paths inside a PVC
+	if spec.BackupRef == nil {
+		if spec.ClaimName != "" {
+			source.mountClaim(spec.ClaimName)
+		}
+		for _, artifact := range []struct{ name, value string }{
+			{"DB_SOURCE", spec.Database},
+			{"PUBLIC_FILES_SOURCE", spec.PublicFiles},
+			{"PRIVATE_FILES_SOURCE", spec.PrivateFiles},
+		} {
+			value := artifact.value
+			if value != "" && !isURL(value) {
+				if spec.ClaimName == "" {
+					return nil, "", fmt.Errorf("%s is not an http(s) URL and no claimName is set", value)
+				}
+				value = path.Join("/source", value)
+			}
+			source.env = append(source.env, corev1.EnvVar{Name: artifact.name, Value: value})
+		}
+		source.sourceVersion = spec.FrappeVersion
+		return source, "", nil
+	}
+
+	backup := &vyogotechv1alpha1.SiteBackup{}
+	if err := r.Get(ctx, types.NamespacedName{Name: spec.BackupRef.Name, Namespace: restore.Namespace}, backup); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Sprintf("waiting for SiteBackup %s", spec.BackupRef.Name), nil
+		}
+		return nil, "", err
+	}
+	switch backup.Status.Phase {
+	case vyogotechv1alpha1.SiteBackupPhaseCompleted:
+	case vyogotechv1alpha1.SiteBackupPhaseFailed:
+		return nil, "", fmt.Errorf("SiteBackup %s failed", backup.Name)
+	case vyogotechv1alpha1.SiteBackupPhaseScheduled:
+		return nil, "", fmt.Errorf("SiteBackup %s is a schedule, reference one of its backups", backup.Name)
+	default:
+		return nil, fmt.Sprintf("waiting for SiteBackup %s to complete", backup.Name), nil
+	}
+
+	envNames := map[string]string{
+		"database":      "DB_SOURCE",
+		"public-files":  "PUBLIC_FILES_SOURCE",
+		"private-files": "PRIVATE_FILES_SOURCE",
+	}
+	benchClaim := benchSitesClaim(bench)
+	hasDatabase := false
+	hasS3 := false
+
+	for _, artifact := range backup.Status.Artifacts {
+		envName, ok := envNames[artifact.Type]
+		if !ok {
+			continue
+		}
+
+		value := artifact.Path
+		if strings.HasPrefix(value, "pvc://") {
+			claim, relPath, _ := strings.Cut(strings.TrimPrefix(value, "pvc://"), "/")
+			if claim == benchClaim {
+				value = path.Join("/home/frappe/frappe-bench/sites", relPath)
+			} else {
+				source.mountClaim(claim)
+				value = path.Join("/source", relPath)
+			}
+		} else if strings.HasPrefix(value, "s3://") {
+			hasS3 = true
+		}
+
+		hasDatabase = hasDatabase || artifact.Type == "database"
+		source.env = append(source.env, corev1.EnvVar{Name: envName, Value: value})
+	}
+
+	if !hasDatabase {
+		return nil, "", fmt.Errorf("SiteBackup %s has no database artifact", backup.Name)
+	}
+	if hasS3 {
+		dest := backup.Spec.Destination
+		if dest == nil || dest.S3 == nil {
+			return nil, "", fmt.Errorf("SiteBackup %s has s3 artifacts but no s3 destination", backup.Name)
+		}
+		source.env = append(source.env, s3EnvVars(dest.S3, "")...)
+	}
+
+	source.sourceVersion = backup.Status.FrappeVersion
+	return source, "", nil
+}
+
+// mountClaim mounts a PVC holding restore artifacts at /source
+func (s *restoreSource) mountClaim(claimName string) {
+	if len(s.volumes) > 0 {
+		return
+	}
+	s.volumeMounts = append(s.volumeMounts, corev1.VolumeMount{
+		Name:      "source",
+		MountPath: "/source",
+		ReadOnly:  true,
+	})
+	s.volumes = append(s.volumes, corev1.Volume{
+		Name: "source",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+				ReadOnly:  true,
+			},
+		},
+	})
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// shouldMigrateAfterRestore applies the migrate policy to the backup and bench versions
+func shouldMigrateAfterRestore(policy vyogotechv1alpha1.RestoreMigratePolicy, sourceVersion, targetVersion string) bool {
+	switch policy {
+	case vyogotechv1alpha1.RestoreMigrateAlways:
+		return true
+	case vyogotechv1alpha1.RestoreMigrateNever:
+		return false
+	}
+
+	// Auto: migrating is safe to repeat, so do it whenever the versions can't be compared
+	older, known := frappeVersionOlder(sourceVersion, targetVersion)
+	return older || !known
+}
+
+var versionNumberPattern = regexp.MustCompile(`\d+`)
+
+// frappeVersionOlder reports whether version a is older than b
+// Versions like "version-14", "v15.2.0" and "15" are compared by their numbers
+func frappeVersionOlder(a, b string) (older bool, known bool) {
+	parse := func(v string) []int {
+		var numbers []int
+		for _, match := range versionNumberPattern.FindAllString(v, -1) {
+			n, err := strconv.Atoi(match)
+			if err != nil {
+				return nil
+			}
+			numbers = append(numbers, n)
+		}
+		return numbers
+	}
+
+	va, vb := parse(a), parse(b)
+	if len(va) == 0 || len(vb) == 0 {
+		return false, false
+	}
+
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x < y, true
+		}
+	}
+	return false, true
+}
+
+func (r *SiteRestoreReconciler) setPending(ctx context.Context, restore *vyogotechv1alpha1.SiteRestore, message string) (ctrl.Result, error) {
+	restore.Status.Phase = vyogotechv1alpha1.SiteRestorePhasePending
+	restore.Status.Message = message
+	if err := r.Status().Update(ctx, restore); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
+
+func (r *SiteRestoreReconciler) setFailed(ctx context.Context, restore *vyogotechv1alpha1.SiteRestore, message string) error {
+	now := metav1.Now()
+	restore.Status.Phase = vyogotechv1alpha1.SiteRestorePhaseFailed
+	restore.Status.Message = message
+	restore.Status.CompletionTime = &now
+	return r.Status().Update(ctx, restore)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SiteRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&vyogotechv1alpha1.SiteRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
+
+// siteRestoreScript fetches the artifacts, imports them into the site under
+// maintenance mode and migrates when asked to. Maintenance mode is turned off on exit,
+// also when a step failed.
+const siteRestoreScript = `#!/bin/bash
+set -e
+set -o pipefail
+
+cd /home/frappe/frappe-bench
+
+if [[ -z "$SITE_NAME" || -z "$DB_SOURCE" ]]; then
+    echo "ERROR: Required environment variables not set"
+    exit 1
+fi
+
+env/bin/python - <<'PYEOF'
+import os
+import shlex
+import shutil
+import urllib.parse
+import urllib.request
+
+
+def fetch(source):
+    if not source:
+        return ""
+    parsed = urllib.parse.urlparse(source)
+    target = os.path.join("/restore", os.path.basename(parsed.path))
+    if parsed.scheme in ("http", "https"):
+        print("Downloading %s" % os.path.basename(parsed.path))
+        with urllib.request.urlopen(source) as response, open(target, "wb") as f:
+            shutil.copyfileobj(response, f)
+        return target
+    if parsed.scheme == "s3":
+        import boto3
+        from botocore.config import Config
+
+        addressing = "path" if os.environ.get("S3_FORCE_PATH_STYLE") == "true" else "auto"
+        s3 = boto3.client(
+            "s3",
+            endpoint_url=os.environ.get("S3_ENDPOINT") or None,
+            region_name=os.environ.get("S3_REGION") or None,
+            config=Config(s3={"addressing_style": addressing}),
+        )
+        print("Downloading %s" % os.path.basename(parsed.path))
+        s3.download_file(parsed.netloc, parsed.path.lstrip("/"), target)
+        return target
+    if not os.path.isfile(source):
+        raise SystemExit("ERROR: %s not found" % source)
+    return source
+
+
+with open("/restore/artifacts.env", "w") as f:
+    for source, name in (
+        ("DB_SOURCE", "DB_FILE"),
+        ("PUBLIC_FILES_SOURCE", "PUBLIC_FILES_FILE"),
+        ("PRIVATE_FILES_SOURCE", "PRIVATE_FILES_FILE"),
+    ):
+        f.write("%s=%s\n" % (name, shlex.quote(fetch(os.environ.get(source, "")))))
+PYEOF
+
+source /restore/artifacts.env
+` + siteImportFunctions + `
+echo "Enabling maintenance mode on $SITE_NAME"
+bench --site "$SITE_NAME" set-maintenance-mode on
+# The site leaves maintenance mode whether or not the restore succeeds
+trap 'echo "Disabling maintenance mode on $SITE_NAME"; bench --site "$SITE_NAME" set-maintenance-mode off' EXIT
+
+echo "Restoring $SITE_NAME"
+import_site_database "$SITE_NAME" "$DB_FILE"
+for archive in "$PUBLIC_FILES_FILE" "$PRIVATE_FILES_FILE"; do
+    if [[ -n "$archive" ]]; then
+        extract_site_files "$SITE_NAME" "$archive"
+    fi
+done
+bench --site "$SITE_NAME" clear-cache
+
+if [[ "$RUN_MIGRATE" == "true" ]]; then
+    echo "Migrating $SITE_NAME"
+    bench --site "$SITE_NAME" migrate
+fi
+
+echo "Restore of $SITE_NAME complete!"
+`
+
+// siteImportFunctions defines the shell functions that restore a Frappe backup into an
+// existing site with the site's own database user, as bench restore needs the database
+// root credentials to recreate the database. Instead every table and view of the site's
+// database is dropped before the import, so nothing created after the backup is left.
+const siteImportFunctions = `
+# import_site_database <site> <dump>: replace the site's database with a .sql or .sql.gz dump
+import_site_database() {
+    local site="$1" dump="$2" db_type cat_dump=cat
+    db_type=$(env/bin/python -c 'import json, sys; print(json.load(open(sys.argv[1])).get("db_type") or "mariadb")' "sites/$site/site_config.json")
+    if [[ "$dump" == *.gz ]]; then
+        cat_dump="gunzip -c"
+    fi
+    if [[ "$db_type" == "postgres" ]]; then
+        # pg_dump output does not drop the tables it recreates
+        echo "DROP SCHEMA public CASCADE; CREATE SCHEMA public;" | bench --site "$site" postgres
+        $cat_dump "$dump" | bench --site "$site" postgres
+    else
+        # mysqldump output only drops the tables it recreates
+        echo "Dropping the tables and views of $site"
+        bench --site "$site" mariadb <<'SQL'
+SET FOREIGN_KEY_CHECKS = 0;
+SET SESSION group_concat_max_len = 4294967295;
+SET @views = (SELECT GROUP_CONCAT(CHAR(96 USING utf8mb4), table_name, CHAR(96 USING utf8mb4)) FROM information_schema.tables
+    WHERE table_schema = DATABASE() AND table_type = 'VIEW');
+SET @stmt = IF(@views IS NULL, 'DO 0', CONCAT('DROP VIEW ', @views));
+PREPARE drop_views FROM @stmt;
+EXECUTE drop_views;
+DEALLOCATE PREPARE drop_views;
+SET @tables = (SELECT GROUP_CONCAT(CHAR(96 USING utf8mb4), table_name, CHAR(96 USING utf8mb4)) FROM information_schema.tables
+    WHERE table_schema = DATABASE() AND table_type <> 'VIEW');
+SET @stmt = IF(@tables IS NULL, 'DO 0', CONCAT('DROP TABLE ', @tables));
+PREPARE drop_tables FROM @stmt;
+EXECUTE drop_tables;
+DEALLOCATE PREPARE drop_tables;
+SQL
+        $cat_dump "$dump" | bench --site "$site" mariadb
+    fi
+}
+
+# extract_site_files <site> <archive>: put the public/files or private/files of a files
+# backup, which may come from a site with another name, into the site
+extract_site_files() {
+    local site="$1" archive="$2" tmp folder files
+    tmp=$(mktemp -d)
+    tar -xf "$archive" -C "$tmp"
+    for folder in public private; do
+        files=$(find "$tmp" -type d -path "*/$folder/files" | head -n 1)
+        if [[ -n "$files" ]]; then
+            echo "Extracting $folder files of $site from $(basename "$archive")"
+            mkdir -p "sites/$site/$folder/files"
+            cp -a "$files/." "sites/$site/$folder/files/"
+        fi
+    done
+    rm -rf "$tmp"
+}
+`
@@ -0,0 +1,300 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteRestore", func() {
+	var (
+		ctx    context.Context
+		ns     string
+		backup *vyogotechv1alpha1.SiteBackup
+		r      *SiteRestoreReconciler
+	)
+
+	createRestore := func(source vyogotechv1alpha1.RestoreSource) *vyogotechv1alpha1.SiteRestore {
+		restore := &vyogotechv1alpha1.SiteRestore{
+			ObjectMeta: metav1.ObjectMeta{Name: "rollback", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteRestoreSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: "site"},
+				Source:  source,
+			},
+		}
+		Expect(k8sClient.Create(ctx, restore)).To(Succeed())
+		return restore
+	}
+
+	// reconcile runs one reconcile and returns the SiteRestore as stored
+	reconcile := func(restore *vyogotechv1alpha1.SiteRestore) *vyogotechv1alpha1.SiteRestore {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(restore)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(restore), restore)).To(Succeed())
+		return restore
+	}
+
+	restoreJob := func() *batchv1.Job {
+		job := &batchv1.Job{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "rollback-restore", Namespace: ns}, job)).To(Succeed())
+		return job
+	}
+
+	// finishJob marks the restore Job as succeeded or failed
+	finishJob := func(succeeded bool) {
+		job := restoreJob()
+		now := metav1.Now()
+		job.Status.StartTime = &now
+		if succeeded {
+			job.Status.CompletionTime = &now
+			job.Status.Succeeded = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobSuccessCriteriaMet, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		} else {
+			job.Status.Failed = 1
+			job.Status.Conditions = []batchv1.JobCondition{
+				{Type: batchv1.JobFailureTarget, Status: corev1.ConditionTrue, LastTransitionTime: now},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now},
+			}
+		}
+		Expect(k8sClient.Status().Update(ctx, job)).To(Succeed())
+	}
+
+	// completeBackup marks the SiteBackup as completed on Frappe 14, with its database on
+	// the bench PVC and its private files on another PVC
+	completeBackup := func() {
+		backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseCompleted
+		backup.Status.FrappeVersion = "version-14"
+		backup.Status.Artifacts = []vyogotechv1alpha1.BackupArtifact{
+			{Type: "database", Path: "pvc://bench-sites/site.example.com/private/backups/nightly/db.sql.gz", Size: 1, Checksum: "sha256:db"},
+			{Type: "private-files", Path: "pvc://backups/frappe/site.example.com/nightly/private.tar", Size: 1, Checksum: "sha256:files"},
+		}
+		Expect(k8sClient.Status().Update(ctx, backup)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "site-restore-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		bench := &vyogotechv1alpha1.FrappeBench{
+			ObjectMeta: metav1.ObjectMeta{Name: "bench", Namespace: ns},
+			Spec:       vyogotechv1alpha1.FrappeBenchSpec{FrappeVersion: "version-15"},
+		}
+		Expect(k8sClient.Create(ctx, bench)).To(Succeed())
+
+		site := &vyogotechv1alpha1.FrappeSite{
+			ObjectMeta: metav1.ObjectMeta{Name: "site", Namespace: ns},
+			Spec: vyogotechv1alpha1.FrappeSiteSpec{
+				BenchRef: &vyogotechv1alpha1.NamespacedName{Name: bench.Name},
+				SiteName: "site.example.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, site)).To(Succeed())
+		site.Status.Phase = vyogotechv1alpha1.FrappeSitePhaseReady
+		Expect(k8sClient.Status().Update(ctx, site)).To(Succeed())
+
+		backup = &vyogotechv1alpha1.SiteBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: ns},
+			Spec:       vyogotechv1alpha1.SiteBackupSpec{SiteRef: &vyogotechv1alpha1.NamespacedName{Name: "site"}},
+		}
+		Expect(k8sClient.Create(ctx, backup)).To(Succeed())
+		backup.Status.Phase = vyogotechv1alpha1.SiteBackupPhaseRunning
+		Expect(k8sClient.Status().Update(ctx, backup)).To(Succeed())
+
+		r = &SiteRestoreReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("waits for the backup, then restores it with a Job", func() {
+		restore := reconcile(createRestore(vyogotechv1alpha1.RestoreSource{
+			BackupRef: &corev1.LocalObjectReference{Name: "nightly"},
+		}))
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhasePending))
+		Expect(restore.Status.Message).To(Equal("waiting for SiteBackup nightly to complete"))
+
+		completeBackup()
+		restore = reconcile(restore)
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseRunning))
+		Expect(restore.Status.JobName).To(Equal("rollback-restore"))
+		Expect(restore.Status.SourceVersion).To(Equal("version-14"))
+		Expect(restore.Status.TargetVersion).To(Equal("version-15"))
+		Expect(restore.Status.Migrated).To(BeTrue())
+
+		job := restoreJob()
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Args).To(Equal([]string{siteRestoreScript}))
+		env := map[string]string{}
+		for _, e := range container.Env {
+			Expect(e.ValueFrom).To(BeNil(), "no credentials are passed to the restore Job")
+			env[e.Name] = e.Value
+		}
+		Expect(env).To(Equal(map[string]string{
+			"SITE_NAME":            "site.example.com",
+			"RUN_MIGRATE":          "true",
+			"DB_SOURCE":            "/home/frappe/frappe-bench/sites/site.example.com/private/backups/nightly/db.sql.gz",
+			"PRIVATE_FILES_SOURCE": "/source/frappe/site.example.com/nightly/private.tar",
+		}))
+
+		volumes := map[string]corev1.VolumeSource{}
+		for _, volume := range job.Spec.Template.Spec.Volumes {
+			volumes[volume.Name] = volume.VolumeSource
+		}
+		Expect(volumes["sites"].PersistentVolumeClaim.ClaimName).To(Equal("bench-sites"))
+		Expect(volumes["restore"].EmptyDir).NotTo(BeNil())
+		Expect(volumes["source"].PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+		Expect(volumes["source"].PersistentVolumeClaim.ReadOnly).To(BeTrue())
+
+		// Nothing changes while the Job runs
+		restore = reconcile(restore)
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseRunning))
+
+		finishJob(true)
+		restore = reconcile(restore)
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseCompleted))
+		Expect(restore.Status.CompletionTime).NotTo(BeNil())
+
+		// A finished restore is never re-run
+		Expect(k8sClient.Delete(ctx, job)).To(Succeed())
+		restore = reconcile(restore)
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseCompleted))
+	})
+
+	It("fails when the Job fails", func() {
+		completeBackup()
+		restore := reconcile(createRestore(vyogotechv1alpha1.RestoreSource{
+			BackupRef: &corev1.LocalObjectReference{Name: "nightly"},
+		}))
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseRunning))
+
+		finishJob(false)
+		restore = reconcile(restore)
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseFailed))
+		Expect(restore.Status.Message).To(ContainSubstring("partially restored"))
+	})
+
+	It("refuses a source with both a backup and a database", func() {
+		restore := reconcile(createRestore(vyogotechv1alpha1.RestoreSource{
+			BackupRef: &corev1.LocalObjectReference{Name: "nightly"},
+			Database:  "https://example.com/db.sql.gz",
+		}))
+		Expect(restore.Status.Phase).To(Equal(vyogotechv1alpha1.SiteRestorePhaseFailed))
+		Expect(restore.Status.Message).To(ContainSubstring("exactly one of backupRef or database"))
+	})
+
+	Describe("restore script", func() {
+		var benchDir, benchLog string
+
+		// runRestoreScript runs the restore script on benchDir with bench replaced by a stub
+		// that logs its calls, and returns whether it succeeded
+		runRestoreScript := func(extraEnv ...string) bool {
+			restoreDir := filepath.Join(benchDir, "restore")
+			Expect(os.MkdirAll(restoreDir, 0o755)).To(Succeed())
+			script := strings.Replace(siteRestoreScript, "cd /home/frappe/frappe-bench", "cd "+benchDir, 1)
+			script = strings.ReplaceAll(script, "/restore/", restoreDir+"/")
+			script = strings.ReplaceAll(script, `"/restore"`, `"`+restoreDir+`"`)
+
+			stub := `bench() {
+    echo "bench $*" >> "$BENCH_LOG"
+    if [[ "$3" == "mariadb" ]]; then
+        cat >> "$BENCH_LOG"
+    fi
+    if [[ "$3" == "migrate" && -n "$FAIL_MIGRATE" ]]; then
+        return 1
+    fi
+    return 0
+}
+`
+			cmd := exec.Command("bash")
+			cmd.Stdin = strings.NewReader(stub + script)
+			cmd.Env = append(os.Environ(),
+				"BENCH_LOG="+benchLog,
+				"SITE_NAME=site.example.com",
+				"DB_SOURCE="+filepath.Join(benchDir, "db.sql"),
+				"RUN_MIGRATE=true",
+			)
+			cmd.Env = append(cmd.Env, extraEnv...)
+			out, err := cmd.CombinedOutput()
+			GinkgoWriter.Println(string(out))
+			return err == nil
+		}
+
+		benchCalls := func() []string {
+			log, err := os.ReadFile(benchLog)
+			Expect(err).NotTo(HaveOccurred())
+			return strings.Split(strings.TrimSpace(string(log)), "\n")
+		}
+
+		BeforeEach(func() {
+			python, err := exec.LookPath("python3")
+			if err != nil {
+				Skip("python3 is required to run the restore script")
+			}
+			benchDir = GinkgoT().TempDir()
+			benchLog = filepath.Join(benchDir, "bench.log")
+
+			Expect(os.MkdirAll(filepath.Join(benchDir, "env", "bin"), 0o755)).To(Succeed())
+			Expect(os.Symlink(python, filepath.Join(benchDir, "env", "bin", "python"))).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(benchDir, "sites", "site.example.com"), 0o755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(benchDir, "sites", "site.example.com", "site_config.json"),
+				[]byte(`{"db_name": "_site", "db_type": "mariadb"}`), 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(benchDir, "db.sql"), []byte("CREATE TABLE `tabNote` (name varchar(140));\n"), 0o644)).To(Succeed())
+		})
+
+		It("drops the tables of the site before importing the dump", func() {
+			Expect(runRestoreScript()).To(BeTrue())
+
+			calls := benchCalls()
+			Expect(calls[0]).To(Equal("bench --site site.example.com set-maintenance-mode on"))
+			Expect(calls[len(calls)-1]).To(Equal("bench --site site.example.com set-maintenance-mode off"))
+
+			log := strings.Join(calls, "\n")
+			drop := strings.Index(log, "CONCAT('DROP TABLE ', @tables)")
+			dump := strings.Index(log, "CREATE TABLE `tabNote`")
+			Expect(drop).To(BeNumerically(">", 0))
+			Expect(dump).To(BeNumerically(">", drop))
+			Expect(log).To(ContainSubstring("bench --site site.example.com migrate"))
+		})
+
+		It("turns maintenance mode off when the restore fails", func() {
+			Expect(runRestoreScript("FAIL_MIGRATE=1")).To(BeFalse())
+
+			calls := benchCalls()
+			Expect(calls[len(calls)-2]).To(Equal("bench --site site.example.com migrate"))
+			Expect(calls[len(calls)-1]).To(Equal("bench --site site.example.com set-maintenance-mode off"))
+		})
+	})
+})
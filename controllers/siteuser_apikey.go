@@ -0,0 +1,219 @@
+/*
+Copyright 2023 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
+)
+
+const (
+	// rotateAPIKeyAnnotation rotates the API key of a SiteUser whenever its value changes
+	rotateAPIKeyAnnotation = "vyogo.tech/rotate-api-key"
+
+	// generateKeysMethod issues a new API secret, and an API key if the user has none
+	generateKeysMethod = "frappe.core.doctype.user.user.generate_keys"
+)
+
+// reconcileAPIKey issues or rotates the user's API key pair into the Secret and
+// returns how long until the next scheduled rotation, zero without a schedule.
+// Frappe keeps a single key pair per user, so issuing a new pair revokes the previous
+// secret; the old Secret is only deleted once the new one has been written.
+func (r *SiteUserReconciler) reconcileAPIKey(ctx context.Context, api *frappeapi.Client, siteUser *vyogotechv1alpha1.SiteUser) (time.Duration, error) {
+	logger := log.FromContext(ctx)
+	spec := siteUser.Spec.APIKey
+	current := siteUser.Status.APIKey
+
+	if spec == nil {
+		if current != nil {
+			if err := r.revokeAPIKey(ctx, api, siteUser); err != nil {
+				return 0, err
+			}
+			siteUser.Status.APIKey = nil
+		}
+		return 0, nil
+	}
+
+	var sched cron.Schedule
+	if spec.RotationSchedule != "" {
+		var err error
+		if sched, err = cron.ParseStandard(spec.RotationSchedule); err != nil {
+			return 0, fmt.Errorf("invalid apiKey.rotationSchedule: %w", err)
+		}
+	}
+
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: spec.SecretName, Namespace: siteUser.Namespace}, secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return 0, err
+	}
+	secretExists := err == nil
+	if secretExists && !metav1.IsControlledBy(secret, siteUser) {
+		return 0, fmt.Errorf("secret %s exists and is not managed by this SiteUser", spec.SecretName)
+	}
+
+	now := time.Now()
+	trigger := siteUser.Annotations[rotateAPIKeyAnnotation]
+	reason := ""
+	switch {
+	case current == nil || current.SecretName != spec.SecretName:
+		reason = "issue"
+	case !secretExists || len(secret.Data["api_key"]) == 0 || len(secret.Data["api_secret"]) == 0:
+		reason = "secret missing"
+	case trigger != current.RotationTrigger:
+		reason = "annotation"
+	case sched != nil:
+		if missed, _ := getScheduleTimes(siteUser.CreationTimestamp, current.LastRotationTime, sched, now); !missed.IsZero() {
+			reason = "schedule"
+		}
+	}
+
+	if reason != "" {
+		key, apiSecret, err := generateAPIKeys(ctx, api, siteUser.Spec.Email)
+		if err != nil {
+			return 0, fmt.Errorf("failed to generate API keys: %w", err)
+		}
+		if err := r.writeAPIKeySecret(ctx, siteUser, secret, secretExists, key, apiSecret); err != nil {
+			return 0, err
+		}
+		logger.Info("Issued API key", "user", siteUser.Spec.Email, "secret", spec.SecretName, "reason", reason)
+
+		if current != nil && current.SecretName != spec.SecretName {
+			if err := r.deleteAPIKeySecret(ctx, siteUser, current.SecretName); err != nil {
+				return 0, err
+			}
+		}
+
+		rotatedAt := metav1.NewTime(now)
+		current = &vyogotechv1alpha1.SiteUserAPIKeyStatus{
+			SecretName:       spec.SecretName,
+			Key:              key,
+			LastRotationTime: &rotatedAt,
+			RotationTrigger:  trigger,
+		}
+	}
+
+	current.NextRotationTime = nil
+	var untilNext time.Duration
+	if sched != nil {
+		_, next := getScheduleTimes(siteUser.CreationTimestamp, current.LastRotationTime, sched, now)
+		current.NextRotationTime = &metav1.Time{Time: next}
+		untilNext = next.Sub(now)
+	}
+	siteUser.Status.APIKey = current
+	return untilNext, nil
+}
+
+// revokeAPIKey invalidates the issued secret by generating a new one nobody receives,
+// and deletes the Secret
+func (r *SiteUserReconciler) revokeAPIKey(ctx context.Context, api *frappeapi.Client, siteUser *vyogotechv1alpha1.SiteUser) error {
+	if _, _, err := generateAPIKeys(ctx, api, siteUser.Status.UserName); err != nil && !frappeapi.IsNotFound(err) {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	log.FromContext(ctx).Info("Revoked API key", "user", siteUser.Status.UserName)
+	return r.deleteAPIKeySecret(ctx, siteUser, siteUser.Status.APIKey.SecretName)
+}
+
+// writeAPIKeySecret stores the key pair, creating the Secret owned by the SiteUser if needed
+func (r *SiteUserReconciler) writeAPIKeySecret(ctx context.Context, siteUser *vyogotechv1alpha1.SiteUser, secret *corev1.Secret, exists bool, key, apiSecret string) error {
+	data := map[string][]byte{
+		"api_key":    []byte(key),
+		"api_secret": []byte(apiSecret),
+	}
+
+	if exists {
+		patch := client.MergeFrom(secret.DeepCopy())
+		secret.Data = data
+		if err := r.Patch(ctx, secret, patch); err != nil {
+			return fmt.Errorf("failed to update API key secret: %w", err)
+		}
+		return nil
+	}
+
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      siteUser.Spec.APIKey.SecretName,
+			Namespace: siteUser.Namespace,
+			Labels: map[string]string{
+				"app":      "frappe",
+				"site":     siteUser.Spec.SiteRef.Name,
+				"siteuser": siteUser.Name,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	if err := controllerutil.SetControllerReference(siteUser, secret, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, secret); err != nil {
+		return fmt.Errorf("failed to create API key secret: %w", err)
+	}
+	return nil
+}
+
+// deleteAPIKeySecret deletes a Secret previously written by the SiteUser
+func (r *SiteUserReconciler) deleteAPIKeySecret(ctx context.Context, siteUser *vyogotechv1alpha1.SiteUser, name string) error {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: siteUser.Namespace}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(secret, siteUser) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, secret))
+}
+
+// generateAPIKeys calls generate_keys for the user and returns the key and the new secret
+// Older Frappe versions only return the secret, the key is then read from the User.
+func generateAPIKeys(ctx context.Context, api *frappeapi.Client, userName string) (string, string, error) {
+	keys := struct {
+		APIKey    string `json:"api_key"`
+		APISecret string `json:"api_secret"`
+	}{}
+	if err := api.Call(ctx, generateKeysMethod, map[string]interface{}{"user": userName}, &keys); err != nil {
+		return "", "", err
+	}
+	if keys.APISecret == "" {
+		return "", "", fmt.Errorf("%s returned no api_secret", generateKeysMethod)
+	}
+
+	if keys.APIKey == "" {
+		user := &frappeUser{}
+		if err := api.GetDoc(ctx, "User", userName, user); err != nil {
+			return "", "", err
+		}
+		keys.APIKey = user.APIKey
+	}
+	if keys.APIKey == "" {
+		return "", "", fmt.Errorf("user %s has no api_key after %s", userName, generateKeysMethod)
+	}
+	return keys.APIKey, keys.APISecret, nil
+}
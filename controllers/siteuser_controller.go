@@ -18,45 +18,351 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
 )
 
+// siteUserFinalizer disables the user on the site when the SiteUser is deleted
+const siteUserFinalizer = "vyogo.tech/siteuser-finalizer"
+
 // SiteUserReconciler reconciles a SiteUser object
 type SiteUserReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 }
 
+// frappeUser holds the User document fields managed by a SiteUser
+type frappeUser struct {
+	Name            string `json:"name"`
+	FirstName       string `json:"first_name"`
+	LastName        string `json:"last_name"`
+	Enabled         int    `json:"enabled"`
+	UserType        string `json:"user_type"`
+	RoleProfileName string `json:"role_profile_name"`
+	ModuleProfile   string `json:"module_profile"`
+	APIKey          string `json:"api_key"`
+	Roles           []struct {
+		Role string `json:"role"`
+	} `json:"roles"`
+}
+
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteusers,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteusers/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteusers/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteUser object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile creates or updates the User on the site through the REST API and
+// disables it when the SiteUser is deleted
 func (r *SiteUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	siteUser := &vyogotechv1alpha1.SiteUser{}
+	if err := r.Get(ctx, req.NamespacedName, siteUser); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteUser")
+		return ctrl.Result{}, err
+	}
+
+	if !siteUser.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(siteUser, siteUserFinalizer) {
+			return r.handleDeletion(ctx, siteUser)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(siteUser, siteUserFinalizer) {
+		controllerutil.AddFinalizer(siteUser, siteUserFinalizer)
+		if err := r.Update(ctx, siteUser); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := validateSiteUserSpec(&siteUser.Spec); err != nil {
+		return ctrl.Result{}, r.status(siteUser).setFailed(ctx, err.Error())
+	}
+
+	if err := checkSiteRefNamespace("SiteUser", siteUser.Spec.SiteRef, siteUser.Namespace); err != nil {
+		return ctrl.Result{}, r.status(siteUser).setFailed(ctx, err.Error())
+	}
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, siteUser.Spec.SiteRef, siteUser.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.status(siteUser).setPending(ctx, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.status(siteUser).setFailed(ctx, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.status(siteUser).setPending(ctx, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+
+	password, passwordVersion, err := r.getUserPassword(ctx, siteUser)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.status(siteUser).setPending(ctx, err.Error())
+		}
+		return ctrl.Result{}, r.status(siteUser).setFailed(ctx, err.Error())
+	}
+
+	api, err := newSiteAPIClient(ctx, r.Client, site, bench)
+	if err != nil {
+		return r.status(siteUser).apiError(ctx, err)
+	}
+
+	enabled, err := r.syncUser(ctx, api, siteUser, password, passwordVersion)
+	if err != nil {
+		return r.status(siteUser).apiError(ctx, err)
+	}
+
+	untilRotation, err := r.reconcileAPIKey(ctx, api, siteUser)
+	if err != nil {
+		return r.status(siteUser).apiError(ctx, err)
+	}
+
+	now := metav1.Now()
+	siteUser.Status.Phase = vyogotechv1alpha1.SiteUserPhaseReady
+	siteUser.Status.UserName = siteUser.Spec.Email
+	siteUser.Status.Enabled = enabled
+	siteUser.Status.LastSyncTime = &now
+	siteUser.Status.ObservedGeneration = siteUser.Generation
+	siteUser.Status.PasswordSecretVersion = passwordVersion
+	siteUser.Status.Message = "User is in sync"
+	if err := r.Status().Update(ctx, siteUser); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	requeueAfter := siteSyncInterval
+	if untilRotation > 0 && untilRotation < requeueAfter {
+		requeueAfter = untilRotation
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// syncUser creates the user or updates the fields that differ from the spec, and returns whether it is enabled
+func (r *SiteUserReconciler) syncUser(ctx context.Context, api *frappeapi.Client, siteUser *vyogotechv1alpha1.SiteUser, password, passwordVersion string) (bool, error) {
+	logger := log.FromContext(ctx)
+	desired := desiredUserFields(&siteUser.Spec)
+	enabled := desired["enabled"] == 1
+
+	current := &frappeUser{}
+	err := api.GetDoc(ctx, "User", siteUser.Spec.Email, current)
+	if frappeapi.IsNotFound(err) {
+		doc := desired
+		doc["email"] = siteUser.Spec.Email
+		doc["send_welcome_email"] = 0
+		if password != "" {
+			doc["new_password"] = password
+		}
+		logger.Info("Creating user", "user", siteUser.Spec.Email)
+		return enabled, api.InsertDoc(ctx, "User", doc, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	changes := userFieldChanges(current, desired)
+	if password != "" && passwordVersion != siteUser.Status.PasswordSecretVersion {
+		changes["new_password"] = password
+	}
+	if len(changes) == 0 {
+		return enabled, nil
+	}
+
+	logger.Info("Updating user", "user", siteUser.Spec.Email, "fields", len(changes))
+	return enabled, api.UpdateDoc(ctx, "User", siteUser.Spec.Email, changes, nil)
+}
+
+// handleDeletion disables the user on the site and removes the finalizer
+// Users are never deleted: they are linked from documents, comments and version history.
+func (r *SiteUserReconciler) handleDeletion(ctx context.Context, siteUser *vyogotechv1alpha1.SiteUser) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if siteUser.Status.UserName != "" {
+		api, err := newSiteAPIClientForCleanup(ctx, r.Client, siteUser.Spec.SiteRef, siteUser.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if api == nil {
+			logger.Info("Site is gone or being deleted, nothing to disable", "user", siteUser.Status.UserName)
+		} else {
+			err = api.UpdateDoc(ctx, "User", siteUser.Status.UserName, map[string]interface{}{"enabled": 0}, nil)
+			if err != nil && !frappeapi.IsNotFound(err) {
+				return ctrl.Result{}, fmt.Errorf("failed to disable user %s: %w", siteUser.Status.UserName, err)
+			}
+			logger.Info("Disabled user", "user", siteUser.Status.UserName)
+
+			// The API key Secret is garbage collected with the SiteUser, the key is revoked here
+			if siteUser.Status.APIKey != nil {
+				if err := r.revokeAPIKey(ctx, api, siteUser); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+		}
+	}
+
+	controllerutil.RemoveFinalizer(siteUser, siteUserFinalizer)
+	return ctrl.Result{}, r.Update(ctx, siteUser)
+}
+
+// getUserPassword returns the password and Secret resourceVersion, or empty strings without a passwordSecretRef
+func (r *SiteUserReconciler) getUserPassword(ctx context.Context, siteUser *vyogotechv1alpha1.SiteUser) (string, string, error) {
+	ref := siteUser.Spec.PasswordSecretRef
+	if ref == nil {
+		return "", "", nil
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: siteUser.Namespace}, secret); err != nil {
+		return "", "", err
+	}
+	password := string(secret.Data["password"])
+	if password == "" {
+		return "", "", fmt.Errorf("password secret %s has no password key", ref.Name)
+	}
+	return password, secret.ResourceVersion, nil
+}
+
+// validateSiteUserSpec rejects users the operator must not manage
+func validateSiteUserSpec(spec *vyogotechv1alpha1.SiteUserSpec) error {
+	if spec.SiteRef == nil {
+		return fmt.Errorf("siteRef is required")
+	}
+	if !strings.Contains(spec.Email, "@") {
+		return fmt.Errorf("email %q is not an email address", spec.Email)
+	}
+	if spec.APIKey != nil && spec.APIKey.RotationSchedule != "" {
+		if _, err := cron.ParseStandard(spec.APIKey.RotationSchedule); err != nil {
+			return fmt.Errorf("invalid apiKey.rotationSchedule: %w", err)
+		}
+	}
+	return nil
+}
+
+// desiredUserFields returns the User fields set by the spec
+func desiredUserFields(spec *vyogotechv1alpha1.SiteUserSpec) map[string]interface{} {
+	enabled := 1
+	if spec.Enabled != nil && !*spec.Enabled {
+		enabled = 0
+	}
+	userType := spec.UserType
+	if userType == "" {
+		userType = "System User"
+	}
+
+	fields := map[string]interface{}{
+		"first_name":        spec.FirstName,
+		"last_name":         spec.LastName,
+		"enabled":           enabled,
+		"user_type":         userType,
+		"role_profile_name": spec.RoleProfile,
+		"module_profile":    spec.ModuleProfile,
+	}
+	// A role profile overwrites the roles when the user is saved
+	if spec.RoleProfile == "" {
+		roles := make([]map[string]string, 0, len(spec.Roles))
+		for _, role := range spec.Roles {
+			roles = append(roles, map[string]string{"role": role})
+		}
+		fields["roles"] = roles
+	}
+	return fields
+}
+
+// userFieldChanges returns the desired fields whose value differs on the site
+func userFieldChanges(current *frappeUser, desired map[string]interface{}) map[string]interface{} {
+	actual := map[string]interface{}{
+		"first_name":        current.FirstName,
+		"last_name":         current.LastName,
+		"enabled":           current.Enabled,
+		"user_type":         current.UserType,
+		"role_profile_name": current.RoleProfileName,
+		"module_profile":    current.ModuleProfile,
+	}
+
+	changes := map[string]interface{}{}
+	for field, value := range desired {
+		if field == "roles" {
+			continue
+		}
+		if actual[field] != value {
+			changes[field] = value
+		}
+	}
+
+	if roles, ok := desired["roles"].([]map[string]string); ok {
+		want := make([]string, 0, len(roles))
+		for _, role := range roles {
+			want = append(want, role["role"])
+		}
+		have := make([]string, 0, len(current.Roles))
+		for _, role := range current.Roles {
+			have = append(have, role.Role)
+		}
+		sort.Strings(want)
+		sort.Strings(have)
+		if strings.Join(want, "\n") != strings.Join(have, "\n") {
+			changes["roles"] = roles
+		}
+	}
+	return changes
+}
+
+// status returns the status writer of siteUser
+func (r *SiteUserReconciler) status(siteUser *vyogotechv1alpha1.SiteUser) siteAPIStatus {
+	return siteAPIStatus{client: r.Client, obj: siteUser, set: func(phase siteAPIPhase, message string, _ []string) {
+		siteUser.Status.Phase = vyogotechv1alpha1.SiteUserPhasePending
+		if phase == siteAPIFailed {
+			siteUser.Status.Phase = vyogotechv1alpha1.SiteUserPhaseFailed
+		}
+		siteUser.Status.Message = message
+	}}
+}
 
-	// TODO(user): your logic here
+// siteUsersForSecret maps a Secret to the SiteUsers using it as password or API key Secret
+func (r *SiteUserReconciler) siteUsersForSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	siteUsers := &vyogotechv1alpha1.SiteUserList{}
+	if err := r.List(ctx, siteUsers, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
 
-	return ctrl.Result{}, nil
+	var requests []reconcile.Request
+	for _, siteUser := range siteUsers.Items {
+		passwordRef := siteUser.Spec.PasswordSecretRef
+		apiKey := siteUser.Spec.APIKey
+		if (passwordRef != nil && passwordRef.Name == obj.GetName()) || (apiKey != nil && apiKey.SecretName == obj.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&siteUser)})
+		}
+	}
+	return requests
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SiteUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vyogotechv1alpha1.SiteUser{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.siteUsersForSecret)).
 		Complete(r)
 }
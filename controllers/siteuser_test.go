@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
+)
+
+var _ = Describe("SiteUser", func() {
+	var (
+		ctx      context.Context
+		ns       string
+		siteUser *vyogotechv1alpha1.SiteUser
+		r        *SiteUserReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "siteuser-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		ns = namespace.Name
+
+		siteUser = &vyogotechv1alpha1.SiteUser{
+			ObjectMeta: metav1.ObjectMeta{Name: "jane", Namespace: ns},
+			Spec: vyogotechv1alpha1.SiteUserSpec{
+				SiteRef:   &vyogotechv1alpha1.NamespacedName{Name: "site"},
+				Email:     "jane@example.com",
+				FirstName: "Jane",
+			},
+		}
+		r = &SiteUserReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	reconcileUser := func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(siteUser)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(siteUser), siteUser)).To(Succeed())
+	}
+
+	It("rejects a site in another namespace", func() {
+		siteUser.Spec.SiteRef.Namespace = "other"
+		Expect(k8sClient.Create(ctx, siteUser)).To(Succeed())
+
+		reconcileUser()
+		Expect(siteUser.Status.Phase).To(Equal(vyogotechv1alpha1.SiteUserPhaseFailed))
+		Expect(siteUser.Status.Message).To(Equal("SiteUser must be in namespace other of site site"))
+	})
+
+	It("waits for a missing site", func() {
+		Expect(k8sClient.Create(ctx, siteUser)).To(Succeed())
+
+		reconcileUser()
+		Expect(siteUser.Status.Phase).To(Equal(vyogotechv1alpha1.SiteUserPhasePending))
+	})
+
+	Describe("API key", func() {
+		var (
+			server *httptest.Server
+			api    *frappeapi.Client
+			issued int
+		)
+
+		BeforeEach(func() {
+			// The site issues a new secret on every generate_keys call, the key stays the same
+			issued = 0
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				defer GinkgoRecover()
+				Expect(req.URL.Path).To(Equal("/api/method/" + generateKeysMethod))
+				issued++
+				Expect(json.NewEncoder(w).Encode(map[string]interface{}{
+					"message": map[string]string{"api_key": "key", "api_secret": fmt.Sprintf("secret-%d", issued)},
+				})).To(Succeed())
+			}))
+			api = frappeapi.NewClient(server.URL, "site.example.com")
+
+			siteUser.Spec.APIKey = &vyogotechv1alpha1.SiteUserAPIKey{SecretName: "jane-api"}
+			Expect(k8sClient.Create(ctx, siteUser)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		reconcileKey := func() time.Duration {
+			untilNext, err := r.reconcileAPIKey(ctx, api, siteUser)
+			Expect(err).NotTo(HaveOccurred())
+			return untilNext
+		}
+
+		apiSecret := func(name string) string {
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: name, Namespace: ns}, secret)).To(Succeed())
+			Expect(string(secret.Data["api_key"])).To(Equal("key"))
+			return string(secret.Data["api_secret"])
+		}
+
+		It("issues the key pair once into a Secret owned by the SiteUser", func() {
+			Expect(reconcileKey()).To(BeZero())
+			Expect(apiSecret("jane-api")).To(Equal("secret-1"))
+			Expect(siteUser.Status.APIKey.Key).To(Equal("key"))
+			Expect(siteUser.Status.APIKey.LastRotationTime).NotTo(BeNil())
+
+			reconcileKey()
+			Expect(issued).To(Equal(1))
+		})
+
+		It("rotates the key pair when the annotation changes", func() {
+			reconcileKey()
+
+			siteUser.Annotations = map[string]string{rotateAPIKeyAnnotation: "1"}
+			reconcileKey()
+			Expect(apiSecret("jane-api")).To(Equal("secret-2"))
+			Expect(siteUser.Status.APIKey.RotationTrigger).To(Equal("1"))
+
+			reconcileKey()
+			Expect(issued).To(Equal(2))
+		})
+
+		It("rotates the key pair on the schedule", func() {
+			siteUser.Spec.APIKey.RotationSchedule = "0 0 1 1 *"
+			reconcileKey()
+			Expect(siteUser.Status.APIKey.NextRotationTime).NotTo(BeNil())
+
+			// The next rotation is not due yet
+			untilNext := reconcileKey()
+			Expect(untilNext).To(BeNumerically(">", 0))
+			Expect(untilNext).To(BeNumerically("<=", 366*24*time.Hour))
+			Expect(issued).To(Equal(1))
+
+			lastRotation := metav1.NewTime(time.Now().AddDate(-2, 0, 0))
+			siteUser.Status.APIKey.LastRotationTime = &lastRotation
+			reconcileKey()
+			Expect(apiSecret("jane-api")).To(Equal("secret-2"))
+			Expect(siteUser.Status.APIKey.LastRotationTime.Time).To(BeTemporally(">", lastRotation.Time))
+		})
+
+		It("reissues the key pair when the Secret is deleted", func() {
+			reconcileKey()
+			Expect(k8sClient.Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "jane-api", Namespace: ns}})).To(Succeed())
+
+			reconcileKey()
+			Expect(apiSecret("jane-api")).To(Equal("secret-2"))
+		})
+
+		It("moves the key pair to a renamed Secret and deletes the old one", func() {
+			reconcileKey()
+
+			siteUser.Spec.APIKey.SecretName = "jane-token"
+			reconcileKey()
+			Expect(apiSecret("jane-token")).To(Equal("secret-2"))
+			err := k8sClient.Get(ctx, client.ObjectKey{Name: "jane-api", Namespace: ns}, &corev1.Secret{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("revokes the key pair when apiKey is removed", func() {
+			reconcileKey()
+
+			siteUser.Spec.APIKey = nil
+			reconcileKey()
+			Expect(issued).To(Equal(2))
+			Expect(siteUser.Status.APIKey).To(BeNil())
+			err := k8sClient.Get(ctx, client.ObjectKey{Name: "jane-api", Namespace: ns}, &corev1.Secret{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("does not overwrite a Secret it does not own", func() {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "jane-api", Namespace: ns},
+				Data:       map[string][]byte{"api_key": []byte("other")},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+			_, err := r.reconcileAPIKey(ctx, api, siteUser)
+			Expect(err).To(MatchError(ContainSubstring("not managed by this SiteUser")))
+			Expect(issued).To(BeZero())
+		})
+	})
+})
@@ -18,15 +18,28 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+	"github.com/vyogotech/frappe-operator/controllers/frappeapi"
 )
 
+// siteWorkspaceFinalizer deletes the workspace from the site when the SiteWorkspace is deleted
+const siteWorkspaceFinalizer = "vyogo.tech/siteworkspace-finalizer"
+
 // SiteWorkspaceReconciler reconciles a SiteWorkspace object
 type SiteWorkspaceReconciler struct {
 	client.Client
@@ -36,22 +49,327 @@ type SiteWorkspaceReconciler struct {
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteworkspaces,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteworkspaces/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vyogo.tech,resources=siteworkspaces/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vyogo.tech,resources=frappesites;frappebenches,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the SiteWorkspace object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
+// Reconcile upserts the Workspace on the site through the REST API and reverts changes made on the site
 func (r *SiteWorkspaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	logger := log.FromContext(ctx)
+
+	workspace := &vyogotechv1alpha1.SiteWorkspace{}
+	if err := r.Get(ctx, req.NamespacedName, workspace); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get SiteWorkspace")
+		return ctrl.Result{}, err
+	}
+
+	if !workspace.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(workspace, siteWorkspaceFinalizer) {
+			return r.handleDeletion(ctx, workspace)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(workspace, siteWorkspaceFinalizer) {
+		controllerutil.AddFinalizer(workspace, siteWorkspaceFinalizer)
+		if err := r.Update(ctx, workspace); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := validateSiteWorkspaceSpec(&workspace.Spec); err != nil {
+		return ctrl.Result{}, r.status(workspace).setFailed(ctx, err.Error())
+	}
+
+	if err := checkSiteRefNamespace("SiteWorkspace", workspace.Spec.SiteRef, workspace.Namespace); err != nil {
+		return ctrl.Result{}, r.status(workspace).setFailed(ctx, err.Error())
+	}
+
+	site, bench, err := getSiteAndBench(ctx, r.Client, workspace.Spec.SiteRef, workspace.Namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return r.status(workspace).setPending(ctx, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	if bench == nil {
+		return ctrl.Result{}, r.status(workspace).setFailed(ctx, fmt.Sprintf("site %s has no benchRef", site.Name))
+	}
+	if site.Status.Phase != vyogotechv1alpha1.FrappeSitePhaseReady {
+		return r.status(workspace).setPending(ctx, fmt.Sprintf("waiting for site %s to be ready", site.Name))
+	}
+
+	api, err := newSiteAPIClient(ctx, r.Client, site, bench)
+	if err != nil {
+		return r.status(workspace).apiError(ctx, err)
+	}
+
+	name := workspaceDocName(&workspace.Spec)
+	if workspace.Status.WorkspaceName != "" && workspace.Status.WorkspaceName != name {
+		// The title or owner changed, the document is recreated under its new name
+		if err := api.DeleteDoc(ctx, "Workspace", workspace.Status.WorkspaceName); err != nil {
+			return r.status(workspace).apiError(ctx, err)
+		}
+		logger.Info("Deleted renamed workspace", "workspace", workspace.Status.WorkspaceName)
+	}
+
+	drifted, err := r.syncWorkspace(ctx, api, workspace, name)
+	if err != nil {
+		return r.status(workspace).apiError(ctx, err)
+	}
+
+	now := metav1.Now()
+	if len(drifted) > 0 {
+		workspace.Status.LastDriftTime = &now
+		workspace.Status.DriftedFields = drifted
+	}
+	workspace.Status.Phase = vyogotechv1alpha1.SiteWorkspacePhaseSynced
+	workspace.Status.WorkspaceName = name
+	workspace.Status.LastSyncTime = &now
+	workspace.Status.ObservedGeneration = workspace.Generation
+	workspace.Status.Message = "Workspace is in sync"
+	if err := r.Status().Update(ctx, workspace); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: siteSyncInterval}, nil
+}
+
+// syncWorkspace creates the workspace or overwrites it when it differs from the spec
+// It returns the fields changed on the site since the last sync of the same generation.
+func (r *SiteWorkspaceReconciler) syncWorkspace(ctx context.Context, api *frappeapi.Client, workspace *vyogotechv1alpha1.SiteWorkspace, name string) ([]string, error) {
+	logger := log.FromContext(ctx)
+
+	desired, err := desiredWorkspaceDoc(&workspace.Spec, name)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := upsertDoc(ctx, api, "Workspace", name, desired)
+	if err != nil || len(changed) == 0 {
+		return nil, err
+	}
+
+	// Differences on a generation already synced were made on the site
+	if workspace.Status.WorkspaceName == name && workspace.Status.ObservedGeneration == workspace.Generation {
+		logger.Info("Reverted changes made on the site", "workspace", name, "fields", changed)
+		return changed, nil
+	}
+	return nil, nil
+}
+
+// handleDeletion deletes the workspace from the site and removes the finalizer
+func (r *SiteWorkspaceReconciler) handleDeletion(ctx context.Context, workspace *vyogotechv1alpha1.SiteWorkspace) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if name := workspace.Status.WorkspaceName; name != "" {
+		api, err := newSiteAPIClientForCleanup(ctx, r.Client, workspace.Spec.SiteRef, workspace.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if api == nil {
+			logger.Info("Site is gone or being deleted, nothing to delete", "workspace", name)
+		} else {
+			if err := api.DeleteDoc(ctx, "Workspace", name); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete workspace %s: %w", name, err)
+			}
+			logger.Info("Deleted workspace", "workspace", name)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(workspace, siteWorkspaceFinalizer)
+	return ctrl.Result{}, r.Update(ctx, workspace)
+}
 
-	// TODO(user): your logic here
+// validateSiteWorkspaceSpec checks the fields the CRD schema cannot
+func validateSiteWorkspaceSpec(spec *vyogotechv1alpha1.SiteWorkspaceSpec) error {
+	if spec.SiteRef == nil {
+		return fmt.Errorf("siteRef is required")
+	}
+	if !workspaceIsPublic(spec) && spec.ForUser == "" {
+		return fmt.Errorf("forUser is required for private workspaces")
+	}
+	for _, shortcut := range spec.Shortcuts {
+		if shortcut.Type == "URL" && shortcut.URL == "" {
+			return fmt.Errorf("shortcut %q needs a url", shortcut.Label)
+		}
+		if shortcut.Type != "URL" && shortcut.LinkTo == "" {
+			return fmt.Errorf("shortcut %q needs linkTo", shortcut.Label)
+		}
+	}
+	return nil
+}
+
+func workspaceIsPublic(spec *vyogotechv1alpha1.SiteWorkspaceSpec) bool {
+	return spec.Public == nil || *spec.Public
+}
+
+// workspaceDocName returns the Workspace document name, which Desk derives from the
+// title and, for private workspaces, the owner
+func workspaceDocName(spec *vyogotechv1alpha1.SiteWorkspaceSpec) string {
+	if workspaceIsPublic(spec) {
+		return spec.Title
+	}
+	return fmt.Sprintf("%s-%s", spec.Title, spec.ForUser)
+}
+
+// desiredWorkspaceDoc returns the Workspace document for the spec
+// Child tables are written in full, so rows added on the site are removed again.
+func desiredWorkspaceDoc(spec *vyogotechv1alpha1.SiteWorkspaceSpec, name string) (map[string]interface{}, error) {
+	public, forUser := 1, ""
+	if !workspaceIsPublic(spec) {
+		public, forUser = 0, spec.ForUser
+	}
+
+	roles := []map[string]interface{}{}
+	for _, role := range spec.Roles {
+		roles = append(roles, map[string]interface{}{"role": role})
+	}
+
+	numberCards := []map[string]interface{}{}
+	for _, card := range spec.NumberCards {
+		numberCards = append(numberCards, map[string]interface{}{
+			"number_card_name": card.Name,
+			"label":            widgetLabel(card),
+		})
+	}
+
+	charts := []map[string]interface{}{}
+	for _, chart := range spec.Charts {
+		charts = append(charts, map[string]interface{}{
+			"chart_name": chart.Name,
+			"label":      widgetLabel(chart),
+		})
+	}
+
+	shortcuts := []map[string]interface{}{}
+	for _, shortcut := range spec.Shortcuts {
+		shortcuts = append(shortcuts, map[string]interface{}{
+			"label":    shortcut.Label,
+			"type":     defaultString(shortcut.Type, "DocType"),
+			"link_to":  shortcut.LinkTo,
+			"url":      shortcut.URL,
+			"doc_view": shortcut.DocView,
+			"color":    shortcut.Color,
+		})
+	}
+
+	links := []map[string]interface{}{}
+	for _, card := range spec.Cards {
+		links = append(links, map[string]interface{}{
+			"type":       "Card Break",
+			"label":      card.Label,
+			"link_count": len(card.Links),
+		})
+		for _, link := range card.Links {
+			isQueryReport := 0
+			if link.IsQueryReport {
+				isQueryReport = 1
+			}
+			links = append(links, map[string]interface{}{
+				"type":            "Link",
+				"label":           link.Label,
+				"link_type":       defaultString(link.Type, "DocType"),
+				"link_to":         link.LinkTo,
+				"is_query_report": isQueryReport,
+				"dependencies":    strings.Join(link.Dependencies, ","),
+				"only_for":        link.OnlyFor,
+			})
+		}
+	}
+
+	content, err := workspaceContent(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"label":        name,
+		"title":        spec.Title,
+		"module":       spec.Module,
+		"icon":         spec.Icon,
+		"parent_page":  spec.ParentPage,
+		"public":       public,
+		"for_user":     forUser,
+		"content":      content,
+		"roles":        roles,
+		"number_cards": numberCards,
+		"charts":       charts,
+		"shortcuts":    shortcuts,
+		"links":        links,
+	}, nil
+}
+
+// workspaceContent returns the Desk layout: number cards, charts, shortcuts and cards, in that order
+// Block ids are derived from the widgets so the content only changes with the spec.
+func workspaceContent(spec *vyogotechv1alpha1.SiteWorkspaceSpec) (string, error) {
+	type block struct {
+		ID   string                 `json:"id"`
+		Type string                 `json:"type"`
+		Data map[string]interface{} `json:"data"`
+	}
+	blocks := []block{}
+	add := func(blockType, key, name string, col int) {
+		data := map[string]interface{}{"col": col}
+		if key != "" {
+			data[key] = name
+		}
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s/%d/%s", blockType, len(blocks), name)))
+		blocks = append(blocks, block{ID: hex.EncodeToString(sum[:])[:10], Type: blockType, Data: data})
+	}
+	header := func(text string) {
+		add("header", "text", fmt.Sprintf(`<span class="h4"><b>%s</b></span>`, html.EscapeString(text)), 12)
+	}
+
+	for _, card := range spec.NumberCards {
+		add("number_card", "number_card_name", widgetLabel(card), 3)
+	}
+	for _, chart := range spec.Charts {
+		add("chart", "chart_name", widgetLabel(chart), 12)
+	}
+	if len(spec.Shortcuts) > 0 {
+		header("Your Shortcuts")
+		for _, shortcut := range spec.Shortcuts {
+			add("shortcut", "shortcut_name", shortcut.Label, 3)
+		}
+	}
+	if len(spec.Cards) > 0 {
+		add("spacer", "", "", 12)
+		header("Reports & Masters")
+		for _, card := range spec.Cards {
+			add("card", "card_name", card.Label, 4)
+		}
+	}
+
+	content, err := json.Marshal(blocks)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func widgetLabel(ref vyogotechv1alpha1.WorkspaceWidgetRef) string {
+	return defaultString(ref.Label, ref.Name)
+}
+
+func defaultString(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
 
-	return ctrl.Result{}, nil
+// status returns the status writer of workspace
+func (r *SiteWorkspaceReconciler) status(workspace *vyogotechv1alpha1.SiteWorkspace) siteAPIStatus {
+	return siteAPIStatus{client: r.Client, obj: workspace, set: func(phase siteAPIPhase, message string, _ []string) {
+		workspace.Status.Phase = vyogotechv1alpha1.SiteWorkspacePhasePending
+		if phase == siteAPIFailed {
+			workspace.Status.Phase = vyogotechv1alpha1.SiteWorkspacePhaseFailed
+		}
+		workspace.Status.Message = message
+	}}
 }
 
 // SetupWithManager sets up the controller with the Manager.
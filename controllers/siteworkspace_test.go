@@ -0,0 +1,77 @@
+/*
+Copyright 2024 Vyogo Technologies.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vyogotechv1alpha1 "github.com/vyogotech/frappe-operator/api/v1alpha1"
+)
+
+var _ = Describe("SiteWorkspace", func() {
+	var (
+		ctx       context.Context
+		workspace *vyogotechv1alpha1.SiteWorkspace
+		r         *SiteWorkspaceReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "siteworkspace-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+
+		workspace = &vyogotechv1alpha1.SiteWorkspace{
+			ObjectMeta: metav1.ObjectMeta{Name: "sales", Namespace: namespace.Name},
+			Spec: vyogotechv1alpha1.SiteWorkspaceSpec{
+				SiteRef: &vyogotechv1alpha1.NamespacedName{Name: "site", Namespace: "other"},
+				Title:   "Sales",
+			},
+		}
+		Expect(k8sClient.Create(ctx, workspace)).To(Succeed())
+		r = &SiteWorkspaceReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+	})
+
+	It("rejects a site in another namespace", func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(workspace)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(workspace), workspace)).To(Succeed())
+		Expect(workspace.Status.Phase).To(Equal(vyogotechv1alpha1.SiteWorkspacePhaseFailed))
+		Expect(workspace.Status.Message).To(Equal("SiteWorkspace must be in namespace other of site site"))
+	})
+
+	It("is removed without contacting a site in another namespace", func() {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(workspace)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Delete(ctx, workspace)).To(Succeed())
+
+		_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(workspace)})
+		Expect(err).NotTo(HaveOccurred())
+		err = k8sClient.Get(ctx, client.ObjectKeyFromObject(workspace), workspace)
+		Expect(client.IgnoreNotFound(err)).To(Succeed())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -154,6 +154,13 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "SiteBackup")
 		os.Exit(1)
 	}
+	if err = (&controllers.SiteRestoreReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SiteRestore")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {